@@ -0,0 +1,169 @@
+// Package aot translates Grol VM programs ahead of time into source code for other languages
+// (`vm togo`, `vm toc`), so they can be built and shipped as native binaries.
+package aot
+
+import (
+	"fmt"
+	"strings"
+
+	"fortio.org/log"
+	"grol.io/vm/asm"
+	"grol.io/vm/cpu"
+)
+
+// Options are the settings for the translators.
+type Options struct {
+	StackSize int // Number of 64-bit stack words, cpu.DefaultStackSize if 0.
+}
+
+// loadProgram reads a .vm file and returns its memory and the stack size it needs (0 if
+// unspecified). The translated code starts at PC 0, so other entry points are rejected.
+func loadProgram(file string) ([]cpu.Operation, int, error) {
+	img, err := cpu.ReadImageFile(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	if img.Entry != 0 {
+		return nil, 0, fmt.Errorf("entry point %d not supported, only 0", img.Entry)
+	}
+	return img.Memory(), img.StackSize, nil
+}
+
+// loadFiles loads each .vm file and calls translate with the program, opts with the stack
+// size raised to the one the program needs if larger, and the file name without the .vm
+// extension.
+func loadFiles(files []string, opts Options,
+	translate func(program []cpu.Operation, opts Options, file, base string) int,
+) int {
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".vm") {
+			return log.FErrf("Invalid file extension for %s, expected .vm", file)
+		}
+		program, stackSize, err := loadProgram(file)
+		if err != nil {
+			return log.FErrf("Failed to load program %s: %v", file, err)
+		}
+		fileOpts := opts
+		current := opts.StackSize
+		if current <= 0 {
+			current = cpu.DefaultStackSize
+		}
+		if stackSize > current {
+			fileOpts.StackSize = stackSize
+		}
+		if res := translate(program, fileOpts, file, strings.TrimSuffix(file, ".vm")); res != 0 {
+			return res
+		}
+	}
+	return 0
+}
+
+// translator has the control flow shared by the languages: the reachable code, the goto labels
+// and the Ret dispatch.
+type translator struct {
+	program   []cpu.Operation
+	code      []bool
+	targets   map[int]bool // PCs used as goto targets (which need a label).
+	hasRet    bool
+	usesEnd   bool // whether the end label is a goto target.
+	stackSize int
+	eos       string                                         // end of statement: "" for Go, ";" for C.
+	fault     func(kind cpu.FaultKind, pc any) (stmt string) // returns the statement ending the program with a fault.
+}
+
+func newTranslator(program []cpu.Operation, opts Options) *translator {
+	t := &translator{
+		program:   program,
+		code:      cpu.Reachable(program, 0),
+		targets:   make(map[int]bool),
+		stackSize: opts.StackSize,
+	}
+	if t.stackSize <= 0 {
+		t.stackSize = cpu.DefaultStackSize
+	}
+	return t
+}
+
+// jump returns the statement jumping to target (or faulting when it's outside of the program).
+func (t *translator) jump(target int64) string {
+	n := int64(len(t.program))
+	switch {
+	case target == n:
+		t.usesEnd = true
+		return "goto end" + t.eos
+	case target < 0 || target > n:
+		return t.fault(cpu.BadMemoryAccess, target)
+	}
+	t.targets[int(target)] = true
+	return fmt.Sprintf("goto L%04d%s", target, t.eos)
+}
+
+// memory returns the memory[] expression for a R instruction, or the fault statement and false
+// if it's out of range.
+func (t *translator) memory(pc int, offset int64) (string, bool) {
+	addr := int64(pc) + offset
+	if addr < 0 || addr >= int64(len(t.program)) {
+		return "\t" + t.fault(cpu.BadMemoryAccess, pc) + "\n", false
+	}
+	return fmt.Sprintf("memory[%d]", addr), true
+}
+
+// addressWord returns the memory[] expression for the R conditional jump at pc, whose address
+// is in the next word, or the fault statement and false if there is no such word or it's out of
+// range.
+func (t *translator) addressWord(pc int) (string, bool) {
+	if pc+1 >= len(t.program) {
+		return "\t" + t.fault(cpu.BadMemoryAccess, pc) + "\n", false
+	}
+	return t.memory(pc, int64(t.program[pc+1]))
+}
+
+// writeBody translates the reachable instructions with instruction and writes them, with their
+// labels, then the end label followed by the end statement and the Ret dispatch (on pc).
+func (t *translator) writeBody(sb *strings.Builder, instruction func(pc int) string, end, dispatch string) {
+	body := make([]string, len(t.program))
+	for pc := range t.program {
+		if t.code[pc] {
+			body[pc] = instruction(pc)
+		}
+	}
+	if t.hasRet {
+		// Ret can go back to any instruction (not just after a Call), so they all need a label.
+		for pc, isCode := range t.code {
+			t.targets[pc] = t.targets[pc] || isCode
+		}
+	}
+	listing := asm.NewListing(t.program, 0)
+	for pc, stmts := range body {
+		if !t.code[pc] {
+			continue
+		}
+		if t.targets[pc] {
+			fmt.Fprintf(sb, "L%04d:\n", pc)
+		}
+		fmt.Fprintf(sb, "\t// %d: %s\n%s", pc, listing.Lines[pc], stmts)
+	}
+	if t.usesEnd || t.hasRet {
+		sb.WriteString("end:\n")
+	}
+	fmt.Fprintf(sb, "\t%s\n", end)
+	if !t.hasRet {
+		return
+	}
+	fmt.Fprintf(sb, "dispatch:\n\t%s {\n", dispatch)
+	for pc, isCode := range t.code {
+		if isCode {
+			fmt.Fprintf(sb, "\tcase %d:\n\t\tgoto L%04d%s\n", pc, pc, t.eos)
+		}
+	}
+	fmt.Fprintf(sb, "\tcase %d:\n\t\tgoto end%s\n\t}\n\t%s\n", len(t.program), t.eos, t.fault(cpu.BadMemoryAccess, "pc"))
+}
+
+// lineWriter returns a function writing an indented statement line to sb.
+func lineWriter(sb *strings.Builder) func(format string, args ...any) {
+	return func(format string, args ...any) {
+		sb.WriteString("\t")
+		fmt.Fprintf(sb, format, args...)
+		sb.WriteString("\n")
+	}
+}
@@ -0,0 +1,457 @@
+package aot
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fortio.org/log"
+	"grol.io/vm/asm"
+	"grol.io/vm/cpu"
+)
+
+// ToC translates each .vm file into a standalone C file, written next to it with the .c
+// extension, that builds with the same flags as cvm/cvm.c (gcc -O3 -Wall -Wextra -pedantic -Werror).
+func ToC(opts Options, files ...string) int {
+	return loadFiles(files, opts, func(program []cpu.Operation, opts Options, file, base string) int {
+		var buf bytes.Buffer
+		if err := TranslateC(&buf, filepath.Base(file), program, opts); err != nil {
+			return log.FErrf("Failed to translate %s: %v", file, err)
+		}
+		output := base + ".c"
+		log.Infof("Translating %s to %s", file, output)
+		if err := os.WriteFile(output, buf.Bytes(), 0o644); err != nil { //nolint:gosec // source code is meant to be readable.
+			return log.FErrf("Failed to write %s: %v", output, err)
+		}
+		return 0
+	})
+}
+
+// cTranslator generates the C statements for each instruction.
+type cTranslator struct {
+	*translator
+}
+
+// TranslateC writes to w a C program running program with the same output and exit code as
+// `vm run`, using the enums of `vm genh`. The translation is the same as TranslateGo's: gotos
+// for the jumps, a switch for Ret and no self modifying code. The arithmetic wraps around like
+// in Go (instead of C's undefined behavior on signed overflow).
+func TranslateC(w io.Writer, name string, program []cpu.Operation, opts Options) error {
+	t := cTranslator{newTranslator(program, opts)}
+	t.eos = ";"
+	t.fault = func(kind cpu.FaultKind, pc any) string {
+		return fmt.Sprintf("fault(%v, %v, sp);", kind, pc)
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "// Code generated by vm toc from %s; DO NOT EDIT.\n", name)
+	sb.WriteString("// Build with: gcc -O3 -Wall -Wextra -pedantic -Werror\n\n")
+	sb.WriteString(cIncludes)
+	if err := asm.WriteHeader(&sb); err != nil {
+		return err
+	}
+	sb.WriteString("\nenum Fault {\n")
+	names := make([]string, 0, cpu.LastFault)
+	for kind := cpu.NoFault + 1; kind < cpu.LastFault; kind++ {
+		fmt.Fprintf(&sb, "  %v = %d,\n", kind, kind)
+		names = append(names, fmt.Sprintf("%q", kind.String()))
+	}
+	fmt.Fprintf(&sb, "};\n\nstatic const char *fault_names[] = {\"\", %s};\n\n", strings.Join(names, ", "))
+	fmt.Fprintf(&sb, "enum { MemorySize = %d, StackSize = %d, FaultExitCodeBase = %d };\n\n",
+		len(program), t.stackSize, cpu.FaultExitCodeBase)
+	sb.WriteString("typedef int64_t Operation;\n\n// +1 so it's never empty.\nstatic Operation memory[MemorySize + 1] = {")
+	for i, op := range program {
+		if i%4 == 0 {
+			sb.WriteString("\n   ")
+		}
+		fmt.Fprintf(&sb, " %s,", cLiteral(int64(op)))
+	}
+	if len(program) == 0 {
+		sb.WriteString("0")
+	}
+	sb.WriteString("\n};\n")
+	sb.WriteString(cRuntime)
+	sb.WriteString("static int run(void) {\n\tint64_t a = 0, pc = 0, sp = -1;\n\t(void)a;\n\t(void)pc;\n")
+	t.writeBody(&sb, t.instruction, "return 0;", "switch (pc)")
+	sb.WriteString("}\n\nint main(void) { return run(); }\n")
+	_, err := io.WriteString(w, strings.ReplaceAll(sb.String(), "\t", "  "))
+	return err
+}
+
+const cIncludes = `#define _POSIX_C_SOURCE 200809L
+
+#include <inttypes.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <time.h>
+#include <unistd.h>
+`
+
+// cRuntime has the faults, wrapping arithmetic and syscalls helpers, with the same checks and
+// results as the Go implementation (cpu.sysRead etc).
+const cRuntime = `
+static Operation stack[StackSize];
+
+static _Noreturn void fault(enum Fault kind, int64_t pc, int64_t sp) {
+  fprintf(stderr, "Fault: %s at PC %" PRId64 ", SP = %" PRId64 "\n",
+          fault_names[kind], pc, sp);
+  exit(FaultExitCodeBase + kind);
+}
+
+static inline void stack_fault(int64_t idx, int64_t pc, int64_t sp) {
+  fault(idx < 0 ? StackUnderflow : StackOverflow, pc, sp);
+}
+
+static inline int64_t add64(int64_t x, int64_t y) {
+  return (int64_t)((uint64_t)x + (uint64_t)y);
+}
+
+static inline int64_t sub64(int64_t x, int64_t y) {
+  return (int64_t)((uint64_t)x - (uint64_t)y);
+}
+
+static inline int64_t mul64(int64_t x, int64_t y) {
+  return (int64_t)((uint64_t)x * (uint64_t)y);
+}
+
+static inline int64_t div64(int64_t x, int64_t y) {
+  return y == -1 ? sub64(0, x) : x / y;
+}
+
+static inline int64_t mod64(int64_t x, int64_t y) { return y == -1 ? 0 : x % y; }
+
+// shift64 is cpu.Shift: left by n, arithmetic right by -n if negative, for any n.
+static inline int64_t shift64(int64_t x, int64_t n) {
+  if (n <= -64) {
+    return x < 0 ? -1 : 0;
+  }
+  if (n < 0) {
+    return x >> -n;
+  }
+  return n >= 64 ? 0 : (int64_t)((uint64_t)x << n);
+}
+
+// bytes_at returns the n bytes at offset of the region of words, or faults.
+static inline uint8_t *bytes_at(Operation *region, int64_t words, int64_t offset,
+                                int64_t n, int64_t pc, int64_t sp) {
+  if (words == 0 || offset < 0 || n < 0 || offset > words * 8 - n) {
+    fault(BadMemoryAccess, pc, sp);
+  }
+  return (uint8_t *)region + offset;
+}
+
+static inline int64_t write_all(const uint8_t *data, int64_t n) {
+  for (int64_t done = 0; done < n;) {
+    ssize_t w = write(STDOUT_FILENO, data + done, (size_t)(n - done));
+    if (w < 0) {
+      perror("Failed to output bytes");
+      return -1;
+    }
+    done += w;
+  }
+  return n;
+}
+
+static inline int64_t sys(int call, int64_t operand, int64_t a, int64_t pc,
+                          int is_stack, int64_t sp) {
+  Operation *region = is_stack ? stack : memory;
+  int64_t words = is_stack ? StackSize : MemorySize;
+  int64_t addr = is_stack ? sp - operand : pc + operand;
+  switch (call) {
+  case Exit:
+    exit((int)operand);
+  case Sleep:
+    if (operand > 0) {
+      struct timespec ts = {operand / 1000, (operand % 1000) * 1000000};
+      nanosleep(&ts, NULL);
+    }
+    return a;
+  case Read8:
+  case Read16: {
+    int prefix = call == Read8 ? 1 : 2;
+    if (a <= 0 || a >= (INT64_C(1) << (8 * prefix))) {
+      fault(BadMemoryAccess, pc, sp);
+    }
+    uint8_t *data = bytes_at(region, words, mul64(addr, 8) + prefix, a, pc, sp);
+    ssize_t r = read(STDIN_FILENO, data, (size_t)a);
+    if (r < 0) {
+      perror("Failed to read string");
+      return -1;
+    }
+    if (r > 0) {
+      for (int i = 0; i < prefix; i++) {
+        data[i - prefix] = (uint8_t)(r >> (8 * i));
+      }
+    }
+    return r;
+  }
+  case Write8:
+  case Write16: {
+    int prefix = call == Write8 ? 1 : 2;
+    int64_t offset = 0;
+    if (is_stack) {
+      addr += a / 8;
+      offset = a % 8;
+    }
+    offset += mul64(addr, 8);
+    uint8_t *len = bytes_at(region, words, offset, prefix, pc, sp);
+    int64_t length = prefix == 1 ? len[0] : len[0] | (len[1] << 8);
+    if (length == 0) {
+      return 0;
+    }
+    return write_all(bytes_at(region, words, offset + prefix, length, pc, sp), length);
+  }
+  case ReadN: {
+    if (a < 0) {
+      fault(BadMemoryAccess, pc, sp);
+    }
+    if (a == 0) {
+      return 0;
+    }
+    ssize_t r = read(STDIN_FILENO, bytes_at(region, words, mul64(addr, 8), a, pc, sp), (size_t)a);
+    if (r < 0) {
+      perror("Failed to read");
+      return -1;
+    }
+    return r;
+  }
+  case WriteN:
+    if (a < 0) {
+      fault(BadMemoryAccess, pc, sp);
+    }
+    if (a == 0) {
+      return 0;
+    }
+    return write_all(bytes_at(region, words, mul64(addr, 8), a, pc, sp), a);
+  default:
+    fprintf(stderr, "ERR: Unknown syscall: %d at PC: %" PRId64 "\n", call, pc);
+    exit(99);
+  }
+}
+
+`
+
+// cLiteral returns the C int64_t literal for v.
+func cLiteral(v int64) string {
+	if v == math.MinInt64 {
+		return "INT64_MIN"
+	}
+	return fmt.Sprintf("INT64_C(%d)", v)
+}
+
+// cStackIndex returns the statement checking the stack index sp-offset.
+func cStackIndex(pc int, offset int64) string {
+	return fmt.Sprintf("\tif ((uint64_t)(sp - %d) >= (uint64_t)StackSize) {\n\t\tstack_fault(sp - %d, %d, sp);\n\t}\n",
+		offset, offset, pc)
+}
+
+var cFunctions = map[cpu.Instruction]string{
+	cpu.AddI: "add64", cpu.SubI: "sub64", cpu.MulI: "mul64",
+	cpu.AddR: "add64", cpu.SubR: "sub64", cpu.MulR: "mul64", cpu.DivR: "div64", cpu.ModR: "mod64", cpu.ShiftR: "shift64",
+	cpu.AddS: "add64", cpu.SubS: "sub64", cpu.MulS: "mul64", cpu.DivS: "div64", cpu.ModS: "mod64", cpu.ShiftS: "shift64",
+}
+
+// cOperators are the bitwise instructions, which don't need a function.
+var cOperators = map[cpu.Instruction]string{
+	cpu.AndI: "&", cpu.OrI: "|", cpu.XorI: "^",
+	cpu.AndR: "&", cpu.OrR: "|", cpu.XorR: "^",
+	cpu.AndS: "&", cpu.OrS: "|", cpu.XorS: "^",
+}
+
+// cOperation returns the C statement applying the arithmetic or bitwise instruction code to the
+// accumulator and operand.
+func cOperation(code cpu.Instruction, operand string) string {
+	if op, ok := cOperators[code]; ok {
+		return fmt.Sprintf("a %s= %s;", op, operand)
+	}
+	return fmt.Sprintf("a = %s(a, %s);", cFunctions[code], operand)
+}
+
+// instruction returns the C statements for the instruction at pc.
+//
+//nolint:gocyclo,funlen // it's a switch on all instructions.
+func (t *cTranslator) instruction(pc int) string {
+	op := t.program[pc]
+	v := op.OperandInt64()
+	var sb strings.Builder
+	line := lineWriter(&sb)
+	switch code := op.Opcode(); code {
+	case cpu.LoadI:
+		line("a = %s;", cLiteral(v))
+	case cpu.AddI, cpu.SubI, cpu.MulI:
+		line("a = %s(a, %s);", cFunctions[code], cLiteral(v))
+	case cpu.AndI, cpu.OrI, cpu.XorI:
+		line("%s", cOperation(code, cLiteral(v)))
+	case cpu.Not:
+		line("a = ~a;")
+	case cpu.ShrI:
+		switch {
+		case v >= 64 || v <= -64:
+			line("a = 0;")
+		case v < 0:
+			line("a = (int64_t)((uint64_t)a << %d);", -v)
+		default:
+			line("a = (int64_t)((uint64_t)a >> %d);", v)
+		}
+	case cpu.DivI, cpu.ModI:
+		switch {
+		case v == 0:
+			line("%s", t.fault(cpu.DivideByZero, pc))
+		case v == -1 && code == cpu.DivI:
+			line("a = sub64(0, a);")
+		case v == -1:
+			line("a = 0;")
+		case code == cpu.DivI:
+			line("a /= %s;", cLiteral(v))
+		default:
+			line("a %%= %s;", cLiteral(v))
+		}
+	case cpu.ShiftI:
+		switch {
+		case v <= -64:
+			line("a = a < 0 ? -1 : 0;")
+		case v < 0:
+			line("a >>= %d;", -v)
+		case v >= 64:
+			line("a = 0;")
+		default:
+			line("a = (int64_t)((uint64_t)a << %d);", v)
+		}
+	case cpu.JNE, cpu.JEQ, cpu.JLT, cpu.JGT, cpu.JGTE, cpu.JLTE:
+		line("if (a %s %d) {\n\t\t%s\n\t}", goConditions[code], v&0xFF, t.jump(int64(pc)+v>>8))
+	case cpu.JNES, cpu.JEQS, cpu.JLTS, cpu.JGTS, cpu.JGTES, cpu.JLTES:
+		sb.WriteString(cStackIndex(pc, v&0xFF))
+		line("if (a %s stack[sp - %d]) {\n\t\t%s\n\t}", goConditions[code], v&0xFF, t.jump(int64(pc)+v>>8))
+	case cpu.JNER, cpu.JEQR, cpu.JLTR, cpu.JGTR, cpu.JGTER, cpu.JLTER:
+		mem, ok := t.addressWord(pc)
+		if !ok {
+			return mem
+		}
+		line("if (a %s %s) {\n\t\t%s\n\t}", goConditions[code], mem, t.jump(int64(pc)+v))
+		if t.code[pc+1] { // the address word is also executed as an instruction from elsewhere.
+			line("%s", t.jump(int64(pc)+2))
+		}
+	case cpu.JumpR:
+		line("%s", t.jump(int64(pc)+v))
+	case cpu.LoadR, cpu.AddR, cpu.SubR, cpu.MulR, cpu.DivR, cpu.StoreR,
+		cpu.ModR, cpu.AndR, cpu.OrR, cpu.XorR, cpu.ShiftR:
+		mem, ok := t.memory(pc, v)
+		if !ok {
+			return mem
+		}
+		switch code { //nolint:exhaustive // just the R ones.
+		case cpu.LoadR:
+			line("a = %s;", mem)
+		case cpu.StoreR:
+			line("%s = a;", mem)
+		case cpu.DivR, cpu.ModR:
+			line("if (%s == 0) {\n\t\t%s\n\t}", mem, t.fault(cpu.DivideByZero, pc))
+			fallthrough
+		default:
+			line("%s", cOperation(code, mem))
+		}
+	case cpu.IncrR:
+		mem, ok := t.memory(pc, v>>8)
+		if !ok {
+			return mem
+		}
+		line("a = add64(%s, %d);", mem, int8(v&0xFF)) //nolint:gosec // signed increment on purpose
+		line("%s = a;", mem)
+	case cpu.Call:
+		line("if (sp + 1 >= StackSize) {\n\t\t%s\n\t}", t.fault(cpu.StackOverflow, pc))
+		line("stack[++sp] = %d;", pc+1)
+		line("%s", t.jump(int64(pc)+v))
+	case cpu.Ret:
+		t.hasRet = true
+		if v > 0 {
+			line("if (sp - %d < 0) {\n\t\t%s\n\t}", v, t.fault(cpu.StackUnderflow, pc))
+			line("sp -= %d;", v)
+		} else {
+			line("if (sp < 0) {\n\t\t%s\n\t}", t.fault(cpu.StackUnderflow, pc))
+		}
+		line("pc = stack[sp--];")
+		line("goto dispatch;")
+	case cpu.Push:
+		line("if (sp + 1 + %d >= StackSize) {\n\t\t%s\n\t}", max(0, v), t.fault(cpu.StackOverflow, pc))
+		if v > 0 {
+			line("for (int64_t i = 0; i < %d; i++) {\n\t\tstack[++sp] = 0;\n\t}", v)
+		}
+		line("stack[++sp] = a;")
+	case cpu.Pop:
+		extra := max(0, v)
+		line("if (sp - %d < 0) {\n\t\t%s\n\t}", extra, t.fault(cpu.StackUnderflow, pc))
+		line("a = stack[sp];")
+		line("sp -= %d;", 1+extra)
+	case cpu.LoadS, cpu.StoreS, cpu.AddS, cpu.SubS, cpu.MulS, cpu.DivS,
+		cpu.ModS, cpu.AndS, cpu.OrS, cpu.XorS, cpu.ShiftS:
+		sb.WriteString(cStackIndex(pc, v))
+		mem := fmt.Sprintf("stack[sp - %d]", v)
+		switch code { //nolint:exhaustive // just the S ones.
+		case cpu.LoadS:
+			line("a = %s;", mem)
+		case cpu.StoreS:
+			line("%s = a;", mem)
+		case cpu.DivS, cpu.ModS:
+			line("if (%s == 0) {\n\t\t%s\n\t}", mem, t.fault(cpu.DivideByZero, pc))
+			fallthrough
+		default:
+			line("%s", cOperation(code, mem))
+		}
+	case cpu.IncrS:
+		offset := v >> 8
+		sb.WriteString(cStackIndex(pc, offset))
+		line("a = add64(stack[sp - %d], %d);", offset, int8(v&0xFF)) //nolint:gosec // signed increment on purpose
+		line("stack[sp - %d] = a;", offset)
+	case cpu.IdivS:
+		sb.WriteString(cStackIndex(pc, v))
+		line("if (a == 0) {\n\t\t%s\n\t}", t.fault(cpu.DivideByZero, pc))
+		line("{\n\t\tint64_t current = stack[sp - %d];", v)
+		line("\tstack[sp - %d] = div64(current, a);", v)
+		line("\ta = mod64(current, a);\n\t}")
+	case cpu.StoreSB, cpu.LoadSB:
+		offset, byteIndex := v>>8, v&0xFF
+		sb.WriteString(cStackIndex(pc, byteIndex))
+		line("{\n\t\tint64_t bytes_offset = stack[sp - %d];", byteIndex)
+		line("\tint64_t idx = sp - %d + bytes_offset / 8;", offset)
+		line("\tif ((uint64_t)idx >= (uint64_t)StackSize || bytes_offset < 0) {\n\t\t\tstack_fault(idx, %d, sp);\n\t\t}", pc)
+		line("\tint shift = (int)(bytes_offset %% 8) * 8;")
+		if code == cpu.LoadSB {
+			line("\ta = (uint8_t)((uint64_t)stack[idx] >> shift);\n\t}")
+			break
+		}
+		line("\tstack[idx] = (int64_t)(((uint64_t)stack[idx] & ~((uint64_t)0xFF << shift)) |")
+		line("\t\t(((uint64_t)a & 0xFF) << shift));\n\t}")
+	case cpu.LoadRB, cpu.StoreRB:
+		base, byteIndex := int64(pc)+v>>8, v&0xFF
+		sb.WriteString(cStackIndex(pc, byteIndex))
+		line("{\n\t\tint64_t bytes_offset = stack[sp - %d];", byteIndex)
+		line("\tint64_t addr = %d + bytes_offset / 8;", base)
+		line("\tif ((uint64_t)addr >= (uint64_t)MemorySize || bytes_offset < 0) {\n\t\t\t%s\n\t\t}",
+			t.fault(cpu.BadMemoryAccess, pc))
+		line("\tint shift = (int)(bytes_offset %% 8) * 8;")
+		if code == cpu.LoadRB {
+			line("\ta = (uint8_t)((uint64_t)memory[addr] >> shift);\n\t}")
+			break
+		}
+		line("\tmemory[addr] = (int64_t)(((uint64_t)memory[addr] & ~((uint64_t)0xFF << shift)) |")
+		line("\t\t(((uint64_t)a & 0xFF) << shift));\n\t}")
+	case cpu.Sys, cpu.SysS:
+		call := cpu.Syscall(v & 0xFF) //nolint:gosec // 0xFF mask
+		callName := fmt.Sprint(int(call))
+		if call > cpu.InvalidSyscall && call < cpu.LastSyscall {
+			callName = call.String()
+		}
+		isStack := 0
+		if code == cpu.SysS {
+			isStack = 1
+		}
+		line("a = sys(%s, %d, a, %d, %d, sp);", callName, v>>8, pc, isStack)
+	default:
+		line("%s", t.fault(cpu.InvalidOpcode, pc))
+	}
+	return sb.String()
+}
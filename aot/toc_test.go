@@ -0,0 +1,61 @@
+package aot
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestToC translates the sample programs to C, compiles them with the flags used for cvm/cvm.c
+// and checks they have the same output and exit code as the interpreter.
+func TestToC(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds C programs")
+	}
+	gcc, err := exec.LookPath("gcc")
+	if err != nil {
+		t.Skip("gcc not found")
+	}
+	dir := t.TempDir()
+	for name, vmFile := range testPrograms(t, dir) {
+		t.Run(name, func(t *testing.T) {
+			if res := ToC(Options{}, vmFile); res != 0 {
+				t.Fatalf("toc failed with %d", res)
+			}
+			binary := filepath.Join(dir, name)
+			src := strings.TrimSuffix(vmFile, ".vm") + ".c"
+			build := exec.Command(gcc, "-O3", "-Wall", "-Wextra", "-pedantic", "-Werror", "-o", binary, src)
+			if out, err := build.CombinedOutput(); err != nil {
+				t.Fatalf("failed to compile the translated %s: %v\n%s", name, err, out)
+			}
+			checkBinary(t, binary, vmFile)
+		})
+	}
+}
+
+// TestCVM runs the sample programs with cvm/cvm.c, the C VM, and checks they have the same output
+// and exit code as the Go one. The faultPrograms are skipped: the C VM trusts its programs.
+func TestCVM(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the C VM")
+	}
+	gcc, err := exec.LookPath("gcc")
+	if err != nil {
+		t.Skip("gcc not found")
+	}
+	dir := t.TempDir()
+	cvm := filepath.Join(dir, "grol_cvm")
+	build := exec.Command(gcc, "-O3", "-Wall", "-Wextra", "-pedantic", "-Werror", "-o", cvm, "../cvm/cvm.c")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("failed to compile the C VM: %v\n%s", err, out)
+	}
+	for name, vmFile := range testPrograms(t, dir) {
+		if _, isFault := faultPrograms[strings.ReplaceAll(name, "_", " ")]; isFault || name == "loop" {
+			continue // loop is only a benchmark.
+		}
+		t.Run(name, func(t *testing.T) {
+			checkBinary(t, cvm, vmFile, vmFile)
+		})
+	}
+}
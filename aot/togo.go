@@ -0,0 +1,302 @@
+package aot
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fortio.org/log"
+	"grol.io/vm/cpu"
+)
+
+// ToGo translates each .vm file into a Go main package, written as main.go in a directory
+// named after the file (without the .vm extension).
+func ToGo(opts Options, files ...string) int {
+	return loadFiles(files, opts, func(program []cpu.Operation, opts Options, file, dir string) int {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return log.FErrf("Failed to create directory %s: %v", dir, err)
+		}
+		var buf bytes.Buffer
+		if err := TranslateGo(&buf, filepath.Base(file), program, opts); err != nil {
+			return log.FErrf("Failed to translate %s: %v", file, err)
+		}
+		output := filepath.Join(dir, "main.go")
+		log.Infof("Translating %s to %s", file, output)
+		if err := os.WriteFile(output, buf.Bytes(), 0o644); err != nil { //nolint:gosec // source code is meant to be readable.
+			return log.FErrf("Failed to write %s: %v", output, err)
+		}
+		return 0
+	})
+}
+
+// goTranslator generates the Go statements for each instruction.
+type goTranslator struct {
+	*translator
+}
+
+// TranslateGo writes to w a Go main package running program with the same output and exit code
+// as `vm run`. Each reachable instruction becomes Go statements, jumps are gotos to labels and
+// Ret goes through a switch on the return address (returning to a word that isn't reachable
+// code is reported as a BadMemoryAccess fault). Self modifying code isn't supported: the
+// instructions are translated as they are in the .vm file.
+func TranslateGo(w io.Writer, name string, program []cpu.Operation, opts Options) error {
+	t := goTranslator{newTranslator(program, opts)}
+	t.fault = func(kind cpu.FaultKind, pc any) string {
+		return fmt.Sprintf("return fault(cpu.%v, %v)", kind, pc)
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "// Code generated by vm togo from %s; DO NOT EDIT.\n\n", name)
+	sb.WriteString(goPrelude)
+	fmt.Fprintf(&sb, "const stackSize = %d\n\n", t.stackSize)
+	sb.WriteString("var memory = []cpu.Operation{")
+	for i, op := range program {
+		if i%4 == 0 {
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(&sb, "%d, ", int64(op))
+	}
+	sb.WriteString("\n}\n\n")
+	sb.WriteString(goRunStart)
+	t.writeBody(&sb, t.instruction, "return 0, nil", "switch pc")
+	sb.WriteString("}\n")
+	src, err := format.Source([]byte(sb.String()))
+	if err != nil {
+		return fmt.Errorf("generated invalid Go: %w", err)
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+const goPrelude = `package main
+
+import (
+	"fmt"
+	"os"
+
+	"grol.io/vm/cpu"
+)
+
+func main() {
+	c := cpu.NewCPU(os.Stdin, os.Stdout, nil)
+	c.Program = memory
+	c.Stack = make([]cpu.Operation, stackSize)
+	code, err := run(c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Fault: %v\n", err)
+	}
+	os.Exit(code)
+}
+
+`
+
+const goRunStart = `//nolint:gocyclo,funlen,gocognit,maintidx // generated code.
+func run(c *cpu.CPU) (int, error) {
+	memory := c.Program
+	stack := c.Stack
+	sp := -1
+	var a, res int64
+	var pc cpu.ImmediateData
+	var exit bool
+	var err error
+	fault := func(kind cpu.FaultKind, pc cpu.ImmediateData) (int, error) {
+		f := c.NewFault(kind, pc, a, sp)
+		return f.ExitCode(), f
+	}
+	stackFault := func(idx int, pc cpu.ImmediateData) (int, error) {
+		if idx < 0 {
+			return fault(cpu.StackUnderflow, pc)
+		}
+		return fault(cpu.StackOverflow, pc)
+	}
+	_, _, _, _, _, _, _ = memory, stack, res, pc, exit, err, stackFault
+`
+
+// stackIndex returns the statements checking the stack index sp-offset, setting idx.
+func stackIndex(pc int, offset int64) string {
+	return fmt.Sprintf("\tif idx := sp - %d; uint(idx) >= uint(len(stack)) {\n\t\treturn stackFault(idx, %d)\n\t}\n",
+		offset, pc)
+}
+
+var goOperators = map[cpu.Instruction]string{
+	cpu.AddI: "+=", cpu.SubI: "-=", cpu.MulI: "*=", cpu.AndI: "&=", cpu.OrI: "|=", cpu.XorI: "^=",
+	cpu.AddR: "+=", cpu.SubR: "-=", cpu.MulR: "*=", cpu.AndR: "&=", cpu.OrR: "|=", cpu.XorR: "^=",
+	cpu.DivR: "/=", cpu.ModR: "%=",
+	cpu.AddS: "+=", cpu.SubS: "-=", cpu.MulS: "*=", cpu.AndS: "&=", cpu.OrS: "|=", cpu.XorS: "^=",
+	cpu.DivS: "/=", cpu.ModS: "%=",
+}
+
+var goConditions = map[cpu.Instruction]string{
+	cpu.JNE: "!=", cpu.JEQ: "==", cpu.JLT: "<", cpu.JGT: ">", cpu.JGTE: ">=", cpu.JLTE: "<=",
+	cpu.JNES: "!=", cpu.JEQS: "==", cpu.JLTS: "<", cpu.JGTS: ">", cpu.JGTES: ">=", cpu.JLTES: "<=",
+	cpu.JNER: "!=", cpu.JEQR: "==", cpu.JLTR: "<", cpu.JGTR: ">", cpu.JGTER: ">=", cpu.JLTER: "<=",
+}
+
+// instruction returns the Go statements for the instruction at pc.
+//
+//nolint:gocyclo,funlen // it's a switch on all instructions.
+func (t *goTranslator) instruction(pc int) string {
+	op := t.program[pc]
+	v := op.OperandInt64()
+	var sb strings.Builder
+	line := lineWriter(&sb)
+	switch code := op.Opcode(); code {
+	case cpu.LoadI:
+		line("a = %d", v)
+	case cpu.AddI, cpu.SubI, cpu.MulI, cpu.AndI, cpu.OrI, cpu.XorI:
+		line("a %s %d", goOperators[code], v)
+	case cpu.Not:
+		line("a = ^a")
+	case cpu.ShrI:
+		line("a = cpu.Shr(a, %d)", v)
+	case cpu.DivI, cpu.ModI:
+		if v == 0 {
+			line("return fault(cpu.DivideByZero, %d)", pc)
+			break
+		}
+		operator := "/="
+		if code == cpu.ModI {
+			operator = "%="
+		}
+		line("a %s %d", operator, v)
+	case cpu.ShiftI:
+		if v < 0 {
+			line("a >>= %d", -v)
+		} else {
+			line("a <<= %d", v)
+		}
+	case cpu.JNE, cpu.JEQ, cpu.JLT, cpu.JGT, cpu.JGTE, cpu.JLTE:
+		line("if a %s %d {\n\t\t%s\n\t}", goConditions[code], v&0xFF, t.jump(int64(pc)+v>>8))
+	case cpu.JNES, cpu.JEQS, cpu.JLTS, cpu.JGTS, cpu.JGTES, cpu.JLTES:
+		sb.WriteString(stackIndex(pc, v&0xFF))
+		line("if a %s int64(stack[sp - %d]) {\n\t\t%s\n\t}", goConditions[code], v&0xFF, t.jump(int64(pc)+v>>8))
+	case cpu.JNER, cpu.JEQR, cpu.JLTR, cpu.JGTR, cpu.JGTER, cpu.JLTER:
+		mem, ok := t.addressWord(pc)
+		if !ok {
+			return mem
+		}
+		line("if a %s int64(%s) {\n\t\t%s\n\t}", goConditions[code], mem, t.jump(int64(pc)+v))
+		if t.code[pc+1] { // the address word is also executed as an instruction from elsewhere.
+			line("%s", t.jump(int64(pc)+2))
+		}
+	case cpu.JumpR:
+		line("%s", t.jump(int64(pc)+v))
+	case cpu.LoadR, cpu.AddR, cpu.SubR, cpu.MulR, cpu.DivR, cpu.StoreR,
+		cpu.ModR, cpu.AndR, cpu.OrR, cpu.XorR, cpu.ShiftR:
+		mem, ok := t.memory(pc, v)
+		if !ok {
+			return mem
+		}
+		switch code { //nolint:exhaustive // just the R ones.
+		case cpu.LoadR:
+			line("a = int64(%s)", mem)
+		case cpu.DivR, cpu.ModR:
+			line("if %s == 0 {\n\t\treturn fault(cpu.DivideByZero, %d)\n\t}", mem, pc)
+			line("a %s int64(%s)", goOperators[code], mem)
+		case cpu.ShiftR:
+			line("a = cpu.Shift(a, int64(%s))", mem)
+		case cpu.StoreR:
+			line("%s = cpu.Operation(a)", mem)
+		default:
+			line("a %s int64(%s)", goOperators[code], mem)
+		}
+	case cpu.IncrR:
+		mem, ok := t.memory(pc, v>>8)
+		if !ok {
+			return mem
+		}
+		line("a = int64(%s) + %d", mem, int8(v&0xFF)) //nolint:gosec // signed increment on purpose
+		line("%s = cpu.Operation(a)", mem)
+	case cpu.Call:
+		line("if sp+1 >= len(stack) {\n\t\treturn fault(cpu.StackOverflow, %d)\n\t}", pc)
+		line("sp++")
+		line("stack[sp] = %d", pc+1)
+		line("%s", t.jump(int64(pc)+v))
+	case cpu.Ret:
+		t.hasRet = true
+		if v > 0 {
+			line("if sp - %d < 0 {\n\t\treturn fault(cpu.StackUnderflow, %d)\n\t}", v, pc)
+			line("sp -= %d", v)
+		} else {
+			line("if sp < 0 {\n\t\treturn fault(cpu.StackUnderflow, %d)\n\t}", pc)
+		}
+		line("pc = cpu.ImmediateData(stack[sp])")
+		line("sp--")
+		line("goto dispatch")
+	case cpu.Push:
+		line("if sp+1+%d >= len(stack) {\n\t\treturn fault(cpu.StackOverflow, %d)\n\t}", max(0, v), pc)
+		if v > 0 {
+			line("for range %d {\n\t\tsp++\n\t\tstack[sp] = 0\n\t}", v)
+		}
+		line("sp++")
+		line("stack[sp] = cpu.Operation(a)")
+	case cpu.Pop:
+		extra := max(0, v)
+		line("if sp - %d < 0 {\n\t\treturn fault(cpu.StackUnderflow, %d)\n\t}", extra, pc)
+		line("a = int64(stack[sp])")
+		line("sp -= %d", 1+extra)
+	case cpu.LoadS, cpu.StoreS, cpu.AddS, cpu.SubS, cpu.MulS, cpu.DivS,
+		cpu.ModS, cpu.AndS, cpu.OrS, cpu.XorS, cpu.ShiftS:
+		sb.WriteString(stackIndex(pc, v))
+		mem := fmt.Sprintf("stack[sp - %d]", v)
+		switch code { //nolint:exhaustive // just the S ones.
+		case cpu.LoadS:
+			line("a = int64(%s)", mem)
+		case cpu.StoreS:
+			line("%s = cpu.Operation(a)", mem)
+		case cpu.DivS, cpu.ModS:
+			line("if %s == 0 {\n\t\treturn fault(cpu.DivideByZero, %d)\n\t}", mem, pc)
+			line("a %s int64(%s)", goOperators[code], mem)
+		case cpu.ShiftS:
+			line("a = cpu.Shift(a, int64(%s))", mem)
+		default:
+			line("a %s int64(%s)", goOperators[code], mem)
+		}
+	case cpu.IncrS:
+		offset := v >> 8
+		sb.WriteString(stackIndex(pc, offset))
+		line("a = int64(stack[sp - %d]) + %d", offset, int8(v&0xFF)) //nolint:gosec // signed increment on purpose
+		line("stack[sp - %d] = cpu.Operation(a)", offset)
+	case cpu.IdivS:
+		sb.WriteString(stackIndex(pc, v))
+		line("if a == 0 {\n\t\treturn fault(cpu.DivideByZero, %d)\n\t}", pc)
+		line("a, stack[sp - %d] = int64(stack[sp - %d])%%a, stack[sp - %d]/cpu.Operation(a)", v, v, v)
+	case cpu.StoreSB, cpu.LoadSB:
+		offset, byteIndex := v>>8, v&0xFF
+		sb.WriteString(stackIndex(pc, byteIndex))
+		line("{\n\t\tbytesOffset := int(stack[sp - %d])", byteIndex)
+		line("\tif idx := sp - %d + bytesOffset/8; uint(idx) >= uint(len(stack)) || bytesOffset < 0 {", offset)
+		line("\t\treturn stackFault(idx, %d)\n\t\t}", pc)
+		line("\tshift := (bytesOffset %% 8) * 8")
+		line("\tw := &stack[sp - %d+bytesOffset/8]", offset)
+		if code == cpu.LoadSB {
+			line("\ta = int64(uint8(*w >> shift))\n\t}")
+			break
+		}
+		line("\t*w = (*w &^ (0xff << shift)) | (cpu.Operation(a&0xff) << shift)\n\t}")
+	case cpu.LoadRB, cpu.StoreRB:
+		base, byteIndex := int64(pc)+v>>8, v&0xFF
+		sb.WriteString(stackIndex(pc, byteIndex))
+		line("{\n\t\tbytesOffset := int(stack[sp - %d])", byteIndex)
+		line("\taddr := %d + bytesOffset/8", base)
+		line("\tif uint(addr) >= uint(len(memory)) || bytesOffset < 0 {")
+		line("\t\treturn fault(cpu.BadMemoryAccess, %d)\n\t\t}", pc)
+		line("\tshift := (bytesOffset %% 8) * 8")
+		if code == cpu.LoadRB {
+			line("\ta = int64(uint8(memory[addr] >> shift))\n\t}")
+			break
+		}
+		line("\tmemory[addr] = (memory[addr] &^ (0xff << shift)) | (cpu.Operation(a&0xff) << shift)\n\t}")
+	case cpu.Sys, cpu.SysS:
+		call := cpu.Syscall(v & 0xFF) //nolint:gosec // 0xFF mask
+		line("res, exit, err = c.Syscall(%d, %d, a, %d, %t, sp) // %v", call, v>>8, pc, code == cpu.SysS, call)
+		line("if exit {\n\t\treturn int(res), err\n\t}")
+		line("a = res")
+	default:
+		line("return fault(cpu.InvalidOpcode, %d)", pc)
+	}
+	return sb.String()
+}
@@ -0,0 +1,161 @@
+package aot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"grol.io/vm/asm"
+	"grol.io/vm/cpu"
+)
+
+const testInput = "some input\nfor cat\n"
+
+// faultPrograms check the translated faults have the interpreter's exit codes.
+var faultPrograms = map[string]string{
+	"divide": "loadi 3\ndivi 0\nsys exit 0\n",
+	"recursion": `
+loop:
+    call loop
+`,
+	"underflow":             "pop 0\n",
+	"bad jump":              "jumpr -10\n",
+	"bad ret":               "loadi 100\npush 0\nret 0\n",
+	"stack index underflow": "push 0\nloads 2\n",
+	"negative stack index":  "push 0\nstores -600\n",
+	"divide stack":          "loadi 0\npush 0\ndivs 0\n",
+	"idivs zero":            "loadi 5\npush 0\nloadi 0\nidivs 0\n",
+	"store byte":            "loadi -3\npush 0\nstoresb 0 0\n",
+	"load byte":             "loadi -8\npush 0\nloadsb 0 0\n",
+	"load memory byte":      "loadi 24\npush 0\nloadrb x 0\nx:\n",
+	"store memory byte":     "loadi -1\npush 0\nstorerb x 0\nx:\n  data 0\n",
+	"modulo stack":          "loadi 0\npush 0\nmods 0\n",
+	"modulo memory":         "loadi 7\nmodr x\nx:\n  data 0\n",
+	"compare stack":         "push 0\njlts 1 x\nx:\n",
+	"compare memory":        "jner -1 x\nx:\n",
+	"push overflow":         "push 600\n",
+	"bad write":             "loadi 1000\nsys writen 0\n",
+}
+
+// testPrograms compiles the sample programs and faultPrograms in dir and returns the .vm
+// files by name.
+func testPrograms(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	sources := map[string][]byte{}
+	files, err := filepath.Glob("../programs/*.asm")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no programs found: %v", err)
+	}
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", file, err)
+		}
+		sources[strings.TrimSuffix(filepath.Base(file), ".asm")] = src
+	}
+	sources["fact"] = append(sources["fact"], sources["itoa"]...)
+	for name, src := range faultPrograms {
+		sources[strings.ReplaceAll(name, " ", "_")] = []byte(src)
+	}
+	vmFiles := make(map[string]string, len(sources))
+	for name, src := range sources {
+		asmFile := filepath.Join(dir, name+".asm")
+		if err := os.WriteFile(asmFile, src, 0o600); err != nil {
+			t.Fatalf("failed to write %s: %v", asmFile, err)
+		}
+		if res := asm.Compile(asm.Options{IncludePath: []string{"../programs"}}, asmFile); res != 0 {
+			t.Fatalf("compile of %s failed with %d", name, res)
+		}
+		vmFiles[name] = filepath.Join(dir, name+".vm")
+	}
+	return vmFiles
+}
+
+// checkBinary runs the translated binary and checks it has the same output and exit code as the
+// interpreter running vmFile. args are the arguments of the binary.
+func checkBinary(t *testing.T, binary, vmFile string, args ...string) {
+	t.Helper()
+	expectedOut, expectedCode := interpret(t, vmFile)
+	cmd := exec.Command(binary, args...)
+	cmd.Stdin = strings.NewReader(testInput)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	code := 0
+	var exitErr *exec.ExitError
+	if err := cmd.Run(); errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatalf("failed to run %s: %v", binary, err)
+	}
+	if code != expectedCode || out.String() != expectedOut {
+		t.Errorf("translated %s got %d %q, interpreter got %d %q", vmFile, code, out.String(),
+			expectedCode, expectedOut)
+	}
+}
+
+// interpret runs the .vm file like `vm run` does and returns its output and exit code.
+func interpret(t *testing.T, vmFile string) (string, int) {
+	t.Helper()
+	program, _, err := loadProgram(vmFile)
+	if err != nil {
+		t.Fatalf("failed to load %s: %v", vmFile, err)
+	}
+	var out bytes.Buffer
+	c := cpu.NewCPU(strings.NewReader(testInput), &out, nil)
+	c.Program = program
+	code, _ := c.Execute(context.Background())
+	return out.String(), int(code) & 0xFF
+}
+
+// goModule makes dir a module using this tree's grol.io/vm, with its requirements and go.sum, so the
+// generated code can import grol.io/vm/cpu from there.
+func goModule(t *testing.T, dir string) {
+	t.Helper()
+	root, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatalf("failed to find the module root: %v", err)
+	}
+	mod, err := os.ReadFile(filepath.Join(root, "go.mod"))
+	if err != nil {
+		t.Fatalf("failed to read go.mod: %v", err)
+	}
+	sum, err := os.ReadFile(filepath.Join(root, "go.sum"))
+	if err != nil {
+		t.Fatalf("failed to read go.sum: %v", err)
+	}
+	mod = append(bytes.Replace(mod, []byte("module grol.io/vm\n"), []byte("module togotest\n"), 1),
+		"\nrequire grol.io/vm v0.0.0\n\nreplace grol.io/vm => "+root+"\n"...)
+	for file, content := range map[string][]byte{"go.mod": mod, "go.sum": sum} {
+		if err = os.WriteFile(filepath.Join(dir, file), content, 0o600); err != nil {
+			t.Fatalf("failed to write %s: %v", file, err)
+		}
+	}
+}
+
+// TestToGo translates the sample programs to Go, builds and runs them and checks they have the
+// same output and exit code as the interpreter.
+func TestToGo(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds Go programs")
+	}
+	dir := t.TempDir()
+	goModule(t, dir)
+	for name, vmFile := range testPrograms(t, dir) {
+		t.Run(name, func(t *testing.T) {
+			if res := ToGo(Options{}, vmFile); res != 0 {
+				t.Fatalf("togo failed with %d", res)
+			}
+			build := exec.Command("go", "build", "-o", name, ".")
+			build.Dir = filepath.Join(dir, name)
+			if out, err := build.CombinedOutput(); err != nil {
+				t.Fatalf("failed to build the translated %s: %v\n%s", name, err, out)
+			}
+			checkBinary(t, filepath.Join(dir, name, name), vmFile)
+		})
+	}
+}
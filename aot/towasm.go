@@ -0,0 +1,901 @@
+package aot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"fortio.org/log"
+	"grol.io/vm/cpu"
+)
+
+// ToWasm translates each .vm file into a WebAssembly module, written next to it with the .wasm
+// extension.
+func ToWasm(opts Options, files ...string) int {
+	return loadFiles(files, opts, func(program []cpu.Operation, opts Options, file, base string) int {
+		var buf bytes.Buffer
+		if err := TranslateWasm(&buf, program, opts); err != nil {
+			return log.FErrf("Failed to translate %s: %v", file, err)
+		}
+		output := base + ".wasm"
+		log.Infof("Translating %s to %s", file, output)
+		if err := os.WriteFile(output, buf.Bytes(), 0o644); err != nil { //nolint:gosec // not a secret.
+			return log.FErrf("Failed to write %s: %v", output, err)
+		}
+		return 0
+	})
+}
+
+// The module imports, from WasmImportModule, one function per cpu.Syscall named after it (Exit,
+// Read8,...) with the WasmSyscallType signature: the operand, the accumulator, the PC, 1 for
+// SysS (0 for Sys) and the stack pointer; returning the new accumulator. The host is expected to
+// run the syscall on the exported "memory", where the program words start at address 0 followed
+// by the stack, like cpu.CPU.Syscall does on the Program and Stack. Exit (and a syscall with an
+// invalid buffer) must end the module (e.g. with CloseWithExitCode).
+// The WasmFaultImport function (kind, PC, accumulator, stack pointer) is called when the program
+// faults and must end the module with the fault's exit code.
+// The exported WasmRunExport function runs the program and returns 0 when it reaches its end
+// without an Exit.
+const (
+	WasmImportModule = "vm"
+	WasmFaultImport  = "Fault"
+	WasmRunExport    = "run"
+)
+
+// WebAssembly binary format constants.
+const (
+	wasmI32 = 0x7F
+	wasmI64 = 0x7E
+
+	wasmBlockVoid = 0x40
+	wasmFuncType  = 0x60
+
+	opUnreachable = 0x00
+	opBlock       = 0x02
+	opLoop        = 0x03
+	opIf          = 0x04
+	opElse        = 0x05
+	opEnd         = 0x0B
+	opBr          = 0x0C
+	opBrIf        = 0x0D
+	opBrTable     = 0x0E
+	opReturn      = 0x0F
+	opCall        = 0x10
+	opSelect      = 0x1B
+	opLocalGet    = 0x20
+	opLocalSet    = 0x21
+	opLocalTee    = 0x22
+	opI64Load     = 0x29
+	opI64Load8U   = 0x31
+	opI64Store    = 0x37
+	opI64Store8   = 0x3C
+	opI32Const    = 0x41
+	opI64Const    = 0x42
+	opI64Eqz      = 0x50
+	opI64Eq       = 0x51
+	opI64Ne       = 0x52
+	opI64LtS      = 0x53
+	opI64GtS      = 0x55
+	opI64GtU      = 0x56
+	opI64LeS      = 0x57
+	opI64GeS      = 0x59
+	opI64GeU      = 0x5A
+	opI32Add      = 0x6A
+	opI32Or       = 0x72
+	opI32Shl      = 0x74
+	opI64Add      = 0x7C
+	opI64Sub      = 0x7D
+	opI64Mul      = 0x7E
+	opI64DivS     = 0x7F
+	opI64RemS     = 0x81
+	opI64And      = 0x83
+	opI64Or       = 0x84
+	opI64Xor      = 0x85
+	opI64Shl      = 0x86
+	opI64ShrS     = 0x87
+	opI64ShrU     = 0x88
+	opI32WrapI64  = 0xA7
+	opPrefixFC    = 0xFC
+	opMemoryFill  = 0x0B
+)
+
+// Indexes of the types, functions and locals of the generated module.
+const (
+	wasmSyscallType = iota
+	wasmFaultType
+	wasmRunType
+	wasmDivType // also the type of the shift function.
+)
+
+const (
+	localA = iota // accumulator
+	localSP
+	localPC
+	localT
+	localU
+	numLocals
+)
+
+var (
+	wasmSyscallCount = int(cpu.LastSyscall - cpu.InvalidSyscall - 1)
+	wasmFaultFunc    = wasmSyscallCount
+	wasmRunFunc      = wasmSyscallCount + 1
+	wasmDivFunc      = wasmSyscallCount + 2
+	wasmShiftFunc    = wasmSyscallCount + 3
+)
+
+// wasmSyscallFunc returns the index of the imported function of call.
+func wasmSyscallFunc(call cpu.Syscall) int {
+	return int(call - cpu.InvalidSyscall - 1)
+}
+
+func appendULEB(b []byte, v uint64) []byte {
+	for {
+		c := byte(v & 0x7F)
+		v >>= 7
+		if v == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func appendSLEB(b []byte, v int64) []byte {
+	for {
+		c := byte(v & 0x7F)
+		v >>= 7
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func appendName(b []byte, name string) []byte {
+	return append(appendULEB(b, uint64(len(name))), name...)
+}
+
+// appendVector appends the number of items (or the size in bytes of the content for sections
+// and function bodies) then the already encoded items.
+func appendVector(b []byte, count int, items []byte) []byte {
+	return append(appendULEB(b, uint64(count)), items...) //nolint:gosec // count isn't negative.
+}
+
+func appendSection(b []byte, id byte, content []byte) []byte {
+	b = append(b, id)
+	b = appendULEB(b, uint64(len(content)))
+	return append(b, content...)
+}
+
+// TranslateWasm writes to w a WebAssembly module running program with the same output and exit
+// code as `vm run` (given a host implementing the imports, see WasmImportModule). The accumulator,
+// stack pointer and pc are locals, the program and the stack are in the memory. The control flow
+// is a loop with a block per jump target (dispatching on the pc) so the jumps become branches.
+// Like for TranslateGo, self modifying code isn't supported and Ret can only return to
+// translated code.
+func TranslateWasm(w io.Writer, program []cpu.Operation, opts Options) error {
+	e := &wasmEmitter{translator: newTranslator(program, opts)}
+	e.stackBase = int64(len(program)) * cpu.OperationSize
+	e.runBody()
+	var types []byte
+	for _, sig := range [][2][]byte{
+		wasmSyscallType: {{wasmI64, wasmI64, wasmI64, wasmI32, wasmI64}, {wasmI64}},
+		wasmFaultType:   {{wasmI32, wasmI64, wasmI64, wasmI64}, {}},
+		wasmRunType:     {{}, {wasmI64}},
+		wasmDivType:     {{wasmI64, wasmI64}, {wasmI64}},
+	} {
+		types = append(types, wasmFuncType)
+		types = appendVector(types, len(sig[0]), sig[0])
+		types = appendVector(types, len(sig[1]), sig[1])
+	}
+	var imports []byte
+	for call := cpu.InvalidSyscall + 1; call < cpu.LastSyscall; call++ {
+		imports = appendName(appendName(imports, WasmImportModule), call.String())
+		imports = append(imports, 0, wasmSyscallType)
+	}
+	imports = appendName(appendName(imports, WasmImportModule), WasmFaultImport)
+	imports = append(imports, 0, wasmFaultType)
+	memBytes := e.stackBase + int64(e.stackSize)*cpu.OperationSize
+	pages := max(1, (memBytes+0xFFFF)/0x10000)
+	var exports []byte
+	exports = append(appendName(exports, "memory"), 2, 0)
+	exports = appendULEB(append(appendName(exports, WasmRunExport), 0), uint64(wasmRunFunc)) //nolint:gosec // small index.
+	// The run function, with its locals, then the division wrapping around like Go's and the
+	// shift for any count like cpu.Shift.
+	run := []byte{1, numLocals, wasmI64}
+	run = append(run, e.out...)
+	div := []byte{
+		0, opLocalGet, 1, opI64Const, 0x7F, opI64Eq, opIf, wasmI64,
+		opI64Const, 0, opLocalGet, 0, opI64Sub,
+		opElse, opLocalGet, 0, opLocalGet, 1, opI64DivS, opEnd, opEnd,
+	}
+	shift := []byte{
+		0, opLocalGet, 1, opI64Const, 0, opI64LtS, opIf, wasmI64,
+		// x >> min(-n, 63), unsigned min so that -MinInt64 is 63 too.
+		opLocalGet, 0, opI64Const, 63, opI64Const, 0, opLocalGet, 1, opI64Sub, opLocalTee, 1,
+		opLocalGet, 1, opI64Const, 63, opI64GtU, opSelect, opI64ShrS,
+		// n > 63 ? 0 : x << n.
+		opElse, opI64Const, 0, opLocalGet, 0, opLocalGet, 1, opI64Shl,
+		opLocalGet, 1, opI64Const, 63, opI64GtU, opSelect, opEnd, opEnd,
+	}
+	var code []byte
+	code = appendVector(code, len(run), run)
+	code = appendVector(code, len(div), div)
+	code = appendVector(code, len(shift), shift)
+	data := []byte{0, opI32Const, 0, opEnd}
+	var words bytes.Buffer
+	if err := binary.Write(&words, binary.LittleEndian, program); err != nil {
+		return err
+	}
+	data = appendVector(data, words.Len(), words.Bytes())
+	module := []byte{0, 'a', 's', 'm', 1, 0, 0, 0}
+	module = appendSection(module, 1, appendVector(nil, wasmDivType+1, types))
+	module = appendSection(module, 2, appendVector(nil, wasmSyscallCount+1, imports))
+	module = appendSection(module, 3, []byte{3, wasmRunType, wasmDivType, wasmDivType})
+	module = appendSection(module, 5, appendULEB([]byte{1, 0}, uint64(pages))) //nolint:gosec // positive.
+	module = appendSection(module, 7, appendVector(nil, 2, exports))
+	module = appendSection(module, 10, appendVector(nil, 3, code))
+	module = appendSection(module, 11, appendVector(nil, 1, data))
+	_, err := w.Write(module)
+	return err
+}
+
+// wasmEmitter writes the body of the run function and keeps track of the open control structures
+// for the branch depths.
+type wasmEmitter struct {
+	*translator
+	out       []byte
+	labels    []string // open blocks, innermost last ("" for the ifs).
+	stackBase int64    // byte address of the stack in memory.
+}
+
+func (e *wasmEmitter) op(ops ...byte) {
+	e.out = append(e.out, ops...)
+}
+
+func (e *wasmEmitter) i32(v int64) {
+	e.out = appendSLEB(append(e.out, opI32Const), v)
+}
+
+func (e *wasmEmitter) i64(v int64) {
+	e.out = appendSLEB(append(e.out, opI64Const), v)
+}
+
+func (e *wasmEmitter) local(op byte, idx int) {
+	e.out = appendULEB(append(e.out, op), uint64(idx)) //nolint:gosec // small index.
+}
+
+func (e *wasmEmitter) call(fn int) {
+	e.out = appendULEB(append(e.out, opCall), uint64(fn)) //nolint:gosec // small index.
+}
+
+// memory emits a load or store (op) of the 64 bits word at address on the stack + offset.
+func (e *wasmEmitter) memory(op byte, offset int64) {
+	align := uint64(3)
+	if op == opI64Store8 || op == opI64Load8U {
+		align = 0
+	}
+	e.out = appendULEB(appendULEB(append(e.out, op), align), uint64(offset)) //nolint:gosec // offset is positive.
+}
+
+func (e *wasmEmitter) open(op byte, label string) {
+	e.op(op, wasmBlockVoid)
+	e.labels = append(e.labels, label)
+}
+
+func (e *wasmEmitter) end() {
+	e.op(opEnd)
+	e.labels = e.labels[:len(e.labels)-1]
+}
+
+// isOpen returns whether the block with label is one of the enclosing ones.
+func (e *wasmEmitter) isOpen(label string) bool {
+	return slices.Contains(e.labels, label)
+}
+
+// depth returns the branch depth for label.
+func (e *wasmEmitter) depth(label string) uint64 {
+	return uint64(len(e.labels) - 1 - slices.Index(e.labels, label)) //nolint:gosec // label is open.
+}
+
+func (e *wasmEmitter) br(op byte, label string) {
+	e.out = appendULEB(append(e.out, op), e.depth(label))
+}
+
+func blockLabel(pc int64) string {
+	return fmt.Sprintf("L%d", pc)
+}
+
+// emitFault emits the call to the fault import with the kind and PC from emitKind and emitPC.
+func (e *wasmEmitter) emitFault(emitKind, emitPC func()) {
+	emitKind()
+	emitPC()
+	e.local(opLocalGet, localA)
+	e.local(opLocalGet, localSP)
+	e.call(wasmFaultFunc)
+	e.op(opUnreachable)
+}
+
+func (e *wasmEmitter) staticFault(kind cpu.FaultKind, pc int64) {
+	e.emitFault(func() { e.i32(int64(kind)) }, func() { e.i64(pc) })
+}
+
+// faultIf emits a fault of kind if the condition on the stack is true.
+func (e *wasmEmitter) faultIf(kind cpu.FaultKind, pc int64) {
+	e.open(opIf, "")
+	e.staticFault(kind, pc)
+	e.end()
+}
+
+// stackIndex emits the range check of the stack index sp-offset, left in localT.
+func (e *wasmEmitter) stackIndex(pc, offset int64) {
+	e.local(opLocalGet, localSP)
+	e.i64(offset)
+	e.op(opI64Sub)
+	e.stackCheck(pc)
+}
+
+// stackCheck checks the stack index on the wasm stack, left in localT.
+func (e *wasmEmitter) stackCheck(pc int64) {
+	e.local(opLocalTee, localT)
+	e.i64(int64(e.stackSize))
+	e.op(opI64GeU)
+	e.open(opIf, "")
+	e.stackFault(pc)
+	e.end()
+}
+
+// stackFault emits the overflow or underflow fault depending on the sign of localT.
+func (e *wasmEmitter) stackFault(pc int64) {
+	e.emitFault(func() {
+		e.i32(int64(cpu.StackUnderflow))
+		e.i32(int64(cpu.StackOverflow))
+		e.local(opLocalGet, localT)
+		e.i64(0)
+		e.op(opI64LtS, opSelect)
+	}, func() { e.i64(pc) })
+}
+
+// stackAddress emits the memory address of the stack word index in local idx (the stack base
+// is then the load/store offset, 0 for a program memory word index).
+func (e *wasmEmitter) stackAddress(idx int) {
+	e.local(opLocalGet, idx)
+	e.op(opI32WrapI64)
+	e.i32(3)
+	e.op(opI32Shl)
+}
+
+// jump emits the jump to target: forward to an enclosing block directly, otherwise through the
+// dispatch loop.
+func (e *wasmEmitter) jump(target int64) {
+	n := int64(len(e.program))
+	switch {
+	case target == n:
+		e.br(opBr, "end")
+	case target < 0 || target > n:
+		e.staticFault(cpu.BadMemoryAccess, target)
+	case e.isOpen(blockLabel(target)):
+		e.br(opBr, blockLabel(target))
+	default:
+		e.i64(target)
+		e.local(opLocalSet, localPC)
+		e.br(opBr, "top")
+	}
+}
+
+// divide emits the division of the 2 values on the stack, wrapping around like Go for -1.
+func (e *wasmEmitter) divide() {
+	e.call(wasmDivFunc)
+}
+
+var wasmOperators = map[cpu.Instruction]byte{
+	cpu.AddI: opI64Add, cpu.SubI: opI64Sub, cpu.MulI: opI64Mul, cpu.AndI: opI64And, cpu.OrI: opI64Or, cpu.XorI: opI64Xor,
+	cpu.AddR: opI64Add, cpu.SubR: opI64Sub, cpu.MulR: opI64Mul, cpu.AndR: opI64And, cpu.OrR: opI64Or, cpu.XorR: opI64Xor,
+	cpu.AddS: opI64Add, cpu.SubS: opI64Sub, cpu.MulS: opI64Mul, cpu.AndS: opI64And, cpu.OrS: opI64Or, cpu.XorS: opI64Xor,
+}
+
+// operation emits the arithmetic or bitwise instruction code on the 2 values on the stack.
+func (e *wasmEmitter) operation(code cpu.Instruction) {
+	switch code { //nolint:exhaustive // the ones not in wasmOperators.
+	case cpu.DivR, cpu.DivS:
+		e.divide()
+	case cpu.ModR, cpu.ModS:
+		e.op(opI64RemS) // doesn't trap for MinInt64 % -1.
+	case cpu.ShiftR, cpu.ShiftS:
+		e.call(wasmShiftFunc)
+	default:
+		e.op(wasmOperators[code])
+	}
+}
+
+var wasmConditions = map[cpu.Instruction]byte{
+	cpu.JNE: opI64Ne, cpu.JEQ: opI64Eq, cpu.JLT: opI64LtS, cpu.JGT: opI64GtS, cpu.JGTE: opI64GeS, cpu.JLTE: opI64LeS,
+	cpu.JNES: opI64Ne, cpu.JEQS: opI64Eq, cpu.JLTS: opI64LtS, cpu.JGTS: opI64GtS, cpu.JGTES: opI64GeS, cpu.JLTES: opI64LeS,
+	cpu.JNER: opI64Ne, cpu.JEQR: opI64Eq, cpu.JLTR: opI64LtS, cpu.JGTR: opI64GtS, cpu.JGTER: opI64GeS, cpu.JLTER: opI64LeS,
+}
+
+// instruction emits the code for the instruction at pc.
+//
+//nolint:gocyclo,funlen,gocognit,maintidx // it's a switch on all instructions.
+func (e *wasmEmitter) instruction(pc int) {
+	op := e.program[pc]
+	v := op.OperandInt64()
+	p := int64(pc)
+	n := int64(len(e.program))
+	switch code := op.Opcode(); code {
+	case cpu.LoadI:
+		e.i64(v)
+		e.local(opLocalSet, localA)
+	case cpu.AddI, cpu.SubI, cpu.MulI, cpu.AndI, cpu.OrI, cpu.XorI:
+		e.local(opLocalGet, localA)
+		e.i64(v)
+		e.op(wasmOperators[code])
+		e.local(opLocalSet, localA)
+	case cpu.Not:
+		e.local(opLocalGet, localA)
+		e.i64(-1)
+		e.op(opI64Xor)
+		e.local(opLocalSet, localA)
+	case cpu.ShrI:
+		e.local(opLocalGet, localA)
+		switch {
+		case v >= 64 || v <= -64:
+			e.i64(0)
+			e.op(opI64Mul)
+		case v < 0:
+			e.i64(-v)
+			e.op(opI64Shl)
+		default:
+			e.i64(v)
+			e.op(opI64ShrU)
+		}
+		e.local(opLocalSet, localA)
+	case cpu.DivI, cpu.ModI:
+		if v == 0 {
+			e.staticFault(cpu.DivideByZero, p)
+			return
+		}
+		e.local(opLocalGet, localA)
+		e.i64(v)
+		if code == cpu.ModI {
+			e.op(opI64RemS) // doesn't trap for MinInt64 % -1.
+		} else {
+			e.divide()
+		}
+		e.local(opLocalSet, localA)
+	case cpu.ShiftI:
+		e.local(opLocalGet, localA)
+		switch {
+		case v <= -64:
+			e.i64(63)
+			e.op(opI64ShrS)
+		case v < 0:
+			e.i64(-v)
+			e.op(opI64ShrS)
+		case v >= 64:
+			e.i64(0)
+			e.op(opI64Mul)
+		default:
+			e.i64(v)
+			e.op(opI64Shl)
+		}
+		e.local(opLocalSet, localA)
+	case cpu.JNE, cpu.JEQ, cpu.JLT, cpu.JGT, cpu.JGTE, cpu.JLTE:
+		e.local(opLocalGet, localA)
+		e.i64(v & 0xFF)
+		e.op(wasmConditions[code])
+		e.open(opIf, "")
+		e.jump(p + v>>8)
+		e.end()
+	case cpu.JNES, cpu.JEQS, cpu.JLTS, cpu.JGTS, cpu.JGTES, cpu.JLTES:
+		e.stackIndex(p, v&0xFF)
+		e.local(opLocalGet, localA)
+		e.stackAddress(localT)
+		e.memory(opI64Load, e.stackBase)
+		e.op(wasmConditions[code])
+		e.open(opIf, "")
+		e.jump(p + v>>8)
+		e.end()
+	case cpu.JNER, cpu.JEQR, cpu.JLTR, cpu.JGTR, cpu.JGTER, cpu.JLTER:
+		if p+1 >= n {
+			e.staticFault(cpu.BadMemoryAccess, p)
+			return
+		}
+		addr := p + int64(e.program[p+1])
+		if addr < 0 || addr >= n {
+			e.staticFault(cpu.BadMemoryAccess, p)
+			return
+		}
+		e.local(opLocalGet, localA)
+		e.i32(0)
+		e.memory(opI64Load, addr*8)
+		e.op(wasmConditions[code])
+		e.open(opIf, "")
+		e.jump(p + v)
+		e.end()
+		if e.code[p+1] { // the address word is also executed as an instruction from elsewhere.
+			e.jump(p + 2)
+		}
+	case cpu.JumpR:
+		e.jump(p + v)
+	case cpu.LoadR, cpu.AddR, cpu.SubR, cpu.MulR, cpu.DivR, cpu.StoreR, cpu.IncrR,
+		cpu.ModR, cpu.AndR, cpu.OrR, cpu.XorR, cpu.ShiftR:
+		offset := v
+		if code == cpu.IncrR {
+			offset = v >> 8
+		}
+		addr := p + offset
+		if addr < 0 || addr >= n {
+			e.staticFault(cpu.BadMemoryAccess, p)
+			return
+		}
+		e.i32(0)
+		switch code { //nolint:exhaustive // just the R ones.
+		case cpu.LoadR:
+			e.memory(opI64Load, addr*8)
+		case cpu.StoreR:
+			e.local(opLocalGet, localA)
+			e.memory(opI64Store, addr*8)
+			return
+		case cpu.IncrR:
+			e.memory(opI64Load, addr*8)
+			e.i64(int64(int8(v & 0xFF))) //nolint:gosec // signed increment on purpose
+			e.op(opI64Add)
+			e.local(opLocalTee, localA)
+			e.local(opLocalSet, localT)
+			e.i32(0)
+			e.local(opLocalGet, localT)
+			e.memory(opI64Store, addr*8)
+			return
+		case cpu.DivR, cpu.ModR:
+			e.memory(opI64Load, addr*8)
+			e.local(opLocalTee, localT)
+			e.op(opI64Eqz)
+			e.faultIf(cpu.DivideByZero, p)
+			e.local(opLocalGet, localA)
+			e.local(opLocalGet, localT)
+			e.operation(code)
+		default:
+			e.memory(opI64Load, addr*8)
+			e.local(opLocalSet, localT)
+			e.local(opLocalGet, localA)
+			e.local(opLocalGet, localT)
+			e.operation(code)
+		}
+		e.local(opLocalSet, localA)
+	case cpu.Call:
+		e.local(opLocalGet, localSP)
+		e.i64(1)
+		e.op(opI64Add)
+		e.local(opLocalTee, localT)
+		e.i64(int64(e.stackSize))
+		e.op(opI64GeS)
+		e.faultIf(cpu.StackOverflow, p)
+		e.stackAddress(localT)
+		e.i64(p + 1)
+		e.memory(opI64Store, e.stackBase)
+		e.local(opLocalGet, localT)
+		e.local(opLocalSet, localSP)
+		e.jump(p + v)
+	case cpu.Ret:
+		if v > 0 {
+			e.local(opLocalGet, localSP)
+			e.i64(v)
+			e.op(opI64Sub)
+			e.local(opLocalTee, localT)
+			e.i64(0)
+			e.op(opI64LtS)
+			e.faultIf(cpu.StackUnderflow, p)
+			e.local(opLocalGet, localT)
+			e.local(opLocalSet, localSP)
+		} else {
+			e.local(opLocalGet, localSP)
+			e.i64(0)
+			e.op(opI64LtS)
+			e.faultIf(cpu.StackUnderflow, p)
+		}
+		e.stackAddress(localSP)
+		e.memory(opI64Load, e.stackBase)
+		e.local(opLocalSet, localPC)
+		e.local(opLocalGet, localSP)
+		e.i64(1)
+		e.op(opI64Sub)
+		e.local(opLocalSet, localSP)
+		e.br(opBr, "top")
+	case cpu.Push:
+		extra := max(0, v)
+		e.local(opLocalGet, localSP)
+		e.i64(1 + extra)
+		e.op(opI64Add)
+		e.local(opLocalTee, localT)
+		e.i64(int64(e.stackSize))
+		e.op(opI64GeS)
+		e.faultIf(cpu.StackOverflow, p)
+		if extra > 0 {
+			e.local(opLocalGet, localSP)
+			e.i64(1)
+			e.op(opI64Add)
+			e.local(opLocalSet, localU)
+			e.stackAddress(localU)
+			e.i32(e.stackBase)
+			e.op(opI32Add)
+			e.i32(0)
+			e.i32(extra * 8)
+			e.op(opPrefixFC, opMemoryFill, 0)
+		}
+		e.stackAddress(localT)
+		e.local(opLocalGet, localA)
+		e.memory(opI64Store, e.stackBase)
+		e.local(opLocalGet, localT)
+		e.local(opLocalSet, localSP)
+	case cpu.Pop:
+		extra := max(0, v)
+		e.local(opLocalGet, localSP)
+		e.i64(extra)
+		e.op(opI64Sub)
+		e.i64(0)
+		e.op(opI64LtS)
+		e.faultIf(cpu.StackUnderflow, p)
+		e.stackAddress(localSP)
+		e.memory(opI64Load, e.stackBase)
+		e.local(opLocalSet, localA)
+		e.local(opLocalGet, localSP)
+		e.i64(1 + extra)
+		e.op(opI64Sub)
+		e.local(opLocalSet, localSP)
+	case cpu.LoadS, cpu.StoreS, cpu.AddS, cpu.SubS, cpu.MulS, cpu.DivS, cpu.IncrS, cpu.IdivS,
+		cpu.ModS, cpu.AndS, cpu.OrS, cpu.XorS, cpu.ShiftS:
+		offset := v
+		if code == cpu.IncrS {
+			offset = v >> 8
+		}
+		e.stackIndex(p, offset)
+		switch code { //nolint:exhaustive // just the S ones.
+		case cpu.LoadS:
+			e.stackAddress(localT)
+			e.memory(opI64Load, e.stackBase)
+			e.local(opLocalSet, localA)
+		case cpu.StoreS:
+			e.stackAddress(localT)
+			e.local(opLocalGet, localA)
+			e.memory(opI64Store, e.stackBase)
+		case cpu.IncrS:
+			e.stackAddress(localT)
+			e.stackAddress(localT)
+			e.memory(opI64Load, e.stackBase)
+			e.i64(int64(int8(v & 0xFF))) //nolint:gosec // signed increment on purpose
+			e.op(opI64Add)
+			e.local(opLocalTee, localA)
+			e.memory(opI64Store, e.stackBase)
+		case cpu.DivS, cpu.ModS:
+			e.stackAddress(localT)
+			e.memory(opI64Load, e.stackBase)
+			e.local(opLocalTee, localU)
+			e.op(opI64Eqz)
+			e.faultIf(cpu.DivideByZero, p)
+			e.local(opLocalGet, localA)
+			e.local(opLocalGet, localU)
+			e.operation(code)
+			e.local(opLocalSet, localA)
+		case cpu.IdivS:
+			e.local(opLocalGet, localA)
+			e.op(opI64Eqz)
+			e.faultIf(cpu.DivideByZero, p)
+			e.stackAddress(localT)
+			e.memory(opI64Load, e.stackBase)
+			e.local(opLocalSet, localU)
+			e.stackAddress(localT)
+			e.local(opLocalGet, localU)
+			e.local(opLocalGet, localA)
+			e.divide()
+			e.memory(opI64Store, e.stackBase)
+			e.local(opLocalGet, localU)
+			e.local(opLocalGet, localA)
+			e.op(opI64RemS)
+			e.local(opLocalSet, localA)
+		default:
+			e.local(opLocalGet, localA)
+			e.stackAddress(localT)
+			e.memory(opI64Load, e.stackBase)
+			e.operation(code)
+			e.local(opLocalSet, localA)
+		}
+	case cpu.StoreSB, cpu.LoadSB:
+		offset, byteIndex := v>>8, v&0xFF
+		e.stackIndex(p, byteIndex)
+		// localU = bytes offset, localT = stack index of the word.
+		e.stackAddress(localT)
+		e.memory(opI64Load, e.stackBase)
+		e.local(opLocalTee, localU)
+		e.i64(0)
+		e.op(opI64LtS)
+		e.local(opLocalGet, localSP)
+		e.i64(offset)
+		e.op(opI64Sub)
+		e.local(opLocalGet, localU)
+		e.i64(8)
+		e.op(opI64DivS)
+		e.op(opI64Add)
+		e.local(opLocalTee, localT)
+		e.i64(int64(e.stackSize))
+		e.op(opI64GeU)
+		e.op(opI32Or)
+		e.open(opIf, "")
+		e.stackFault(p)
+		e.end()
+		e.stackAddress(localT)
+		e.local(opLocalGet, localU)
+		e.i64(7)
+		e.op(opI64And)
+		e.op(opI32WrapI64, opI32Add)
+		if code == cpu.LoadSB {
+			e.memory(opI64Load8U, e.stackBase)
+			e.local(opLocalSet, localA)
+			break
+		}
+		e.local(opLocalGet, localA)
+		e.memory(opI64Store8, e.stackBase)
+	case cpu.LoadRB, cpu.StoreRB:
+		base, byteIndex := p+v>>8, v&0xFF
+		e.stackIndex(p, byteIndex)
+		// localU = bytes offset, localT = memory index of the word (the memory starts at 0).
+		e.stackAddress(localT)
+		e.memory(opI64Load, e.stackBase)
+		e.local(opLocalTee, localU)
+		e.i64(0)
+		e.op(opI64LtS)
+		e.i64(base)
+		e.local(opLocalGet, localU)
+		e.i64(8)
+		e.op(opI64DivS)
+		e.op(opI64Add)
+		e.local(opLocalTee, localT)
+		e.i64(n)
+		e.op(opI64GeU)
+		e.op(opI32Or)
+		e.faultIf(cpu.BadMemoryAccess, p)
+		e.stackAddress(localT)
+		e.local(opLocalGet, localU)
+		e.i64(7)
+		e.op(opI64And)
+		e.op(opI32WrapI64, opI32Add)
+		if code == cpu.LoadRB {
+			e.memory(opI64Load8U, 0)
+			e.local(opLocalSet, localA)
+			break
+		}
+		e.local(opLocalGet, localA)
+		e.memory(opI64Store8, 0)
+	case cpu.Sys, cpu.SysS:
+		call := cpu.Syscall(v & 0xFF) //nolint:gosec // 0xFF mask
+		operand := v >> 8
+		if call <= cpu.InvalidSyscall || call >= cpu.LastSyscall {
+			// Unknown syscalls end the program with 99, like in the interpreter.
+			call, operand = cpu.Exit, 99
+		}
+		e.i64(operand)
+		e.local(opLocalGet, localA)
+		e.i64(p)
+		if code == cpu.SysS {
+			e.i32(1)
+		} else {
+			e.i32(0)
+		}
+		e.local(opLocalGet, localSP)
+		e.call(wasmSyscallFunc(call))
+		e.local(opLocalSet, localA)
+		if call == cpu.Exit {
+			e.op(opUnreachable)
+		}
+	default:
+		e.staticFault(cpu.InvalidOpcode, p)
+	}
+}
+
+// blockStarts returns the sorted PCs starting the basic blocks: 0 and the jump targets, or all
+// the reachable instructions if there is a Ret (which can go back to any of them).
+func (e *wasmEmitter) blockStarts() []int {
+	n := len(e.program)
+	starts := map[int]bool{}
+	if n > 0 {
+		starts[0] = true
+	}
+	add := func(target int64) {
+		if target >= 0 && target < int64(n) {
+			starts[int(target)] = true
+		}
+	}
+	for pc, isCode := range e.code {
+		if !isCode {
+			continue
+		}
+		op := e.program[pc]
+		switch op.Opcode() { //nolint:exhaustive // only the control flow ones.
+		case cpu.JNE, cpu.JEQ, cpu.JLT, cpu.JGT, cpu.JGTE, cpu.JLTE, cpu.JNES, cpu.JEQS, cpu.JLTS, cpu.JGTS, cpu.JGTES,
+			cpu.JLTES:
+			add(int64(pc) + op.OperandInt64()>>8)
+		case cpu.JNER, cpu.JEQR, cpu.JLTR, cpu.JGTR, cpu.JGTER, cpu.JLTER:
+			add(int64(pc) + op.OperandInt64())
+			if pc+1 < n && e.code[pc+1] {
+				add(int64(pc) + 2)
+			}
+		case cpu.JumpR, cpu.Call:
+			add(int64(pc) + op.OperandInt64())
+		case cpu.Ret:
+			e.hasRet = true
+		}
+	}
+	if e.hasRet {
+		for pc, isCode := range e.code {
+			starts[pc] = starts[pc] || isCode
+		}
+	}
+	res := make([]int, 0, len(starts))
+	for pc := range starts {
+		res = append(res, pc)
+	}
+	slices.Sort(res)
+	return res
+}
+
+// runBody emits the run function: a loop around nested blocks, one per basic block, with a
+// br_table on the pc at the innermost level so a branch to the loop with the pc set continues
+// at any basic block (forward jumps branch directly to the end of the target's block, where
+// its code starts).
+func (e *wasmEmitter) runBody() {
+	n := len(e.program)
+	starts := e.blockStarts()
+	e.i64(-1)
+	e.local(opLocalSet, localSP)
+	e.open(opLoop, "top")
+	e.open(opBlock, "bad")
+	e.open(opBlock, "end")
+	for i := len(starts) - 1; i >= 0; i-- {
+		e.open(opBlock, blockLabel(int64(starts[i])))
+	}
+	// Dispatch.
+	e.local(opLocalGet, localPC)
+	e.i64(int64(n))
+	e.op(opI64GtU)
+	e.br(opBrIf, "bad")
+	e.local(opLocalGet, localPC)
+	e.op(opI32WrapI64, opBrTable)
+	e.out = appendULEB(e.out, uint64(n+1)) //nolint:gosec // not negative.
+	isStart := make(map[int]bool, len(starts))
+	for _, pc := range starts {
+		isStart[pc] = true
+	}
+	for pc := range n + 1 {
+		switch {
+		case isStart[pc]:
+			e.out = appendULEB(e.out, e.depth(blockLabel(int64(pc))))
+		case pc == n:
+			e.out = appendULEB(e.out, e.depth("end"))
+		default:
+			e.out = appendULEB(e.out, e.depth("bad"))
+		}
+	}
+	e.out = appendULEB(e.out, e.depth("bad"))
+	for i, start := range starts {
+		e.end()
+		stop := n
+		if i+1 < len(starts) {
+			stop = starts[i+1]
+		}
+		for pc := start; pc < stop; pc++ {
+			if e.code[pc] {
+				e.instruction(pc)
+			}
+		}
+	}
+	e.end() // end:
+	e.i64(0)
+	e.op(opReturn)
+	e.end() // bad:
+	e.emitFault(func() { e.i32(int64(cpu.BadMemoryAccess)) }, func() { e.local(opLocalGet, localPC) })
+	e.end() // top loop.
+	e.op(opUnreachable, opEnd)
+}
@@ -0,0 +1,96 @@
+package aot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/sys"
+	"grol.io/vm/cpu"
+)
+
+// runWasm instantiates the module with a host running the syscalls with cpu.CPU.Syscall and
+// returns the output and exit code.
+func runWasm(t *testing.T, module []byte, programSize int) (string, int) {
+	t.Helper()
+	ctx := context.Background()
+	r := wazero.NewRuntime(ctx)
+	defer r.Close(ctx)
+	var out bytes.Buffer
+	c := cpu.NewCPU(strings.NewReader(testInput), &out, nil)
+	exit := func(ctx context.Context, m api.Module, code int64) {
+		_ = m.CloseWithExitCode(ctx, uint32(code)) //nolint:gosec // exit codes are truncated anyway.
+		panic(sys.NewExitError(uint32(code)))      //nolint:gosec // exit codes are truncated anyway.
+	}
+	host := r.NewHostModuleBuilder(WasmImportModule)
+	for call := cpu.InvalidSyscall + 1; call < cpu.LastSyscall; call++ {
+		host.NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module,
+			operand, accumulator, pc int64, isStack int32, sp int64,
+		) int64 {
+			res, abort, _ := c.Syscall(call, operand, accumulator, cpu.ImmediateData(pc), isStack != 0, int(sp))
+			if abort {
+				exit(ctx, m, res)
+			}
+			return res
+		}).Export(call.String())
+	}
+	host.NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, kind int32, pc, accumulator, sp int64) {
+		f := c.NewFault(cpu.FaultKind(kind), cpu.ImmediateData(pc), accumulator, int(sp)) //nolint:gosec // valid kinds.
+		exit(ctx, m, int64(f.ExitCode()))
+	}).Export(WasmFaultImport)
+	if _, err := host.Instantiate(ctx); err != nil {
+		t.Fatalf("failed to instantiate the host module: %v", err)
+	}
+	mod, err := r.Instantiate(ctx, module)
+	if err != nil {
+		t.Fatalf("failed to instantiate the module: %v", err)
+	}
+	// The Program and Stack of the CPU are views of the module's memory, for the syscalls.
+	size := (programSize + cpu.DefaultStackSize) * cpu.OperationSize
+	mem, ok := mod.Memory().Read(0, uint32(size)) //nolint:gosec // small size.
+	if !ok {
+		t.Fatalf("memory is smaller than %d", size)
+	}
+	words := unsafe.Slice((*cpu.Operation)(unsafe.Pointer(&mem[0])), size/cpu.OperationSize)
+	c.Program, c.Stack = words[:programSize], words[programSize:]
+	res, err := mod.ExportedFunction(WasmRunExport).Call(ctx)
+	var exitErr *sys.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		return out.String(), int(exitErr.ExitCode()) & 0xFF
+	case err != nil:
+		t.Fatalf("failed to run: %v", err)
+	}
+	return out.String(), int(res[0]) & 0xFF //nolint:gosec // truncated like exit codes.
+}
+
+// TestToWasm translates the sample programs to WebAssembly, runs them in wazero and checks they
+// have the same output and exit code as the interpreter.
+func TestToWasm(t *testing.T) {
+	for name, vmFile := range testPrograms(t, t.TempDir()) {
+		t.Run(name, func(t *testing.T) {
+			if res := ToWasm(Options{}, vmFile); res != 0 {
+				t.Fatalf("towasm failed with %d", res)
+			}
+			module, err := os.ReadFile(strings.TrimSuffix(vmFile, ".vm") + ".wasm")
+			if err != nil {
+				t.Fatalf("failed to read the module: %v", err)
+			}
+			program, _, err := loadProgram(vmFile)
+			if err != nil {
+				t.Fatalf("failed to load %s: %v", vmFile, err)
+			}
+			gotOut, gotCode := runWasm(t, module, len(program))
+			expectedOut, expectedCode := interpret(t, vmFile)
+			if gotCode != expectedCode || gotOut != expectedOut {
+				t.Errorf("wasm got %d %q, interpreter got %d %q", gotCode, gotOut, expectedCode, expectedOut)
+			}
+		})
+	}
+}
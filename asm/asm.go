@@ -3,11 +3,14 @@ package asm
 
 import (
 	"bufio"
+	"cmp"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"unicode"
@@ -16,15 +19,55 @@ import (
 	"grol.io/vm/cpu"
 )
 
+// Options are the settings for Compile.
+type Options struct {
+	StackSize int // Stack size used for the range checks of stack indices, cpu.DefaultStackSize if 0.
+	// FormatVersion of the .vm file written: 1 (default, cpu.HEADER then the words) or 2
+	// (cpu.HEADER2 and sections, with the symbols, stack size and ISA version).
+	FormatVersion int
+	// IncludePath are the directories searched for the .include and .import files not found
+	// relative to the file using them.
+	IncludePath []string
+	// Object compiles each file separately into an object file (.o) for Link, with the labels
+	// declared by .export for the other objects and the .extern ones left to resolve.
+	Object bool
+	// DiagFormat is how the errors are reported: "text" (default, logged as
+	// file:line:column: message) or "json" (one object per line on stdout, for editors).
+	DiagFormat string
+}
+
 type Line struct {
 	Op      cpu.Operation
 	Label   string
+	Expr    expr // Operand (or Data) expression using labels, evaluated by emitCode.
+	Addr    expr // Address word (of the R conditional jumps) relative to the instruction before, evaluated by emitCode.
 	Data    bool
 	Is48bit bool
+	Source  cpu.SourceInfo // Statement the word comes from (Function is set by emitCode).
 }
 
-func Compile(files ...string) int {
-	readers := make([]io.Reader, 0, len(files))
+func Compile(opts Options, files ...string) int {
+	if opts.FormatVersion < 0 || opts.FormatVersion > 2 {
+		return log.FErrf("Invalid format version %d, expected 1 or 2", opts.FormatVersion)
+	}
+	if opts.DiagFormat != "" && opts.DiagFormat != "text" && opts.DiagFormat != "json" {
+		return log.FErrf("Invalid diagnostics format %q, expected text or json", opts.DiagFormat)
+	}
+	if !opts.Object {
+		return compileFiles(opts, ".vm", files...)
+	}
+	for _, file := range files {
+		if res := compileFiles(opts, ".o", file); res != 0 {
+			return res
+		}
+	}
+	return 0
+}
+
+// compileFiles assembles the files together into the first one with the .asm extension
+// replaced by ext.
+func compileFiles(opts Options, ext string, files ...string) int {
+	sources := make([]*source, 0, len(files))
 	var writer *bufio.Writer
 	for i, file := range files {
 		log.Infof("Compiling file: %s", file)
@@ -38,7 +81,7 @@ func Compile(files ...string) int {
 			return log.FErrf("Invalid file extension for %s, expected .asm", file)
 		}
 		if i == 0 {
-			outputFile := strings.TrimSuffix(file, ".asm") + ".vm"
+			outputFile := strings.TrimSuffix(file, ".asm") + ext
 			log.Infof("Output file: %s", outputFile)
 			out, err := os.Create(outputFile)
 			if err != nil {
@@ -47,22 +90,127 @@ func Compile(files ...string) int {
 			defer out.Close()
 			writer = bufio.NewWriter(out)
 			defer writer.Flush()
-			_, _ = writer.WriteString(cpu.HEADER)
+			if opts.FormatVersion != 2 && !opts.Object {
+				_, _ = writer.WriteString(cpu.HEADER) // version 2 images and objects are written whole by emitCode.
+			}
 		}
-		readers = append(readers, f)
+		sources = append(sources, newSource(file, bufio.NewReader(f)))
 	}
-	reader := bufio.NewReader(io.MultiReader(readers...))
-	return compile(reader, writer)
+	return compileSources(opts, writer, sources...)
+}
+
+// lineReader is what parse reads from: a *bufio.Reader or a *source.
+type lineReader interface {
+	ReadRune() (rune, int, error)
+	ReadString(delim byte) (string, error)
+}
+
+// tokenMarker is implemented by the readers tracking the position of the tokens parse emits.
+type tokenMarker interface {
+	markToken() // the last rune read starts a token.
+}
+
+// tokenPos is the position of a token in the source.
+type tokenPos struct {
+	line, column int
+}
+
+// source reads an assembly file, tracking the position and text of the statement being parsed
+// for the debug info, and the position of its tokens for the errors.
+type source struct {
+	*bufio.Reader
+	file    string
+	line    int        // Line of the next rune.
+	col     int        // Column of the next rune.
+	last    tokenPos   // Position of the last rune read.
+	eol     bool       // whether the last rune read ends a line.
+	start   int        // Line of the first non blank rune of the statement.
+	column  int        // Column of that rune, 0 until seen.
+	tokens  []tokenPos // of the statement, as parse emits them.
+	text    strings.Builder
+	comment bool    // whether the statement ended with a comment.
+	parent  *source // file with the .include of this one.
+}
+
+func newSource(file string, r *bufio.Reader) *source {
+	return &source{Reader: r, file: file, line: 1, col: 1}
+}
+
+func (s *source) ReadRune() (rune, int, error) {
+	r, size, err := s.Reader.ReadRune()
+	if err != nil {
+		return r, size, err
+	}
+	if s.column == 0 && !unicode.IsSpace(r) {
+		s.start, s.column = s.line, s.col
+	}
+	s.last = tokenPos{s.line, s.col}
+	s.eol = r == '\n'
+	if r == '\n' {
+		s.line++
+		s.col = 1
+	} else {
+		s.col++
+	}
+	s.text.WriteRune(r)
+	return r, size, nil
+}
+
+// ReadString is only used by parse to skip the comments.
+func (s *source) ReadString(delim byte) (string, error) {
+	str, err := s.Reader.ReadString(delim)
+	if strings.HasSuffix(str, "\n") {
+		s.line++
+		s.col = 1
+		s.eol = true
+	}
+	s.comment = true
+	return str, err
+}
+
+func (s *source) markToken() {
+	s.tokens = append(s.tokens, s.last)
+}
+
+// skipLine skips the rest of the line, after a parse error.
+func (s *source) skipLine() {
+	if !s.eol {
+		_, _ = s.ReadString('\n')
+	}
+}
+
+// next resets the statement tracking, before parsing one.
+func (s *source) next() {
+	s.column = 0
+	s.tokens = nil
+	s.text.Reset()
+	s.comment = false
+}
+
+// statement returns the source text of the statement just parsed, without the comment.
+func (s *source) statement() string {
+	text := s.text.String()
+	if s.comment {
+		text = text[:len(text)-1] // the # or ; starting the comment.
+	}
+	return strings.TrimSpace(text)
 }
 
 //nolint:gocyclo // it's a full parser.
-func parse(reader *bufio.Reader) ([]string, error) {
+func parse(reader lineReader) ([]string, error) {
 	var result []string
 	var current strings.Builder
 	inQuote := false
 	inEscape := false
 	prevRune := ' '
 	var whichQuote rune
+	marker, _ := reader.(tokenMarker)
+	write := func(ch rune) {
+		if current.Len() == 0 && marker != nil {
+			marker.markToken()
+		}
+		current.WriteRune(ch)
+	}
 	emit := func() {
 		if current.Len() > 0 {
 			result = append(result, current.String())
@@ -87,18 +235,18 @@ loop:
 			break loop
 		case !inQuote && (ch == '"' || ch == '\'' || ch == '`'):
 			if prevRune != ' ' && prevRune != '\t' {
-				log.Errf("Unexpected quote %q in the middle of a token; current token so far: %q", ch, current.String())
-				return nil, strconv.ErrSyntax
+				return nil, fmt.Errorf("unexpected quote %q in the middle of the token %q: %w", ch, current.String(),
+					strconv.ErrSyntax)
 			}
 			emit()
 			whichQuote = ch
-			current.WriteRune(ch)
+			write(ch)
 			inQuote = true
 		case inQuote && ch == whichQuote && !inEscape:
-			current.WriteRune(ch)
+			write(ch)
 			s, errUnquote := strconv.Unquote(current.String())
 			if errUnquote != nil {
-				return nil, errUnquote
+				return nil, fmt.Errorf("invalid quoted string %s: %w", current.String(), errUnquote)
 			}
 			if whichQuote == '\'' {
 				// get the rune value
@@ -117,17 +265,17 @@ loop:
 		case !inQuote && (ch == ' ' || ch == '\t'):
 			emit() // collapses all whitespace
 		case !inEscape && ch == '\\' && inQuote && whichQuote != '`':
-			current.WriteRune(ch)
+			write(ch)
 			inEscape = true
 		default:
-			current.WriteRune(ch)
+			write(ch)
 			inEscape = false
 		}
 		prevRune = ch
 	}
 	if inQuote {
-		log.Errf("Unterminated quote %c at the end of line/file; started with: %q", whichQuote, current.String())
-		return nil, strconv.ErrSyntax
+		return nil, fmt.Errorf("unterminated quote %c at the end of the line/file, started with %q: %w", whichQuote,
+			current.String(), strconv.ErrSyntax)
 	}
 	emit()
 	if len(result) != 0 {
@@ -140,33 +288,44 @@ func isAddressLabel(s string) bool {
 	return unicode.IsLetter(rune(s[0]))
 }
 
-func sysCalls(op *cpu.Operation, args []string) (int, string) {
+func sysCalls(op *cpu.Operation, args []string, syms *symbols) (string, expr, error) {
 	sysCallStr := args[0]
 	arg := args[1]
-	noLabel := ""
 	syscall, ok := cpu.SyscallFromString(strings.ToLower(sysCallStr))
 	if !ok {
-		return log.FErrf("Unknown syscall: %s", sysCallStr), noLabel
+		return "", nil, fmt.Errorf("unknown syscall %s", sysCallStr)
 	}
-	if isAddressLabel(arg) {
-		*op = op.SetOperand(cpu.ImmediateData(syscall))
-		return 0, arg
+	var v int64
+	var err error
+	if syms.vars != nil {
+		v, err = syms.constant(arg) // SysS stack index.
+	} else {
+		var label string
+		var e expr
+		v, label, e, err = syms.operand(arg)
+		if err == nil && (label != "" || e != nil) {
+			*op = op.SetOperand(cpu.ImmediateData(syscall))
+			return label, e, nil
+		}
 	}
-	v, err := parseArg(arg)
 	if err != nil {
-		return log.FErrf("Failed to parse SYS argument %q: %v", arg, err), noLabel
+		return "", nil, fmt.Errorf("failed to parse SYS argument %q: %w", arg, err)
 	}
 	// check if the argument is within the valid range for a syscall operand - 48 bits are left
 	// so signed range is -(1<<47) to (1<<47)-1
 	if v > (1<<47)-1 || v < -(1<<47) {
-		return log.FErrf("SYS argument %q out of range: %d %x vs %d", arg, v, v, (1 << 47)), noLabel
+		return "", nil, fmt.Errorf("SYS argument %q out of range: %d %x vs %d", arg, v, v, (1 << 47))
 	}
 	*op = op.SetOperand(cpu.ImmediateData(v)<<8 | cpu.ImmediateData(syscall))
-	return 0, noLabel
+	return "", nil, nil
 }
 
 func serializeStr8(b []byte) []Line {
-	ops := cpu.SerializeStr8(b)
+	return dataLines(cpu.SerializeStr8(b))
+}
+
+// dataLines returns the data Lines for the words ops.
+func dataLines(ops []cpu.Operation) []Line {
 	result := make([]Line, 0, len(ops))
 	for _, op := range ops {
 		result = append(result, Line{
@@ -177,88 +336,345 @@ func serializeStr8(b []byte) []Line {
 	return result
 }
 
+// compile assembles the source read from reader (without file name in the debug info).
+func compile(opts Options, reader *bufio.Reader, writer *bufio.Writer) int {
+	return compileSources(opts, writer, newSource("", reader))
+}
+
+// compileSources assembles the sources, in order, into writer and reports the errors.
+func compileSources(opts Options, writer *bufio.Writer, sources ...*source) int {
+	return report(opts, os.Stdout, assembleSources(opts, writer, sources...))
+}
+
+// assembleSources assembles the sources, in order, into writer, which is left untouched when
+// there are errors: the statement with an error is skipped to find the next ones. Macros are
+// expanded as they are used: the statements of their body are queued before the rest of the
+// source. Included files are read in place of the .include and imported ones after the last
+// source.
+//
 //nolint:gocognit,funlen,gocyclo,maintidx // yes it is a full assembler...
-func compile(reader *bufio.Reader, writer *bufio.Writer) int {
+func assembleSources(opts Options, writer *bufio.Writer, sources ...*source) diagnostics {
+	stackSize := int64(opts.StackSize)
+	if stackSize <= 0 {
+		stackSize = cpu.DefaultStackSize
+	}
 	pc := cpu.ImmediateData(0)
 	labels := make(map[string]cpu.ImmediateData)
 	varmap := make(map[string]cpu.ImmediateData)
+	syms := newSymbols()
+	var atPC []string // labels of the current pc, for sizeof.
+	scope := newLabelScope()
+	labelPos := make(map[string]cpu.SourceInfo) // where each label is defined.
 	returnN := 0
 	var result []Line
-	for {
-		fields, err := parse(reader)
-		if errors.Is(err, io.EOF) {
-			break
+	lastLabel := ""
+	var exports []string
+	exportPos := make(map[string]cpu.SourceInfo)
+	externs := make(map[string]bool)
+	macros := make(map[string]*macro)
+	var defining *macro // macro being defined, until .endm.
+	var pending []statement
+	expansions := 0
+	var loaded []string // files compiled, for .import.
+	for _, src := range sources {
+		loaded = append(loaded, src.file)
+	}
+	var opened []*os.File // included and imported files.
+	defer func() {
+		for _, f := range opened {
+			f.Close()
 		}
-		if err != nil {
-			return log.FErrf("Failed to parse line: %v", err)
+	}()
+	var diags diagnostics
+	for len(sources) > 0 || len(pending) > 0 {
+		if len(diags) >= maxDiagnostics {
+			diags.add(cpu.SourceInfo{}, nil, "Too many errors, stopping")
+			return diags
 		}
-		if len(fields) == 0 {
-			continue
+		var st statement
+		if len(pending) > 0 {
+			st, pending = pending[0], pending[1:]
+		} else {
+			src := sources[0]
+			src.next()
+			fields, err := parse(src)
+			if errors.Is(err, io.EOF) {
+				if defining != nil {
+					diags.add(defining.pos, nil, "Missing .endm for macro %s", defining.name)
+					defining = nil
+				}
+				sources = sources[1:]
+				continue
+			}
+			st = statement{fields: fields, tokens: src.tokens, pos: cpu.SourceInfo{
+				File: src.file, Line: src.start, Column: src.column, Text: src.statement(),
+			}}
+			if err != nil {
+				diags.add(st.at(len(st.tokens)-1), nil, "Failed to parse line: %v", err)
+				src.skipLine()
+				continue
+			}
+			if len(fields) == 0 {
+				continue
+			}
+		}
+		// fail records an error about the i-th field of the statement.
+		fail := func(i int, format string, args ...any) {
+			diags.add(st.at(i), st.expansion, format, args...)
 		}
+		fields := st.fields
 		first := fields[0]
+		instr := strings.ToLower(first)
+		if defining != nil {
+			switch instr {
+			case ".endm":
+				defining = nil
+			case ".macro":
+				fail(0, "Nested .macro in macro %s defined at %s", defining.name, position(defining.pos))
+			default:
+				defining.add(st)
+			}
+			continue
+		}
 		// label
 		if _, found := strings.CutSuffix(first, ":"); found {
-			label := strings.TrimSuffix(first, ":")
+			label := scope.define(strings.TrimSuffix(first, ":"))
 			log.Debugf("Found label: %s at PC: %d", label, pc)
+			if prev, dup := labelPos[label]; dup {
+				fail(0, "Duplicate label %s, already defined at %s", label, position(prev))
+				continue
+			}
+			labelPos[label] = st.pos
+			if len(atPC) > 0 && labels[atPC[0]] != pc {
+				atPC = atPC[:0]
+			}
+			atPC = append(atPC, label)
 			labels[label] = pc
+			lastLabel = label
 			continue
 		}
-		instr := strings.ToLower(first)
+		pos := st.pos
+		pos.Label = lastLabel
 		args := fields[1:]
 		narg := len(args)
 		switch instr {
-		case "return":
+		case "str8", "str16", ".include", ".import", ".macro", ".export", ".extern":
+		default:
+			failed := false
+			for i, arg := range args {
+				if instr == ".equ" && i == 0 {
+					continue
+				}
+				var err error
+				if args[i], err = scope.qualify(arg); err != nil {
+					fail(i+1, "Invalid label: %v", err)
+					failed = true
+				}
+			}
+			if failed {
+				continue
+			}
+		}
+		if m, ok := macros[instr]; ok {
+			expansions++
+			e := &expansion{macro: m, use: pos, parent: st.expansion}
+			if st.expansion != nil {
+				e.depth = st.expansion.depth + 1
+			}
+			body, err := m.expand(args, e, expansions)
+			if err != nil {
+				fail(0, "Failed to expand macro: %v", err)
+				continue
+			}
+			pending = append(body, pending...)
+			continue
+		}
+		switch instr {
+		case ".macro":
+			m, err := newMacro(args, pos)
+			if err != nil {
+				fail(min(narg, 1), "Invalid macro: %v", err)
+				defining = &macro{pos: pos} // skips the body.
+				continue
+			}
+			key := strings.ToLower(m.name)
+			if prev, ok := macros[key]; ok {
+				fail(1, "Macro %s already defined at %s", m.name, position(prev.pos))
+			} else {
+				macros[key] = m
+			}
+			defining = m
+			continue
+		case ".endm":
+			fail(0, ".endm without .macro")
+			continue
+		case ".include":
+			if narg != 1 {
+				fail(0, "Expecting 1 file argument for .include, got %d (%v)", narg, args)
+				continue
+			}
+			if st.expansion != nil {
+				fail(0, ".include can't be used in a macro")
+				continue
+			}
+			inc, f, err := sources[0].include(args[0], opts.IncludePath)
+			if err != nil {
+				fail(1, "Failed to include %s: %v", args[0], err)
+				continue
+			}
+			log.Infof("Including file: %s", inc.file)
+			opened = append(opened, f)
+			loaded = append(loaded, inc.file)
+			sources = append([]*source{inc}, sources...)
+			continue
+		case ".import":
+			if narg == 0 {
+				fail(0, "Expecting at least 1 argument for .import, got none")
+				continue
+			}
+			for i, name := range args {
+				if filepath.Ext(name) == "" {
+					name += ".asm"
+				}
+				path, err := findFile(name, pos.File, opts.IncludePath)
+				if err != nil {
+					fail(i+1, "Failed to import %s: %v", name, err)
+					continue
+				}
+				if slices.ContainsFunc(loaded, func(file string) bool { return sameFile(file, path) }) {
+					continue
+				}
+				f, err := os.Open(path)
+				if err != nil {
+					fail(i+1, "Failed to import %s: %v", name, err)
+					continue
+				}
+				log.Infof("Importing file: %s", path)
+				opened = append(opened, f)
+				loaded = append(loaded, path)
+				sources = append(sources, newSource(path, bufio.NewReader(f)))
+			}
+			continue
+		case "return", "not":
 			if narg != 0 {
-				return log.FErrf("Expecting 0 arguments for return, got %d (%v)", narg, args)
+				fail(1, "Expecting 0 arguments for %s, got %d (%v)", instr, narg, args)
+				continue
 			}
-		case "var", "param":
+		case "var", "param", ".export", ".extern":
 			if narg == 0 {
-				return log.FErrf("Expecting at least 1 argument for %s, got none", instr)
+				fail(0, "Expecting at least 1 argument for %s, got none", instr)
+				continue
 			}
-		case "incrr", "incrs", "sys", "syss", "storesb", "jne", "jeq", "jlt", "jgt", "jgte", "jlte":
+		case "incrr", "incrs", "sys", "syss", "storesb", "loadsb", "loadrb", "storerb", "jne", "jeq", "jlt", "jgt", "jgte", "jlte",
+			"jnes", "jeqs", "jlts", "jgts", "jgtes", "jltes", "jner", "jeqr", "jltr", "jgtr", "jgter", "jlter":
 			if narg != 2 {
-				return log.FErrf("Expecting 2 arguments for %s, got %d (%v)", instr, narg, args)
+				fail(0, "Expecting 2 arguments for %s, got %d (%v)", instr, narg, args)
+				continue
 			}
-		default:
+		case ".equ":
+			if narg < 2 {
+				fail(0, "Expecting a name and a value for .equ, got %d arguments (%v)", narg, args)
+				continue
+			}
+		case "str8", "str16":
 			if narg != 1 {
-				return log.FErrf("Expecting 1 argument for %s, got %d (%v)", instr, narg, args)
+				fail(0, "Expecting 1 argument for %s, got %d (%v)", instr, narg, args)
+				continue
 			}
+		default:
+			if narg == 0 {
+				fail(0, "Expecting 1 argument for %s, got none", instr)
+				continue
+			}
+			// the operand expression can have spaces.
+			args = []string{strings.Join(args, " ")}
 		}
 		var op cpu.Operation
 		label := "" // no label except for instructions that require it
+		var expression expr
+		syms.vars = nil
 		data := true
 		is48bit := false
 		switch instr {
+		case ".export":
+			exports = append(exports, args...)
+			for i, name := range args {
+				exportPos[name] = st.at(i + 1)
+			}
+			continue
+		case ".extern":
+			for _, name := range args {
+				externs[name] = true
+			}
+			continue
+		case ".equ":
+			constName := args[0]
+			if !isAddressLabel(constName) {
+				fail(1, "Invalid constant name %s for .equ", constName)
+				continue
+			}
+			if _, ok := syms.constants[constName]; ok {
+				fail(1, "Constant %s already defined", constName)
+				continue
+			}
+			e, err := parseExpr(strings.Join(args[1:], " "))
+			if err != nil {
+				fail(2, "Failed to parse .equ %s value: %v", constName, err)
+				continue
+			}
+			syms.constants[constName] = e
+			continue
 		case ".space":
 			// reserve multiple 0 initialized words
-			count, err := parseArg(args[0])
+			count, err := syms.constant(args[0])
 			if err != nil {
-				return log.FErrf("Failed to parse .space argument %q: %v", args[0], err)
+				fail(1, "Failed to parse .space argument %q: %v", args[0], err)
+				continue
 			}
 			if count <= 0 {
-				return log.FErrf(".space argument must be positive, got %d", count)
+				fail(1, ".space argument must be positive, got %d", count)
+				continue
 			}
 			for range count {
 				result = append(result, Line{
-					Op:   cpu.Operation(0),
-					Data: true,
+					Op:     cpu.Operation(0),
+					Data:   true,
+					Source: pos,
 				})
 			}
 			pc += cpu.ImmediateData(count)
 			continue
 		case "data":
 			// This is using the full 64-bit Operation as data instead of 56+8. There is no instruction.
-			v, err := parseArg(args[0])
+			v, dataLabel, e, err := syms.operand(args[0])
 			if err != nil {
-				return log.FErrf("Failed to parse data argument %q: %v", args[0], err)
+				fail(1, "Failed to parse data argument %q: %v", args[0], err)
+				continue
+			}
+			if dataLabel != "" {
+				e = name(dataLabel) // an error in emitCode unless it's a constant.
 			}
 			op = cpu.Operation(v)
-		case "str8":
+			expression = e
+		case "str8", "str16":
 			l := len(args[0])
-			if l == 0 || l > 255 {
-				return log.FErrf("str8 argument out of range: %d", l)
+			maxLen, serialize := 255, cpu.SerializeStr8
+			if instr == "str16" {
+				maxLen, serialize = 65535, cpu.SerializeStr16
+			}
+			if l == 0 || l > maxLen {
+				fail(1, "%s argument out of range: %d", instr, l)
+				continue
+			}
+			ops := dataLines(serialize([]byte(args[0])))
+			for i := range ops {
+				ops[i].Source = pos
+			}
+			if len(atPC) > 0 && labels[atPC[0]] == pc {
+				for _, strLabel := range atPC {
+					syms.strings[strLabel] = int64(l)
+				}
 			}
-			ops := serializeStr8([]byte(args[0]))
 			result = append(result, ops...)
 			pc += cpu.ImmediateData(len(ops))
 			continue
@@ -287,141 +703,407 @@ func compile(reader *bufio.Reader, writer *bufio.Writer) int {
 			log.Debugf("Return -> Ret %d", returnN)
 			// Don't reset returnN or varmap because there could be more than 1 return
 			// point.
+		case "not":
+			data = false
+			op = op.SetOpcode(cpu.Not)
 		default:
 			instrEnum, ok := cpu.InstructionFromString(instr)
 			if !ok {
-				return log.FErrf("Unknown instruction: %s", instr)
+				fail(0, "Unknown instruction: %s", instr)
+				continue
 			}
 			log.Debugf("Parsing instruction: %s %v", instrEnum, args)
-			if instrEnum >= cpu.LoadS { // for stack instructions, resolve var references
-				for i, v := range args {
-					if !isAddressLabel(v) {
-						continue
-					}
-					if idx, ok := varmap[v]; ok {
-						log.Debugf("Resolved var %s to index %d", v, idx)
-						args[i] = fmt.Sprintf("%d", idx)
-					} else if instrEnum != cpu.SysS || i != 0 {
-						// First argument of SysS is the syscall name not a stack variable.
-						return log.FErrf("Unknown stack variable: %s", v)
-					}
-				}
+			if isStackInstruction(instrEnum) { // stack instructions operands can use the var names.
+				syms.vars = varmap
 			}
 			arg := args[0]
 			data = false
 			op = op.SetOpcode(instrEnum)
 			switch instrEnum {
 			case cpu.Sys, cpu.SysS:
-				var failed int
-				failed, label = sysCalls(&op, args)
-				if failed != 0 {
-					return failed
+				var err error
+				if label, expression, err = sysCalls(&op, args, syms); err != nil {
+					fail(1, "Invalid %s: %v", instr, err)
+					continue
 				}
 				is48bit = true
-			case cpu.StoreSB:
-				// Store byte at stack index (first argument) with byte offset from stack index (second argument)
-				v1, err := parseArg(args[0])
+			case cpu.StoreSB, cpu.LoadSB:
+				// Store or load byte at stack index (first argument) with byte offset from stack index (second argument)
+				v1, err := syms.constant(args[0])
 				if err != nil {
-					return log.FErrf("Failed to parse argument %q: %v", args[0], err)
+					fail(1, "Failed to parse argument %q: %v", args[0], err)
+					continue
 				}
-				if v1 < 0 || v1 >= cpu.StackSize {
-					return log.FErrf("StoreSB stack base out of range (0 to %d): %d", cpu.StackSize-1, v1)
+				if v1 < 0 || v1 >= stackSize {
+					fail(1, "%s stack base out of range (0 to %d): %d", instrEnum, stackSize-1, v1)
+					continue
 				}
-				v2, err := parseArg(args[1])
+				v2, err := syms.constant(args[1])
 				if err != nil {
-					return log.FErrf("Failed to parse stack index argument %q: %v", args[1], err)
+					fail(2, "Failed to parse stack index argument %q: %v", args[1], err)
+					continue
 				}
-				if v2 < 0 || v2 >= cpu.StackSize {
-					return log.FErrf("StoreSB byte offset stack index out of range (0 to %d): %d", cpu.StackSize-1, v2)
+				if v2 < 0 || v2 >= stackSize {
+					fail(2, "%s byte offset stack index out of range (0 to %d): %d", instrEnum, stackSize-1, v2)
+					continue
 				}
 				op = op.SetOperand(cpu.ImmediateData(v2))
 				op = op.Set48BitsOperand(cpu.ImmediateData(v1))
 				is48bit = true
+			case cpu.LoadRB, cpu.StoreRB:
+				// Load or store byte at address (first argument, usually a label) with byte offset
+				// from stack index (second argument)
+				v, err := syms.constant(args[1])
+				if err != nil {
+					fail(2, "Failed to parse stack index argument %q: %v", args[1], err)
+					continue
+				}
+				if v < 0 || v >= stackSize {
+					fail(2, "%s byte offset stack index out of range (0 to %d): %d", instrEnum, stackSize-1, v)
+					continue
+				}
+				op = op.SetOperand(cpu.ImmediateData(v))
+				is48bit = true
+				syms.vars = nil // the address isn't a stack variable.
+				label, expression, err = setTarget(syms, &op, args[0], is48bit)
+				syms.vars = varmap
+				if err != nil {
+					fail(1, "Failed to parse address argument %q: %v", args[0], err)
+					continue
+				}
 			case cpu.IncrS:
 				// Increment by delta (first argument) at stack index (second argument)
-				v1, err := parseArg(args[0])
+				v1, err := syms.constant(args[0])
 				if err != nil {
-					return log.FErrf("Failed to parse argument %q: %v", args[0], err)
+					fail(1, "Failed to parse argument %q: %v", args[0], err)
+					continue
 				}
 				if v1 < -128 || v1 > 127 {
-					return log.FErrf("IncrS immediate value out of range (-128 to 127): %d", v1)
+					fail(1, "IncrS immediate value out of range (-128 to 127): %d", v1)
+					continue
 				}
-				v2, err := parseArg(args[1])
+				v2, err := syms.constant(args[1])
 				if err != nil {
-					return log.FErrf("Failed to parse stack index argument %q: %v", args[1], err)
+					fail(2, "Failed to parse stack index argument %q: %v", args[1], err)
+					continue
 				}
-				if v2 < 0 || v2 >= cpu.StackSize {
-					return log.FErrf("IncrS stack index out of range (0 to %d): %d", cpu.StackSize-1, v2)
+				if v2 < 0 || v2 >= stackSize {
+					fail(2, "IncrS stack index out of range (0 to %d): %d", stackSize-1, v2)
+					continue
 				}
 				op = op.SetOperand(cpu.ImmediateData(v1))
 				op = op.Set48BitsOperand(cpu.ImmediateData(v2))
 				is48bit = true
 			case cpu.IncrR:
 				// 2 arguments: value (-128 to 127) and label
-				label = args[1]
-				v, err := parseArg(args[0])
+				v, err := syms.constant(args[0])
 				if err != nil {
-					return log.FErrf("Failed to parse argument %q: %v", args[0], err)
+					fail(1, "Failed to parse argument %q: %v", args[0], err)
+					continue
 				}
 				if v < -128 || v > 127 {
-					return log.FErrf("IncrR immediate value out of range (-128 to 127): %d", v)
+					fail(1, "IncrR immediate value out of range (-128 to 127): %d", v)
+					continue
 				}
 				op = op.SetOperand(cpu.ImmediateData(v))
 				is48bit = true
+				if label, expression, err = setTarget(syms, &op, args[1], is48bit); err != nil {
+					fail(2, "Failed to parse address argument %q: %v", args[1], err)
+					continue
+				}
 			case cpu.JNE, cpu.JEQ, cpu.JLT, cpu.JGT, cpu.JGTE, cpu.JLTE:
 				// 2 arguments: value to compare and label for destination
-				label = args[1]
-				v, err := parseArg(args[0])
+				v, err := syms.constant(args[0])
 				if err != nil {
-					return log.FErrf("Failed to parse argument %q: %v", args[0], err)
+					fail(1, "Failed to parse argument %q: %v", args[0], err)
+					continue
 				}
 				if v < 0 || v > 255 {
-					return log.FErrf("Jump comparison value out of range (0 to 255): %d", v)
+					// Doesn't fit in 8 bits: compare with a data word instead, using the R variant.
+					lines, err := fullRangeJump(syms, instrEnum, v, args[1], pos)
+					if err != nil {
+						fail(2, "Failed to parse destination argument %q: %v", args[1], err)
+						continue
+					}
+					result = append(result, lines...)
+					pc += cpu.ImmediateData(len(lines))
+					continue
 				}
 				// Encode as: lower 8 bits = value, upper bits = destination (to be filled in by emitCode)
 				op = op.SetOperand(cpu.ImmediateData(v))
 				is48bit = true
-			default:
-				// allow labels as arguments even for immediate operands (eg load the address into accumulator)
-				if isAddressLabel(arg) {
-					label = arg
-					break
+				if label, expression, err = setTarget(syms, &op, args[1], is48bit); err != nil {
+					fail(2, "Failed to parse destination argument %q: %v", args[1], err)
+					continue
 				}
-				v, err := parseArg(arg)
+			case cpu.JNES, cpu.JEQS, cpu.JLTS, cpu.JGTS, cpu.JGTES, cpu.JLTES:
+				// 2 arguments: stack index of the value to compare and label for destination
+				v, err := syms.constant(args[0])
 				if err != nil {
-					return log.FErrf("Failed to parse argument %q: %v", arg, err)
+					fail(1, "Failed to parse stack index argument %q: %v", args[0], err)
+					continue
+				}
+				if v < 0 || v > 255 {
+					fail(1, "%s stack index out of range (0 to 255): %d", instrEnum, v)
+					continue
 				}
 				op = op.SetOperand(cpu.ImmediateData(v))
+				is48bit = true
+				syms.vars = nil // the destination isn't a stack variable.
+				label, expression, err = setTarget(syms, &op, args[1], is48bit)
+				syms.vars = varmap
+				if err != nil {
+					fail(2, "Failed to parse destination argument %q: %v", args[1], err)
+					continue
+				}
+			case cpu.JNER, cpu.JEQR, cpu.JLTR, cpu.JGTR, cpu.JGTER, cpu.JLTER:
+				// 2 arguments: address (usually a label) of the value to compare, which goes in
+				// the next word, and label for destination
+				v, addrLabel, e, err := syms.operand(args[0])
+				if err != nil {
+					fail(1, "Failed to parse memory operand %q: %v", args[0], err)
+					continue
+				}
+				if addrLabel != "" {
+					e = name(addrLabel)
+				}
+				if label, expression, err = setTarget(syms, &op, args[1], false); err != nil {
+					fail(2, "Failed to parse destination argument %q: %v", args[1], err)
+					continue
+				}
+				result = append(result,
+					Line{Op: op, Label: label, Expr: expression, Source: pos},
+					Line{Op: cpu.Operation(v), Addr: e, Source: pos})
+				pc += 2
+				continue
+			default:
+				var err error
+				if syms.vars != nil {
+					var v int64
+					if v, err = syms.constant(arg); err == nil {
+						op, err = setOperand(op, v, false)
+					}
+				} else {
+					// allow labels as arguments even for immediate operands (eg load the address into accumulator)
+					label, expression, err = setTarget(syms, &op, arg, false)
+				}
+				if err != nil {
+					fail(1, "Failed to parse argument %q: %v", arg, err)
+					continue
+				}
 			}
 		}
-		result = append(result, Line{Op: op, Label: label, Data: data, Is48bit: is48bit})
+		result = append(result, Line{
+			Op: op, Label: label, Expr: expression, Data: data, Is48bit: is48bit, Source: pos,
+		})
 		pc++
 	}
-	return emitCode(writer, result, labels)
+	for _, name := range exports {
+		if _, ok := labels[name]; !ok {
+			diags.add(exportPos[name], nil, "Exported label %s is not defined", name)
+		}
+	}
+	syms.labels = labels
+	syms.vars = nil // the stack variables were resolved while parsing, only labels are left.
+	var w io.Writer // nil to only check the labels and expressions.
+	if len(diags) == 0 {
+		w = writer
+	}
+	return append(diags, emitCode(opts, w, result, syms, exports, externs)...)
+}
+
+// isStackInstruction returns whether instr has a stack index operand (all the ones from LoadS
+// on, except the later immediate and R ones).
+func isStackInstruction(instr cpu.Instruction) bool {
+	switch instr { //nolint:exhaustive // just the ones after LoadS without a stack index.
+	case cpu.OrI, cpu.XorI, cpu.Not, cpu.ShrI, cpu.ModR, cpu.AndR, cpu.OrR, cpu.XorR, cpu.ShiftR,
+		cpu.JNER, cpu.JEQR, cpu.JLTR, cpu.JGTR, cpu.JGTER, cpu.JLTER:
+		return false
+	default:
+		return instr >= cpu.LoadS
+	}
 }
 
-func emitCode(writer io.Writer, result []Line, labels map[string]cpu.ImmediateData) int {
+// fullRangeJump returns the words for the conditional jump instr comparing with v, which doesn't
+// fit in its 8 bits operand, to target: the R variant (and its address word) comparing with a
+// data word holding v, after a JumpR over that word for when it doesn't jump.
+func fullRangeJump(syms *symbols, instr cpu.Instruction, v int64, target string, pos cpu.SourceInfo) ([]Line, error) {
+	op := cpu.Operation(0).SetOpcode(instr + cpu.JNER - cpu.JNE)
+	label, expression, err := setTarget(syms, &op, target, false)
+	if err != nil {
+		return nil, err
+	}
+	return []Line{
+		{Op: op, Label: label, Expr: expression, Source: pos},
+		{Op: cpu.Operation(3), Source: pos},
+		{Op: cpu.Operation(0).SetOpcode(cpu.JumpR).SetOperand(2), Source: pos},
+		{Op: cpu.Operation(v), Data: true, Source: pos},
+	}, nil
+}
+
+// setTarget sets arg as the operand of op (the 48 bits one if is48bit) when its value is
+// already known, else returns the label or expression for emitCode to resolve.
+func setTarget(syms *symbols, op *cpu.Operation, arg string, is48bit bool) (string, expr, error) {
+	v, label, e, err := syms.operand(arg)
+	if err != nil || label != "" || e != nil {
+		return label, e, err
+	}
+	*op, err = setOperand(*op, v, is48bit)
+	return "", nil, err
+}
+
+// emitCode resolves the labels and writes the program words, or for FormatVersion 2 and
+// objects the whole image with the trailing data words in the data section, the labels as
+// symbols and the source of each word as debug info. Objects also get the exports, and the
+// .extern labels they use as imports with the relocations of the operands to patch. Nothing
+// is written when writer is nil or there are errors.
+//
+//nolint:funlen // the 3 formats.
+func emitCode(opts Options, writer io.Writer, result []Line, syms *symbols,
+	exports []string, externs map[string]bool,
+) diagnostics {
+	labels := syms.labels
+	var diags diagnostics
+	var program []cpu.Operation
+	var imports []string
+	var relocations []cpu.Relocation
 	for pc, line := range result {
 		op := line.Op
 		if !line.Data && line.Label != "" {
 			// resolve label
 			targetPC, ok := labels[line.Label]
+			if !ok && opts.Object && externs[line.Label] {
+				idx := slices.Index(imports, line.Label)
+				if idx < 0 {
+					idx = len(imports)
+					imports = append(imports, line.Label)
+				}
+				relocations = append(relocations, cpu.Relocation{PC: cpu.ImmediateData(pc), Import: idx, Is48bit: line.Is48bit})
+				program = append(program, op)
+				continue
+			}
 			if !ok {
-				return log.FErrf("Unknown label: %s for %#v", line.Label, line)
+				diags.add(line.Source, nil, "Unknown label: %s", line.Label)
+				continue
 			}
-			relativePC := targetPC - cpu.ImmediateData(pc)
-			if line.Is48bit {
-				op = op.Set48BitsOperand(relativePC)
-			} else {
-				op = op.SetOperand(relativePC)
+			var err error
+			if op, err = setOperand(op, int64(targetPC)-int64(pc), line.Is48bit); err != nil {
+				diags.add(line.Source, nil, "Label %s: %v", line.Label, err)
+				continue
+			}
+		}
+		if line.Expr != nil {
+			var err error
+			if op, err = resolve(op, line, pc, syms); err != nil {
+				diags.add(line.Source, nil, "Failed to evaluate %q: %v", line.Source.Text, err)
+				continue
+			}
+		}
+		if line.Addr != nil {
+			var err error
+			if op, err = resolveAddr(line.Addr, pc-1, syms); err != nil {
+				diags.add(line.Source, nil, "Failed to evaluate the memory operand of %q: %v", line.Source.Text, err)
+				continue
 			}
 		}
-		if err := binary.Write(writer, binary.LittleEndian, op); err != nil {
-			return log.FErrf("Failed to write operation: %v", err)
+		log.Debugf("Emitting operation: %x %v %v", (uint64)(op), op.Opcode(), op.Operand()) //nolint:gosec // on purpose
+		program = append(program, op)
+	}
+	if writer == nil || len(diags) > 0 {
+		return diags
+	}
+	if opts.FormatVersion != 2 && !opts.Object {
+		if err := binary.Write(writer, binary.LittleEndian, program); err != nil {
+			diags.add(cpu.SourceInfo{}, nil, "Failed to write operations: %v", err)
 		}
-		log.Debugf("Wrote operation: %x %v %v", (uint64)(op), op.Opcode(), op.Operand()) //nolint:gosec // on purpose
+		return diags
 	}
-	return 0
+	codeSize := len(result)
+	for codeSize > 0 && result[codeSize-1].Data {
+		codeSize--
+	}
+	img := &cpu.Image{
+		Code:      program[:codeSize],
+		Data:      program[codeSize:],
+		StackSize: max(opts.StackSize, 0),
+		ISA:       cpu.ISAVersion,
+	}
+	if opts.Object {
+		img.Object, img.Exports, img.Imports, img.Relocations = true, exports, imports, relocations
+	}
+	for name, addr := range labels {
+		img.Symbols = append(img.Symbols, cpu.Symbol{Name: name, Address: addr})
+	}
+	slices.SortFunc(img.Symbols, func(a, b cpu.Symbol) int {
+		return cmp.Or(cmp.Compare(a.Address, b.Address), strings.Compare(a.Name, b.Name))
+	})
+	img.Debug = debugInfo(result, img.Symbols, exports).Encode()
+	if err := img.Write(writer); err != nil {
+		diags.add(cpu.SourceInfo{}, nil, "Failed to write image: %v", err)
+	}
+	return diags
+}
+
+// resolve returns op with the value of the line's expression: as is for a constant (and the
+// whole word for data), relative to pc for an address.
+func resolve(op cpu.Operation, line Line, pc int, syms *symbols) (cpu.Operation, error) {
+	v, err := line.Expr.eval(syms, 0)
+	switch {
+	case err != nil:
+		return op, err
+	case v.addrs == 0 && line.Data:
+		return cpu.Operation(v.n), nil
+	case v.addrs == 0:
+		return setOperand(op, v.n, line.Is48bit)
+	case v.addrs == 1 && !line.Data:
+		return setOperand(op, v.n-int64(pc), line.Is48bit)
+	case v.addrs == 1:
+		return op, errors.New("data can't be a label address (the code is position independent)")
+	default:
+		return op, fmt.Errorf("invalid expression using %d label addresses, expecting 0 or 1", v.addrs)
+	}
+}
+
+// resolveAddr returns the address word for the address e, relative to pc.
+func resolveAddr(e expr, pc int, syms *symbols) (cpu.Operation, error) {
+	v, err := e.eval(syms, 0)
+	switch {
+	case err != nil:
+		return 0, err
+	case v.addrs == 1:
+		return cpu.Operation(v.n - int64(pc)), nil
+	case v.addrs == 0:
+		return cpu.Operation(v.n), nil
+	default:
+		return 0, fmt.Errorf("invalid expression using %d label addresses, expecting 0 or 1", v.addrs)
+	}
+}
+
+// debugInfo returns the source of each word, with the function: the last label, in address
+// order, that is the target of a Call or exported.
+func debugInfo(result []Line, symbols []cpu.Symbol, exports []string) cpu.DebugInfo {
+	functions := make(map[string]bool)
+	for _, name := range exports {
+		functions[name] = true
+	}
+	for _, line := range result {
+		if !line.Data && line.Op.Opcode() == cpu.Call && line.Label != "" {
+			functions[line.Label] = true
+		}
+	}
+	info := make(cpu.DebugInfo, len(result))
+	function := ""
+	next := 0
+	for pc, line := range result {
+		for ; next < len(symbols) && symbols[next].Address <= cpu.ImmediateData(pc); next++ {
+			if functions[symbols[next].Name] {
+				function = symbols[next].Name
+			}
+		}
+		info[pc] = line.Source
+		info[pc].Function = function
+	}
+	return info
 }
 
 func parseArg(arg string) (int64, error) {
@@ -2,11 +2,17 @@ package asm
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"io"
+	"os"
+	"path/filepath"
 	"reflect"
+	"slices"
 	"strings"
 	"testing"
+
+	"grol.io/vm/cpu"
 )
 
 func TestParse(t *testing.T) {
@@ -243,3 +249,526 @@ func TestSerializeStr8Panics(t *testing.T) {
 		})
 	}
 }
+
+func TestStackSizeRangeChecks(t *testing.T) {
+	for _, tt := range []struct {
+		src       string
+		stackSize int
+		ok        bool
+	}{
+		{"IncrS 1 511", 0, true},
+		{"IncrS 1 512", 0, false},
+		{"IncrS 1 600", 1024, true},
+		{"StoreSB 1023 0", 1024, true},
+		{"StoreSB 1024 0", 1024, false},
+		{"StoreSB 3 1", 4, true},
+		{"StoreSB 4 1", 4, false},
+		{"LoadSB 3 3", 4, true},
+		{"LoadSB 4 0", 4, false},
+		{"LoadRB 0 3", 4, true},
+		{"StoreRB 0 4", 4, false},
+	} {
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		res := compile(Options{StackSize: tt.stackSize}, bufio.NewReader(strings.NewReader(tt.src)), w)
+		if (res == 0) != tt.ok {
+			t.Errorf("compile(%q, stack size %d) = %d, expected ok=%v", tt.src, tt.stackSize, res, tt.ok)
+		}
+	}
+}
+
+func TestCompileVersion2(t *testing.T) {
+	src := `
+start:
+    LoadR value
+    Sys Write8 msg
+    Sys Exit 0
+value:
+    Data 42
+msg:
+    str8 "hi"
+`
+	expected := assemble(t, src)
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if res := compile(Options{StackSize: 64, FormatVersion: 2}, bufio.NewReader(strings.NewReader(src)), w); res != 0 {
+		t.Fatalf("compile failed with %d", res)
+	}
+	_ = w.Flush()
+	img, err := cpu.ReadImage(&buf)
+	if err != nil {
+		t.Fatalf("failed to read the image: %v", err)
+	}
+	if img.Version != 2 || len(img.Code) != 3 || img.StackSize != 64 || img.ISA != cpu.ISAVersion {
+		t.Errorf("unexpected image %+v", img)
+	}
+	if !slices.Equal(img.Memory(), expected) {
+		t.Errorf("got memory %x, expected %x", img.Memory(), expected)
+	}
+	symbols := []cpu.Symbol{{Name: "start", Address: 0}, {Name: "value", Address: 3}, {Name: "msg", Address: 4}}
+	if !slices.Equal(img.Symbols, symbols) {
+		t.Errorf("got symbols %v, expected %v", img.Symbols, symbols)
+	}
+}
+
+func TestCompileDebugInfo(t *testing.T) {
+	main := "  loadi 3 ; comment\nstart:\n\tcall f\n  sys exit 0\n"
+	lib := "f:\n  str8 `a\nb` # 2 lines\nloop:\n  jumpr loop"
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	res := compileSources(Options{FormatVersion: 2}, w,
+		newSource("main.asm", bufio.NewReader(strings.NewReader(main))),
+		newSource("lib.asm", bufio.NewReader(strings.NewReader(lib))))
+	if res != 0 {
+		t.Fatalf("compile failed with %d", res)
+	}
+	_ = w.Flush()
+	img, err := cpu.ReadImage(&buf)
+	if err != nil {
+		t.Fatalf("failed to read the image: %v", err)
+	}
+	info, err := cpu.DecodeDebugInfo(img.Debug)
+	if err != nil {
+		t.Fatalf("failed to decode the debug info: %v", err)
+	}
+	expected := cpu.DebugInfo{
+		{File: "main.asm", Line: 1, Column: 3, Text: "loadi 3"},
+		{File: "main.asm", Line: 3, Column: 2, Label: "start", Text: "call f"},
+		{File: "main.asm", Line: 4, Column: 3, Label: "start", Text: "sys exit 0"},
+		{File: "lib.asm", Line: 2, Column: 3, Label: "f", Function: "f", Text: "str8 `a\nb`"},
+		{File: "lib.asm", Line: 5, Column: 3, Label: "loop", Function: "f", Text: "jumpr loop"},
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Errorf("got\n%+v\nexpected\n%+v", info, expected)
+	}
+}
+
+func TestMacros(t *testing.T) {
+	src := `
+.macro countdown n counter ; labels in the body are local to each use.
+    loadi n
+    storer counter
+loop:
+    incrr -1 counter
+    jne 0 loop
+.endm
+.macro twice n
+    COUNTDOWN n c ; macros can use macros, names are case insensitive.
+    countdown n c
+.endm
+    twice 3
+    sys exit 0
+c:
+    data 0
+`
+	expanded := `
+    loadi 3
+    storer c
+loop1:
+    incrr -1 c
+    jne 0 loop1
+    loadi 3
+    storer c
+loop2:
+    incrr -1 c
+    jne 0 loop2
+    sys exit 0
+c:
+    data 0
+`
+	got, expected := assemble(t, src), assemble(t, expanded)
+	if !slices.Equal(got, expected) {
+		t.Errorf("got %x, expected %x", got, expected)
+	}
+}
+
+func TestMacroErrors(t *testing.T) {
+	for _, src := range []string{
+		".macro m a\n  loadi a\n",                 // missing .endm
+		".macro m a\n  loadi a\n.endm\n  m 1 2\n", // wrong argument count
+		".macro m\n  m\n.endm\n  m\n",             // recursive
+		".macro m\n.macro n\n.endm\n.endm\n",      // nested definition
+		".macro m\n.endm\n.macro M\n.endm\n",      // duplicate
+		".macro loadi\n.endm\n",                   // instruction name
+		".macro\n.endm\n",
+		".endm\n",
+		".macro m\n  bogus 1\n.endm\n  m\n",
+	} {
+		var buf bytes.Buffer
+		if res := compile(Options{}, bufio.NewReader(strings.NewReader(src)), bufio.NewWriter(&buf)); res == 0 {
+			t.Errorf("expected an error compiling %q", src)
+		}
+	}
+}
+
+func TestMacroErrorPosition(t *testing.T) {
+	m := &macro{name: "inner", pos: cpu.SourceInfo{File: "lib.asm", Line: 10}}
+	outer := &expansion{macro: &macro{name: "outer"}, use: cpu.SourceInfo{File: "main.asm", Line: 3}}
+	e := &expansion{macro: m, use: cpu.SourceInfo{File: "lib.asm", Line: 21}, parent: outer, depth: 1}
+	expected := "in macro inner at lib.asm:12 (defined at lib.asm:10), used at lib.asm:21 in macro outer, used at main.asm:3"
+	if got := e.describe(cpu.SourceInfo{File: "lib.asm", Line: 12}); got != expected {
+		t.Errorf("got %q, expected %q", got, expected)
+	}
+}
+
+// writeFiles creates the files (name to content) in a temporary directory and returns it.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// compiled returns the program words of the .vm file compiled for file.asm.
+func compiled(t *testing.T, file string) []cpu.Operation {
+	t.Helper()
+	img, err := cpu.ReadImageFile(strings.TrimSuffix(file, ".asm") + ".vm")
+	if err != nil {
+		t.Fatalf("failed to read the compiled %s: %v", file, err)
+	}
+	return img.Memory()
+}
+
+func TestIncludeImport(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.asm":     ".import lib\n.include \"inc/defs.asm\"\n  call f\n  sys exit 0\n",
+		"inc/defs.asm": ".include \"more.asm\"\n  addi 1\n",
+		"inc/more.asm": ".import lib ; imported only once\n  loadi 2\n",
+		"libs/lib.asm": "f:\n  muli 3\n  ret 0\n",
+	})
+	main := filepath.Join(dir, "main.asm")
+	opts := Options{IncludePath: []string{filepath.Join(dir, "libs")}}
+	if res := Compile(opts, main); res != 0 {
+		t.Fatalf("compile failed with %d", res)
+	}
+	expected := assemble(t, "  loadi 2\n  addi 1\n  call f\n  sys exit 0\nf:\n  muli 3\n  ret 0\n")
+	if got := compiled(t, main); !slices.Equal(got, expected) {
+		t.Errorf("got %x, expected %x", got, expected)
+	}
+	// Not imported again when already on the command line.
+	if res := Compile(opts, main, filepath.Join(dir, "libs", "lib.asm")); res != 0 {
+		t.Fatalf("compile with lib.asm failed with %d", res)
+	}
+	if got := compiled(t, main); !slices.Equal(got, expected) {
+		t.Errorf("got %x, expected %x", got, expected)
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"cycle.asm":     ".include \"sub/a.asm\"\n",
+		"sub/a.asm":     ".include \"../cycle.asm\"\n",
+		"self.asm":      ".include \"self.asm\"\n",
+		"missing.asm":   ".include \"nothere.asm\"\n",
+		"noimport.asm":  ".import nothere\n",
+		"macro.asm":     ".macro m\n.include \"self.asm\"\n.endm\n  m\n",
+		"noarg.asm":     ".include\n",
+		"twoargs.asm":   ".include \"a.asm\" \"b.asm\"\n",
+		"noimports.asm": ".import\n",
+	})
+	files, _ := filepath.Glob(filepath.Join(dir, "*.asm"))
+	for _, file := range files {
+		if res := Compile(Options{}, file); res == 0 {
+			t.Errorf("expected an error compiling %s", filepath.Base(file))
+		}
+	}
+	chain := strings.Join([]string{"cycle.asm", "sub/a.asm", "cycle.asm"}, " -> ")
+	cycle := newSource(filepath.Join(dir, "cycle.asm"), nil)
+	a, f, err := cycle.include("sub/a.asm", nil)
+	if err != nil {
+		t.Fatalf("include failed: %v", err)
+	}
+	f.Close()
+	_, _, err = a.include("../cycle.asm", nil)
+	if err == nil || !strings.Contains(strings.ReplaceAll(err.Error(), dir+"/", ""), chain) {
+		t.Errorf("expected the include cycle %s, got %v", chain, err)
+	}
+}
+
+func TestLocalLabels(t *testing.T) {
+	src := `
+    call f
+    sys exit 0
+f:
+.loop: ; f.loop
+    jne 0 .loop
+1:
+    jeq 0 1f
+    jumpr 1b
+1:
+    loadr g.loop
+    ret 0
+g:
+.loop: ; g.loop, no conflict with f's.
+    jne 0 .loop
+    jeq 0 1b
+    ret 0
+`
+	expanded := `
+    call f
+    sys exit 0
+f:
+f_loop:
+    jne 0 f_loop
+one_a:
+    jeq 0 one_b
+    jumpr one_a
+one_b:
+    loadr g_loop
+    ret 0
+g:
+g_loop:
+    jne 0 g_loop
+    jeq 0 one_b
+    ret 0
+`
+	got, expected := assemble(t, src), assemble(t, expanded)
+	if !slices.Equal(got, expected) {
+		t.Errorf("got %x, expected %x", got, expected)
+	}
+}
+
+func TestLabelErrors(t *testing.T) {
+	for _, src := range []string{
+		"a:\n  loadi 1\na:\n  ret 0\n", // duplicate
+		"f:\n.x:\n  loadi 1\n.x:\n",    // duplicate local
+		"f:\n.x:\n  loadi 1\nf.x:\n",   // same as the local
+		"  jumpr 1b\n1:\n",             // no previous
+		"  jumpr 1f\n",                 // no next
+		"f:\n  jumpr .x\ng:\n.x:\n",    // not in scope
+	} {
+		var buf bytes.Buffer
+		if res := compile(Options{}, bufio.NewReader(strings.NewReader(src)), bufio.NewWriter(&buf)); res == 0 {
+			t.Errorf("expected an error compiling %q", src)
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	src := `.macro m x
+    loadi x +
+.endm
+start:
+    foo 3
+    addi  "abc
+    jnes 300 start
+    m 2
+start:
+    incrs 1 x
+    call nowhere
+`
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	diags := assembleSources(Options{}, w, newSource("t.asm", bufio.NewReader(strings.NewReader(src))))
+	w.Flush()
+	expected := []struct {
+		line, column int
+		message      string
+	}{
+		{5, 5, "Unknown instruction: foo"},
+		{6, 11, "unterminated quote"},
+		{7, 10, "JNES stack index out of range"},
+		{2, 11, "used at t.asm:8"},
+		{9, 1, "Duplicate label start, already defined at t.asm:4"},
+		{10, 13, "Failed to parse stack index argument \"x\""},
+		{11, 5, "Unknown label: nowhere"},
+	}
+	if len(diags) != len(expected) {
+		t.Fatalf("got %d diagnostics, expected %d: %v", len(diags), len(expected), diags)
+	}
+	for i, d := range diags {
+		e := expected[i]
+		if d.File != "t.asm" || d.Line != e.line || d.Column != e.column || !strings.Contains(d.Message, e.message) {
+			t.Errorf("got %s, expected t.asm:%d:%d: ...%s...", d, e.line, e.column, e.message)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing written when there are errors, got %d bytes", buf.Len())
+	}
+}
+
+func TestReportJSON(t *testing.T) {
+	diags := diagnostics{{File: "a.asm", Line: 3, Column: 7, Message: "Unknown label: x"}, {Message: "Too many errors"}}
+	var buf bytes.Buffer
+	if res := report(Options{DiagFormat: "json"}, &buf, diags); res == 0 {
+		t.Errorf("expected an error exit code")
+	}
+	expected := `{"file":"a.asm","line":3,"column":7,"message":"Unknown label: x"}
+{"file":"","line":0,"column":0,"message":"Too many errors"}
+`
+	if buf.String() != expected {
+		t.Errorf("got %s, expected %s", buf.String(), expected)
+	}
+	if got := diags[0].String(); got != "a.asm:3:7: Unknown label: x" {
+		t.Errorf("got %q", got)
+	}
+	if res := report(Options{DiagFormat: "json"}, &buf, nil); res != 0 {
+		t.Errorf("expected 0 without diagnostics, got %d", res)
+	}
+}
+
+func TestStr16(t *testing.T) {
+	long := strings.Repeat("abcdefghij", 30)
+	src := `
+.macro msg s
+    str16 s
+.endm
+    loadi sizeof(text)
+text:
+    msg "` + long + `"
+`
+	got := assemble(t, src)
+	expected := append([]cpu.Operation{cpu.Operation(0).SetOpcode(cpu.LoadI).SetOperand(300)},
+		cpu.SerializeStr16([]byte(long))...)
+	if !slices.Equal(got, expected) {
+		t.Errorf("got %x, expected %x", got, expected)
+	}
+	for _, bad := range []string{"  str16 \"\"\n", "  str16 \"" + strings.Repeat("x", 65536) + "\"\n", "  str16 a b\n"} {
+		var buf bytes.Buffer
+		if res := compile(Options{}, bufio.NewReader(strings.NewReader(bad)), bufio.NewWriter(&buf)); res == 0 {
+			t.Errorf("expected an error compiling %.20q", bad)
+		}
+	}
+}
+
+func TestByteInstructions(t *testing.T) {
+	src := `
+    var i msg buf ; msg is a stack variable but loadrb and storerb only use labels.
+    loadsb buf i
+    storesb buf msg
+    loadrb msg i
+    storerb msg+1 2
+msg:
+    data 0
+    data 0
+`
+	op := func(code cpu.Instruction, base, idx int64) cpu.Operation {
+		return cpu.Operation(0).SetOpcode(code).SetOperand(cpu.ImmediateData(idx)).Set48BitsOperand(cpu.ImmediateData(base))
+	}
+	expected := []cpu.Operation{
+		cpu.Operation(0).SetOpcode(cpu.Push).SetOperand(2),
+		op(cpu.LoadSB, 2, 0),
+		op(cpu.StoreSB, 2, 1),
+		op(cpu.LoadRB, 2, 0), // msg at PC 5, relative to PC 3.
+		op(cpu.StoreRB, 2, 2),
+		0, 0,
+	}
+	got := assemble(t, src)
+	if !slices.Equal(got, expected) {
+		t.Errorf("got %x, expected %x", got, expected)
+	}
+	if got[3]&0xFF != cpu.Operation(cpu.LoadRB) || got[3]>>8&0xFF != 0 || got[3]>>16 != 2 {
+		t.Errorf("LoadRB packed as %x, expected opcode, stack index then base", got[3])
+	}
+	for _, bad := range []string{"  loadrb x\nx:\n", "  push 0\n  storerb y 0\n", "  loadrb 0 -1\n", "  loadsb -1 0\n"} {
+		var buf bytes.Buffer
+		if res := compile(Options{}, bufio.NewReader(strings.NewReader(bad)), bufio.NewWriter(&buf)); res == 0 {
+			t.Errorf("expected an error compiling %q", bad)
+		}
+	}
+}
+
+func TestBitwiseInstructions(t *testing.T) {
+	src := `
+    var mask x
+    not
+    ori 0xF0
+    xori -1
+    shri 4
+    ands mask
+    shifts x
+    modr mask ; the label, not the stack variable: R operands are memory ones.
+mask:
+    data 7
+`
+	op := func(code cpu.Instruction, operand int64) cpu.Operation {
+		return cpu.Operation(0).SetOpcode(code).SetOperand(cpu.ImmediateData(operand))
+	}
+	expected := []cpu.Operation{
+		op(cpu.Push, 1),
+		op(cpu.Not, 0),
+		op(cpu.OrI, 0xF0),
+		op(cpu.XorI, -1),
+		op(cpu.ShrI, 4),
+		op(cpu.AndS, 0),
+		op(cpu.ShiftS, 1),
+		op(cpu.ModR, 1),
+		7,
+	}
+	got := assemble(t, src)
+	if !slices.Equal(got, expected) {
+		t.Errorf("got %x, expected %x", got, expected)
+	}
+	for _, bad := range []string{"  not 1\n", "  var x\n  ori x\n", "  xors\n"} {
+		var buf bytes.Buffer
+		if res := compile(Options{}, bufio.NewReader(strings.NewReader(bad)), bufio.NewWriter(&buf)); res == 0 {
+			t.Errorf("expected an error compiling %q", bad)
+		}
+	}
+}
+
+func TestCompareInstructions(t *testing.T) {
+	src := `
+    var limit x
+start:
+    jlts limit start ; limit is a stack variable, the destination is a label.
+    jgter max start
+    jne 255 start
+    jlt -1 start ; doesn't fit in 8 bits: expanded.
+    jeq 1<<40 start
+max:
+    data 100
+`
+	expanded := `
+    push 1
+start:
+    jlts 0 start
+    jgter max start
+    jne 255 start
+    jltr 3 start
+    jumpr 2
+    data -1
+    jeqr 3 start
+    jumpr 2
+    data 1<<40
+max:
+    data 100
+`
+	got, expected := assemble(t, src), assemble(t, expanded)
+	if !slices.Equal(got, expected) {
+		t.Errorf("got %x, expected %x", got, expected)
+	}
+	jgter := cpu.Operation(0).SetOpcode(cpu.JGTER).SetOperand(-1)
+	if got[2] != jgter || got[3] != 11 {
+		t.Errorf("JGTER packed as %x %x, expected %x b (the address of max in the next word)", got[2], got[3], jgter)
+	}
+	far := assemble(t, "  jltr far x\nx:\n  .space 100_000\nfar:\n  data 0\n")
+	if far[0] != cpu.Operation(0).SetOpcode(cpu.JLTR).SetOperand(2) || far[1] != 100_002 {
+		t.Errorf("far JLTR packed as %x %x", far[0], far[1])
+	}
+	var buf bytes.Buffer
+	diags := assembleSources(Options{}, bufio.NewWriter(&buf), newSource("t.asm",
+		bufio.NewReader(strings.NewReader("  jltr nowhere x\nx:\n"))))
+	if len(diags) != 1 || !strings.Contains(diags[0].Message, "memory operand") {
+		t.Errorf("expected the memory operand error, got %v", diags)
+	}
+	for _, bad := range []string{
+		"  jlts 256 x\nx:\n", // stack index.
+		"  jltr 1+ x\nx:\n",  // memory operand.
+		"  jgt -5 y\n",       // unknown destination.
+		"  jnes 0\n",         // missing destination.
+	} {
+		var buf bytes.Buffer
+		if res := compile(Options{}, bufio.NewReader(strings.NewReader(bad)), bufio.NewWriter(&buf)); res == 0 {
+			t.Errorf("expected an error compiling %q", bad)
+		}
+	}
+}
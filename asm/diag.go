@@ -0,0 +1,65 @@
+package asm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"fortio.org/log"
+	"grol.io/vm/cpu"
+)
+
+// maxDiagnostics stops the assembly after that many errors.
+const maxDiagnostics = 100
+
+// Diagnostic is an assembler error and the position, in the source, of the token it's about.
+type Diagnostic struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+// String returns the diagnostic as "file:line:column: message", like the compilers do.
+func (d Diagnostic) String() string {
+	switch {
+	case d.Line == 0:
+		return d.Message
+	case d.File == "":
+		return fmt.Sprintf("%d:%d: %s", d.Line, d.Column, d.Message)
+	default:
+		return fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Column, d.Message)
+	}
+}
+
+// diagnostics are the errors found by the assembler, which goes on with the next statement
+// after most of them.
+type diagnostics []Diagnostic
+
+// add records the error at pos, with the macro use(s) it comes from when e isn't nil.
+func (d *diagnostics) add(pos cpu.SourceInfo, e *expansion, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if e != nil {
+		msg += " (" + e.describe(pos) + ")"
+	}
+	*d = append(*d, Diagnostic{File: pos.File, Line: pos.Line, Column: pos.Column, Message: msg})
+}
+
+// report writes the diagnostics in the format of Options.DiagFormat: logged as text or, for
+// "json", one JSON object per line to w (for editors). Returns the exit code.
+func report(opts Options, w io.Writer, diags diagnostics) int {
+	if len(diags) == 0 {
+		return 0
+	}
+	enc := json.NewEncoder(w)
+	for _, d := range diags {
+		if opts.DiagFormat != "json" {
+			log.Errf("%s", d.String())
+			continue
+		}
+		if err := enc.Encode(d); err != nil {
+			return log.FErrf("Failed to write the diagnostics: %v", err)
+		}
+	}
+	return log.FErrf("Failed to assemble: %d error(s)", len(diags))
+}
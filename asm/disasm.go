@@ -0,0 +1,353 @@
+package asm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"fortio.org/log"
+	"grol.io/vm/cpu"
+)
+
+// Disasm disassembles the given .vm files to stdout, in a form that Compile can assemble back
+// into the same bytes.
+func Disasm(files ...string) int {
+	writer := bufio.NewWriter(os.Stdout)
+	defer writer.Flush()
+	for _, file := range files {
+		log.Infof("Disassembling file: %s", file)
+		img, err := cpu.ReadImageFile(file)
+		if err != nil {
+			return log.FErrf("Failed to load program %s: %v", file, err)
+		}
+		program := img.Memory()
+		_, _ = fmt.Fprintf(writer, "; Disassembly of %s (%d words)\n", file, len(program))
+		err = Disassemble(writer, program, int(img.Entry))
+		if err != nil {
+			return log.FErrf("Failed to disassemble %s: %v", file, err)
+		}
+	}
+	return 0
+}
+
+// disasmOp is a decoded operation: the instruction (or syscall) name, its numeric arguments
+// and, for relative addressing, the absolute target PC.
+type disasmOp struct {
+	name        string
+	args        []int64
+	target      int  // absolute PC of the relative operand, if hasTarget.
+	hasTarget   bool // operand is relative to the PC (and will be printed as a label).
+	targetFirst bool // the target is the first operand, before args (LoadRB and StoreRB).
+	addr        int  // absolute PC of the address word operand, if hasAddr.
+	hasAddr     bool // the next word is an address (R conditional jumps), printed as a label first.
+	addrWord    bool // the next word is part of the instruction (R conditional jumps).
+	next        bool // execution can continue to the next instruction.
+}
+
+// isMemorySyscall returns true for the syscalls whose argument is an address.
+func isMemorySyscall(s cpu.Syscall) bool {
+	switch s { //nolint:exhaustive // only the ones with address arguments.
+	case cpu.Read8, cpu.Write8, cpu.Read16, cpu.Write16, cpu.ReadN, cpu.WriteN:
+		return true
+	default:
+		return false
+	}
+}
+
+// decodeOp decodes op at pc, returns false if it isn't something the assembler could have produced.
+//
+//nolint:gocyclo // it's a switch on all instructions.
+func decodeOp(program []cpu.Operation, pc int) (disasmOp, bool) {
+	n, op := len(program), program[pc]
+	instr := op.Opcode()
+	d := disasmOp{name: instr.String(), next: true}
+	inRange := func(target cpu.ImmediateData) bool {
+		return target >= 0 && int(target) <= n
+	}
+	switch instr {
+	case cpu.LoadI, cpu.AddI, cpu.SubI, cpu.MulI, cpu.DivI, cpu.ModI, cpu.ShiftI, cpu.AndI,
+		cpu.OrI, cpu.XorI, cpu.ShrI, cpu.Push, cpu.Pop, cpu.LoadS, cpu.StoreS, cpu.AddS, cpu.SubS, cpu.MulS,
+		cpu.DivS, cpu.IdivS, cpu.ModS, cpu.AndS, cpu.OrS, cpu.XorS, cpu.ShiftS:
+		d.args = []int64{op.OperandInt64()}
+	case cpu.Not:
+		if op.Operand() != 0 {
+			return d, false
+		}
+	case cpu.Ret:
+		d.args = []int64{op.OperandInt64()}
+		d.next = false
+	case cpu.LoadR, cpu.AddR, cpu.SubR, cpu.MulR, cpu.DivR, cpu.StoreR, cpu.JumpR, cpu.Call,
+		cpu.ModR, cpu.AndR, cpu.OrR, cpu.XorR, cpu.ShiftR:
+		target := cpu.ImmediateData(pc) + op.Operand()
+		if inRange(target) {
+			d.target, d.hasTarget = int(target), true
+		} else {
+			d.args = []int64{op.OperandInt64()}
+		}
+		d.next = instr != cpu.JumpR
+	case cpu.JNE, cpu.JEQ, cpu.JLT, cpu.JGT, cpu.JGTE, cpu.JLTE, cpu.IncrR,
+		cpu.JNES, cpu.JEQS, cpu.JLTS, cpu.JGTS, cpu.JGTES, cpu.JLTES:
+		target := cpu.ImmediateData(pc) + op.Operand48()
+		if !inRange(target) {
+			return d, false
+		}
+		if instr == cpu.IncrR {
+			d.args = []int64{int64(int8(op.Operand8()))} //nolint:gosec // signed increment on purpose
+		} else {
+			d.args = []int64{int64(op.Operand8())}
+		}
+		d.target, d.hasTarget = int(target), true // these only accept a label.
+	case cpu.JNER, cpu.JEQR, cpu.JLTR, cpu.JGTR, cpu.JGTER, cpu.JLTER:
+		target := cpu.ImmediateData(pc) + op.Operand()
+		if !inRange(target) || pc+1 >= n {
+			return d, false
+		}
+		addr := cpu.ImmediateData(pc) + cpu.ImmediateData(program[pc+1])
+		if inRange(addr) && int(addr) < n {
+			d.addr, d.hasAddr = int(addr), true
+		} else {
+			d.args = []int64{int64(program[pc+1])} // the relative address out of the program.
+		}
+		d.target, d.hasTarget, d.addrWord = int(target), true, true
+	case cpu.IncrS:
+		idx := op.Operand48()
+		if idx < 0 {
+			return d, false
+		}
+		d.args = []int64{int64(int8(op.Operand8())), int64(idx)} //nolint:gosec // signed increment on purpose
+	case cpu.StoreSB, cpu.LoadSB:
+		base := op.Operand48()
+		if base < 0 {
+			return d, false
+		}
+		d.args = []int64{int64(base), int64(op.Operand8())}
+	case cpu.LoadRB, cpu.StoreRB:
+		target := cpu.ImmediateData(pc) + op.Operand48()
+		if inRange(target) {
+			d.target, d.hasTarget, d.targetFirst = int(target), true, true
+			d.args = []int64{int64(op.Operand8())}
+		} else {
+			d.args = []int64{int64(op.Operand48()), int64(op.Operand8())}
+		}
+	case cpu.Sys, cpu.SysS:
+		syscall := cpu.Syscall(op.Operand8())
+		if syscall <= cpu.InvalidSyscall || syscall >= cpu.LastSyscall {
+			return d, false
+		}
+		d.name += " " + syscall.String()
+		arg := op.Operand48()
+		target := cpu.ImmediateData(pc) + arg
+		if instr == cpu.Sys && isMemorySyscall(syscall) && inRange(target) {
+			d.target, d.hasTarget = int(target), true
+		} else {
+			d.args = []int64{int64(arg)}
+		}
+		d.next = syscall != cpu.Exit
+	default:
+		return d, false
+	}
+	return d, true
+}
+
+// successors returns the PCs execution can continue at after d (at pc).
+func (d disasmOp) successors(pc int, instr cpu.Instruction) []int {
+	var res []int
+	switch {
+	case d.addrWord:
+		res = append(res, pc+2)
+	case d.next:
+		res = append(res, pc+1)
+	}
+	if d.hasTarget {
+		switch instr { //nolint:exhaustive // only control flow instructions.
+		case cpu.JumpR, cpu.Call, cpu.JNE, cpu.JEQ, cpu.JLT, cpu.JGT, cpu.JGTE, cpu.JLTE,
+			cpu.JNES, cpu.JEQS, cpu.JLTS, cpu.JGTS, cpu.JGTES, cpu.JLTES, cpu.JNER, cpu.JEQR, cpu.JLTR, cpu.JGTR, cpu.JGTER, cpu.JLTER:
+			res = append(res, d.target)
+		}
+	}
+	return res
+}
+
+// decodeStr returns the directive, string and number of words of a str8 or str16 starting at
+// program[pc], if it looks like (printable) text that serializes back to the same words.
+func decodeStr(program []cpu.Operation, pc int) (string, string, int, bool) {
+	if s, words, ok := decodeStrPrefix(program, pc, 1); ok {
+		return "str8", s, words, true
+	}
+	if s, words, ok := decodeStrPrefix(program, pc, 2); ok {
+		return "str16", s, words, true
+	}
+	return "", "", 0, false
+}
+
+// decodeStrPrefix decodes the string with a prefix bytes length (1 for str8, 2 for str16).
+func decodeStrPrefix(program []cpu.Operation, pc, prefix int) (string, int, bool) {
+	l := int(program[pc] & (1<<(8*prefix) - 1))
+	if l == 0 {
+		return "", 0, false
+	}
+	words := (prefix + l + cpu.OperationSize - 1) / cpu.OperationSize
+	if pc+words > len(program) {
+		return "", 0, false
+	}
+	buf := make([]byte, 0, words*cpu.OperationSize)
+	for i := range words {
+		for b := range cpu.OperationSize {
+			buf = append(buf, byte(program[pc+i]>>(8*b)))
+		}
+	}
+	s := buf[prefix : prefix+l]
+	if !utf8.Valid(s) {
+		return "", 0, false
+	}
+	for _, r := range string(s) {
+		if r != '\n' && r != '\t' && !strconv.IsPrint(r) {
+			return "", 0, false
+		}
+	}
+	ops := cpu.SerializeStr8
+	if prefix == 2 {
+		ops = cpu.SerializeStr16
+	}
+	for i, op := range ops(s) {
+		if op != program[pc+i] {
+			return "", 0, false
+		}
+	}
+	return string(s), words, true
+}
+
+// Listing is a disassembled program: the assembly for each word and the generated labels.
+type Listing struct {
+	// Lines has the assembly for each word, empty for the continuation words of a multi words str8 or str16
+	// and the address words of the R conditional jumps.
+	Lines []string
+	// Code is true for the words decoded as instructions.
+	Code []bool
+	// Labels maps the PCs that are targets of relative operands to their (generated) label, but
+	// for the address words of the R conditional jumps (see NewListing).
+	Labels map[int]string
+}
+
+// NewListing disassembles program. Words reachable from the entries (PCs) are decoded as
+// instructions, the rest as str8, str16 or data. Relative targets get generated labels, but
+// the ones on the address word of an R conditional jump, which can't have a label of their
+// own, are referenced as the jump's label + 1.
+func NewListing(program []cpu.Operation, entries ...int) *Listing {
+	n := len(program)
+	decoded := make([]disasmOp, n)
+	l := &Listing{
+		Lines:  make([]string, n),
+		Code:   make([]bool, n),
+		Labels: make(map[int]string),
+	}
+	todo := slices.Clone(entries)
+	for len(todo) > 0 {
+		pc := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if pc < 0 || pc >= n || l.Code[pc] {
+			continue
+		}
+		d, ok := decodeOp(program, pc)
+		if !ok {
+			log.LogVf("Not an instruction at PC %d: %x", pc, program[pc])
+			continue
+		}
+		l.Code[pc] = true
+		decoded[pc] = d
+		if d.hasTarget {
+			l.Labels[d.target] = fmt.Sprintf("L%04d", d.target)
+		}
+		if d.hasAddr {
+			l.Labels[d.addr] = fmt.Sprintf("L%04d", d.addr)
+		}
+		todo = append(todo, d.successors(pc, program[pc].Opcode())...)
+	}
+	for pc := range l.Labels {
+		if pc > 0 && l.Code[pc-1] && decoded[pc-1].addrWord {
+			delete(l.Labels, pc)
+			l.Labels[pc-1] = fmt.Sprintf("L%04d", pc-1)
+		}
+	}
+	ref := func(pc int) string {
+		if label, ok := l.Labels[pc]; ok {
+			return label
+		}
+		return l.Labels[pc-1] + "+1"
+	}
+	var sb strings.Builder
+	for pc := 0; pc < n; pc++ {
+		sb.Reset()
+		if !l.Code[pc] {
+			if directive, s, words, ok := decodeStr(program, pc); ok && !spansLabelOrCode(l.Labels, l.Code, pc, words) {
+				l.Lines[pc] = directive + " " + strconv.Quote(s)
+				pc += words - 1
+				continue
+			}
+			l.Lines[pc] = fmt.Sprintf("data %d", int64(program[pc]))
+			continue
+		}
+		d := decoded[pc]
+		sb.WriteString(d.name)
+		if d.targetFirst {
+			sb.WriteString(" ")
+			sb.WriteString(ref(d.target))
+		}
+		if d.hasAddr {
+			sb.WriteString(" ")
+			sb.WriteString(ref(d.addr))
+		}
+		for _, a := range d.args {
+			fmt.Fprintf(&sb, " %d", a)
+		}
+		if d.hasTarget && !d.targetFirst {
+			sb.WriteString(" ")
+			sb.WriteString(ref(d.target))
+		}
+		l.Lines[pc] = sb.String()
+		if d.addrWord {
+			pc++ // part of the instruction, its line stays empty.
+		}
+	}
+	return l
+}
+
+// Disassemble writes the assembly source for program, starting at the entries, to w.
+func Disassemble(w io.Writer, program []cpu.Operation, entries ...int) error {
+	l := NewListing(program, entries...)
+	var sb strings.Builder
+	for pc, line := range l.Lines {
+		if label, ok := l.Labels[pc]; ok {
+			sb.WriteString(label)
+			sb.WriteString(":\n")
+		}
+		if line == "" {
+			continue
+		}
+		sb.WriteString("    ")
+		sb.WriteString(line)
+		sb.WriteString("\n")
+	}
+	if label, ok := l.Labels[len(l.Lines)]; ok {
+		sb.WriteString(label)
+		sb.WriteString(":\n")
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// spansLabelOrCode checks whether any of the words after the first one of a multi words
+// string need a label or are code.
+func spansLabelOrCode(labels map[int]string, code []bool, pc, words int) bool {
+	for i := pc + 1; i < pc+words; i++ {
+		if _, ok := labels[i]; ok || code[i] {
+			return true
+		}
+	}
+	return false
+}
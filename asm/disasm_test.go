@@ -0,0 +1,137 @@
+package asm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"grol.io/vm/cpu"
+)
+
+// assemble compiles src and returns the resulting program.
+func assemble(t *testing.T, src string) []cpu.Operation {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	// .import finds the libraries in programs/.
+	if res := compile(Options{IncludePath: []string{"../programs"}}, bufio.NewReader(strings.NewReader(src)), writer); res != 0 {
+		t.Fatalf("compile failed with %d for:\n%s", res, src)
+	}
+	_ = writer.Flush()
+	program := make([]cpu.Operation, buf.Len()/cpu.OperationSize)
+	if err := binary.Read(&buf, binary.LittleEndian, program); err != nil {
+		t.Fatalf("failed to read back program: %v", err)
+	}
+	return program
+}
+
+func TestDisassembleRoundTrip(t *testing.T) {
+	files, err := filepath.Glob("../programs/*.asm")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no programs found: %v", err)
+	}
+	itoa, err := os.ReadFile("../programs/itoa.asm")
+	if err != nil {
+		t.Fatalf("failed to read itoa.asm: %v", err)
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			src, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", file, err)
+			}
+			if filepath.Base(file) == "fact.asm" {
+				src = append(src, itoa...)
+			}
+			program := assemble(t, string(src))
+			var out bytes.Buffer
+			if err = Disassemble(&out, program, 0); err != nil {
+				t.Fatalf("Disassemble failed: %v", err)
+			}
+			again := assemble(t, out.String())
+			if len(again) != len(program) {
+				t.Fatalf("round trip length mismatch: %d vs %d\n%s", len(again), len(program), out.String())
+			}
+			for i := range program {
+				if again[i] != program[i] {
+					t.Errorf("round trip mismatch at %d: %x vs %x", i, again[i], program[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	src := `
+    LoadI 3
+loop:
+    AddI -1
+    JNE 0 loop
+    Sys Write8 msg
+    Sys Exit 0
+msg:
+    str8 "hi"
+`
+	var out bytes.Buffer
+	if err := Disassemble(&out, assemble(t, src), 0); err != nil {
+		t.Fatalf("Disassemble failed: %v", err)
+	}
+	expected := `    LoadI 3
+L0001:
+    AddI -1
+    JNE 0 L0001
+    Sys Write8 L0005
+    Sys Exit 0
+L0005:
+    str8 "hi"
+`
+	if out.String() != expected {
+		t.Errorf("Disassemble got:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+}
+
+func TestDisassembleAddressWordTarget(t *testing.T) {
+	src := `
+    LoadR jump+1
+jump:
+    JEQR value done
+    Sys Exit 1
+done:
+    Sys Exit 0
+value:
+    data 5
+`
+	program := assemble(t, src)
+	var out bytes.Buffer
+	if err := Disassemble(&out, program, 0); err != nil {
+		t.Fatalf("Disassemble failed: %v", err)
+	}
+	expected := `    LoadR L0001+1
+L0001:
+    JEQR L0005 L0004
+    Sys Exit 1
+L0004:
+    Sys Exit 0
+L0005:
+    data 5
+`
+	if out.String() != expected {
+		t.Errorf("Disassemble got:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+	if again := assemble(t, out.String()); !slices.Equal(again, program) {
+		t.Errorf("round trip mismatch: %x vs %x", again, program)
+	}
+}
+
+func TestListingEntry(t *testing.T) {
+	program := assemble(t, "    data 0\n    Sys Exit 0\n")
+	l := NewListing(program, 1)
+	if l.Code[0] || !l.Code[1] || l.Lines[0] != "data 0" || l.Lines[1] != "Sys Exit 0" {
+		t.Errorf("unexpected listing from entry 1: %+v", l)
+	}
+}
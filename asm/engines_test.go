@@ -0,0 +1,56 @@
+package asm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"grol.io/vm/cpu"
+)
+
+// TestProgramsEngines runs the sample programs with each engine and checks they all behave
+// like the reference switch engine.
+func TestProgramsEngines(t *testing.T) {
+	files, err := filepath.Glob("../programs/*.asm")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no programs found: %v", err)
+	}
+	itoa, err := os.ReadFile("../programs/itoa.asm")
+	if err != nil {
+		t.Fatalf("failed to read itoa.asm: %v", err)
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			src, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", file, err)
+			}
+			if filepath.Base(file) == "fact.asm" {
+				src = append(src, itoa...)
+			}
+			program := assemble(t, string(src))
+			expected := runWith(cpu.SwitchEngine, program)
+			for _, engine := range []cpu.Engine{cpu.ThreadedEngine, cpu.JITEngine} {
+				if got := runWith(engine, program); got != expected {
+					t.Errorf("%v engine got:\n%s\nswitch engine got:\n%s", engine, got, expected)
+				}
+			}
+		})
+	}
+}
+
+// runWith executes a copy of program, for at most 2 million instructions, and describes the outcome.
+func runWith(engine cpu.Engine, program []cpu.Operation) string {
+	var out, errOut bytes.Buffer
+	c := cpu.NewCPU(strings.NewReader("some input\nfor cat\n"), &out, &errOut)
+	c.Program = append([]cpu.Operation(nil), program...)
+	c.Engine = engine
+	c.MaxInstructions = 2_000_000
+	code, err := c.Execute(context.Background())
+	return fmt.Sprintf("code %d err %v A %d PC %d SP %d executed %d\nout %q err %q",
+		code, err, c.Accumulator, c.PC, c.StackPtr, c.Executed, out.String(), errOut.String())
+}
@@ -0,0 +1,371 @@
+package asm
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+
+	"grol.io/vm/cpu"
+)
+
+// maxConstantDepth limits .equ constants using constants, to stop recursive ones.
+const maxConstantDepth = 64
+
+// value is the result of an expression: a number plus, for each label used, its address. addrs
+// is the number of label addresses added (minus the subtracted ones): 0 for a constant (e.g.
+// `end-start`) and 1 for an address (e.g. `label+2`), which operands use relative to their PC.
+type value struct {
+	n     int64
+	addrs int64
+}
+
+// expr is a parsed operand expression.
+type expr interface {
+	eval(s *symbols, depth int) (value, error)
+}
+
+type (
+	number  int64
+	name    string
+	sizeof  string // sizeof(label): length in bytes of the str8 or str16 at label.
+	unaryOp struct {
+		op string
+		x  expr
+	}
+	binaryOp struct {
+		op   string
+		x, y expr
+	}
+)
+
+// unresolvedError is returned for a name which isn't known yet: a label before emitCode.
+type unresolvedError struct {
+	name string
+}
+
+func (e unresolvedError) Error() string {
+	return "unresolved " + e.name
+}
+
+// symbols are the names expressions can use.
+type symbols struct {
+	constants map[string]expr              // .equ
+	strings   map[string]int64             // length of the str8/str16 defined at a label, for sizeof.
+	vars      map[string]cpu.ImmediateData // stack variables, set for the stack instructions.
+	labels    map[string]cpu.ImmediateData // set for emitCode, once all the labels are defined.
+}
+
+func newSymbols() *symbols {
+	return &symbols{constants: make(map[string]expr), strings: make(map[string]int64)}
+}
+
+func (n number) eval(*symbols, int) (value, error) {
+	return value{n: int64(n)}, nil
+}
+
+func (n name) eval(s *symbols, depth int) (value, error) {
+	if idx, ok := s.vars[string(n)]; ok {
+		return value{n: int64(idx)}, nil
+	}
+	if e, ok := s.constants[string(n)]; ok {
+		if depth > maxConstantDepth {
+			return value{}, fmt.Errorf("too many nested constants for %s (recursive .equ?)", n)
+		}
+		return e.eval(s, depth+1)
+	}
+	if s.labels == nil {
+		return value{}, unresolvedError{string(n)}
+	}
+	addr, ok := s.labels[string(n)]
+	if !ok {
+		return value{}, fmt.Errorf("unknown label or constant %s", n)
+	}
+	return value{n: int64(addr), addrs: 1}, nil
+}
+
+func (n sizeof) eval(s *symbols, _ int) (value, error) {
+	if l, ok := s.strings[string(n)]; ok {
+		return value{n: l}, nil
+	}
+	if s.labels == nil {
+		return value{}, unresolvedError{string(n)}
+	}
+	return value{}, fmt.Errorf("sizeof(%s): %s isn't the label of a str8 or str16", n, n)
+}
+
+func (u unaryOp) eval(s *symbols, depth int) (value, error) {
+	v, err := u.x.eval(s, depth)
+	if u.op == "-" {
+		v.n, v.addrs = -v.n, -v.addrs
+	}
+	return v, err
+}
+
+func (b binaryOp) eval(s *symbols, depth int) (value, error) {
+	x, err := b.x.eval(s, depth)
+	if err != nil {
+		return x, err
+	}
+	y, err := b.y.eval(s, depth)
+	if err != nil {
+		return y, err
+	}
+	switch b.op {
+	case "+":
+		return value{x.n + y.n, x.addrs + y.addrs}, nil
+	case "-":
+		return value{x.n - y.n, x.addrs - y.addrs}, nil
+	case "*":
+		if x.addrs == 0 {
+			return value{x.n * y.n, x.n * y.addrs}, nil
+		}
+		if y.addrs == 0 {
+			return value{x.n * y.n, x.addrs * y.n}, nil
+		}
+	}
+	if x.addrs != 0 || y.addrs != 0 {
+		return value{}, fmt.Errorf("invalid %s of a label address", b.op)
+	}
+	switch b.op {
+	case "/":
+		if y.n == 0 {
+			return value{}, errors.New("division by 0")
+		}
+		return value{n: x.n / y.n}, nil
+	case "<<", ">>":
+		if y.n < 0 || y.n > 63 {
+			return value{}, fmt.Errorf("shift count %d out of range (0 to 63)", y.n)
+		}
+		if b.op == "<<" {
+			return value{n: x.n << y.n}, nil
+		}
+		return value{n: x.n >> y.n}, nil
+	case "&":
+		return value{n: x.n & y.n}, nil
+	default: // "|"
+		return value{n: x.n | y.n}, nil
+	}
+}
+
+// exprParser parses the tokens of an expression, by increasing precedence: |, &, << and >>,
+// + and -, * and /, then unary - and +, numbers, names, sizeof(label) and parentheses.
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+// operators by precedence level, lowest first.
+var operators = [][]string{{"|"}, {"&"}, {"<<", ">>"}, {"+", "-"}, {"*", "/"}}
+
+// parseExpr parses an operand expression.
+func parseExpr(s string) (expr, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("empty expression")
+	}
+	p := &exprParser{tokens: tokens}
+	e, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(tokens) {
+		return nil, fmt.Errorf("unexpected %q in %q", tokens[p.pos], s)
+	}
+	return e, nil
+}
+
+func isNameStart(r rune) bool {
+	return unicode.IsLetter(r) || r == '_' || r == '.'
+}
+
+func isNameRune(r rune) bool {
+	return isNameStart(r) || unicode.IsDigit(r) || r == '@'
+}
+
+func tokenize(s string) ([]string, error) {
+	var tokens []string
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case unicode.IsDigit(r):
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+		case isNameStart(r):
+			for i < len(runes) && isNameRune(runes[i]) {
+				i++
+			}
+		case strings.ContainsRune("+-*/&|()", r):
+			i++
+		case (r == '<' || r == '>') && i+1 < len(runes) && runes[i+1] == r:
+			i += 2
+		default:
+			return nil, fmt.Errorf("unexpected %q in %q", r, s)
+		}
+		tokens = append(tokens, string(runes[start:i]))
+	}
+	return tokens, nil
+}
+
+// mapTokens returns s with each of its numbers and names (as tokenized for the expressions)
+// replaced by the result of fn, the rest is kept as is.
+func mapTokens(s string, fn func(token string) string) string {
+	var sb strings.Builder
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		start := i
+		switch {
+		case unicode.IsDigit(runes[i]):
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+		case isNameStart(runes[i]):
+			for i < len(runes) && isNameRune(runes[i]) {
+				i++
+			}
+		default:
+			i++
+			sb.WriteRune(runes[start])
+			continue
+		}
+		sb.WriteString(fn(string(runes[start:i])))
+	}
+	return sb.String()
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) expect(token string) error {
+	if p.peek() != token {
+		return fmt.Errorf("expected %q, got %q", token, p.peek())
+	}
+	p.pos++
+	return nil
+}
+
+func (p *exprParser) binary(level int) (expr, error) {
+	if level == len(operators) {
+		return p.unary()
+	}
+	x, err := p.binary(level + 1)
+	for err == nil {
+		op := p.peek()
+		if !slices.Contains(operators[level], op) {
+			break
+		}
+		p.pos++
+		var y expr
+		y, err = p.binary(level + 1)
+		x = binaryOp{op, x, y}
+	}
+	return x, err
+}
+
+func (p *exprParser) unary() (expr, error) {
+	token := p.peek()
+	p.pos++
+	switch {
+	case token == "-" || token == "+":
+		if next := p.peek(); next != "" && unicode.IsDigit(rune(next[0])) && token == "-" {
+			// so the most negative number can be written.
+			p.pos++
+			v, err := parseArg("-" + next)
+			return number(v), err
+		}
+		x, err := p.unary()
+		return unaryOp{token, x}, err
+	case token == "(":
+		x, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	case token == "sizeof":
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		label := p.peek()
+		if label == "" || !isNameStart(rune(label[0])) {
+			return nil, fmt.Errorf("expected a label in sizeof, got %q", label)
+		}
+		p.pos++
+		return sizeof(label), p.expect(")")
+	case token == "":
+		return nil, errors.New("unexpected end of expression")
+	case unicode.IsDigit(rune(token[0])):
+		v, err := parseArg(token)
+		return number(v), err
+	case isNameStart(rune(token[0])):
+		return name(token), nil
+	}
+	return nil, fmt.Errorf("unexpected %q", token)
+}
+
+// operand parses arg, returning its value when it can already be computed, else the label
+// (when it's just a label) or the expression to resolve in emitCode.
+func (s *symbols) operand(arg string) (int64, string, expr, error) {
+	e, err := parseExpr(arg)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	if n, ok := e.(name); ok {
+		if _, isConstant := s.constants[string(n)]; !isConstant {
+			if _, isVar := s.vars[string(n)]; !isVar {
+				return 0, string(n), nil, nil
+			}
+		}
+	}
+	v, err := e.eval(s, 0)
+	var unresolved unresolvedError
+	if errors.As(err, &unresolved) {
+		return 0, "", e, nil
+	}
+	return v.n, "", nil, err
+}
+
+// constant returns the value of arg, which can only use constants (and stack variables when
+// set), not labels.
+func (s *symbols) constant(arg string) (int64, error) {
+	e, err := parseExpr(arg)
+	if err != nil {
+		return 0, err
+	}
+	v, err := e.eval(s, 0)
+	var unresolved unresolvedError
+	if errors.As(err, &unresolved) {
+		if s.vars != nil {
+			return 0, fmt.Errorf("unknown stack variable or constant %s", unresolved.name)
+		}
+		return 0, fmt.Errorf("%s isn't a constant", unresolved.name)
+	}
+	return v.n, err
+}
+
+// setOperand sets v as the operand of op, the 48 bits one if is48bit, checking that it fits.
+func setOperand(op cpu.Operation, v int64, is48bit bool) (cpu.Operation, error) {
+	if is48bit {
+		if v > (1<<47)-1 || v < -(1<<47) {
+			return op, fmt.Errorf("%d doesn't fit in the 48 bits operand", v)
+		}
+		return op.Set48BitsOperand(cpu.ImmediateData(v)), nil
+	}
+	if v > (1<<55)-1 || v < -(1<<55) {
+		return op, fmt.Errorf("%d doesn't fit in the 56 bits operand", v)
+	}
+	return op.SetOperand(cpu.ImmediateData(v)), nil
+}
@@ -0,0 +1,135 @@
+package asm
+
+import (
+	"bufio"
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+
+	"grol.io/vm/cpu"
+)
+
+func TestExpressions(t *testing.T) {
+	syms := newSymbols()
+	syms.constants["TEN"] = number(10)
+	syms.constants["TWENTY"] = binaryOp{"*", name("TEN"), number(2)}
+	syms.strings["msg"] = 5
+	syms.labels = map[string]cpu.ImmediateData{"start": 3, "end": 10}
+	tests := []struct {
+		expr     string
+		expected value
+	}{
+		{"42", value{n: 42}},
+		{"0x10 + 0b11", value{n: 19}},
+		{"1 + 2 * 3", value{n: 7}},
+		{"(1 + 2) * 3", value{n: 9}},
+		{"1 << 4 | 3 & 1", value{n: 17}},
+		{"-8 >> 1", value{n: -4}},
+		{"- (2 - 5)", value{n: 3}},
+		{"-9223372036854775808", value{n: -9223372036854775808}},
+		{"7 / 2 - 1", value{n: 2}},
+		{"TWENTY + TEN", value{n: 30}},
+		{"sizeof(msg) + 1", value{n: 6}},
+		{"end - start", value{n: 7}},
+		{"start + 2", value{n: 5, addrs: 1}},
+		{"2 * end - start - end", value{n: 7, addrs: 0}},
+	}
+	for _, tt := range tests {
+		e, err := parseExpr(tt.expr)
+		if err != nil {
+			t.Errorf("parse %q failed: %v", tt.expr, err)
+			continue
+		}
+		got, err := e.eval(syms, 0)
+		if err != nil || got != tt.expected {
+			t.Errorf("%q = %+v, %v expected %+v", tt.expr, got, err, tt.expected)
+		}
+	}
+	for _, bad := range []string{"", "1 +", "(1", "1)", "1 $ 2", "sizeof msg", "sizeof(1)", "1 < 2", "0x1g"} {
+		if _, err := parseExpr(bad); err == nil {
+			t.Errorf("expected a parse error for %q", bad)
+		}
+	}
+	for _, bad := range []string{"1 / 0", "start * end", "start / 2", "start | 1", "sizeof(end)", "missing", "1 << -1", "1 << 64", "-8 >> 200"} {
+		e, err := parseExpr(bad)
+		if err != nil {
+			t.Fatalf("parse %q failed: %v", bad, err)
+		}
+		if v, err := e.eval(syms, 0); err == nil {
+			t.Errorf("expected an error evaluating %q, got %+v", bad, v)
+		}
+	}
+}
+
+func TestCompileExpressions(t *testing.T) {
+	src := `
+.equ COUNT 3
+.equ LAST COUNT - 1 ; constants can use constants
+.macro load2x n
+    loadi n*2
+.endm
+    load2x 1+1
+    loadi (1 << 4) | COUNT
+    loadi end - start
+    loadr msg + 1
+    jne LAST-2 start
+    var a b
+    loads b + 1 - 1
+    incrs 1-COUNT a
+start:
+    sys write8 msg
+end:
+    sys exit sizeof(msg)
+    data end-start
+msg:
+    str8 "hello"
+`
+	expanded := `
+    loadi 4
+    loadi 19
+    loadi 1
+    loadr 9 ; msg + 1 relative to PC 3
+    jne 0 start
+    push 1
+    loads 1
+    incrs -2 0
+start:
+    sys write8 msg
+    sys exit 5
+    data 1
+msg:
+    str8 "hello"
+`
+	got, expected := assemble(t, src), assemble(t, expanded)
+	if !slices.Equal(got, expected) {
+		t.Errorf("got %x, expected %x", got, expected)
+	}
+}
+
+func TestCompileExpressionErrors(t *testing.T) {
+	for _, src := range []string{
+		"  loadi 1 << 55\n",               // doesn't fit in 56 bits.
+		"  jne 0 1 << 47\n",               // 48 bits.
+		"  jnes 1<<8 x\nx:\n",             // 8 bits.
+		"  incrr 128 x\nx:\n  data 0\n",   // 8 bits signed.
+		"  loadi 1 2\n",                   // not an expression.
+		"  loadi x + x\nx:\n",             // 2 addresses.
+		"  data x\nx:\n",                  // address as data.
+		"  loadi sizeof(x)\nx:\n  data 0", // not a str8.
+		"  .equ A A + 1\n  loadi A\n",     // recursive.
+		"  .equ A 1\n  .equ A 2\n",        // duplicate.
+		"  .equ 1A 1\n",
+		"  .equ A\n",
+		"  .space x\nx:\n",  // labels aren't constants.
+		"  loads x\n",       // not a stack variable.
+		"  loadi y\n",       // unknown label.
+		"  loadi 1 << -1\n", // negative shift count.
+		"  loadi 1 << 200\n",
+	} {
+		var buf bytes.Buffer
+		if res := compile(Options{}, bufio.NewReader(strings.NewReader(src)), bufio.NewWriter(&buf)); res == 0 {
+			t.Errorf("expected an error compiling %q", src)
+		}
+	}
+}
@@ -2,27 +2,42 @@ package asm
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"strings"
 
+	"fortio.org/log"
 	"grol.io/vm/cpu"
 )
 
+// GenHeader prints the C header for the C VM (vm genh).
 func GenHeader() int {
-	fmt.Printf(`
+	if err := WriteHeader(os.Stdout); err != nil {
+		return log.FErrf("Failed to write header: %v", err)
+	}
+	return 0
+}
+
+// WriteHeader writes the C enums for the instructions and syscalls to w.
+func WriteHeader(w io.Writer) error {
+	var sb strings.Builder
+	sb.WriteString(`
 // Autogenerated (by vm genh) - DO NOT EDIT
 
 enum Instruction {
 `)
 	extra := " = 1"
 	for i := cpu.InvalidInstruction + 1; i < cpu.LastInstruction; i++ {
-		fmt.Printf("  %v%s,\n", i, extra)
+		fmt.Fprintf(&sb, "  %v%s,\n", i, extra)
 		extra = ""
 	}
-	fmt.Printf("};\n\nenum Syscall {\n")
+	sb.WriteString("};\n\nenum Syscall {\n")
 	extra = " = 1"
 	for i := cpu.InvalidSyscall + 1; i < cpu.LastSyscall; i++ {
-		fmt.Printf("  %v%s,\n", i, extra)
+		fmt.Fprintf(&sb, "  %v%s,\n", i, extra)
 		extra = ""
 	}
-	fmt.Printf("};\n")
-	return 0
+	sb.WriteString("};\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
 }
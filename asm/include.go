@@ -0,0 +1,61 @@
+package asm
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// findFile returns the path of the file name used by .include or .import in the source file
+// from: relative to its directory first, then to each of the include path directories.
+func findFile(name, from string, includePath []string) (string, error) {
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+	dirs := append([]string{filepath.Dir(from)}, includePath...)
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in %s", name, strings.Join(dirs, ", "))
+}
+
+// sameFile is true when a and b are the same path, once made absolute.
+func sameFile(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// includeChain returns the files including src, outermost first, followed by src's.
+func (s *source) includeChain() []string {
+	var chain []string
+	for p := s; p != nil; p = p.parent {
+		chain = append([]string{p.file}, chain...)
+	}
+	return chain
+}
+
+// include opens the file name for a .include in s, checking it isn't already being included.
+func (s *source) include(name string, includePath []string) (*source, *os.File, error) {
+	path, err := findFile(name, s.file, includePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	for p := s; p != nil; p = p.parent {
+		if sameFile(p.file, path) {
+			return nil, nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(s.includeChain(), " -> "), path)
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	inc := newSource(path, bufio.NewReader(f))
+	inc.parent = s
+	return inc, f, nil
+}
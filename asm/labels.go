@@ -0,0 +1,64 @@
+package asm
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// labelScope names the local labels: `.name` ones belong to the last global label (so they are
+// named global.name) and numeric ones (`1:`) are used as `1f` for the next one and `1b` for the
+// previous one, so the same local names can be used in every function.
+type labelScope struct {
+	global  string
+	numeric map[string]int // number of definitions of each numeric label so far.
+}
+
+func newLabelScope() *labelScope {
+	return &labelScope{numeric: make(map[string]int)}
+}
+
+func isNumeric(s string) bool {
+	return s != "" && strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) }) < 0
+}
+
+// numericLabel is the name of the count-th definition of the numeric label n.
+func numericLabel(n string, count int) string {
+	return fmt.Sprintf("_%s@%d", n, count)
+}
+
+// define returns the name of the label defined by `label:`.
+func (s *labelScope) define(label string) string {
+	switch {
+	case isNumeric(label):
+		count := s.numeric[label]
+		s.numeric[label]++
+		return numericLabel(label, count)
+	case strings.HasPrefix(label, "."):
+		return s.global + label
+	case !strings.Contains(label, "@"): // not a macro local label.
+		s.global = label
+	}
+	return label
+}
+
+// qualify returns the operand arg with the local labels replaced by their names.
+func (s *labelScope) qualify(arg string) (string, error) {
+	var err error
+	result := mapTokens(arg, func(token string) string {
+		switch last := len(token) - 1; {
+		case strings.HasPrefix(token, "."):
+			return s.global + token
+		case last > 0 && token[last] == 'f' && isNumeric(token[:last]):
+			return numericLabel(token[:last], s.numeric[token[:last]])
+		case last > 0 && token[last] == 'b' && isNumeric(token[:last]):
+			count := s.numeric[token[:last]]
+			if count == 0 {
+				err = fmt.Errorf("no %s: label before %s", token[:last], token)
+			}
+			return numericLabel(token[:last], count-1)
+		}
+		return token
+	})
+	return result, err
+}
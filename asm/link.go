@@ -0,0 +1,169 @@
+package asm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"fortio.org/log"
+	"grol.io/vm/cpu"
+)
+
+// Link links the object files (from Compile with Options.Object) into a program written next to
+// the first one with the .vm extension, in the opts.FormatVersion format.
+func Link(opts Options, files ...string) int {
+	if len(files) == 0 {
+		return log.FErrf("Link needs at least 1 object file")
+	}
+	objects := make([]*cpu.Image, 0, len(files))
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".o") {
+			return log.FErrf("Invalid file extension for %s, expected .o", file)
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return log.FErrf("Failed to open file %s: %v", file, err)
+		}
+		obj, err := cpu.ReadObject(f)
+		f.Close()
+		if err != nil {
+			return log.FErrf("Failed to read object %s: %v", file, err)
+		}
+		objects = append(objects, obj)
+	}
+	img, err := LinkObjects(files, objects)
+	if err != nil {
+		return log.FErrf("Link failed:\n%v", err)
+	}
+	output := strings.TrimSuffix(files[0], ".o") + ".vm"
+	log.Infof("Linking %d objects (%d words) into %s", len(objects), len(img.Code)+len(img.Data), output)
+	out, err := os.Create(output)
+	if err != nil {
+		return log.FErrf("Failed to create output file %s: %v", output, err)
+	}
+	defer out.Close()
+	writer := bufio.NewWriter(out)
+	if opts.FormatVersion == 2 {
+		err = img.Write(writer)
+	} else {
+		_, _ = writer.WriteString(cpu.HEADER)
+		err = binary.Write(writer, binary.LittleEndian, img.Memory())
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		return log.FErrf("Failed to write %s: %v", output, err)
+	}
+	return 0
+}
+
+// LinkObjects places the objects one after the other, in order (so the program starts with
+// the first one), and patches the operands using imported symbols with their relative
+// address. files are the names of the objects for the errors: all the undefined and duplicate
+// symbols and the addresses not fitting their operand are reported. The exported symbols keep
+// their name in the program's symbols, the other labels get their object's as prefix (e.g.
+// `fact.o:print`).
+func LinkObjects(files []string, objects []*cpu.Image) (*cpu.Image, error) {
+	type definition struct {
+		object int
+		addr   cpu.ImmediateData
+	}
+	bases := make([]cpu.ImmediateData, len(objects))
+	defined := make(map[string]definition)
+	definers := make(map[string][]string)
+	var errs []error
+	img := &cpu.Image{Version: 2, Entry: objects[0].Entry}
+	base := cpu.ImmediateData(0)
+	for i, obj := range objects {
+		bases[i] = base
+		for _, name := range obj.Exports {
+			idx := slices.IndexFunc(obj.Symbols, func(s cpu.Symbol) bool { return s.Name == name })
+			if idx < 0 {
+				errs = append(errs, fmt.Errorf("exported symbol %s has no address in %s", name, files[i]))
+				continue
+			}
+			defined[name] = definition{i, base + obj.Symbols[idx].Address}
+			definers[name] = append(definers[name], files[i])
+		}
+		for _, s := range obj.Symbols {
+			name := s.Name
+			if !slices.Contains(obj.Exports, name) {
+				name = filepath.Base(files[i]) + ":" + name
+			}
+			img.Symbols = append(img.Symbols, cpu.Symbol{Name: name, Address: base + s.Address})
+		}
+		img.StackSize = max(img.StackSize, obj.StackSize)
+		img.ISA = max(img.ISA, obj.ISA)
+		base += cpu.ImmediateData(len(obj.Code) + len(obj.Data))
+	}
+	for _, name := range sortedKeys(definers) {
+		if files := definers[name]; len(files) > 1 {
+			errs = append(errs, fmt.Errorf("duplicate symbol %s exported by %s", name, strings.Join(files, ", ")))
+		}
+	}
+	undefined := make(map[string][]string)
+	for i, obj := range objects {
+		for _, name := range obj.Imports {
+			if _, ok := defined[name]; !ok {
+				undefined[name] = append(undefined[name], files[i])
+			}
+		}
+	}
+	for _, name := range sortedKeys(undefined) {
+		errs = append(errs, fmt.Errorf("undefined symbol %s imported by %s", name, strings.Join(undefined[name], ", ")))
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	memory := make([]cpu.Operation, 0, base)
+	var debug cpu.DebugInfo
+	hasDebug := false
+	for i, obj := range objects {
+		words := obj.Memory()
+		for _, r := range obj.Relocations {
+			name := obj.Imports[r.Import]
+			relativePC := defined[name].addr - (bases[i] + r.PC)
+			op, err := setOperand(words[r.PC], int64(relativePC), r.Is48bit)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("symbol %s used at PC %d in %s: %w", name, r.PC, files[i], err))
+			}
+			words[r.PC] = op
+		}
+		memory = append(memory, words...)
+		info := make(cpu.DebugInfo, len(words))
+		if len(obj.Debug) > 0 {
+			decoded, err := cpu.DecodeDebugInfo(obj.Debug)
+			if err != nil {
+				return nil, fmt.Errorf("invalid debug info in %s: %w", files[i], err)
+			}
+			copy(info, decoded)
+			hasDebug = true
+		}
+		debug = append(debug, info...)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if hasDebug {
+		img.Debug = debug.Encode()
+	}
+	// Only the last object's data is at the end of the program.
+	codeSize := len(memory) - len(objects[len(objects)-1].Data)
+	img.Code, img.Data = memory[:codeSize], memory[codeSize:]
+	return img, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
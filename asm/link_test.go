@@ -0,0 +1,125 @@
+package asm
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"grol.io/vm/cpu"
+)
+
+// object assembles src as an object file and reads it back.
+func object(t *testing.T, name, src string) *cpu.Image {
+	t.Helper()
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if res := compileSources(Options{Object: true}, w, newSource(name, bufio.NewReader(strings.NewReader(src)))); res != 0 {
+		t.Fatalf("compile of %s failed with %d", name, res)
+	}
+	_ = w.Flush()
+	img, err := cpu.ReadObject(&buf)
+	if err != nil {
+		t.Fatalf("failed to read object %s: %v", name, err)
+	}
+	return img
+}
+
+func TestLinkFact(t *testing.T) {
+	fact, err := os.ReadFile("../programs/fact.asm")
+	if err != nil {
+		t.Fatalf("failed to read fact.asm: %v", err)
+	}
+	itoa, err := os.ReadFile("../programs/itoa.asm")
+	if err != nil {
+		t.Fatalf("failed to read itoa.asm: %v", err)
+	}
+	expected := assemble(t, string(fact)+string(itoa))
+	factObj := object(t, "fact.asm", string(fact))
+	itoaObj := object(t, "itoa.asm", string(itoa))
+	if !slices.Equal(factObj.Imports, []string{"itoa"}) || len(factObj.Relocations) != 3 {
+		t.Errorf("unexpected imports %v relocations %v", factObj.Imports, factObj.Relocations)
+	}
+	if !slices.Equal(itoaObj.Exports, []string{"itoa"}) {
+		t.Errorf("unexpected exports %v", itoaObj.Exports)
+	}
+	img, err := LinkObjects([]string{"fact.o", "itoa.o"}, []*cpu.Image{factObj, itoaObj})
+	if err != nil {
+		t.Fatalf("link failed: %v", err)
+	}
+	if !slices.Equal(img.Memory(), expected) {
+		t.Errorf("linked program differs from the whole program compile:\n%x\n%x", img.Memory(), expected)
+	}
+	info, err := cpu.DecodeDebugInfo(img.Debug)
+	if err != nil || len(info) != len(expected) {
+		t.Fatalf("unexpected debug info (%d entries): %v", len(info), err)
+	}
+	if s := info.At(cpu.ImmediateData(len(factObj.Memory()))); s.File != "itoa.asm" {
+		t.Errorf("expected itoa.asm source after fact's code, got %+v", s)
+	}
+	names := make(map[string]int)
+	for _, sym := range img.Symbols {
+		names[sym.Name]++
+	}
+	if names["itoa"] != 1 || names["fact.o:factrec"] != 1 || names["factrec"] != 0 {
+		t.Errorf("expected itoa and the qualified fact.o locals, got %v", img.Symbols)
+	}
+	for name, n := range names {
+		if n != 1 {
+			t.Errorf("symbol %s appears %d times", name, n)
+		}
+	}
+}
+
+func TestLinkErrors(t *testing.T) {
+	main := object(t, "main.asm", ".extern f g\n  call f\n  call g\n  sys exit 0\n")
+	lib1 := object(t, "lib1.asm", ".export f\nf:\n  return\n")
+	lib2 := object(t, "lib2.asm", ".export f\nf:\n  return\nh:\n  return\n")
+	lib3 := object(t, "lib3.asm", ".extern h\n  call h\n")
+	_, err := LinkObjects([]string{"main.o", "lib1.o", "lib2.o", "lib3.o"}, []*cpu.Image{main, lib1, lib2, lib3})
+	if err == nil {
+		t.Fatalf("expected link errors")
+	}
+	expected := "duplicate symbol f exported by lib1.o, lib2.o\n" +
+		"undefined symbol g imported by main.o\n" +
+		"undefined symbol h imported by lib3.o" // h is not exported by lib2.
+	if err.Error() != expected {
+		t.Errorf("got errors:\n%v\nexpected:\n%s", err, expected)
+	}
+}
+
+func TestLinkOperandRange(t *testing.T) {
+	// hand made, as the objects would need to be huge for the distance not to fit.
+	main := &cpu.Image{
+		Code:        []cpu.Operation{cpu.Operation(0).SetOpcode(cpu.Call), cpu.Operation(0).SetOpcode(cpu.Call)},
+		Imports:     []string{"far", "near"},
+		Relocations: []cpu.Relocation{{PC: 0, Import: 0, Is48bit: true}, {PC: 1, Import: 1, Is48bit: true}},
+	}
+	lib := &cpu.Image{
+		Code:    []cpu.Operation{0},
+		Exports: []string{"far", "near"},
+		Symbols: []cpu.Symbol{{Name: "far", Address: 1 << 50}, {Name: "near", Address: 0}},
+	}
+	_, err := LinkObjects([]string{"main.o", "lib.o"}, []*cpu.Image{main, lib})
+	expected := fmt.Sprintf("symbol far used at PC 0 in main.o: %d doesn't fit in the 48 bits operand", 1<<50+2)
+	if err == nil || err.Error() != expected {
+		t.Errorf("got error %v, expected %s", err, expected)
+	}
+}
+
+func TestCompileObjectErrors(t *testing.T) {
+	for _, src := range []string{
+		".export f\n  return\n", // not defined.
+		"  call f\n",            // not declared .extern.
+		".extern\n",
+	} {
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		if res := compileSources(Options{Object: true}, w, newSource("bad.asm", bufio.NewReader(strings.NewReader(src)))); res == 0 {
+			t.Errorf("expected an error compiling %q", src)
+		}
+	}
+}
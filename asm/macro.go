@@ -0,0 +1,151 @@
+package asm
+
+import (
+	"fmt"
+	"strings"
+
+	"grol.io/vm/cpu"
+)
+
+// maxMacroDepth limits macros using macros, to stop recursive ones.
+const maxMacroDepth = 64
+
+// statement is a parsed source line: its fields and where it comes from.
+type statement struct {
+	fields    []string
+	pos       cpu.SourceInfo
+	tokens    []tokenPos // of the fields, when known.
+	expansion *expansion // nil unless it comes from a macro.
+}
+
+// at returns the position of the i-th field, for the errors about it.
+func (st statement) at(i int) cpu.SourceInfo {
+	pos := st.pos
+	if i >= 0 && i < len(st.tokens) {
+		pos.Line, pos.Column = st.tokens[i].line, st.tokens[i].column
+	}
+	return pos
+}
+
+// macro is a `.macro name params...` to `.endm` block.
+type macro struct {
+	name   string
+	params []string
+	body   []statement
+	pos    cpu.SourceInfo // of the .macro line.
+	locals map[string]bool
+}
+
+// expansion is one use of a macro.
+type expansion struct {
+	macro  *macro
+	use    cpu.SourceInfo
+	parent *expansion // when used from another macro.
+	depth  int
+}
+
+// position returns "file:line" for the errors.
+func position(pos cpu.SourceInfo) string {
+	return fmt.Sprintf("%s:%d", pos.File, pos.Line)
+}
+
+// describe returns where the statement at pos, from the macro expansion e, comes from: the
+// macro definition and its use(s).
+func (e *expansion) describe(pos cpu.SourceInfo) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "in macro %s at %s (defined at %s), used at %s", e.macro.name, position(pos),
+		position(e.macro.pos), position(e.use))
+	for p := e.parent; p != nil; p = p.parent {
+		if p.depth > 2 && p.parent != nil {
+			continue // only the outermost of deeply nested (recursive) uses.
+		}
+		fmt.Fprintf(&sb, " in macro %s, used at %s", p.macro.name, position(p.use))
+	}
+	return sb.String()
+}
+
+func newMacro(args []string, pos cpu.SourceInfo) (*macro, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf(".macro needs a name")
+	}
+	name := strings.ToLower(args[0])
+	if _, ok := cpu.InstructionFromString(name); ok || isDirective(name) || !isAddressLabel(name) {
+		return nil, fmt.Errorf("invalid macro name %s", args[0])
+	}
+	for _, p := range args[1:] {
+		if !isAddressLabel(p) {
+			return nil, fmt.Errorf("invalid macro %s parameter %s", args[0], p)
+		}
+	}
+	return &macro{name: args[0], params: args[1:], pos: pos, locals: make(map[string]bool)}, nil
+}
+
+// isDirective is true for the assembler only instructions, which can't be macro names.
+func isDirective(name string) bool {
+	switch name {
+	case "data", "str8", "str16", "var", "param", "return":
+		return true
+	}
+	return strings.HasPrefix(name, ".")
+}
+
+// add appends a statement of the body, the labels it defines are local to each expansion.
+func (m *macro) add(st statement) {
+	if label, found := strings.CutSuffix(st.fields[0], ":"); found {
+		m.locals[label] = true
+	}
+	m.body = append(m.body, st)
+}
+
+// expand returns the body of the macro with the parameters replaced by args and the local
+// labels renamed with the unique id of this expansion.
+func (m *macro) expand(args []string, e *expansion, id int) ([]statement, error) {
+	if len(args) != len(m.params) {
+		return nil, fmt.Errorf("macro %s (defined at %s) expects %d arguments, got %d (%v)",
+			m.name, position(m.pos), len(m.params), len(args), args)
+	}
+	if e.depth > maxMacroDepth {
+		return nil, fmt.Errorf("macro %s: too many nested macros (recursive?)", m.name)
+	}
+	values := make(map[string]string, len(m.params)+len(m.locals))
+	for i, p := range m.params {
+		values[p] = args[i]
+	}
+	for label := range m.locals {
+		values[label] = fmt.Sprintf("%s@%d", label, id)
+	}
+	result := make([]statement, 0, len(m.body))
+	for _, st := range m.body {
+		fields := make([]string, len(st.fields))
+		isStr := strings.EqualFold(st.fields[0], "str8") || strings.EqualFold(st.fields[0], "str16")
+		for i, f := range st.fields {
+			switch {
+			case i == 0 && !strings.HasSuffix(f, ":"): // instruction.
+			case isStr:
+				if v, ok := values[f]; ok {
+					f = v // the whole string, not the words in it.
+				}
+			default:
+				f = replaceNames(f, values)
+			}
+			fields[i] = f
+		}
+		result = append(result, statement{fields: fields, pos: st.pos, tokens: st.tokens, expansion: e})
+	}
+	return result, nil
+}
+
+// replaceNames returns the field with the names (as in expressions) found in values replaced,
+// in parentheses when they are expressions used in a bigger one.
+func replaceNames(field string, values map[string]string) string {
+	return mapTokens(field, func(token string) string {
+		v, ok := values[token]
+		if !ok {
+			return token
+		}
+		if tokens, err := tokenize(v); len(token) < len(field) && (err != nil || len(tokens) > 1) {
+			v = "(" + v + ")" // keeps the precedence of the argument expression.
+		}
+		return v
+	})
+}
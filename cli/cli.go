@@ -1,16 +1,21 @@
 // Package cli provides the command-line interface for the Grol VM dispatching commands
-// to either compile (assembler), run (execute), or generate headers for the C VM.
+// to either compile (assembler), link (object files from compile -c), run (execute), resume (from a snapshot), debug (interactive debugger),
+// disasm (disassembler), verify (static checks of .vm files), togo, toc and towasm (ahead-of-time translation to Go, C and WebAssembly), or generate
+// headers for the C VM.
 package cli
 
 import (
 	"flag"
 	"os"
+	"path/filepath"
 	"runtime/pprof"
 
 	"fortio.org/cli"
 	"fortio.org/log"
+	"grol.io/vm/aot"
 	"grol.io/vm/asm"
 	"grol.io/vm/cpu"
+	"grol.io/vm/debugger"
 )
 
 func memProfile(fname string) {
@@ -30,9 +35,25 @@ func Main() int {
 	cli.CommandBeforeFlags = true
 	cli.MinArgs = 0 // no arg to genh
 	cli.MaxArgs = -1
-	cli.ArgsHelp = "[<files>...]\nwhere command is one of: compile, genh, run"
+	cli.ArgsHelp = "[<files>...]\nwhere command is one of: compile, debug, disasm, genh, link, resume, run, toc, togo, towasm, verify"
 	cpuProf := flag.String("profile-cpu", "", "write CPU profile to file")
 	memProf := flag.String("profile-mem", "", "write memory profile to file")
+	stackSize := flag.Int("stack-size", cpu.DefaultStackSize,
+		"stack size in 64-bit words for run, debug, togo, toc and towasm, and for the compile stack index range checks")
+	maxInstructions := flag.Int64("max-instructions", 0, "stop run/resume after that many instructions executed (0 for no limit)")
+	timeout := flag.Duration("timeout", 0, "stop run/resume after that wall-clock `duration` (0 for no timeout)")
+	engine := flag.String("engine", "switch",
+		"interpreter for run and resume: switch (reference), threaded (pre-decoded) or jit (native code on linux/amd64)")
+	jit := flag.Bool("jit", false, "use the JIT for run and resume, same as -engine jit")
+	snapshot := flag.String("snapshot", "", "save the CPU state to that `file` when run or resume is stopped by a limit")
+	formatVersion := flag.Int("format-version", 1,
+		"version of the .vm files written by compile and link: 1 (header and code) or 2 (sections with symbols, stack size...)")
+	includePath := flag.String("include-path", "",
+		"directories (separated by "+string(os.PathListSeparator)+") searched by compile for the .include and .import files")
+	diagFormat := flag.String("diag-format", "text",
+		"format of the compile errors: text (file:line:column: message) or json (one object per line on stdout)")
+	object := flag.Bool("c", false, "compile each file into an object file (.o) to link with the link command")
+	verify := flag.Bool("verify", false, "verify the programs before running them (see the verify command)")
 	cli.Main()
 	log.Debugf("Command: %s, Args: %v", cli.Command, flag.Args())
 	if *cpuProf != "" {
@@ -50,11 +71,54 @@ func Main() int {
 	if *memProf != "" {
 		defer memProfile(*memProf)
 	}
+	if *stackSize < 1 || *stackSize > cpu.MaxStackSize {
+		cli.ErrUsage("Invalid -stack-size %d, must be between 1 and %d", *stackSize, cpu.MaxStackSize)
+	}
+	runEngine, err := cpu.EngineFromString(*engine)
+	if err != nil {
+		return log.FErrf("Invalid -engine: %v", err)
+	}
+	if *jit {
+		runEngine = cpu.JITEngine
+	}
+	runOptions := cpu.Options{
+		StackSize:       *stackSize,
+		MaxInstructions: *maxInstructions,
+		Timeout:         *timeout,
+		Snapshot:        *snapshot,
+		Engine:          runEngine,
+		Verify:          *verify,
+	}
 	switch cli.Command {
 	case "compile":
-		return asm.Compile(flag.Args()...)
+		return asm.Compile(asm.Options{
+			StackSize: *stackSize, FormatVersion: *formatVersion, Object: *object,
+			IncludePath: filepath.SplitList(*includePath), DiagFormat: *diagFormat,
+		}, flag.Args()...)
+	case "link":
+		return asm.Link(asm.Options{FormatVersion: *formatVersion}, flag.Args()...)
 	case "run":
-		return cpu.Run(flag.Args()...)
+		return cpu.Run(runOptions, flag.Args()...)
+	case "resume":
+		if len(flag.Args()) != 1 {
+			return log.FErrf("resume expects exactly 1 snapshot file argument")
+		}
+		return cpu.Resume(runOptions, flag.Arg(0))
+	case "debug":
+		if len(flag.Args()) != 1 {
+			return log.FErrf("debug expects exactly 1 .vm file argument")
+		}
+		return debugger.Run(flag.Arg(0), *stackSize)
+	case "disasm":
+		return asm.Disasm(flag.Args()...)
+	case "verify":
+		return cpu.VerifyFiles(flag.Args()...)
+	case "togo":
+		return aot.ToGo(aot.Options{StackSize: *stackSize}, flag.Args()...)
+	case "toc":
+		return aot.ToC(aot.Options{StackSize: *stackSize}, flag.Args()...)
+	case "towasm":
+		return aot.ToWasm(aot.Options{StackSize: *stackSize}, flag.Args()...)
 	case "genh":
 		return asm.GenHeader()
 	default:
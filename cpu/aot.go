@@ -0,0 +1,24 @@
+package cpu
+
+// Helpers for the programs translated ahead of time (vm togo), so they behave exactly like the
+// interpreter for syscalls and faults.
+
+// Syscall executes the syscall of the Sys (or SysS if isStack) instruction at pc, with the given
+// operand and accumulator, on the CPU's Program and Stack (with stackPtr). It returns the new
+// accumulator, or the exit code and true if the program ends. The error is the BadMemoryAccess
+// Fault for an invalid syscall buffer, the exit code is then the fault's ExitCode.
+func (c *CPU) Syscall(call Syscall, operand, accumulator int64, pc ImmediateData,
+	isStack bool, stackPtr int,
+) (int64, bool, error) {
+	res, abort, ok := c.executeSyscall(call, operand, accumulator, c.Program, pc, isStack, c.Stack, stackPtr)
+	if !ok {
+		f := c.NewFault(BadMemoryAccess, pc, accumulator, stackPtr)
+		return int64(f.ExitCode()), true, f
+	}
+	return res, abort, nil
+}
+
+// NewFault saves the given state in the CPU and returns the corresponding Fault.
+func (c *CPU) NewFault(kind FaultKind, pc ImmediateData, accumulator int64, stackPtr int) *Fault {
+	return c.fault(kind, pc, accumulator, stackPtr, 0)
+}
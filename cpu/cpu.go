@@ -3,12 +3,15 @@
 package cpu
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/signal"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
@@ -32,6 +35,21 @@ func (op Operation) OperandInt64() int64 {
 	return int64(op >> 8)
 }
 
+// Operand48 returns the upper 48 bits of the operation (for instructions with an additional 8 bits operand).
+func (op Operation) Operand48() ImmediateData {
+	return ImmediateData(op >> 16)
+}
+
+// Operand8 returns the lower 8 bits of the operand (for instructions with a 48 bits operand).
+func (op Operation) Operand8() uint8 {
+	return uint8(op >> 8) //nolint:gosec // on purpose, we want the low byte
+}
+
+// SetOperand8 sets the lower 8 bits of the operand, keeping the 48 bits one.
+func (op Operation) SetOperand8(operand uint8) Operation {
+	return (op &^ 0xFF00) | (Operation(operand) << 8)
+}
+
 func (op Operation) SetOpcode(opcode Instruction) Operation {
 	return (op &^ 0xFF) | Operation(opcode)
 }
@@ -53,13 +71,61 @@ func (op Operation) Set48BitsOperand(operand ImmediateData) Operation {
 type CPU struct {
 	Accumulator int64
 	PC          ImmediateData
-	// SP          uint64
-	Program []Operation
+	Program     []Operation
+	// Stack is allocated (StackSize entries, DefaultStackSize if 0) on first execution, StackPtr is
+	// the index of the top entry (-1 when empty).
+	Stack     []Operation // we use Operation while it's really plain int64 to be compatible when using stack with sysPrint
+	StackPtr  int
+	StackSize int
+	// In and Out are used by the read and write syscalls, they default to os.Stdin and os.Stdout.
+	In  io.Reader
+	Out io.Writer
+	// Err receives the VM's runtime error messages (e.g. unknown syscall), they are logged when nil.
+	Err io.Writer
+	// MaxInstructions, when positive, stops Execute with an InstructionLimit LimitError once that many
+	// instructions have been executed.
+	MaxInstructions int64
+	// Timeout, when positive, stops Execute with a Timeout LimitError after that (wall-clock) duration.
+	Timeout time.Duration
+	// Executed is the number of instructions executed so far.
+	Executed int64
+	// Engine selects the interpreter used by Execute (Step always uses the reference SwitchEngine).
+	Engine Engine
+	// Source maps the PCs to the assembly source, for the error messages and traces (from the
+	// debug info of version 2 .vm files, nil if none).
+	Source    DebugInfo
+	entry     ImmediateData // PC the program started at, for StackTrace.
+	stepsLeft int64         // remaining steps budget when execute returned.
+	// ctx is the context of the running Execute, for the blocking syscalls, which set interrupted
+	// when it's done before they complete.
+	ctx         context.Context //nolint:containedctx // only set during Execute.
+	interrupted bool
+	pendingRead chan readResult // read of In interrupted by ctx, its data is for the next read.
+	unread      []byte          // rest of the pending read's data.
+	// stopRequested stops the stoppable executeSwitch, set when the context is done.
+	stopRequested atomic.Bool
+}
+
+// NewCPU returns a CPU using the given streams for its input, output and errors.
+// nil in and out default to os.Stdin and os.Stdout, nil errOut means errors are logged.
+func NewCPU(in io.Reader, out, errOut io.Writer) *CPU {
+	c := &CPU{In: in, Out: out, Err: errOut}
+	c.setup()
+	return c
+}
+
+// errorf reports a runtime error to Err, or logs it if Err isn't set.
+func (c *CPU) errorf(format string, args ...any) {
+	if c.Err == nil {
+		log.Errf(format, args...)
+		return
+	}
+	_, _ = fmt.Fprintf(c.Err, "ERR: "+format+"\n", args...)
 }
 
 const (
-	// HEADER for the VM binary format, starts with non printable version byte to indicate it's binary.
-	// The first byte is the version byte, followed by the ASCII characters "GROL VM".
+	// HEADER for the version 1 VM binary format, starts with non printable version byte to indicate it's binary.
+	// The first byte is the version byte, followed by the ASCII characters "GROL VM". See HEADER2 for version 2.
 	HEADER = "\x01GROL VM"
 	// OperationSize is the size of an Operation in bytes (int64).
 	OperationSize = 8
@@ -70,9 +136,32 @@ func signalSetup() {
 	signal.Ignore(syscall.SIGPIPE)
 }
 
-func Run(files ...string) int {
+// Options are the settings for Run.
+type Options struct {
+	StackSize       int           // Number of 64-bit stack words, DefaultStackSize if 0.
+	MaxInstructions int64         // Stop after that many instructions executed if positive.
+	Timeout         time.Duration // Stop after that wall-clock time if positive.
+	Snapshot        string        // File to save the CPU state into when stopped by a limit, if set.
+	Engine          Engine        // Interpreter to use.
+	Verify          bool          // Run Verify on each program before executing it.
+}
+
+// newRunCPU returns the CPU for Run and Resume, on the standard streams, and the context to
+// execute with (canceled by Ctrl-C).
+func newRunCPU(opts Options) (*CPU, context.Context, context.CancelFunc) {
 	signalSetup()
-	cpu := &CPU{}
+	cpu := &CPU{
+		In: os.Stdin, Out: os.Stdout, StackSize: opts.StackSize,
+		MaxInstructions: opts.MaxInstructions, Timeout: opts.Timeout, Engine: opts.Engine,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	return cpu, ctx, stop
+}
+
+func Run(opts Options, files ...string) int {
+	cpu, ctx, stop := newRunCPU(opts)
+	defer stop()
+	cpu.setup()
 	rtSize := binary.Size(Operation(0))
 	log.Infof("Starting CPU - size of operation: %d bytes", rtSize)
 	if rtSize != OperationSize {
@@ -85,45 +174,70 @@ func Run(files ...string) int {
 			return log.FErrf("Failed to read file %s: %v", file, err)
 		}
 		defer f.Close()
-		header := make([]byte, len(HEADER))
-		_, err = f.Read(header)
-		if err != nil {
-			return log.FErrf("Failed to read header from file %s: %v", file, err)
-		}
-		if string(header) != HEADER {
-			return log.FErrf("Invalid header in file %s: %q", file, string(header))
-		}
 		err = cpu.LoadProgram(f)
 		if err != nil {
 			return log.FErrf("Failed to load program %s: %v", file, err)
 		}
-		execResult := cpu.Execute()
-		if execResult != 0 {
-			log.Warnf("Non 0 exit of program %s: %v", file, execResult)
-			return execResult
+		if opts.Verify {
+			if err = VerifyFrom(cpu.Program, cpu.PC); err != nil {
+				return log.FErrf("Program %s failed verification:\n%v", file, err)
+			}
+		}
+		execResult, err := cpu.Execute(ctx)
+		if err != nil || execResult != 0 {
+			return cpu.report(opts, file, execResult, err)
 		}
 	}
 	return 0
 }
 
-func (c *CPU) LoadProgram(f *os.File) error {
-	var op Operation
-	for {
-		err := binary.Read(f, binary.LittleEndian, &op)
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
+// Resume continues the execution of a program from the snapshot file saved by Run (or Resume).
+// MaxInstructions is then the number of additional instructions to execute.
+func Resume(opts Options, file string) int {
+	cpu, ctx, stop := newRunCPU(opts)
+	defer stop()
+	err := cpu.ReadSnapshotFile(file)
+	if err != nil {
+		return log.FErrf("Failed to load snapshot %s: %v", file, err)
+	}
+	if cpu.MaxInstructions > 0 {
+		cpu.MaxInstructions += cpu.Executed
+	}
+	log.Infof("Resuming %s at PC %d after %d instructions", file, cpu.PC, cpu.Executed)
+	execResult, err := cpu.Execute(ctx)
+	if err != nil || execResult != 0 {
+		return cpu.report(opts, file, execResult, err)
+	}
+	return 0
+}
+
+// report logs why the program stopped, saving a snapshot if it was stopped by a limit and
+// opts.Snapshot is set, and returns the exit code.
+func (c *CPU) report(opts Options, file string, execResult int, err error) int {
+	var limitErr *LimitError
+	switch {
+	case errors.As(err, &limitErr):
+		log.Errf("Program %s stopped: %v", file, err)
+		if opts.Snapshot != "" {
+			if err = c.WriteSnapshotFile(opts.Snapshot); err != nil {
+				return log.FErrf("Failed to save snapshot %s: %v", opts.Snapshot, err)
 			}
-			return err
+			log.Infof("Saved snapshot to %s", opts.Snapshot)
+		}
+	case err != nil:
+		log.Errf("Fault in program %s: %v", file, err)
+		if c.Source != nil {
+			log.Errf("Stack trace:\n  %s", strings.Join(c.StackTrace(), "\n  "))
 		}
-		c.Program = append(c.Program, op)
+	default:
+		log.Warnf("Non 0 exit of program %s: %v", file, execResult)
 	}
-	return nil
+	return execResult
 }
 
 const unknownSyscallAbortCode = 99
 
-func sysRead(in io.Reader, memory []Operation, addr, n int) int64 {
+func (c *CPU) sysRead(memory []Operation, addr, n int) int64 {
 	if n < 0 {
 		panic(fmt.Sprintf("invalid read size: %d", n))
 	}
@@ -138,18 +252,31 @@ func sysRead(in io.Reader, memory []Operation, addr, n int) int64 {
 	// Each Operation is an int64, so we need addr*OperationSize bytes offset
 	memAsBytes := unsafe.Slice((*byte)(unsafe.Pointer(&memory[0])), len(memory)*OperationSize)
 	byteOffset := addr * OperationSize
-	r, err := in.Read(memAsBytes[byteOffset : byteOffset+n])
+	r, err := c.read(memAsBytes[byteOffset : byteOffset+n])
+	if c.interrupted {
+		return -1
+	}
 	if err != nil && !errors.Is(err, io.EOF) {
-		log.Errf("Failed to read: %v", err)
+		c.errorf("Failed to read: %v", err)
 		return -1
 	}
-	log.LogVf("Read %d bytes from stdin", r)
+	log.LogVf("Read %d bytes from input", r)
 	return int64(r)
 }
 
-func sysRead8(in io.Reader, memory []Operation, addr, n int) int64 {
-	if n <= 0 || n > 255 {
-		panic(fmt.Sprintf("invalid read size for str8: %d", n))
+func (c *CPU) sysRead8(memory []Operation, addr, n int) int64 {
+	return c.sysReadStr(memory, addr, n, 1)
+}
+
+func (c *CPU) sysRead16(memory []Operation, addr, n int) int64 {
+	return c.sysReadStr(memory, addr, n, 2)
+}
+
+// sysReadStr reads up to n bytes as a string with a prefix bytes (1 for str8, 2 for str16)
+// length, which is only set when something was read.
+func (c *CPU) sysReadStr(memory []Operation, addr, n, prefix int) int64 {
+	if n <= 0 || n >= 1<<(8*prefix) {
+		panic(fmt.Sprintf("invalid read size for str%d: %d", 8*prefix, n))
 	}
 	if len(memory) == 0 {
 		panic("memory slice is empty")
@@ -158,26 +285,42 @@ func sysRead8(in io.Reader, memory []Operation, addr, n int) int64 {
 	// Each Operation is an int64, so we need addr*OperationSize bytes offset
 	memAsBytes := unsafe.Slice((*byte)(unsafe.Pointer(&memory[0])), len(memory)*OperationSize)
 
-	// For str8, the length byte goes at byteOffset 0, data starts at byteOffset 1
+	// The length bytes go at byteOffset, data starts after them
 	byteOffset := addr * OperationSize
 
-	r, err := in.Read(memAsBytes[byteOffset+1 : byteOffset+1+n])
+	r, err := c.read(memAsBytes[byteOffset+prefix : byteOffset+prefix+n])
+	if c.interrupted {
+		return -1
+	}
 	if err != nil && !errors.Is(err, io.EOF) {
-		log.Errf("Failed to read8: %v", err)
+		c.errorf("Failed to read str%d: %v", 8*prefix, err)
 		return -1
 	}
-	log.LogVf("Read8 %d bytes from stdin", r)
+	log.LogVf("Read str%d %d bytes from input", 8*prefix, r)
 	if r == 0 {
 		return 0
 	}
-	// Set the length byte
-	memAsBytes[byteOffset] = byte(r)
+	// Set the length bytes (little endian)
+	for i := range prefix {
+		memAsBytes[byteOffset+i] = byte(r >> (8 * i))
+	}
 	return int64(r)
 }
 
 // sysWrite8 writes the str8 bytes and returns the number of bytes it did output.
-func sysWrite8(out io.Writer, memory []Operation, addr, offset int) int64 {
-	log.LogVf("Writing str8 from memory at addr: %d, offset: %d", addr, offset)
+func (c *CPU) sysWrite8(memory []Operation, addr, offset int) int64 {
+	return c.sysWriteStr(memory, addr, offset, 1)
+}
+
+// sysWrite16 writes the str16 bytes and returns the number of bytes it did output.
+func (c *CPU) sysWrite16(memory []Operation, addr, offset int) int64 {
+	return c.sysWriteStr(memory, addr, offset, 2)
+}
+
+// sysWriteStr writes the bytes of the string with a prefix bytes length (1 for str8, 2 for
+// str16) and returns the number of bytes it did output.
+func (c *CPU) sysWriteStr(memory []Operation, addr, offset, prefix int) int64 {
+	log.LogVf("Writing str%d from memory at addr: %d, offset: %d", 8*prefix, addr, offset)
 	if len(memory) == 0 {
 		panic("memory slice is empty")
 	}
@@ -186,31 +329,35 @@ func sysWrite8(out io.Writer, memory []Operation, addr, offset int) int64 {
 	memAsBytes := unsafe.Slice((*byte)(unsafe.Pointer(&memory[0])), len(memory)*OperationSize)
 
 	byteOffset := addr*OperationSize + offset
-	length := int(memAsBytes[byteOffset])
+	length := 0
+	for i := range prefix {
+		length |= int(memAsBytes[byteOffset+i]) << (8 * i)
+	}
 	if length == 0 {
 		return 0
 	}
+	data := memAsBytes[byteOffset+prefix : byteOffset+prefix+length]
 	if log.LogVerbose() {
 		// this would alloc a slice so we avoid it unless verbose logging is enabled
-		log.LogVf("Before writing bytes: %d %q", length, memAsBytes[byteOffset+1:byteOffset+1+length])
+		log.LogVf("Before writing bytes: %d %q", length, data)
 	}
 	// Write directly from memory without copying
-	n, err := out.Write(memAsBytes[byteOffset+1 : byteOffset+1+length])
-	log.LogVf("Wrote %d bytes to stdout (err %v)", n, err)
+	n, err := c.Out.Write(data)
+	log.LogVf("Wrote %d bytes to output (err %v)", n, err)
 
 	if err != nil {
-		log.Errf("Failed to output str8: %v", err)
+		c.errorf("Failed to output str%d: %v", 8*prefix, err)
 		return -1
 	}
 	if n != length {
-		log.Errf("Failed to output all bytes: expected %d, got %d", length, n)
+		c.errorf("Failed to output all bytes: expected %d, got %d", length, n)
 		return -1
 	}
 	return int64(length)
 }
 
 // sysWrite writes the n bytes and returns the number of bytes it did output.
-func sysWrite(out io.Writer, memory []Operation, addr, n int) int64 {
+func (c *CPU) sysWrite(memory []Operation, addr, n int) int64 {
 	log.LogVf("Writing n bytes from memory at addr: %d, n: %d", addr, n)
 	if n < 0 {
 		panic(fmt.Sprintf("invalid write size: %d", n))
@@ -230,20 +377,39 @@ func sysWrite(out io.Writer, memory []Operation, addr, n int) int64 {
 		log.LogVf("Before writing bytes: %d %q", n, memAsBytes[byteOffset:byteOffset+n])
 	}
 	// Write directly from memory without copying
-	m, err := out.Write(memAsBytes[byteOffset : byteOffset+n])
-	log.LogVf("Wrote %d bytes to stdout (err %v)", m, err)
+	m, err := c.Out.Write(memAsBytes[byteOffset : byteOffset+n])
+	log.LogVf("Wrote %d bytes to output (err %v)", m, err)
 	if err != nil {
-		log.Errf("Failed to output bytes: %v", err)
+		c.errorf("Failed to output bytes: %v", err)
 		return -1
 	}
 	if n != m {
-		log.Errf("Failed to output all bytes: expected %d, got %d", n, m)
+		c.errorf("Failed to output all bytes: expected %d, got %d", n, m)
 		return -1
 	}
 	return int64(n)
 }
 
-func executeSyscall(syscall Syscall, operand, accumulator int64,
+// executeSyscall returns the new accumulator (or exit code) and whether to abort (exit) the program.
+// ok is false if the syscall's buffer or size were invalid (outside of memory or stack).
+func (c *CPU) executeSyscall(syscall Syscall, operand, accumulator int64,
+	memory []Operation, pc ImmediateData,
+	isStack bool, stack []Operation, stackPtr int,
+) (res int64, abort, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.errorf("Invalid %v syscall at PC: %d%s: %v", syscall, pc, c.where(pc), r)
+			res, abort, ok = -1, true, false
+		}
+	}()
+	res, abort = c.syscall(syscall, operand, accumulator, memory, pc, isStack, stack, stackPtr)
+	if c.interrupted {
+		return LimitExitCode, true, true
+	}
+	return res, abort, true
+}
+
+func (c *CPU) syscall(syscall Syscall, operand, accumulator int64,
 	memory []Operation, pc ImmediateData,
 	isStack bool, stack []Operation, stackPtr int,
 ) (int64, bool) {
@@ -251,60 +417,169 @@ func executeSyscall(syscall Syscall, operand, accumulator int64,
 	case Exit:
 		return operand, true
 	case Sleep:
-		time.Sleep(time.Duration(operand) * time.Millisecond)
+		c.sleep(time.Duration(operand) * time.Millisecond)
 		return accumulator, false
 	case Read8:
 		if isStack {
 			addr := stackPtr - int(operand)
-			return sysRead8(os.Stdin, stack, addr, int(accumulator)), false
+			return c.sysRead8(stack, addr, int(accumulator)), false
+		}
+		addr := int64(pc) + operand
+		return c.sysRead8(memory, int(addr), int(accumulator)), false
+	case Read16:
+		if isStack {
+			addr := stackPtr - int(operand)
+			return c.sysRead16(stack, addr, int(accumulator)), false
 		}
 		addr := int64(pc) + operand
-		return sysRead8(os.Stdin, memory, int(addr), int(accumulator)), false
+		return c.sysRead16(memory, int(addr), int(accumulator)), false
 	case Write8:
 		if isStack {
 			addr := stackPtr - int(operand) + int(accumulator)/8
-			return sysWrite8(os.Stdout, stack, addr, int(accumulator%8)), false
+			return c.sysWrite8(stack, addr, int(accumulator%8)), false
+		}
+		addr := int64(pc) + operand
+		return c.sysWrite8(memory, int(addr), 0), false
+	case Write16:
+		if isStack {
+			addr := stackPtr - int(operand) + int(accumulator)/8
+			return c.sysWrite16(stack, addr, int(accumulator%8)), false
 		}
 		addr := int64(pc) + operand
-		return sysWrite8(os.Stdout, memory, int(addr), 0), false
+		return c.sysWrite16(memory, int(addr), 0), false
 	case ReadN:
 		if isStack {
 			addr := stackPtr - int(operand)
-			return sysRead(os.Stdin, stack, addr, int(accumulator)), false
+			return c.sysRead(stack, addr, int(accumulator)), false
 		}
 		addr := int64(pc) + operand
-		return sysRead(os.Stdin, memory, int(addr), int(accumulator)), false
+		return c.sysRead(memory, int(addr), int(accumulator)), false
 	case WriteN:
 		if isStack {
 			addr := stackPtr - int(operand)
-			return sysWrite(os.Stdout, stack, addr, int(accumulator)), false
+			return c.sysWrite(stack, addr, int(accumulator)), false
 		}
 		addr := int64(pc) + operand
-		return sysWrite(os.Stdout, memory, int(addr), int(accumulator)), false
+		return c.sysWrite(memory, int(addr), int(accumulator)), false
 	default:
-		log.Errf("Unknown syscall: %d", syscall)
+		c.errorf("Unknown syscall: %d at PC: %d%s", syscall, pc, c.where(pc))
 	}
 	return unknownSyscallAbortCode, true // unknown syscall abort code.
 }
 
-const StackSize = 512
+// Shift returns a shifted left by n bits, or right (arithmetic) by -n bits if n is negative,
+// for any n: ShiftR and ShiftS. ShiftI, with its constant n, shifts inline instead (with the same
+// results, Go's shifts by 64 or more bits included).
+func Shift(a, n int64) int64 {
+	switch {
+	case n <= -64:
+		return a >> 63
+	case n < 0:
+		return a >> -n
+	case n >= 64:
+		return 0
+	default:
+		return a << n
+	}
+}
 
+// Shr returns a shifted right without the sign (logical) by n bits, or left by -n bits if n
+// is negative, for any n: ShrI.
+func Shr(a, n int64) int64 {
+	switch {
+	case n >= 64 || n <= -64:
+		return 0
+	case n < 0:
+		return a << -n
+	default:
+		return int64(uint64(a) >> n) //nolint:gosec // unsigned shift on purpose
+	}
+}
+
+// bitwise returns the result of the R or S instruction code, from the bitwise family (and
+// modulo), for a and the operand value b (not 0 for the modulo).
+func bitwise(code Instruction, a, b int64) int64 {
+	switch code { //nolint:exhaustive // just the bitwise R and S ones.
+	case ModR, ModS:
+		return a % b
+	case AndR, AndS:
+		return a & b
+	case OrR, OrS:
+		return a | b
+	case XorR, XorS:
+		return a ^ b
+	default: // ShiftR, ShiftS
+		return Shift(a, b)
+	}
+}
+
+// compare returns whether the conditional jump code (JNE to JLTE or their S and R variants)
+// jumps when comparing a with b.
+func compare(code Instruction, a, b int64) bool {
+	switch code { //nolint:exhaustive // just the conditional jumps.
+	case JNE, JNES, JNER:
+		return a != b
+	case JEQ, JEQS, JEQR:
+		return a == b
+	case JLT, JLTS, JLTR:
+		return a < b
+	case JGT, JGTS, JGTR:
+		return a > b
+	case JGTE, JGTES, JGTER:
+		return a >= b
+	default: // JLTE, JLTES, JLTER
+		return a <= b
+	}
+}
+
+// DefaultStackSize is the number of 64-bit words of the stack when not otherwise specified.
+const DefaultStackSize = 512
+
+// MaxStackSize is the largest stack, in 64-bit words (128 MiB), that -stack-size and the stack size
+// section of the .vm files can ask for.
+const MaxStackSize = 1 << 24
+
+// execute runs the program from the current CPU state for at most steps instructions (no limit
+// if steps is negative). It returns the exit code and whether the program ended (as opposed to running out of steps) and
+// the Fault if the program did something invalid.
+func (c *CPU) execute(steps int64) (int64, bool, error) {
+	return c.executeSwitch(steps, false)
+}
+
+// executeSwitch is the reference interpreter behind execute. When stoppable (Execute without
+// instruction limit, running as a single chunk) it also stops, at the next jump, once
+// stopRequested is set.
+//
 //nolint:gocognit,gocyclo,funlen,maintidx // yeah well...
-func execute(pc ImmediateData, program []Operation, accumulator int64) (int64, int64) {
-	var stack [StackSize]Operation // we use Operation while it's really plain int64 to be compatible when using stack with sysPrint
-	stackPtr := -1
+func (c *CPU) executeSwitch(steps int64, stoppable bool) (int64, bool, error) {
+	pc, program, accumulator := c.PC, c.Program, c.Accumulator
+	stack, stackPtr := c.Stack, c.StackPtr
+	stackSize := len(stack)
 	end := ImmediateData(len(program))
-	for pc < end {
+	for uint64(pc) < uint64(end) { //nolint:gosec // negative pc (bad jump) becomes a large unsigned
+		if steps == 0 {
+			c.save(pc, accumulator, stackPtr, steps)
+			return 0, false, nil
+		}
+		steps--
 		op := program[pc]
+		if Debug && c.Source != nil {
+			log.Debugf("PC: %d %v", pc, c.Source.At(pc))
+		}
 		switch code := op.Opcode(); code {
 		case Sys, SysS:
 			arg := op.OperandInt64()
 			callID := Syscall(arg & 0xFF) //nolint:gosec // duh... 0xFF means it can't overflow
 			v := arg >> 8
-			log.Infof("Syscall %v at PC: %d, accumulator: %d - operand: %d (%x)", callID, pc, accumulator, v, v)
-			code, abort := executeSyscall(callID, v, accumulator, program, pc, code == SysS, stack[:], stackPtr)
+			log.Infof("Syscall %v at PC: %d%s, accumulator: %d - operand: %d (%x)", callID, pc, c.where(pc), accumulator, v, v)
+			code, abort, ok := c.executeSyscall(callID, v, accumulator, program, pc, code == SysS, stack, stackPtr)
+			if !ok {
+				f := c.fault(BadMemoryAccess, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			if abort {
-				return accumulator, code
+				c.save(pc, accumulator, stackPtr, steps)
+				return code, true, nil
 			}
 			accumulator = code
 		case LoadI:
@@ -328,11 +603,19 @@ func execute(pc ImmediateData, program []Operation, accumulator int64) (int64, i
 				log.Debugf("MulI    at PC: %d, value: %d -> %d (%x)", pc, op.OperandInt64(), accumulator, accumulator)
 			}
 		case DivI:
+			if op.OperandInt64() == 0 {
+				f := c.fault(DivideByZero, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			accumulator /= op.OperandInt64()
 			if Debug {
 				log.Debugf("DivI    at PC: %d, value: %d -> %d (%x)", pc, op.OperandInt64(), accumulator, accumulator)
 			}
 		case ModI:
+			if op.OperandInt64() == 0 {
+				f := c.fault(DivideByZero, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			accumulator %= op.OperandInt64()
 			if Debug {
 				log.Debugf("ModI    at PC: %d, value: %d -> %d (%x)", pc, op.OperandInt64(), accumulator, accumulator)
@@ -352,6 +635,26 @@ func execute(pc ImmediateData, program []Operation, accumulator int64) (int64, i
 			if Debug {
 				log.Debugf("AndI    at PC: %d, value: %d -> %d", pc, op.OperandInt64(), accumulator)
 			}
+		case OrI:
+			accumulator |= op.OperandInt64()
+			if Debug {
+				log.Debugf("OrI     at PC: %d, value: %d -> %d", pc, op.OperandInt64(), accumulator)
+			}
+		case XorI:
+			accumulator ^= op.OperandInt64()
+			if Debug {
+				log.Debugf("XorI    at PC: %d, value: %d -> %d", pc, op.OperandInt64(), accumulator)
+			}
+		case Not:
+			accumulator = ^accumulator
+			if Debug {
+				log.Debugf("Not     at PC: %d -> %d", pc, accumulator)
+			}
+		case ShrI:
+			accumulator = Shr(accumulator, op.OperandInt64())
+			if Debug {
+				log.Debugf("ShrI    at PC: %d, value: %d -> %d", pc, op.OperandInt64(), accumulator)
+			}
 		case JNE:
 			param := op.OperandInt64()
 			addr := param >> 8
@@ -361,7 +664,7 @@ func execute(pc ImmediateData, program []Operation, accumulator int64) (int64, i
 					log.Debugf("JNE     at PC: %d, jumping to PC: +%d", pc, addr)
 				}
 				pc += ImmediateData(addr)
-				continue
+				goto jumped
 			}
 			if Debug {
 				log.Debugf("JNE     at PC: %d, not jumping", pc)
@@ -375,7 +678,7 @@ func execute(pc ImmediateData, program []Operation, accumulator int64) (int64, i
 					log.Debugf("JEQ     at PC: %d, jumping to PC: +%d", pc, addr)
 				}
 				pc += ImmediateData(addr)
-				continue
+				goto jumped
 			}
 			if Debug {
 				log.Debugf("JEQ     at PC: %d, not jumping", pc)
@@ -389,7 +692,7 @@ func execute(pc ImmediateData, program []Operation, accumulator int64) (int64, i
 					log.Debugf("JLT     at PC: %d, jumping to PC: +%d", pc, addr)
 				}
 				pc += ImmediateData(addr)
-				continue
+				goto jumped
 			}
 			if Debug {
 				log.Debugf("JLT     at PC: %d, not jumping", pc)
@@ -403,7 +706,7 @@ func execute(pc ImmediateData, program []Operation, accumulator int64) (int64, i
 					log.Debugf("JGT     at PC: %d, jumping to PC: +%d", pc, addr)
 				}
 				pc += ImmediateData(addr)
-				continue
+				goto jumped
 			}
 			if Debug {
 				log.Debugf("JGT     at PC: %d, not jumping", pc)
@@ -417,7 +720,7 @@ func execute(pc ImmediateData, program []Operation, accumulator int64) (int64, i
 					log.Debugf("JGTE    at PC: %d, jumping to PC: +%d", pc, addr)
 				}
 				pc += ImmediateData(addr)
-				continue
+				goto jumped
 			}
 			if Debug {
 				log.Debugf("JGTE    at PC: %d, not jumping", pc)
@@ -431,27 +734,74 @@ func execute(pc ImmediateData, program []Operation, accumulator int64) (int64, i
 					log.Debugf("JLTE    at PC: %d, jumping to PC: +%d", pc, addr)
 				}
 				pc += ImmediateData(addr)
-				continue
+				goto jumped
 			}
 			if Debug {
 				log.Debugf("JLTE    at PC: %d, not jumping", pc)
 			}
+		case JNES, JEQS, JLTS, JGTS, JGTES, JLTES:
+			param := op.OperandInt64()
+			addr := param >> 8
+			offset := int(param & 0xFF)
+			if idx := stackPtr - offset; uint(idx) >= uint(stackSize) { //nolint:gosec // negative becomes large unsigned
+				f := c.stackFault(idx, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
+			value := int64(stack[stackPtr-offset])
+			if compare(code, accumulator, value) {
+				if Debug {
+					log.Debugf("%-7v at PC: %d, value: %d, jumping to PC: +%d", code, pc, value, addr)
+				}
+				pc += ImmediateData(addr)
+				goto jumped
+			}
+			if Debug {
+				log.Debugf("%-7v at PC: %d, value: %d, not jumping", code, pc, value)
+			}
+		case JNER, JEQR, JLTR, JGTR, JGTER, JLTER:
+			if pc+1 >= end {
+				f := c.fault(BadMemoryAccess, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
+			offset := ImmediateData(program[pc+1])
+			if uint64(pc+offset) >= uint64(end) { //nolint:gosec // negative becomes large unsigned
+				f := c.fault(BadMemoryAccess, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
+			value := int64(program[pc+offset])
+			if compare(code, accumulator, value) {
+				if Debug {
+					log.Debugf("%-7v at PC: %d, value: %d, jumping to PC: +%d", code, pc, value, op.OperandInt64())
+				}
+				pc += op.Operand()
+				goto jumped
+			}
+			if Debug {
+				log.Debugf("%-7v at PC: %d, value: %d, not jumping", code, pc, value)
+			}
+			pc++ // skip the address word.
 		case JumpR:
 			if Debug {
 				log.Debugf("JumpR   at PC: %d, jumping to PC: +%d", pc, op.OperandInt64())
 			}
 			pc += op.Operand()
-			continue
+			goto jumped
 		case LoadR:
 			offset := op.Operand()
-			// ok to panic if offset is out of bounds
+			if uint64(pc+offset) >= uint64(end) { //nolint:gosec // negative becomes large unsigned
+				f := c.fault(BadMemoryAccess, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			accumulator = int64(program[pc+offset])
 			if Debug {
 				log.Debugf("LoadR   at PC: %d, offset: %d, value: %d", pc, offset, accumulator)
 			}
 		case AddR:
 			offset := op.Operand()
-			// ok to panic if offset is out of bounds
+			if uint64(pc+offset) >= uint64(end) { //nolint:gosec // negative becomes large unsigned
+				f := c.fault(BadMemoryAccess, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			value := int64(program[pc+offset])
 			accumulator += value
 			if Debug {
@@ -459,7 +809,10 @@ func execute(pc ImmediateData, program []Operation, accumulator int64) (int64, i
 			}
 		case SubR:
 			offset := op.Operand()
-			// ok to panic if offset is out of bounds
+			if uint64(pc+offset) >= uint64(end) { //nolint:gosec // negative becomes large unsigned
+				f := c.fault(BadMemoryAccess, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			value := int64(program[pc+offset])
 			accumulator -= value
 			if Debug {
@@ -467,7 +820,10 @@ func execute(pc ImmediateData, program []Operation, accumulator int64) (int64, i
 			}
 		case MulR:
 			offset := op.Operand()
-			// ok to panic if offset is out of bounds
+			if uint64(pc+offset) >= uint64(end) { //nolint:gosec // negative becomes large unsigned
+				f := c.fault(BadMemoryAccess, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			value := int64(program[pc+offset])
 			accumulator *= value
 			if Debug {
@@ -475,44 +831,82 @@ func execute(pc ImmediateData, program []Operation, accumulator int64) (int64, i
 			}
 		case DivR:
 			offset := op.Operand()
-			// ok to panic if offset is out of bounds
+			if uint64(pc+offset) >= uint64(end) { //nolint:gosec // negative becomes large unsigned
+				f := c.fault(BadMemoryAccess, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			value := int64(program[pc+offset])
+			if value == 0 {
+				f := c.fault(DivideByZero, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			accumulator /= value
 			if Debug {
 				log.Debugf("DivR    at PC: %d, offset: %d, value: %d -> %d", pc, offset, value, accumulator)
 			}
+		case ModR, AndR, OrR, XorR, ShiftR:
+			offset := op.Operand()
+			if uint64(pc+offset) >= uint64(end) { //nolint:gosec // negative becomes large unsigned
+				f := c.fault(BadMemoryAccess, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
+			value := int64(program[pc+offset])
+			if value == 0 && code == ModR {
+				f := c.fault(DivideByZero, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
+			accumulator = bitwise(code, accumulator, value)
+			if Debug {
+				log.Debugf("%-7v at PC: %d, offset: %d, value: %d -> %d", code, pc, offset, value, accumulator)
+			}
 		case StoreR:
 			offset := op.Operand()
+			if uint64(pc+offset) >= uint64(end) { //nolint:gosec // negative becomes large unsigned
+				f := c.fault(BadMemoryAccess, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			if Debug {
-				oldValue := int64(program[pc+offset]) // may panic if offset is out of bounds, that's fine
+				oldValue := int64(program[pc+offset])
 				log.Debugf("StoreR  at PC: %d, offset: %d, old value: %d, new value: %d", pc, offset, oldValue, accumulator)
 			}
-			// ok to panic if offset is out of bounds
 			program[pc+offset] = Operation(accumulator)
 		case IncrR:
 			arg := op.Operand()
 			offset := arg >> 8
-			value := int8(arg & 0xff) //nolint:gosec // 0xff implies can't overflow (and we want the sign bit too)
-			// ok to panic if offset is out of bounds
+			value := int8(arg & 0xff)             //nolint:gosec // 0xff implies can't overflow (and we want the sign bit too)
+			if uint64(pc+offset) >= uint64(end) { //nolint:gosec // negative becomes large unsigned
+				f := c.fault(BadMemoryAccess, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			oldValue := int64(program[pc+offset])
 			accumulator = oldValue + int64(value)
 			program[pc+offset] = Operation(accumulator)
 			if Debug {
 				log.Debugf("IncrR   at PC: %d, offset: %d, value: %d -> %d", pc, offset, value, accumulator)
 			}
-		// panic / oob in stack access is fine (no checks outside of go's runtime)
 		case Call:
+			if stackPtr+1 >= stackSize {
+				f := c.fault(StackOverflow, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			stackPtr++
 			stack[stackPtr] = Operation(pc + 1)
 			if Debug {
 				log.Debugf("Call    at PC: %d, jumping to PC: +%d, SP = %d %v", pc, op.OperandInt64(), stackPtr, stack[:stackPtr+1])
 			}
 			pc += op.Operand()
-			continue
+			goto jumped
 		case Ret:
 			extra := int(op.OperandInt64())
 			if extra > 0 {
+				if stackPtr-extra < 0 {
+					f := c.fault(StackUnderflow, pc, accumulator, stackPtr, steps)
+					return int64(f.ExitCode()), true, f
+				}
 				stackPtr -= extra
+			} else if stackPtr < 0 {
+				f := c.fault(StackUnderflow, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
 			}
 			oldPC := pc
 			pc = ImmediateData(stack[stackPtr])
@@ -520,8 +914,12 @@ func execute(pc ImmediateData, program []Operation, accumulator int64) (int64, i
 			if Debug {
 				log.Debugf("Return  at PC: %d, returning to PC: %d - SP = %d %v", oldPC, pc, stackPtr, stack[:stackPtr+1])
 			}
-			continue
+			goto jumped
 		case Push:
+			if stackPtr+1+max(0, int(op.Operand())) >= stackSize {
+				f := c.fault(StackOverflow, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			for range op.Operand() {
 				stackPtr++
 				stack[stackPtr] = 0 //nolint:gosec // gosec smoking crack again?
@@ -532,29 +930,42 @@ func execute(pc ImmediateData, program []Operation, accumulator int64) (int64, i
 				log.Debugf("Push    at PC: %d, value: %d - SP = %d %v", pc, accumulator, stackPtr, stack[:stackPtr+1])
 			}
 		case Pop:
-			accumulator = int64(stack[stackPtr])
-			stackPtr--
-			extra := int(op.OperandInt64())
-			if extra > 0 {
-				stackPtr -= extra
+			extra := max(0, int(op.OperandInt64()))
+			if stackPtr-extra < 0 {
+				f := c.fault(StackUnderflow, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
 			}
+			accumulator = int64(stack[stackPtr])
+			stackPtr -= 1 + extra
 			if Debug {
 				log.Debugf("Pop     at PC: %d, value: %d - SP = %d %v", pc, accumulator, stackPtr, stack[:stackPtr+1])
 			}
 		case LoadS:
 			offset := int(op.Operand())
+			if idx := stackPtr - offset; uint(idx) >= uint(stackSize) { //nolint:gosec // negative becomes large unsigned
+				f := c.stackFault(idx, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			accumulator = int64(stack[stackPtr-offset])
 			if Debug {
 				log.Debugf("LoadS   at PC: %d, offset: %d, value: %d - SP = %d %v", pc, offset, accumulator, stackPtr, stack[:stackPtr+1])
 			}
 		case StoreS:
 			offset := int(op.Operand())
+			if idx := stackPtr - offset; uint(idx) >= uint(stackSize) { //nolint:gosec // negative becomes large unsigned
+				f := c.stackFault(idx, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			stack[stackPtr-offset] = Operation(accumulator)
 			if Debug {
 				log.Debugf("StoreS  at PC: %d, offset: %d, value: %d - SP = %d %v", pc, offset, accumulator, stackPtr, stack[:stackPtr+1])
 			}
 		case AddS:
 			offset := int(op.Operand())
+			if idx := stackPtr - offset; uint(idx) >= uint(stackSize) { //nolint:gosec // negative becomes large unsigned
+				f := c.stackFault(idx, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			accumulator += int64(stack[stackPtr-offset])
 			if Debug {
 				log.Debugf("AddS    at PC: %d, offset: %d, value: %d -> %d - SP = %d %v",
@@ -562,6 +973,10 @@ func execute(pc ImmediateData, program []Operation, accumulator int64) (int64, i
 			}
 		case SubS:
 			offset := int(op.Operand())
+			if idx := stackPtr - offset; uint(idx) >= uint(stackSize) { //nolint:gosec // negative becomes large unsigned
+				f := c.stackFault(idx, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			accumulator -= int64(stack[stackPtr-offset])
 			if Debug {
 				log.Debugf("SubS    at PC: %d, offset: %d, value: %d -> %d - SP = %d %v",
@@ -569,6 +984,10 @@ func execute(pc ImmediateData, program []Operation, accumulator int64) (int64, i
 			}
 		case MulS:
 			offset := int(op.Operand())
+			if idx := stackPtr - offset; uint(idx) >= uint(stackSize) { //nolint:gosec // negative becomes large unsigned
+				f := c.stackFault(idx, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			accumulator *= int64(stack[stackPtr-offset])
 			if Debug {
 				log.Debugf("MulS    at PC: %d, offset: %d, value: %d -> %d - SP = %d %v",
@@ -576,15 +995,43 @@ func execute(pc ImmediateData, program []Operation, accumulator int64) (int64, i
 			}
 		case DivS:
 			offset := int(op.Operand())
+			if idx := stackPtr - offset; uint(idx) >= uint(stackSize) { //nolint:gosec // negative becomes large unsigned
+				f := c.stackFault(idx, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
+			if stack[stackPtr-offset] == 0 {
+				f := c.fault(DivideByZero, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			accumulator /= int64(stack[stackPtr-offset])
 			if Debug {
 				log.Debugf("DivS    at PC: %d, offset: %d, value: %d -> %d - SP = %d %v",
 					pc, offset, stack[stackPtr-offset], accumulator, stackPtr, stack[:stackPtr+1])
 			}
+		case ModS, AndS, OrS, XorS, ShiftS:
+			offset := int(op.Operand())
+			if idx := stackPtr - offset; uint(idx) >= uint(stackSize) { //nolint:gosec // negative becomes large unsigned
+				f := c.stackFault(idx, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
+			value := int64(stack[stackPtr-offset])
+			if value == 0 && code == ModS {
+				f := c.fault(DivideByZero, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
+			accumulator = bitwise(code, accumulator, value)
+			if Debug {
+				log.Debugf("%-7v at PC: %d, offset: %d, value: %d -> %d - SP = %d %v",
+					code, pc, offset, value, accumulator, stackPtr, stack[:stackPtr+1])
+			}
 		case IncrS:
 			arg := op.Operand()
 			offset := int(arg >> 8)
-			value := int8(arg & 0xff) //nolint:gosec // 0xff implies can't overflow (and we want the sign bit too)
+			value := int8(arg & 0xff)                                   //nolint:gosec // 0xff implies can't overflow (and we want the sign bit too)
+			if idx := stackPtr - offset; uint(idx) >= uint(stackSize) { //nolint:gosec // negative becomes large unsigned
+				f := c.stackFault(idx, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			oldValue := stack[stackPtr-offset]
 			accumulator = int64(oldValue) + int64(value)
 			stack[stackPtr-offset] = Operation(accumulator)
@@ -594,6 +1041,14 @@ func execute(pc ImmediateData, program []Operation, accumulator int64) (int64, i
 			}
 		case IdivS:
 			offset := int(op.Operand())
+			if idx := stackPtr - offset; uint(idx) >= uint(stackSize) { //nolint:gosec // negative becomes large unsigned
+				f := c.stackFault(idx, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
+			if accumulator == 0 {
+				f := c.fault(DivideByZero, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			current := int64(stack[stackPtr-offset])
 			stack[stackPtr-offset] = Operation(current / accumulator)
 			accumulator = current % accumulator
@@ -603,10 +1058,18 @@ func execute(pc ImmediateData, program []Operation, accumulator int64) (int64, i
 			}
 		case StoreSB:
 			arg := op.Operand()
-			offset := int(arg >> 8)              // base offset (highest stack offset in the span)
-			bytesStackIndex := uint8(arg & 0xff) //nolint:gosec // 0xff implies can't overflow (and we want the sign bit too)
+			offset := int(arg >> 8)                                                   // base offset (highest stack offset in the span)
+			bytesStackIndex := uint8(arg & 0xff)                                      //nolint:gosec // 0xff implies can't overflow (and we want the sign bit too)
+			if idx := stackPtr - int(bytesStackIndex); uint(idx) >= uint(stackSize) { //nolint:gosec // negative becomes large unsigned
+				f := c.stackFault(idx, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			bytesOffset := int(stack[stackPtr-int(bytesStackIndex)])
 			wordOffset := bytesOffset / 8
+			if idx := stackPtr - offset + wordOffset; uint(idx) >= uint(stackSize) || bytesOffset < 0 { //nolint:gosec // negative becomes large unsigned
+				f := c.stackFault(idx, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
 			oldValue := stack[stackPtr-offset+wordOffset]
 			innerOffsetBits := (bytesOffset % 8) * 8
 			newValue := (oldValue & ^(0xff << innerOffsetBits)) | (Operation(accumulator&0xff) << innerOffsetBits)
@@ -616,18 +1079,103 @@ func execute(pc ImmediateData, program []Operation, accumulator int64) (int64, i
 					" oldValue: %x -> newValue: %x - SP = %d %x",
 					pc, offset, bytesStackIndex, bytesOffset, oldValue, newValue, stackPtr, stack[:stackPtr+1])
 			}
+		case LoadSB:
+			arg := op.Operand()
+			offset := int(arg >> 8)                                                   // base offset (highest stack offset in the span)
+			bytesStackIndex := uint8(arg & 0xff)                                      //nolint:gosec // 0xff implies can't overflow
+			if idx := stackPtr - int(bytesStackIndex); uint(idx) >= uint(stackSize) { //nolint:gosec // negative becomes large unsigned
+				f := c.stackFault(idx, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
+			bytesOffset := int(stack[stackPtr-int(bytesStackIndex)])
+			idx := stackPtr - offset + bytesOffset/8
+			if uint(idx) >= uint(stackSize) || bytesOffset < 0 { //nolint:gosec // negative becomes large unsigned
+				f := c.stackFault(idx, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
+			accumulator = int64(uint8(stack[idx] >> ((bytesOffset % 8) * 8))) //nolint:gosec // the byte on purpose
+			if Debug {
+				log.Debugf("LoadSB  at PC: %d, baseOffset: %d, bytesStackIndex: %d, bytesOffset: %d, value: %d - SP = %d %x",
+					pc, offset, bytesStackIndex, bytesOffset, accumulator, stackPtr, stack[:stackPtr+1])
+			}
+		case LoadRB, StoreRB:
+			arg := op.Operand()
+			bytesStackIndex := uint8(arg & 0xff)                                      //nolint:gosec // 0xff implies can't overflow
+			if idx := stackPtr - int(bytesStackIndex); uint(idx) >= uint(stackSize) { //nolint:gosec // negative becomes large unsigned
+				f := c.stackFault(idx, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
+			bytesOffset := int64(stack[stackPtr-int(bytesStackIndex)])
+			addr := pc + arg>>8 + ImmediateData(bytesOffset/8)
+			if uint64(addr) >= uint64(end) || bytesOffset < 0 { //nolint:gosec // negative becomes large unsigned
+				f := c.fault(BadMemoryAccess, pc, accumulator, stackPtr, steps)
+				return int64(f.ExitCode()), true, f
+			}
+			shift := (bytesOffset % 8) * 8
+			if op.Opcode() == LoadRB {
+				accumulator = int64(uint8(program[addr] >> shift)) //nolint:gosec // the byte on purpose
+			} else {
+				program[addr] = (program[addr] &^ (0xff << shift)) | (Operation(accumulator&0xff) << shift)
+			}
+			if Debug {
+				log.Debugf("%v at PC: %d, address: %d, bytesOffset: %d, A: %d", op.Opcode(), pc, addr, bytesOffset, accumulator)
+			}
 		default:
-			log.Errf("unknown instruction: %v at PC: %d (%x)", op.Opcode(), pc, op)
-			return accumulator, -1
+			f := c.fault(InvalidOpcode, pc, accumulator, stackPtr, steps)
+			return int64(f.ExitCode()), true, f
 		}
 		pc++
+		continue
+	jumped:
+		// a program can only run forever through jumps: that's where a single chunk checks if
+		// Execute should stop.
+		if stoppable && c.stopRequested.Load() {
+			c.save(pc, accumulator, stackPtr, steps)
+			return 0, false, nil
+		}
+	}
+	if pc != end {
+		// jumped (or returned) outside of the program.
+		f := c.fault(BadMemoryAccess, pc, accumulator, stackPtr, steps)
+		return int64(f.ExitCode()), true, f
 	}
 	log.Warnf("Program terminated without explicit Exit instruction. Accumulator: %d, PC: %d", accumulator, pc)
-	return accumulator, 0
+	c.save(pc, accumulator, stackPtr, steps)
+	return 0, true, nil
+}
+
+// setup allocates the stack and sets the default streams if this is the first execution.
+func (c *CPU) setup() {
+	if c.Stack == nil {
+		if c.StackSize <= 0 {
+			c.StackSize = DefaultStackSize
+		}
+		c.Stack = make([]Operation, c.StackSize)
+		c.StackPtr = -1
+	}
+	if c.In == nil {
+		c.In = os.Stdin
+	}
+	if c.Out == nil {
+		c.Out = os.Stdout
+	}
+}
+
+// Execute runs the program until it exits and returns the exit code, and a *Fault error if
+// the program did something invalid (the exit code is then the fault's ExitCode).
+// The program is stopped with a *LimitError (and LimitExitCode) if ctx is done or the
+// MaxInstructions or Timeout limits are reached; it can be resumed by calling Execute again
+// (after raising the limit).
+func (c *CPU) Execute(ctx context.Context) (int, error) {
+	c.setup()
+	return c.run(ctx)
 }
 
-func (c *CPU) Execute() int {
-	accumulator, exitCode := execute(c.PC, c.Program, c.Accumulator)
-	c.Accumulator = accumulator
-	return int(exitCode)
+// Step executes a single instruction. It returns the exit code and true if the program ended,
+// and the *Fault if that instruction was invalid.
+func (c *CPU) Step() (int, bool, error) {
+	c.setup()
+	exitCode, done, err := c.execute(1)
+	c.Executed += 1 - c.stepsLeft
+	return int(exitCode), done, err
 }
@@ -2,6 +2,10 @@ package cpu
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"slices"
 	"testing"
 )
 
@@ -468,7 +472,7 @@ func TestSysPrint(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			var buf bytes.Buffer
-			n := sysWrite8(&buf, tt.memory, tt.addr, tt.offset)
+			n := (&CPU{Out: &buf}).sysWrite8(tt.memory, tt.addr, tt.offset)
 			if n != tt.wantN {
 				t.Errorf("sysPrint() returned %d, want %d", n, tt.wantN)
 			}
@@ -499,12 +503,13 @@ func BenchmarkSysWrite(b *testing.B) {
 	memory[1] = Operation(0x0A21646C726F)
 
 	var buf bytes.Buffer
+	c := &CPU{Out: &buf}
 	b.ReportAllocs()
 	b.ResetTimer()
 
 	for b.Loop() {
 		buf.Reset()
-		sysWrite8(&buf, memory, 0, 0)
+		c.sysWrite8(memory, 0, 0)
 	}
 	str := buf.String()
 	if str != "Hello\nWorld!\n" {
@@ -523,12 +528,12 @@ func BenchmarkSysWriteNoBuffer(b *testing.B) {
 	// o(0x6F), r(0x72), l(0x6C), d(0x64), !(0x21), \n(0x0A)
 	memory[1] = Operation(0x0A21646C726F)
 
-	var discard DiscardWriter
+	c := &CPU{Out: DiscardWriter{}}
 	b.ReportAllocs()
 	b.ResetTimer()
 
 	for b.Loop() {
-		sysWrite8(discard, memory, 0, 0)
+		c.sysWrite8(memory, 0, 0)
 	}
 }
 
@@ -540,12 +545,171 @@ func BenchmarkSysRead(b *testing.B) {
 	input := []byte("Hello")
 	// Pre-create the reader outside the loop (allocated once before timing)
 	reader := bytes.NewReader(input)
+	c := &CPU{In: reader}
 
 	b.ReportAllocs()
 	b.ResetTimer()
 
 	for b.Loop() {
 		reader.Reset(input)
-		sysRead8(reader, memory, 0, len(input))
+		c.sysRead8(memory, 0, len(input))
+	}
+}
+
+func TestStr16(t *testing.T) {
+	long := bytes.Repeat([]byte("0123456789"), 30) // more than a str8 can hold.
+	ops := SerializeStr16(long)
+	if ops[0]&0xFFFF != 300 || len(ops) != 38 { // (2 + 300 + 7) / 8 words.
+		t.Fatalf("SerializeStr16 got length %d in %d words", ops[0]&0xFFFF, len(ops))
+	}
+	if got := SerializeStr16([]byte("ABC")); len(got) != 1 || got[0] != 0x434241_0003 {
+		t.Errorf("SerializeStr16(ABC) = %x", got)
+	}
+	var out bytes.Buffer
+	c := NewCPU(bytes.NewReader(long), &out, nil)
+	memory := append(ops, make([]Operation, 40)...)
+	if n, _, ok := c.executeSyscall(Write16, 0, 0, memory, 0, false, nil, 0); !ok || n != 300 || !bytes.Equal(out.Bytes(), long) {
+		t.Errorf("Write16 got %d %v %q", n, ok, out.String())
+	}
+	// SysS variants: read in a stack buffer whose first word is at index 39, then write from it.
+	stack := make([]Operation, 40)
+	if n, _, ok := c.executeSyscall(Read16, 39, 300, nil, 0, true, stack, 39); !ok || n != 300 {
+		t.Fatalf("Read16 got %d %v", n, ok)
+	}
+	if !slices.Equal(stack[:len(ops)], ops) {
+		t.Errorf("Read16 stored %x, expected %x", stack[:len(ops)], ops)
+	}
+	out.Reset()
+	if n, _, ok := c.executeSyscall(Write16, 39, 0, nil, 0, true, stack, 39); !ok || n != 300 || !bytes.Equal(out.Bytes(), long) {
+		t.Errorf("SysS Write16 got %d %v %q", n, ok, out.String())
+	}
+	if _, _, ok := c.executeSyscall(Read16, 0, 1<<16, memory, 0, false, nil, 0); ok {
+		t.Errorf("Read16 of more than 65535 bytes should fail")
+	}
+}
+
+// TestByteInstructions checks the packing of the operands (base in the 48 bits operand, stack
+// index of the byte offset in the low 8 bits) and of the bytes in the words, on each engine.
+func TestByteInstructions(t *testing.T) {
+	tests := []struct {
+		name     string
+		program  []Operation
+		expected ImmediateData // accumulator
+		word     int           // index of the modified word, in the program or in the stack.
+		value    Operation     // expected value of that word.
+		inStack  bool
+	}{
+		{
+			name: "StoreSB",
+			program: []Operation{
+				instr(LoadI, 9), // byte offset: byte 1 of the 2nd word
+				instr(Push, 2),
+				instr(LoadI, 0x1C3),    // only the low byte is stored
+				instr(StoreSB, 2<<8|0), // base 2 is stack[0] and the byte offset is on top (SP - 0)
+				sys(Sys, Exit, 0),
+			},
+			expected: 0x1C3, word: 1, value: 0xC300, inStack: true,
+		},
+		{
+			name: "LoadSB",
+			program: []Operation{
+				instr(LoadI, 0x7788),
+				instr(Push, 1),
+				instr(LoadI, 1), // byte offset
+				instr(Push, 0),
+				instr(LoadSB, 1<<8|0), // 2nd byte of stack[1]
+				sys(Sys, Exit, 0),
+			},
+			expected: 0x77, word: 1, value: 0x7788, inStack: true,
+		},
+		{
+			name: "LoadSB unsigned",
+			program: []Operation{
+				instr(LoadI, -2),
+				instr(Push, 1),
+				instr(LoadI, 15), // byte offset: last byte of the 2nd word
+				instr(Push, 0),
+				instr(LoadSB, 2<<8|0), // base 2 is stack[0]
+				sys(Sys, Exit, 0),
+			},
+			expected: 0xFF, word: 1, value: -2, inStack: true,
+		},
+		{
+			name: "StoreRB",
+			program: []Operation{
+				instr(LoadI, 10), // byte offset: byte 2 of the 2nd word
+				instr(Push, 0),
+				instr(LoadI, 0x1AB),
+				instr(StoreRB, 3<<8|0), // base: PC 6
+				sys(Sys, Exit, 0),
+				0,
+				0x0706050403020100,
+				0x0F0E0D0C0B0A0908,
+			},
+			expected: 0x1AB, word: 7, value: 0x0F0E0D0C0BAB0908,
+		},
+		{
+			name: "LoadRB",
+			program: []Operation{
+				instr(LoadI, 13),
+				instr(Push, 0),
+				instr(LoadRB, 3<<8|0), // base: PC 5
+				sys(Sys, Exit, 0),
+				0,
+				0x0706050403020100,
+				-0x0102030405060708, // 0xFEFDFCFBFAF9F8F8
+			},
+			expected: 0xFC, word: 6, value: -0x0102030405060708,
+		},
+	}
+	for _, tt := range tests {
+		for _, engine := range []Engine{SwitchEngine, ThreadedEngine, JITEngine} {
+			t.Run(fmt.Sprintf("%s/%v", tt.name, engine), func(t *testing.T) {
+				c := NewCPU(nil, nil, nil)
+				c.Program = slices.Clone(tt.program)
+				c.Engine = engine
+				if code, err := c.Execute(context.Background()); code != 0 || err != nil {
+					t.Fatalf("got exit code %d, %v", code, err)
+				}
+				if c.Accumulator != int64(tt.expected) {
+					t.Errorf("accumulator %x, expected %x", c.Accumulator, tt.expected)
+				}
+				words := c.Program
+				if tt.inStack {
+					words = c.Stack
+				}
+				if words[tt.word] != tt.value {
+					t.Errorf("word %d is %x, expected %x", tt.word, words[tt.word], tt.value)
+				}
+			})
+		}
+	}
+}
+
+func TestShifts(t *testing.T) {
+	tests := []struct {
+		a, n       int64
+		shift, shr int64
+	}{
+		{1, 3, 8, 0},
+		{-256, 4, -4096, 0x0FFF_FFFF_FFFF_FFF0},
+		{-256, -4, -16, -4096},
+		{1, 63, math.MinInt64, 0},
+		{1, 64, 0, 0},
+		{-1, -63, -1, math.MinInt64},
+		{-1, -64, -1, 0},
+		{math.MinInt64, 63, 0, 1},
+		{math.MinInt64, -63, -1, 0},
+		{5, 1000, 0, 0},
+		{-5, -1000, -1, 0},
+		{5, -1000, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := Shift(tt.a, tt.n); got != tt.shift {
+			t.Errorf("Shift(%d, %d) = %d, expected %d", tt.a, tt.n, got, tt.shift)
+		}
+		if got := Shr(tt.a, tt.n); got != tt.shr {
+			t.Errorf("Shr(%d, %d) = %d, expected %d", tt.a, tt.n, got, tt.shr)
+		}
 	}
 }
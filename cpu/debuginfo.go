@@ -0,0 +1,164 @@
+package cpu
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SourceInfo is where a program word comes from in the assembly source.
+type SourceInfo struct {
+	File     string
+	Line     int
+	Column   int
+	Label    string // Closest label defined before the word.
+	Function string // Closest Call target label defined before the word.
+	Text     string // Source of the statement (without the comment).
+}
+
+// String returns the position and source, e.g. "fact.asm:25 muls n", or "" if unknown.
+func (s SourceInfo) String() string {
+	if s.File == "" && s.Line == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d %s", s.File, s.Line, strings.ReplaceAll(s.Text, "\n", `\n`))
+}
+
+// DebugInfo is the source of each program word, indexed by PC. It is stored in the
+// DebugSection of version 2 .vm files.
+type DebugInfo []SourceInfo
+
+// At returns the source of the word at pc, the zero SourceInfo if unknown.
+func (d DebugInfo) At(pc ImmediateData) SourceInfo {
+	if pc < 0 || int(pc) >= len(d) {
+		return SourceInfo{}
+	}
+	return d[pc]
+}
+
+// Encode returns the binary form of the debug info: the number of strings followed by each
+// string (length and bytes) then, for each PC, the file, line, column, label, function and text
+// (strings as indices in that table), all as unsigned varints.
+func (d DebugInfo) Encode() []byte {
+	index := map[string]uint64{}
+	var table []string
+	str := func(s string) uint64 {
+		i, ok := index[s]
+		if !ok {
+			i = uint64(len(table))
+			index[s] = i
+			table = append(table, s)
+		}
+		return i
+	}
+	var entries []byte
+	for _, s := range d {
+		entries = binary.AppendUvarint(entries, str(s.File))
+		entries = binary.AppendUvarint(entries, uint64(s.Line))   //nolint:gosec // not negative.
+		entries = binary.AppendUvarint(entries, uint64(s.Column)) //nolint:gosec // not negative.
+		entries = binary.AppendUvarint(entries, str(s.Label))
+		entries = binary.AppendUvarint(entries, str(s.Function))
+		entries = binary.AppendUvarint(entries, str(s.Text))
+	}
+	data := binary.AppendUvarint(nil, uint64(len(table)))
+	for _, s := range table {
+		data = binary.AppendUvarint(data, uint64(len(s)))
+		data = append(data, s...)
+	}
+	return append(data, entries...)
+}
+
+// DecodeDebugInfo parses the output of DebugInfo.Encode.
+func DecodeDebugInfo(data []byte) (DebugInfo, error) {
+	errTruncated := errors.New("truncated debug info")
+	next := func() (uint64, error) {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, errTruncated
+		}
+		data = data[n:]
+		return v, nil
+	}
+	count, err := next()
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(len(data)) {
+		return nil, errTruncated
+	}
+	table := make([]string, count)
+	for i := range table {
+		n, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(data)) {
+			return nil, errTruncated
+		}
+		table[i] = string(data[:n])
+		data = data[n:]
+	}
+	var d DebugInfo
+	var fields [6]uint64
+	for len(data) > 0 {
+		for i := range fields {
+			if fields[i], err = next(); err != nil {
+				return nil, err
+			}
+		}
+		for _, i := range []int{0, 3, 4, 5} {
+			if fields[i] >= count {
+				return nil, fmt.Errorf("invalid string index %d (%d strings)", fields[i], count)
+			}
+		}
+		d = append(d, SourceInfo{
+			File: table[fields[0]], Line: int(fields[1]), Column: int(fields[2]), //nolint:gosec // small values.
+			Label: table[fields[3]], Function: table[fields[4]], Text: table[fields[5]],
+		})
+	}
+	return d, nil
+}
+
+// where returns " (file:line text)" for pc when the debug info has its source, "" otherwise, to
+// append to the messages giving a PC.
+func (c *CPU) where(pc ImmediateData) string {
+	if s := c.Source.At(pc).String(); s != "" {
+		return " (" + s + ")"
+	}
+	return ""
+}
+
+// StackTrace describes the current PC and the calls leading to it, most recent first, with
+// the source from the debug info. The return addresses are found using the static stack depth
+// of each PC (as computed by Verify), so the trace stops at code that doesn't verify.
+func (c *CPU) StackTrace() []string {
+	frames := frameDepths(c.Program, c.entry)
+	var trace []string
+	pc, stackPtr := c.PC, c.StackPtr
+	for range len(c.Stack) + 1 {
+		s := c.Source.At(pc)
+		line := fmt.Sprintf("PC %d", pc)
+		if str := s.String(); str != "" {
+			line += " " + str
+		}
+		if s.Function != "" {
+			line += " in " + s.Function
+		}
+		trace = append(trace, line)
+		f, ok := frames[pc]
+		if !ok || f.main {
+			break
+		}
+		idx := stackPtr - f.depth // return address.
+		if idx < 0 || idx >= len(c.Stack) {
+			break
+		}
+		call := ImmediateData(c.Stack[idx]) - 1
+		if call < 0 || int(call) >= len(c.Program) || c.Program[call].Opcode() != Call {
+			break
+		}
+		pc, stackPtr = call, idx-1
+	}
+	return trace
+}
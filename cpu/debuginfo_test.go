@@ -0,0 +1,84 @@
+package cpu
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDebugInfoEncoding(t *testing.T) {
+	info := DebugInfo{
+		{File: "a.asm", Line: 3, Column: 5, Label: "start", Text: "loadi 1"},
+		{File: "a.asm", Line: 4, Column: 5, Label: "start", Text: "call f"},
+		{},
+		{File: "b.asm", Line: 300, Column: 1, Label: "f", Function: "f", Text: "str8 `a\nb`"},
+	}
+	got, err := DecodeDebugInfo(info.Encode())
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, info) {
+		t.Errorf("got %+v, expected %+v", got, info)
+	}
+	if s := info.At(3).String(); s != `b.asm:300 str8 `+"`a\\nb`" {
+		t.Errorf("unexpected String() %q", s)
+	}
+	if s := info.At(2).String() + info.At(-1).String() + info.At(4).String(); s != "" {
+		t.Errorf("expected no source, got %q", s)
+	}
+	data := info.Encode()
+	for _, bad := range [][]byte{{}, {5}, {1, 10, 'a'}, data[:len(data)-1], append([]byte{1, 0}, 7, 1, 1, 0, 0, 0)} {
+		if _, err := DecodeDebugInfo(bad); err == nil {
+			t.Errorf("expected an error decoding %v", bad)
+		}
+	}
+}
+
+// sourceProgram calls f, which calls g with a variable on the stack, which divides by 0.
+func sourceProgram() ([]Operation, DebugInfo) {
+	program := []Operation{
+		instr(LoadI, 4),
+		instr(Call, 2),
+		sys(Sys, Exit, 0),
+		instr(Push, 1), // f: 2 variables, the first (4) looks like a return address after the Call f.
+		instr(Call, 3),
+		instr(Ret, 1),
+		0,
+		instr(DivI, 0), // g:
+		instr(Ret, 0),
+	}
+	info := make(DebugInfo, len(program))
+	for pc := range info {
+		info[pc] = SourceInfo{File: "t.asm", Line: pc + 1, Column: 1, Text: program[pc].Opcode().String()}
+		switch {
+		case pc >= 7:
+			info[pc].Function = "g"
+		case pc >= 3:
+			info[pc].Function = "f"
+		}
+	}
+	return program, info
+}
+
+func TestSourceFaultAndStackTrace(t *testing.T) {
+	program, info := sourceProgram()
+	c := NewCPU(strings.NewReader(""), nil, nil)
+	if err := c.LoadImage(&Image{Code: program, Debug: info.Encode()}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := c.Execute(context.Background())
+	var f *Fault
+	if !errors.As(err, &f) || f.Kind != DivideByZero {
+		t.Fatalf("expected a DivideByZero fault, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "at PC 7 (t.asm:8 DivI): DivI 0") {
+		t.Errorf("expected the source in %q", err.Error())
+	}
+	expected := []string{"PC 7 t.asm:8 DivI in g", "PC 4 t.asm:5 Call in f", "PC 1 t.asm:2 Call"}
+	if trace := c.StackTrace(); !slices.Equal(trace, expected) {
+		t.Errorf("got trace %q, expected %q", trace, expected)
+	}
+}
@@ -0,0 +1,66 @@
+package cpu
+
+import "fmt"
+
+// FaultKind is the type of invalid operation a program attempted.
+type FaultKind uint8
+
+const (
+	NoFault FaultKind = iota
+
+	BadMemoryAccess // Relative address (or jump target, syscall buffer) outside of the program memory
+	StackOverflow   // Push/Call beyond the stack size or stack access above it
+	StackUnderflow  // Pop/Ret of an empty stack or stack access below it
+	DivideByZero    // Div/Mod/IdivS by 0
+	InvalidOpcode   // Unknown instruction
+
+	LastFault
+)
+
+//go:generate stringer -type=FaultKind
+var _ = LastFault.String() // force compile error if go generate is missing.
+
+// FaultExitCodeBase is added to the FaultKind to get the exit code of a program that faulted.
+const FaultExitCodeBase = 100
+
+// Fault is the error returned by Execute when the program attempts an invalid operation.
+type Fault struct {
+	Kind     FaultKind
+	PC       ImmediateData
+	Op       Operation // Instruction that caused the fault.
+	StackPtr int
+	Source   SourceInfo // Where the instruction comes from, if the program has debug info.
+}
+
+func (f *Fault) Error() string {
+	where := ""
+	if s := f.Source.String(); s != "" {
+		where = " (" + s + ")"
+	}
+	return fmt.Sprintf("%v at PC %d%s: %v %d (%x), SP = %d", f.Kind, f.PC, where, f.Op.Opcode(), f.Op.Operand(),
+		uint64(f.Op), //nolint:gosec // on purpose
+		f.StackPtr)
+}
+
+// ExitCode returns the exit code for a program that ended with this fault.
+func (f *Fault) ExitCode() int {
+	return FaultExitCodeBase + int(f.Kind)
+}
+
+// fault saves the state, so it can be inspected, and returns the fault error.
+func (c *CPU) fault(kind FaultKind, pc ImmediateData, accumulator int64, stackPtr int, steps int64) *Fault {
+	c.save(pc, accumulator, stackPtr, steps)
+	f := &Fault{Kind: kind, PC: pc, StackPtr: stackPtr, Source: c.Source.At(pc)}
+	if pc >= 0 && int(pc) < len(c.Program) {
+		f.Op = c.Program[pc] // otherwise we jumped outside the program and there is no instruction.
+	}
+	return f
+}
+
+// stackFault returns the fault for an out of range stack index.
+func (c *CPU) stackFault(idx int, pc ImmediateData, accumulator int64, stackPtr int, steps int64) *Fault {
+	if idx < 0 {
+		return c.fault(StackUnderflow, pc, accumulator, stackPtr, steps)
+	}
+	return c.fault(StackOverflow, pc, accumulator, stackPtr, steps)
+}
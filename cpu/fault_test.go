@@ -0,0 +1,101 @@
+package cpu
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var faultTests = []struct {
+	name     string
+	program  []Operation
+	kind     FaultKind
+	pc       ImmediateData
+	stackPtr int
+}{
+	{"LoadR out of range", []Operation{instr(LoadR, 100)}, BadMemoryAccess, 0, -1},
+	{"StoreR negative", []Operation{instr(LoadI, 1), instr(StoreR, -5)}, BadMemoryAccess, 1, -1},
+	{"IncrR out of range", []Operation{instr(IncrR, 3<<8|1)}, BadMemoryAccess, 0, -1},
+	{"jump outside", []Operation{instr(JumpR, -5)}, BadMemoryAccess, -5, -1},
+	{"syscall buffer", []Operation{sys(Sys, Write8, 1000)}, BadMemoryAccess, 0, -1},
+	{"infinite recursion", []Operation{instr(Call, 0)}, StackOverflow, 0, DefaultStackSize - 1},
+	{"push too much", []Operation{instr(Push, DefaultStackSize)}, StackOverflow, 0, -1},
+	{"pop empty", []Operation{instr(Pop, 0)}, StackUnderflow, 0, -1},
+	{"ret empty", []Operation{instr(Ret, 0)}, StackUnderflow, 0, -1},
+	{"ret too many", []Operation{instr(Push, 0), instr(Ret, 1)}, StackUnderflow, 1, 0},
+	{"loads below", []Operation{instr(LoadS, 3)}, StackUnderflow, 0, -1},
+	{"stores above", []Operation{instr(StoreS, -DefaultStackSize-1)}, StackOverflow, 0, -1},
+	{"loadsb below", []Operation{instr(Push, 0), instr(LoadSB, 1<<8)}, StackUnderflow, 1, 0},
+	{"loadrb out of range", []Operation{instr(LoadI, 24), instr(Push, 0), instr(LoadRB, 1<<8)}, BadMemoryAccess, 2, 0},
+	{"storerb negative", []Operation{instr(LoadI, -1), instr(Push, 0), instr(StoreRB, 0)}, BadMemoryAccess, 2, 0},
+	{"divi", []Operation{instr(DivI, 0)}, DivideByZero, 0, -1},
+	{"modi", []Operation{instr(ModI, 0)}, DivideByZero, 0, -1},
+	{"divs", []Operation{instr(Push, 0), instr(LoadI, 5), instr(DivS, 0)}, DivideByZero, 2, 0},
+	{"idivs", []Operation{instr(Push, 0), instr(IdivS, 0)}, DivideByZero, 1, 0},
+	{"divr", []Operation{instr(DivR, 1), 0}, DivideByZero, 0, -1},
+	{"modr", []Operation{instr(LoadI, 3), instr(ModR, 1), 0}, DivideByZero, 1, -1},
+	{"mods", []Operation{instr(Push, 0), instr(LoadI, 5), instr(ModS, 0)}, DivideByZero, 2, 0},
+	{"orr out of range", []Operation{instr(OrR, 2)}, BadMemoryAccess, 0, -1},
+	{"shifts below", []Operation{instr(Push, 0), instr(ShiftS, 1)}, StackUnderflow, 1, 0},
+	{"jlts below", []Operation{instr(Push, 0), instr(JLTS, 1<<8|1)}, StackUnderflow, 1, 0},
+	{"jner out of range", []Operation{instr(JNER, 2), -200}, BadMemoryAccess, 0, -1},
+	{"jner without address", []Operation{instr(JNER, 1)}, BadMemoryAccess, 0, -1},
+	{"invalid opcode", []Operation{Operation(0xFF)}, InvalidOpcode, 0, -1},
+}
+
+func TestFaults(t *testing.T) {
+	for _, tt := range faultTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out, errOut bytes.Buffer
+			c := NewCPU(strings.NewReader(""), &out, &errOut)
+			c.Program = tt.program
+			code, err := c.Execute(context.Background())
+			var f *Fault
+			if !errors.As(err, &f) {
+				t.Fatalf("expected a Fault, got %v (exit code %d)", err, code)
+			}
+			if f.Kind != tt.kind || f.PC != tt.pc || f.StackPtr != tt.stackPtr {
+				t.Errorf("got %v, expected %v at PC %d SP %d", f, tt.kind, tt.pc, tt.stackPtr)
+			}
+			if code != FaultExitCodeBase+int(tt.kind) || code != f.ExitCode() {
+				t.Errorf("exit code %d, expected %d", code, FaultExitCodeBase+int(tt.kind))
+			}
+			if tt.pc >= 0 && f.Op != tt.program[tt.pc] {
+				t.Errorf("fault instruction %x, expected %x", f.Op, tt.program[tt.pc])
+			}
+			if c.PC != tt.pc {
+				t.Errorf("CPU PC %d, expected %d", c.PC, tt.pc)
+			}
+		})
+	}
+}
+
+func TestStackSize(t *testing.T) {
+	// recurse 100 times: decrements A and calls itself until 0 then returns all the way.
+	program := []Operation{
+		instr(LoadI, 100),
+		instr(Call, 3),
+		sys(Sys, Exit, 0),
+		Operation(0), // unused
+		instr(JEQ, 3<<8|0),
+		instr(SubI, 1),
+		instr(Call, -2),
+		instr(Ret, 0),
+	}
+	for _, size := range []int{0, 101, 200} {
+		c := &CPU{Program: slices.Clone(program), StackSize: size}
+		code, err := c.Execute(context.Background())
+		if err != nil || code != 0 {
+			t.Errorf("stack size %d: unexpected %d %v", size, code, err)
+		}
+	}
+	c := &CPU{Program: slices.Clone(program), StackSize: 100}
+	_, err := c.Execute(context.Background())
+	var f *Fault
+	if !errors.As(err, &f) || f.Kind != StackOverflow || f.StackPtr != 99 || len(c.Stack) != 100 {
+		t.Errorf("expected stack overflow at 99 with a 100 entries stack, got %v (%d)", err, len(c.Stack))
+	}
+}
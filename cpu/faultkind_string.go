@@ -0,0 +1,30 @@
+// Code generated by "stringer -type=FaultKind"; DO NOT EDIT.
+
+package cpu
+
+import "strconv"
+
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[NoFault-0]
+	_ = x[BadMemoryAccess-1]
+	_ = x[StackOverflow-2]
+	_ = x[StackUnderflow-3]
+	_ = x[DivideByZero-4]
+	_ = x[InvalidOpcode-5]
+	_ = x[LastFault-6]
+}
+
+const _FaultKind_name = "NoFaultBadMemoryAccessStackOverflowStackUnderflowDivideByZeroInvalidOpcodeLastFault"
+
+var _FaultKind_index = [...]uint8{0, 7, 22, 35, 49, 61, 74, 83}
+
+func (i FaultKind) String() string {
+	idx := int(i) - 0
+	if i < 0 || idx >= len(_FaultKind_index)-1 {
+		return "FaultKind(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _FaultKind_name[_FaultKind_index[idx]:_FaultKind_index[idx+1]]
+}
@@ -0,0 +1,476 @@
+package cpu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"fortio.org/log"
+)
+
+// The version 2 .vm container starts with HEADER2 (HEADER with the version byte set to 2)
+// followed by a section table and the sections, all little-endian:
+//
+//	HEADER2                                  8 bytes
+//	number of sections                       uint32
+//	reserved (0)                             uint32
+//	for each section: kind, reserved (0)     uint32, uint32
+//	                  offset, size in bytes  uint64, uint64 (offset from the start of the file)
+//	sections data                            each starting on an 8 bytes boundary
+//
+// Sections of unknown kinds are skipped so newer files with extra metadata still load.
+// Version 1 files are HEADER followed directly by the program words. Object files (from
+// `vm compile -c`, for `vm link`) use the same layout starting with OBJHEADER.
+
+// SectionKind identifies the content of a section of a version 2 .vm file.
+type SectionKind uint32
+
+const (
+	InvalidSection SectionKind = iota
+
+	CodeSection      // Program words, loaded at address 0
+	DataSection      // Initialized data words, loaded right after the code
+	SymbolsSection   // Labels: for each, the address (int64), the name length (uint16) and the name
+	DebugSection     // Source-line debug info, see DebugInfo.Encode
+	StackSizeSection // Stack size (uint64 number of words) the program needs
+	EntrySection     // PC (int64) to start the execution at
+	ISASection       // Instruction set version (uint64) the program needs
+	// Object files only:
+	ExportsSection     // Names (uint16 length and bytes) of the Symbols other objects can use
+	ImportsSection     // Names of the symbols defined in other objects
+	RelocationsSection // For each: the PC (uint64), import index (uint32) and 1 for a 48 bits operand (uint32)
+
+	LastSection
+)
+
+//go:generate stringer -type=SectionKind
+var _ = LastSection.String() // force compile error if go generate is missing.
+
+const (
+	// HEADER2 starts the version 2 (sectioned) VM binary format.
+	HEADER2 = "\x02GROL VM"
+	// OBJHEADER starts the object files, which have the version 2 layout.
+	OBJHEADER = "\x02GROL VO"
+	// ISAVersion is the instruction set version implemented by this VM, checked against the
+	// ISASection of version 2 files. 2 added the Read16 and Write16 syscalls, 3 the LoadSB,
+	// LoadRB and StoreRB byte instructions, 4 the bitwise ones (OrI to ShiftS) and 5 the full
+	// range compare and branch ones (JNES to JLTER).
+	ISAVersion = 5
+
+	sectionEntrySize    = 24
+	relocationEntrySize = 16
+)
+
+// Symbol is a named address (label) of a program.
+type Symbol struct {
+	Name    string
+	Address ImmediateData
+}
+
+// Relocation is an operand of an object file to patch, when linking, with the relative address
+// of an imported symbol.
+type Relocation struct {
+	PC      ImmediateData
+	Import  int  // Index in Imports.
+	Is48bit bool // Operand in the upper 48 bits (jumps, syscalls, IncrR) instead of all 56 bits.
+}
+
+// Image is the content of a .vm (or object) file.
+type Image struct {
+	Version   int // File format version: 1 (HEADER then the code) or 2 (sections).
+	Code      []Operation
+	Data      []Operation // Loaded after Code.
+	Symbols   []Symbol
+	Debug     []byte
+	StackSize int           // Stack words the program needs, 0 if unspecified.
+	Entry     ImmediateData // PC to start at.
+	ISA       int           // Instruction set version the program needs, 0 if unspecified.
+	// Object files only:
+	Object      bool     // Written with OBJHEADER.
+	Exports     []string // Symbols other objects can use.
+	Imports     []string // Symbols defined in other objects.
+	Relocations []Relocation
+}
+
+// Memory returns the initial program memory: the code followed by the data.
+func (img *Image) Memory() []Operation {
+	return slices.Concat(img.Code, img.Data)
+}
+
+// ReadHeader reads and checks the HEADER (or HEADER2) at the start of a VM binary and returns
+// the file format version.
+func ReadHeader(r io.Reader) (int, error) {
+	header := make([]byte, len(HEADER))
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read header: %w", err)
+	}
+	switch string(header) {
+	case HEADER:
+		return 1, nil
+	case HEADER2:
+		return 2, nil
+	case OBJHEADER:
+		return 0, errors.New("object file, it needs to be linked (vm link) first")
+	default:
+		return 0, fmt.Errorf("invalid header: %q", string(header))
+	}
+}
+
+// ReadImage reads a version 1 or 2 VM binary.
+func ReadImage(r io.Reader) (*Image, error) {
+	version, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{Version: version}
+	if version == 1 {
+		img.Code, err = decodeWords(rest)
+		return img, err
+	}
+	err = img.readSections(rest)
+	if err != nil {
+		return nil, err
+	}
+	if err = img.checkISA(); err != nil {
+		return nil, err
+	}
+	return img, img.checkEntry()
+}
+
+// ReadObject reads an object file.
+func ReadObject(r io.Reader) (*Image, error) {
+	header := make([]byte, len(OBJHEADER))
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	if string(header) != OBJHEADER {
+		return nil, fmt.Errorf("not an object file, invalid header: %q", string(header))
+	}
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{Version: 2, Object: true}
+	if err = img.readSections(rest); err != nil {
+		return nil, err
+	}
+	for _, r := range img.Relocations {
+		if r.Import >= len(img.Imports) || r.PC < 0 || int(r.PC) >= len(img.Code)+len(img.Data) {
+			return nil, fmt.Errorf("invalid relocation %+v", r)
+		}
+	}
+	return img, img.checkISA()
+}
+
+func (img *Image) checkEntry() error {
+	if size := len(img.Code) + len(img.Data); img.Entry < 0 || int(img.Entry) >= size {
+		return fmt.Errorf("invalid entry point %d (0 to %d)", img.Entry, size-1)
+	}
+	return nil
+}
+
+func (img *Image) checkISA() error {
+	if img.ISA > ISAVersion {
+		return fmt.Errorf("program needs instruction set version %d, this VM implements %d", img.ISA, ISAVersion)
+	}
+	return nil
+}
+
+// ReadImageFile reads a version 1 or 2 .vm file.
+func ReadImageFile(file string) (*Image, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadImage(f)
+}
+
+// readSections decodes the section table and sections of a version 2 file, rest being the
+// bytes following the header.
+func (img *Image) readSections(rest []byte) error {
+	if len(rest) < 8 {
+		return errors.New("truncated section table")
+	}
+	count := uint64(binary.LittleEndian.Uint32(rest))
+	if uint64(len(rest)-8) < count*sectionEntrySize {
+		return fmt.Errorf("truncated section table (%d sections)", count)
+	}
+	seen := make(map[SectionKind]bool)
+	for i := range count {
+		entry := rest[8+i*sectionEntrySize:]
+		kind := SectionKind(binary.LittleEndian.Uint32(entry))
+		offset := binary.LittleEndian.Uint64(entry[8:])
+		size := binary.LittleEndian.Uint64(entry[16:])
+		// Offsets are from the start of the file, rest starts after the header.
+		start := offset - uint64(len(HEADER))
+		if offset < uint64(len(HEADER)) || start > uint64(len(rest)) || size > uint64(len(rest))-start {
+			return fmt.Errorf("%v at %d (%d bytes) is outside of the file", kind, offset, size)
+		}
+		if seen[kind] {
+			return fmt.Errorf("duplicate %v", kind)
+		}
+		seen[kind] = true
+		if err := img.readSection(kind, rest[start:start+size]); err != nil {
+			return fmt.Errorf("invalid %v: %w", kind, err)
+		}
+	}
+	if !seen[CodeSection] {
+		return errors.New("no CodeSection")
+	}
+	return nil
+}
+
+func (img *Image) readSection(kind SectionKind, data []byte) error {
+	var err error
+	switch kind { //nolint:exhaustive // unknown sections are skipped.
+	case CodeSection:
+		img.Code, err = decodeWords(data)
+	case DataSection:
+		img.Data, err = decodeWords(data)
+	case SymbolsSection:
+		img.Symbols, err = decodeSymbols(data)
+	case DebugSection:
+		img.Debug = data
+	case ExportsSection:
+		img.Exports, err = decodeNames(data)
+	case ImportsSection:
+		img.Imports, err = decodeNames(data)
+	case RelocationsSection:
+		img.Relocations, err = decodeRelocations(data)
+	case StackSizeSection, EntrySection, ISASection:
+		if len(data) != 8 {
+			return fmt.Errorf("expected 8 bytes, got %d", len(data))
+		}
+		v := binary.LittleEndian.Uint64(data)
+		switch kind { //nolint:exhaustive // the 3 single value kinds.
+		case StackSizeSection:
+			if v == 0 || v > MaxStackSize {
+				return fmt.Errorf("invalid stack size %d (1 to %d)", v, MaxStackSize)
+			}
+			img.StackSize = int(v) //nolint:gosec // checked just above.
+		case EntrySection:
+			img.Entry = ImmediateData(v) //nolint:gosec // signed on purpose.
+		default:
+			img.ISA = int(v) //nolint:gosec // compared with ISAVersion.
+		}
+	default:
+		log.LogVf("Skipping unknown section %v (%d bytes)", kind, len(data))
+	}
+	return err
+}
+
+func decodeWords(data []byte) ([]Operation, error) {
+	if len(data)%OperationSize != 0 {
+		return nil, fmt.Errorf("size %d is not a multiple of %d", len(data), OperationSize)
+	}
+	words := make([]Operation, len(data)/OperationSize)
+	for i := range words {
+		words[i] = Operation(binary.LittleEndian.Uint64(data[i*OperationSize:])) //nolint:gosec // on purpose
+	}
+	return words, nil
+}
+
+func decodeSymbols(data []byte) ([]Symbol, error) {
+	var symbols []Symbol
+	for len(data) > 0 {
+		if len(data) < 10 {
+			return nil, errors.New("truncated symbol")
+		}
+		addr := ImmediateData(binary.LittleEndian.Uint64(data)) //nolint:gosec // signed on purpose.
+		n := int(binary.LittleEndian.Uint16(data[8:]))
+		data = data[10:]
+		if len(data) < n {
+			return nil, errors.New("truncated symbol name")
+		}
+		symbols = append(symbols, Symbol{Name: string(data[:n]), Address: addr})
+		data = data[n:]
+	}
+	return symbols, nil
+}
+
+func decodeNames(data []byte) ([]string, error) {
+	var names []string
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, errors.New("truncated name")
+		}
+		n := int(binary.LittleEndian.Uint16(data))
+		if len(data) < 2+n {
+			return nil, errors.New("truncated name")
+		}
+		names = append(names, string(data[2:2+n]))
+		data = data[2+n:]
+	}
+	return names, nil
+}
+
+func encodeNames(names []string) ([]byte, error) {
+	var data []byte
+	for _, name := range names {
+		if len(name) > 0xFFFF {
+			return nil, fmt.Errorf("name too long: %d bytes", len(name))
+		}
+		data = binary.LittleEndian.AppendUint16(data, uint16(len(name)))
+		data = append(data, name...)
+	}
+	return data, nil
+}
+
+func decodeRelocations(data []byte) ([]Relocation, error) {
+	if len(data)%relocationEntrySize != 0 {
+		return nil, fmt.Errorf("size %d is not a multiple of %d", len(data), relocationEntrySize)
+	}
+	relocations := make([]Relocation, 0, len(data)/relocationEntrySize)
+	for ; len(data) > 0; data = data[relocationEntrySize:] {
+		relocations = append(relocations, Relocation{
+			PC:      ImmediateData(binary.LittleEndian.Uint64(data)), //nolint:gosec // checked by ReadObject.
+			Import:  int(binary.LittleEndian.Uint32(data[8:])),
+			Is48bit: binary.LittleEndian.Uint32(data[12:]) != 0,
+		})
+	}
+	return relocations, nil
+}
+
+// Write writes the image in the version 2 format, or as an object file if Object is set. Empty
+// sections are omitted, as are the stack size, entry point and ISA version when 0.
+func (img *Image) Write(w io.Writer) error {
+	type section struct {
+		kind SectionKind
+		data []byte
+	}
+	var sections []section
+	add := func(kind SectionKind, data []byte) {
+		if len(data) > 0 {
+			sections = append(sections, section{kind, data})
+		}
+	}
+	value := func(kind SectionKind, v uint64) {
+		if v != 0 {
+			add(kind, binary.LittleEndian.AppendUint64(nil, v))
+		}
+	}
+	sections = append(sections, section{CodeSection, encodeWords(img.Code)}) // always present, even if empty.
+	add(DataSection, encodeWords(img.Data))
+	var symbols []byte
+	for _, s := range img.Symbols {
+		if len(s.Name) > 0xFFFF {
+			return fmt.Errorf("symbol name too long: %d bytes", len(s.Name))
+		}
+		symbols = binary.LittleEndian.AppendUint64(symbols, uint64(s.Address)) //nolint:gosec // on purpose
+		symbols = binary.LittleEndian.AppendUint16(symbols, uint16(len(s.Name)))
+		symbols = append(symbols, s.Name...)
+	}
+	add(SymbolsSection, symbols)
+	add(DebugSection, img.Debug)
+	exports, err := encodeNames(img.Exports)
+	if err != nil {
+		return err
+	}
+	add(ExportsSection, exports)
+	imports, err := encodeNames(img.Imports)
+	if err != nil {
+		return err
+	}
+	add(ImportsSection, imports)
+	var relocations []byte
+	for _, r := range img.Relocations {
+		relocations = binary.LittleEndian.AppendUint64(relocations, uint64(r.PC))     //nolint:gosec // on purpose
+		relocations = binary.LittleEndian.AppendUint32(relocations, uint32(r.Import)) //nolint:gosec // small index.
+		is48bit := uint32(0)
+		if r.Is48bit {
+			is48bit = 1
+		}
+		relocations = binary.LittleEndian.AppendUint32(relocations, is48bit)
+	}
+	add(RelocationsSection, relocations)
+	value(StackSizeSection, uint64(img.StackSize)) //nolint:gosec // not negative.
+	value(EntrySection, uint64(img.Entry))         //nolint:gosec // on purpose
+	value(ISASection, uint64(img.ISA))             //nolint:gosec // not negative.
+	var buf bytes.Buffer
+	if img.Object {
+		buf.WriteString(OBJHEADER)
+	} else {
+		buf.WriteString(HEADER2)
+	}
+	buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(sections)))) //nolint:gosec // a handful.
+	buf.Write(make([]byte, 4))
+	offset := uint64(buf.Len() + len(sections)*sectionEntrySize)
+	for _, s := range sections {
+		entry := binary.LittleEndian.AppendUint32(nil, uint32(s.kind))
+		entry = binary.LittleEndian.AppendUint32(entry, 0)
+		entry = binary.LittleEndian.AppendUint64(entry, offset)
+		entry = binary.LittleEndian.AppendUint64(entry, uint64(len(s.data)))
+		buf.Write(entry)
+		offset += align8(len(s.data))
+	}
+	for _, s := range sections {
+		buf.Write(s.data)
+		buf.Write(make([]byte, align8(len(s.data))-uint64(len(s.data))))
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func align8(n int) uint64 {
+	return uint64((n + 7) &^ 7) //nolint:gosec // not negative.
+}
+
+func encodeWords(words []Operation) []byte {
+	data := make([]byte, 0, len(words)*OperationSize)
+	for _, w := range words {
+		data = binary.LittleEndian.AppendUint64(data, uint64(w)) //nolint:gosec // on purpose
+	}
+	return data
+}
+
+// LoadProgram reads a version 1 or 2 VM binary (including its header) and loads it with
+// LoadImage.
+func (c *CPU) LoadProgram(r io.Reader) error {
+	img, err := ReadImage(r)
+	if err != nil {
+		return err
+	}
+	return c.LoadImage(img)
+}
+
+// LoadImage sets the program memory, PC and source debug info from img, and raises the stack size to the one
+// the image needs if it is larger (growing the stack if it was already allocated). It fails, leaving the CPU
+// unchanged, if the entry point is outside of the program.
+func (c *CPU) LoadImage(img *Image) error {
+	if err := img.checkEntry(); err != nil {
+		return err
+	}
+	c.Program = img.Memory()
+	c.PC, c.entry = img.Entry, img.Entry
+	c.Source = nil
+	if len(img.Debug) > 0 {
+		source, err := DecodeDebugInfo(img.Debug)
+		if err != nil {
+			log.Warnf("Ignoring invalid debug info: %v", err)
+		}
+		c.Source = source
+	}
+	current := c.StackSize
+	if current <= 0 {
+		current = DefaultStackSize
+	}
+	if img.StackSize <= current {
+		return nil
+	}
+	log.Infof("Program needs a stack of %d words, raising it from %d", img.StackSize, current)
+	c.StackSize = img.StackSize
+	if c.Stack != nil {
+		c.Stack = append(c.Stack, make([]Operation, img.StackSize-len(c.Stack))...)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package cpu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestImageRoundTrip(t *testing.T) {
+	img := &Image{
+		Version:   2,
+		Code:      []Operation{instr(LoadR, 2), sys(Sys, Exit, 0)},
+		Data:      []Operation{42, -1},
+		Symbols:   []Symbol{{"start", 0}, {"value", 2}, {"a_longer_name", 3}},
+		Debug:     []byte("debug"), // not a multiple of 8 bytes, the next section is still aligned.
+		StackSize: 1000,
+		Entry:     1,
+		ISA:       ISAVersion,
+	}
+	var buf bytes.Buffer
+	if err := img.Write(&buf); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), HEADER2) {
+		t.Errorf("expected HEADER2, got %q", buf.String()[:8])
+	}
+	got, err := ReadImage(&buf)
+	if err != nil {
+		t.Fatalf("ReadImage failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, img) {
+		t.Errorf("got %+v, expected %+v", got, img)
+	}
+}
+
+func TestImageVersion1(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(HEADER)
+	program := []Operation{instr(LoadI, 3), sys(Sys, Exit, 0)}
+	_ = binary.Write(&buf, binary.LittleEndian, program)
+	img, err := ReadImage(&buf)
+	if err != nil {
+		t.Fatalf("ReadImage failed: %v", err)
+	}
+	if img.Version != 1 || !reflect.DeepEqual(img.Memory(), program) || img.Entry != 0 || img.StackSize != 0 {
+		t.Errorf("unexpected image %+v", img)
+	}
+}
+
+// v2 builds a version 2 file from raw section table entries (kind, offset, size) and data.
+func v2(entries [][3]uint64, data []byte) []byte {
+	b := []byte(HEADER2)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(entries))) //nolint:gosec // small test.
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	for _, e := range entries {
+		b = binary.LittleEndian.AppendUint32(b, uint32(e[0])) //nolint:gosec // small test.
+		b = binary.LittleEndian.AppendUint32(b, 0)
+		b = binary.LittleEndian.AppendUint64(b, e[1])
+		b = binary.LittleEndian.AppendUint64(b, e[2])
+	}
+	return append(b, data...)
+}
+
+func TestImageErrors(t *testing.T) {
+	word := binary.LittleEndian.AppendUint64(nil, uint64(sys(Sys, Exit, 0)))
+	tests := []struct {
+		name string
+		file []byte
+		err  string
+	}{
+		{"bad header", []byte("\x03GROL VM"), "invalid header"},
+		{"short", []byte("\x01GROL"), "failed to read header"},
+		{"v1 partial word", append([]byte(HEADER), 1, 2, 3), "not a multiple"},
+		{"no table", []byte(HEADER2), "truncated section table"},
+		{"truncated table", v2([][3]uint64{{1, 40, 8}}, nil)[:30], "truncated section table"},
+		{"no code", v2(nil, nil), "no CodeSection"},
+		{"outside", v2([][3]uint64{{uint64(CodeSection), 40, 16}}, word), "outside of the file"},
+		{"huge size", v2([][3]uint64{{uint64(CodeSection), 40, 1 << 63}}, word), "outside of the file"},
+		{"before start", v2([][3]uint64{{uint64(CodeSection), 2, 8}}, word), "outside of the file"},
+		{"duplicate", v2([][3]uint64{{uint64(CodeSection), 64, 8}, {uint64(CodeSection), 64, 8}}, word), "duplicate"},
+		{"bad value", v2([][3]uint64{{uint64(CodeSection), 40, 0}, {uint64(EntrySection), 64, 4}}, word), "expected 8 bytes"},
+		{"bad symbols", v2([][3]uint64{{uint64(CodeSection), 64, 0}, {uint64(SymbolsSection), 64, 8}}, word), "truncated symbol"},
+		{"newer isa", v2([][3]uint64{{uint64(CodeSection), 64, 0}, {uint64(ISASection), 64, 8}},
+			binary.LittleEndian.AppendUint64(nil, ISAVersion+1)), "instruction set version"},
+		{"zero stack", v2([][3]uint64{{uint64(CodeSection), 64, 0}, {uint64(StackSizeSection), 64, 8}},
+			binary.LittleEndian.AppendUint64(nil, 0)), "invalid stack size"},
+		{"huge stack", v2([][3]uint64{{uint64(CodeSection), 64, 0}, {uint64(StackSizeSection), 64, 8}},
+			binary.LittleEndian.AppendUint64(nil, 1<<40)), "invalid stack size"},
+		{"entry past the end", v2([][3]uint64{{uint64(CodeSection), 64, 8}, {uint64(EntrySection), 72, 8}},
+			binary.LittleEndian.AppendUint64(slices.Clone(word), 1)), "invalid entry point 1 (0 to 0)"},
+		{"negative entry", v2([][3]uint64{{uint64(CodeSection), 64, 8}, {uint64(EntrySection), 72, 8}},
+			binary.LittleEndian.AppendUint64(slices.Clone(word), 1<<64-1)), "invalid entry point -1"},
+		{"empty program", v2([][3]uint64{{uint64(CodeSection), 40, 0}}, nil), "invalid entry point 0"},
+	}
+	for _, tt := range tests {
+		_, err := ReadImage(bytes.NewReader(tt.file))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected error with %q, got %v", tt.name, tt.err, err)
+		}
+	}
+	// Unknown sections are skipped.
+	img, err := ReadImage(bytes.NewReader(v2([][3]uint64{{uint64(LastSection) + 5, 64, 8}, {uint64(CodeSection), 64, 8}}, word)))
+	if err != nil || len(img.Code) != 1 {
+		t.Errorf("unexpected %+v, %v with an unknown section", img, err)
+	}
+}
+
+func TestLoadImage(t *testing.T) {
+	c := &CPU{Program: []Operation{1, 2, 3}}
+	c.setup()
+	if err := c.LoadImage(&Image{Code: []Operation{instr(LoadI, 7), sys(Sys, Exit, 0)}, Data: []Operation{5}, Entry: 1, StackSize: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Program) != 3 || c.Program[2] != 5 || c.PC != 1 {
+		t.Errorf("unexpected program %v PC %d", c.Program, c.PC)
+	}
+	if c.StackSize != 1000 || len(c.Stack) != 1000 {
+		t.Errorf("expected the stack to grow to 1000, got %d %d", c.StackSize, len(c.Stack))
+	}
+	if err := c.LoadImage(&Image{Code: []Operation{0}, StackSize: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if c.StackSize != 1000 {
+		t.Errorf("stack shouldn't shrink, got %d", c.StackSize)
+	}
+	err := c.LoadImage(&Image{Code: []Operation{0}, Data: []Operation{5}, Entry: 2})
+	if err == nil || !strings.Contains(err.Error(), "invalid entry point 2 (0 to 1)") || len(c.Program) != 1 {
+		t.Errorf("expected an entry point error leaving the program unchanged, got %v, %v", err, c.Program)
+	}
+}
+
+func TestObjectRoundTrip(t *testing.T) {
+	obj := &Image{
+		Version:     2,
+		Object:      true,
+		Code:        []Operation{instr(Call, 0), instr(JumpR, 0), sys(Sys, Exit, 0)},
+		Symbols:     []Symbol{{"start", 0}},
+		Exports:     []string{"start"},
+		Imports:     []string{"f", "loop"},
+		Relocations: []Relocation{{PC: 0, Import: 0}, {PC: 1, Import: 1, Is48bit: true}},
+	}
+	var buf bytes.Buffer
+	if err := obj.Write(&buf); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	data := buf.Bytes()
+	if _, err := ReadImage(bytes.NewReader(data)); err == nil || !strings.Contains(err.Error(), "vm link") {
+		t.Errorf("expected an error to link the object, got %v", err)
+	}
+	got, err := ReadObject(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadObject failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, obj) {
+		t.Errorf("got %+v, expected %+v", got, obj)
+	}
+	obj.Relocations[1].Import = 2
+	buf.Reset()
+	_ = obj.Write(&buf)
+	if _, err = ReadObject(&buf); err == nil || !strings.Contains(err.Error(), "invalid relocation") {
+		t.Errorf("expected an invalid relocation error, got %v", err)
+	}
+	if _, err = ReadObject(strings.NewReader(HEADER2)); err == nil || !strings.Contains(err.Error(), "not an object") {
+		t.Errorf("expected a not an object file error, got %v", err)
+	}
+}
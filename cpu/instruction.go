@@ -27,7 +27,6 @@ const (
 	SubR   // A = A - *[PC + param]
 	MulR   // A = A * *[PC + param]
 	DivR   // A = A / *[PC + param]
-	// no ModR, ShiftR, AndR on purpose.
 
 	StoreR // *[PC + param] = A
 	IncrR  // A = *[PC + param1] + param0; *[PC + param1] = A
@@ -50,11 +49,53 @@ const (
 	IncrS  // A = *[SP - param1] + param0; *[SP - param1] = A
 	IdivS  // A = *[SP - param] % A; *[SP - param] /= A
 
-	// LoadSB  // load byte from stack with param0 = base, param1 = byte offset.
-
 	StoreSB // store byte to stack with param0 = stack base, param1 = stack indicating byte offset
 
 	SysS // syscall with stack index operand
+
+	// -- Byte instructions, last so the opcodes of the existing programs don't change. Like for
+	// StoreSB, param1 is the stack index of the byte offset from the base param0.
+
+	LoadSB  // load byte from stack: A = byte at stack base param0 + *[SP - param1] bytes
+	LoadRB  // load byte from memory: A = byte at PC + param0 + *[SP - param1] bytes
+	StoreRB // store byte to memory: byte at PC + param0 + *[SP - param1] bytes = A & 0xFF
+
+	// -- Bitwise instructions. ShiftR and ShiftS shift left, or right (arithmetic, like ShiftI)
+	// when negative. ShrI shifts right without the sign (logical), or left when negative.
+	// Shifting by 64 bits or more gives 0 (or -1 for the arithmetic shift of a negative A).
+
+	OrI    // A = A | param
+	XorI   // A = A ^ param
+	Not    // A = ^A (no param)
+	ShrI   // A = A >> param, unsigned (logical) shift right
+	ModR   // A = A % *[PC + param]
+	AndR   // A = A & *[PC + param]
+	OrR    // A = A | *[PC + param]
+	XorR   // A = A ^ *[PC + param]
+	ShiftR // A = A << *[PC + param]
+	ModS   // A = A % *[SP - param]
+	AndS   // A = A & *[SP - param]
+	OrS    // A = A | *[SP - param]
+	XorS   // A = A ^ *[SP - param]
+	ShiftS // A = A << *[SP - param]
+
+	// -- Full range compare and branch: like JNE to JLTE but comparing A with a stack or memory
+	// word instead of a 0-255 immediate. For the S ones param0 is the relative jump target and
+	// param1 the stack index (0 to 255). The R ones take 2 words: the operand is the relative jump
+	// target and the next word the address, relative to the PC, of the memory word to compare with.
+
+	JNES  // Jump if A != *[SP - param1]
+	JEQS  // Jump if A == *[SP - param1]
+	JLTS  // Jump if A < *[SP - param1]
+	JGTS  // Jump if A > *[SP - param1]
+	JGTES // Jump if A >= *[SP - param1]
+	JLTES // Jump if A <= *[SP - param1]
+	JNER  // Jump if A != *[PC + *[PC + 1]]
+	JEQR  // Jump if A == *[PC + *[PC + 1]]
+	JLTR  // Jump if A < *[PC + *[PC + 1]]
+	JGTR  // Jump if A > *[PC + *[PC + 1]]
+	JGTER // Jump if A >= *[PC + *[PC + 1]]
+	JLTER // Jump if A <= *[PC + *[PC + 1]]
 	LastInstruction
 )
 
@@ -46,12 +46,41 @@ func _() {
 	_ = x[IdivS-35]
 	_ = x[StoreSB-36]
 	_ = x[SysS-37]
-	_ = x[LastInstruction-38]
+	_ = x[LoadSB-38]
+	_ = x[LoadRB-39]
+	_ = x[StoreRB-40]
+	_ = x[OrI-41]
+	_ = x[XorI-42]
+	_ = x[Not-43]
+	_ = x[ShrI-44]
+	_ = x[ModR-45]
+	_ = x[AndR-46]
+	_ = x[OrR-47]
+	_ = x[XorR-48]
+	_ = x[ShiftR-49]
+	_ = x[ModS-50]
+	_ = x[AndS-51]
+	_ = x[OrS-52]
+	_ = x[XorS-53]
+	_ = x[ShiftS-54]
+	_ = x[JNES-55]
+	_ = x[JEQS-56]
+	_ = x[JLTS-57]
+	_ = x[JGTS-58]
+	_ = x[JGTES-59]
+	_ = x[JLTES-60]
+	_ = x[JNER-61]
+	_ = x[JEQR-62]
+	_ = x[JLTR-63]
+	_ = x[JGTR-64]
+	_ = x[JGTER-65]
+	_ = x[JLTER-66]
+	_ = x[LastInstruction-67]
 }
 
-const _Instruction_name = "InvalidInstructionLoadIAddISubIMulIDivIModIShiftIAndIJNEJEQJLTJGTJGTEJLTEJumpRLoadRAddRSubRMulRDivRStoreRIncrRCallRetPushPopSysLoadSStoreSAddSSubSMulSDivSIncrSIdivSStoreSBSysSLastInstruction"
+const _Instruction_name = "InvalidInstructionLoadIAddISubIMulIDivIModIShiftIAndIJNEJEQJLTJGTJGTEJLTEJumpRLoadRAddRSubRMulRDivRStoreRIncrRCallRetPushPopSysLoadSStoreSAddSSubSMulSDivSIncrSIdivSStoreSBSysSLoadSBLoadRBStoreRBOrIXorINotShrIModRAndROrRXorRShiftRModSAndSOrSXorSShiftSJNESJEQSJLTSJGTSJGTESJLTESJNERJEQRJLTRJGTRJGTERJLTERLastInstruction"
 
-var _Instruction_index = [...]uint8{0, 18, 23, 27, 31, 35, 39, 43, 49, 53, 56, 59, 62, 65, 69, 73, 78, 83, 87, 91, 95, 99, 105, 110, 114, 117, 121, 124, 127, 132, 138, 142, 146, 150, 154, 159, 164, 171, 175, 190}
+var _Instruction_index = [...]uint16{0, 18, 23, 27, 31, 35, 39, 43, 49, 53, 56, 59, 62, 65, 69, 73, 78, 83, 87, 91, 95, 99, 105, 110, 114, 117, 121, 124, 127, 132, 138, 142, 146, 150, 154, 159, 164, 171, 175, 181, 187, 194, 197, 201, 204, 208, 212, 216, 219, 223, 229, 233, 237, 240, 244, 250, 254, 258, 262, 266, 271, 276, 280, 284, 288, 292, 297, 302, 317}
 
 func (i Instruction) String() string {
 	idx := int(i) - 0
@@ -0,0 +1,81 @@
+package cpu
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func instr(code Instruction, operand ImmediateData) Operation {
+	return Operation(0).SetOpcode(code).SetOperand(operand)
+}
+
+func sys(code Instruction, syscall Syscall, arg ImmediateData) Operation {
+	return instr(code, arg<<8|ImmediateData(syscall))
+}
+
+// echoProgram reads up to 64 bytes on the (blank) stack, writes them back and exits with 3.
+func echoProgram() []Operation {
+	return []Operation{
+		instr(LoadI, 64),
+		sys(SysS, ReadN, -1),
+		sys(SysS, WriteN, -1),
+		sys(Sys, Exit, 3),
+	}
+}
+
+func TestInjectedIO(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			input := strings.Repeat("x", i+1) + "\n"
+			var out bytes.Buffer
+			c := NewCPU(strings.NewReader(input), &out, nil)
+			c.Program = echoProgram()
+			if code, _ := c.Execute(context.Background()); code != 3 {
+				t.Errorf("exit code %d, expected 3", code)
+			}
+			if out.String() != input {
+				t.Errorf("output %q, expected %q", out.String(), input)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestInjectedErrors(t *testing.T) {
+	var out, errOut bytes.Buffer
+	c := NewCPU(strings.NewReader(""), &out, &errOut)
+	c.Program = []Operation{sys(Sys, InvalidSyscall, 0)}
+	if code, _ := c.Execute(context.Background()); code != unknownSyscallAbortCode {
+		t.Errorf("exit code %d, expected %d", code, unknownSyscallAbortCode)
+	}
+	if errOut.String() != "ERR: Unknown syscall: 0 at PC: 0\n" {
+		t.Errorf("unexpected error output %q", errOut.String())
+	}
+}
+
+type failingIO struct{}
+
+func (failingIO) Read([]byte) (int, error)  { return 0, errors.New("read failed") }
+func (failingIO) Write([]byte) (int, error) { return 0, errors.New("write failed") }
+
+func TestInjectedIOErrors(t *testing.T) {
+	var errOut bytes.Buffer
+	c := NewCPU(failingIO{}, failingIO{}, &errOut)
+	// ReadN and Write8 of the "hi" str8 at 4, which both fail.
+	c.Program = []Operation{instr(LoadI, 8), sys(Sys, ReadN, 3), sys(Sys, Write8, 2), sys(Sys, Exit, 0), 0x696802}
+	code, err := c.Execute(context.Background())
+	if err != nil || code != 0 {
+		t.Errorf("unexpected %d, %v", code, err)
+	}
+	expected := "ERR: Failed to read: read failed\nERR: Failed to output str8: write failed\n"
+	if errOut.String() != expected {
+		t.Errorf("error output %q, expected %q", errOut.String(), expected)
+	}
+}
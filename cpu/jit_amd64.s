@@ -0,0 +1,11 @@
+//go:build linux
+
+#include "textflag.h"
+
+// func jitCall(entry, state uintptr)
+// The generated code only uses the return address pushed by CALL on the stack.
+TEXT ·jitCall(SB), NOSPLIT, $0-16
+	MOVQ entry+0(FP), AX
+	MOVQ state+8(FP), BX
+	CALL AX
+	RET
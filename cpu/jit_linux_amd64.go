@@ -0,0 +1,574 @@
+package cpu
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+	"syscall"
+	"unsafe"
+)
+
+// The JIT translates the reachable instructions of the program into x86-64 code, once per
+// Execute. Each instruction starts by consuming one step of the budget and bails out to the
+// interpreter, before any side effect, for the cases it doesn't handle natively: unsupported
+// instructions (Sys, StoreSB, ModR, ShiftS, ...), anything that would fault, stores into compiled code, and
+// running out of steps. The interpreter then executes that one instruction (or reports the
+// limit) and the native code is re-entered at the next PC.
+
+const jitSupported = true
+
+// Registers used by the generated code.
+const (
+	rAX = iota // accumulator
+	rCX        // scratch
+	rDX        // scratch (idiv)
+	rBX        // *jitState
+	rSP
+	rBP
+	rSI // &stack[0]
+	rDI // stack pointer (index)
+	r8  // scratch
+	r9  // steps left
+	r10 // &program[0]
+	r11 // &table[0]: native address of each PC
+)
+
+const noIndex = rSP // SIB index value meaning no index register.
+
+// x86 condition codes, for Jcc rel32 (0x0F 0x80+cc).
+const (
+	ccB  = 0x2
+	ccAE = 0x3
+	ccE  = 0x4
+	ccNE = 0x5
+	ccS  = 0x8
+	ccL  = 0xC
+	ccGE = 0xD
+	ccLE = 0xE
+	ccG  = 0xF
+)
+
+// jitMaxWords bounds the program size so PCs and memory offsets fit in 32 bits immediates.
+const jitMaxWords = 1 << 28
+
+// jitState is shared with the generated code (the field offsets are used by the emitted code).
+type jitState struct {
+	accumulator int64   // 0
+	stackPtr    int64   // 8
+	steps       int64   // 16
+	pc          int64   // 24: where the native code stopped.
+	stack       uintptr // 32
+	program     uintptr // 40
+	table       uintptr // 48
+}
+
+// jitCall runs the native code at entry with BX pointing to the state (jit_amd64.s).
+func jitCall(entry, state uintptr)
+
+// jitCode is the native translation of a program.
+type jitCode struct {
+	mem    []byte      // executable mapping: code then the PC to native address table.
+	source []Operation // copy of the program that was translated.
+	state  *jitState
+}
+
+// emitter accumulates x86-64 machine code with rel32 fixups to labels.
+type emitter struct {
+	code   []byte
+	labels []int // position of each label.
+	fixups []fixup
+}
+
+type fixup struct {
+	at    int // position of the rel32 to patch.
+	label int
+}
+
+func (e *emitter) bytes(b ...byte) {
+	e.code = append(e.code, b...)
+}
+
+func (e *emitter) i32(v int32) {
+	e.code = binary.LittleEndian.AppendUint32(e.code, uint32(v)) //nolint:gosec // on purpose
+}
+
+// rex emits the REX prefix with W set and the high bits of the register numbers.
+func (e *emitter) rex(reg, index, base int) {
+	e.bytes(byte(0x48 | (reg>>3)<<2 | (index>>3)<<1 | base>>3)) //nolint:gosec // registers are < 16
+}
+
+// regReg emits a 64 bits op with a register direct ModRM (reg is the opcode extension for /digit ops).
+func (e *emitter) regReg(op []byte, reg, rm int) {
+	e.rex(reg, 0, rm)
+	e.bytes(op...)
+	e.bytes(byte(0xC0 | (reg&7)<<3 | rm&7)) //nolint:gosec // registers are < 16
+}
+
+// mem emits a 64 bits op with a [base + index*8 + disp] memory operand.
+func (e *emitter) mem(op []byte, reg, base, index int, disp int32) {
+	scale := 3
+	if index == noIndex {
+		scale = 0
+	}
+	e.rex(reg, index, base)
+	e.bytes(op...)
+	e.bytes(byte(0x84|(reg&7)<<3), byte(scale<<6|(index&7)<<3|base&7)) //nolint:gosec // registers are < 16
+	e.i32(disp)
+}
+
+func fitsInt32(v int64) bool {
+	return v >= math.MinInt32 && v <= math.MaxInt32
+}
+
+// movImm loads v into reg.
+func (e *emitter) movImm(reg int, v int64) {
+	if fitsInt32(v) {
+		e.regReg([]byte{0xC7}, 0, reg)
+		e.i32(int32(v))
+		return
+	}
+	e.bytes(byte(0x48|reg>>3), byte(0xB8+reg&7)) //nolint:gosec // registers are < 16
+	e.code = binary.LittleEndian.AppendUint64(e.code, uint64(v))
+}
+
+// aluImm emits the group 1 operation digit (0 add, 4 and, 5 sub, 7 cmp) of reg with v.
+func (e *emitter) aluImm(digit, reg int, v int64) {
+	if fitsInt32(v) {
+		e.regReg([]byte{0x81}, digit, reg)
+		e.i32(int32(v))
+		return
+	}
+	e.movImm(rCX, v)
+	e.regReg([]byte{byte(digit<<3 | 1)}, rCX, reg) //nolint:gosec // digit < 8
+}
+
+func (e *emitter) jcc(cc byte, label int) {
+	e.bytes(0x0F, 0x80|cc)
+	e.fixup(label)
+}
+
+func (e *emitter) jmp(label int) {
+	e.bytes(0xE9)
+	e.fixup(label)
+}
+
+func (e *emitter) fixup(label int) {
+	e.fixups = append(e.fixups, fixup{at: len(e.code), label: label})
+	e.i32(0)
+}
+
+func (e *emitter) label(label int) {
+	e.labels[label] = len(e.code)
+}
+
+// checkedDivide divides rAX by divisor, going to slow for 0 and -1 (which would trap).
+func (e *emitter) checkedDivide(divisor, slow int) {
+	e.regReg([]byte{0x85}, divisor, divisor) // test
+	e.jcc(ccE, slow)
+	e.aluImm(7, divisor, -1)
+	e.jcc(ccE, slow)
+	e.bytes(0x48, 0x99) // cqo
+	e.regReg([]byte{0xF7}, 7, divisor)
+}
+
+// stackAddress sets rCX to the stack index for offset and goes to slow if it's out of range.
+func (e *emitter) stackAddress(offset int64, stackSize, slow int) {
+	e.regReg([]byte{0x89}, rDI, rCX)
+	if offset != 0 {
+		e.aluImm(5, rCX, offset)
+	}
+	e.aluImm(7, rCX, int64(stackSize))
+	e.jcc(ccAE, slow)
+}
+
+// newJIT translates the CPU's program, starting from PC 0 and the current PC.
+func (c *CPU) newJIT() (*jitCode, error) {
+	program := c.Program
+	n := len(program)
+	if n == 0 || n > jitMaxWords || len(c.Stack) > jitMaxWords {
+		return nil, fmt.Errorf("program size %d or stack size %d not supported", n, len(c.Stack))
+	}
+	native := Reachable(program, 0, c.PC)
+	// labels: 0..n-1 the instructions, n the end of the program, n+1+pc the bail out for pc, 2n+1 the exit.
+	e := &emitter{labels: make([]int, 2*n+2)}
+	exit := 2*n + 1
+	// Entry: load the state and jump to the native code for state.pc.
+	e.mem([]byte{0x8B}, rAX, rBX, noIndex, 0)
+	e.mem([]byte{0x8B}, rDI, rBX, noIndex, 8)
+	e.mem([]byte{0x8B}, r9, rBX, noIndex, 16)
+	e.mem([]byte{0x8B}, r8, rBX, noIndex, 24)
+	e.mem([]byte{0x8B}, rSI, rBX, noIndex, 32)
+	e.mem([]byte{0x8B}, r10, rBX, noIndex, 40)
+	e.mem([]byte{0x8B}, r11, rBX, noIndex, 48)
+	e.mem([]byte{0xFF}, 4, r11, r8, 0) // jmp [r11 + r8*8]
+	for pc := range n {
+		e.label(pc)
+		slow := n + 1 + pc
+		e.bytes(0x49, 0x83, 0xE9, 0x01) // sub r9, 1
+		e.jcc(ccB, slow)
+		if !native[pc] || !e.instruction(program, native, pc, len(c.Stack)) {
+			e.jmp(slow)
+		}
+	}
+	// End of the program (or bail out): save the PC then the registers and return.
+	e.label(n)
+	e.mem([]byte{0xC7}, 0, rBX, noIndex, 24)
+	e.i32(int32(n)) //nolint:gosec // n < jitMaxWords
+	e.jmp(exit)
+	for pc := range n {
+		e.label(n + 1 + pc)
+		e.bytes(0x49, 0x83, 0xC1, 0x01) // add r9, 1: the instruction isn't executed.
+		e.mem([]byte{0xC7}, 0, rBX, noIndex, 24)
+		e.i32(int32(pc)) //nolint:gosec // pc < jitMaxWords
+		e.jmp(exit)
+	}
+	e.label(exit)
+	e.mem([]byte{0x89}, rAX, rBX, noIndex, 0)
+	e.mem([]byte{0x89}, rDI, rBX, noIndex, 8)
+	e.mem([]byte{0x89}, r9, rBX, noIndex, 16)
+	e.bytes(0xC3) // ret
+	for _, f := range e.fixups {
+		rel := e.labels[f.label] - (f.at + 4)
+		binary.LittleEndian.PutUint32(e.code[f.at:], uint32(int32(rel))) //nolint:gosec // code is small
+	}
+	return newJITCode(e, program)
+}
+
+// newJITCode copies the code and the PC table into executable memory.
+func newJITCode(e *emitter, program []Operation) (*jitCode, error) {
+	n := len(program)
+	tableOffset := (len(e.code) + 7) &^ 7
+	size := tableOffset + 8*n
+	mem, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, fmt.Errorf("mmap: %w", err)
+	}
+	copy(mem, e.code)
+	base := uintptr(unsafe.Pointer(&mem[0]))
+	for pc := range n {
+		binary.LittleEndian.PutUint64(mem[tableOffset+8*pc:], uint64(base)+uint64(e.labels[pc]))
+	}
+	if err = syscall.Mprotect(mem, syscall.PROT_READ|syscall.PROT_EXEC); err != nil {
+		_ = syscall.Munmap(mem)
+		return nil, fmt.Errorf("mprotect: %w", err)
+	}
+	return &jitCode{
+		mem:    mem,
+		source: slices.Clone(program),
+		state:  &jitState{table: base + uintptr(tableOffset)},
+	}, nil
+}
+
+func (j *jitCode) release() {
+	_ = syscall.Munmap(j.mem)
+	j.mem = nil
+}
+
+var jitConditions = map[Instruction]byte{
+	JNE: ccNE, JEQ: ccE, JLT: ccL, JGT: ccG, JGTE: ccGE, JLTE: ccLE,
+	JNES: ccNE, JEQS: ccE, JLTS: ccL, JGTS: ccG, JGTES: ccGE, JLTES: ccLE,
+	JNER: ccNE, JEQR: ccE, JLTR: ccL, JGTR: ccG, JGTER: ccGE, JLTER: ccLE,
+}
+
+// instruction emits the native code for the instruction at pc (after the step accounting).
+// It returns false if the instruction isn't supported and must be left to the interpreter.
+//
+//nolint:gocyclo,funlen // it's an instruction dispatcher.
+func (e *emitter) instruction(program []Operation, native []bool, pc, stackSize int) bool {
+	n := int64(len(program))
+	op := program[pc]
+	v := op.OperandInt64()
+	slow := len(program) + 1 + pc
+	inProgram := func(target int64) bool { return target >= 0 && target < n }
+	// data is true if addr can be accessed natively: in range and not itself translated (stores
+	// into translated code, including the address word of the R conditional jumps, are left to
+	// the interpreter, which detects the code change).
+	data := func(addr int64, store bool) bool {
+		return inProgram(addr) && (!store || !native[addr] && (addr == 0 || !native[addr-1] ||
+			program[addr-1].Opcode() < JNER || program[addr-1].Opcode() > JLTER))
+	}
+	switch code := op.Opcode(); code { //nolint:exhaustive // default is the interpreter.
+	case LoadI:
+		e.movImm(rAX, v)
+	case AddI:
+		e.aluImm(0, rAX, v)
+	case SubI:
+		e.aluImm(5, rAX, v)
+	case AndI:
+		e.aluImm(4, rAX, v)
+	case OrI:
+		e.aluImm(1, rAX, v)
+	case XorI:
+		e.aluImm(6, rAX, v)
+	case Not:
+		e.regReg([]byte{0xF7}, 2, rAX)
+	case ShrI:
+		switch {
+		case v >= 64 || v <= -64:
+			e.bytes(0x31, 0xC0) // xor eax, eax
+		case v > 0:
+			e.regReg([]byte{0xC1}, 5, rAX)
+			e.bytes(byte(v))
+		case v < 0:
+			e.regReg([]byte{0xC1}, 4, rAX)
+			e.bytes(byte(-v))
+		}
+	case MulI:
+		e.movImm(rCX, v)
+		e.regReg([]byte{0x0F, 0xAF}, rAX, rCX)
+	case DivI, ModI:
+		if v == 0 || v == -1 {
+			return false
+		}
+		e.movImm(rCX, v)
+		e.bytes(0x48, 0x99) // cqo
+		e.regReg([]byte{0xF7}, 7, rCX)
+		if code == ModI {
+			e.regReg([]byte{0x89}, rDX, rAX)
+		}
+	case ShiftI:
+		switch {
+		case v >= 64:
+			e.bytes(0x31, 0xC0) // xor eax, eax
+		case v > 0:
+			e.regReg([]byte{0xC1}, 4, rAX)
+			e.bytes(byte(v))
+		case v < 0:
+			e.regReg([]byte{0xC1}, 7, rAX)
+			e.bytes(byte(min(-v, 63)))
+		}
+	case JNE, JEQ, JLT, JGT, JGTE, JLTE:
+		target := int64(pc) + v>>8
+		if !inProgram(target) {
+			return false
+		}
+		e.aluImm(7, rAX, v&0xFF)
+		e.jcc(jitConditions[code], int(target))
+	case JNES, JEQS, JLTS, JGTS, JGTES, JLTES:
+		target := int64(pc) + v>>8
+		if !inProgram(target) {
+			return false
+		}
+		e.stackAddress(v&0xFF, stackSize, slow)
+		e.mem([]byte{0x3B}, rAX, rSI, rCX, 0) // cmp rax, [rsi + rcx*8]
+		e.jcc(jitConditions[code], int(target))
+	case JNER, JEQR, JLTR, JGTR, JGTER, JLTER:
+		if int64(pc)+1 >= n {
+			return false
+		}
+		target := int64(pc) + v
+		addr := int64(pc) + int64(program[pc+1])
+		if !inProgram(target) || !data(addr, false) {
+			return false
+		}
+		e.mem([]byte{0x3B}, rAX, r10, noIndex, int32(addr*OperationSize)) //nolint:gosec // addr < jitMaxWords
+		e.jcc(jitConditions[code], int(target))
+		e.jmp(pc + 2) // over the address word.
+	case JumpR:
+		target := int64(pc) + v
+		if !inProgram(target) {
+			return false
+		}
+		e.jmp(int(target))
+	case LoadR, AddR, SubR, MulR, DivR, StoreR, AndR, OrR, XorR:
+		addr := int64(pc) + v
+		if !data(addr, code == StoreR) {
+			return false
+		}
+		disp := int32(addr * OperationSize) //nolint:gosec // addr < jitMaxWords
+		switch code {                       //nolint:exhaustive // just the R ones.
+		case LoadR:
+			e.mem([]byte{0x8B}, rAX, r10, noIndex, disp)
+		case AddR:
+			e.mem([]byte{0x03}, rAX, r10, noIndex, disp)
+		case SubR:
+			e.mem([]byte{0x2B}, rAX, r10, noIndex, disp)
+		case MulR:
+			e.mem([]byte{0x0F, 0xAF}, rAX, r10, noIndex, disp)
+		case DivR:
+			e.mem([]byte{0x8B}, r8, r10, noIndex, disp)
+			e.checkedDivide(r8, slow)
+		case StoreR:
+			e.mem([]byte{0x89}, rAX, r10, noIndex, disp)
+		case AndR:
+			e.mem([]byte{0x23}, rAX, r10, noIndex, disp)
+		case OrR:
+			e.mem([]byte{0x0B}, rAX, r10, noIndex, disp)
+		case XorR:
+			e.mem([]byte{0x33}, rAX, r10, noIndex, disp)
+		}
+	case IncrR:
+		addr := int64(pc) + v>>8
+		if !data(addr, true) {
+			return false
+		}
+		disp := int32(addr * OperationSize) //nolint:gosec // addr < jitMaxWords
+		e.mem([]byte{0x8B}, rAX, r10, noIndex, disp)
+		e.aluImm(0, rAX, int64(int8(v&0xFF))) //nolint:gosec // on purpose, signed increment.
+		e.mem([]byte{0x89}, rAX, r10, noIndex, disp)
+	case Call:
+		target := int64(pc) + v
+		if !inProgram(target) {
+			return false
+		}
+		e.aluImm(7, rDI, int64(stackSize-1))
+		e.jcc(ccGE, slow)
+		e.regReg([]byte{0xFF}, 0, rDI) // inc rdi
+		e.mem([]byte{0xC7}, 0, rSI, rDI, 0)
+		e.i32(int32(pc + 1)) //nolint:gosec // pc < jitMaxWords
+		e.jmp(int(target))
+	case Ret:
+		if !fitsInt32(v) {
+			return false
+		}
+		e.regReg([]byte{0x89}, rDI, rCX)
+		if v > 0 {
+			e.aluImm(5, rCX, v)
+		} else {
+			e.regReg([]byte{0x85}, rCX, rCX) // test
+		}
+		e.jcc(ccS, slow)
+		e.mem([]byte{0x8B}, r8, rSI, rCX, 0)
+		e.aluImm(7, r8, n)
+		e.jcc(ccAE, slow) // unsigned: also catches negative return addresses.
+		e.regReg([]byte{0x89}, rCX, rDI)
+		e.regReg([]byte{0xFF}, 1, rDI)     // dec rdi
+		e.mem([]byte{0xFF}, 4, r11, r8, 0) // jmp [r11 + r8*8]
+	case Push:
+		if v > 8 {
+			return false
+		}
+		e.aluImm(7, rDI, int64(stackSize-1)-max(0, v))
+		e.jcc(ccGE, slow)
+		for range v {
+			e.regReg([]byte{0xFF}, 0, rDI)
+			e.mem([]byte{0xC7}, 0, rSI, rDI, 0)
+			e.i32(0)
+		}
+		e.regReg([]byte{0xFF}, 0, rDI)
+		e.mem([]byte{0x89}, rAX, rSI, rDI, 0)
+	case Pop:
+		extra := max(0, v)
+		if !fitsInt32(extra + 1) {
+			return false
+		}
+		e.aluImm(7, rDI, extra)
+		e.jcc(ccL, slow)
+		e.mem([]byte{0x8B}, rAX, rSI, rDI, 0)
+		e.aluImm(5, rDI, extra+1)
+	case LoadS, StoreS, AddS, SubS, MulS, DivS, AndS, OrS, XorS:
+		if !fitsInt32(v) {
+			return false
+		}
+		e.stackAddress(v, stackSize, slow)
+		switch code { //nolint:exhaustive // just the S ones.
+		case LoadS:
+			e.mem([]byte{0x8B}, rAX, rSI, rCX, 0)
+		case StoreS:
+			e.mem([]byte{0x89}, rAX, rSI, rCX, 0)
+		case AddS:
+			e.mem([]byte{0x03}, rAX, rSI, rCX, 0)
+		case SubS:
+			e.mem([]byte{0x2B}, rAX, rSI, rCX, 0)
+		case MulS:
+			e.mem([]byte{0x0F, 0xAF}, rAX, rSI, rCX, 0)
+		case DivS:
+			e.mem([]byte{0x8B}, r8, rSI, rCX, 0)
+			e.checkedDivide(r8, slow)
+		case AndS:
+			e.mem([]byte{0x23}, rAX, rSI, rCX, 0)
+		case OrS:
+			e.mem([]byte{0x0B}, rAX, rSI, rCX, 0)
+		case XorS:
+			e.mem([]byte{0x33}, rAX, rSI, rCX, 0)
+		}
+	case IncrS:
+		offset := v >> 8
+		if !fitsInt32(offset) {
+			return false
+		}
+		e.stackAddress(offset, stackSize, slow)
+		e.mem([]byte{0x8B}, rAX, rSI, rCX, 0)
+		e.aluImm(0, rAX, int64(int8(v&0xFF))) //nolint:gosec // on purpose, signed increment.
+		e.mem([]byte{0x89}, rAX, rSI, rCX, 0)
+	default:
+		return false
+	}
+	return true
+}
+
+// executeJIT is the equivalent of execute running the native code of j, and the interpreter for
+// the instructions the native code stops at.
+func (c *CPU) executeJIT(j *jitCode, steps int64) (int64, bool, error) {
+	end := ImmediateData(len(c.Program))
+	s := j.state
+	s.stack = uintptr(unsafe.Pointer(&c.Stack[0]))
+	s.program = uintptr(unsafe.Pointer(&c.Program[0]))
+	for {
+		inProgram := c.PC >= 0 && c.PC < end
+		if inProgram && steps != 0 {
+			s.accumulator, s.stackPtr, s.steps, s.pc = c.Accumulator, int64(c.StackPtr), steps, int64(c.PC)
+			jitCall(uintptr(unsafe.Pointer(&j.mem[0])), uintptr(unsafe.Pointer(s)))
+			c.Accumulator, c.StackPtr, c.PC, steps = s.accumulator, int(s.stackPtr), ImmediateData(s.pc), s.steps
+			inProgram = c.PC < end
+		}
+		if inProgram && steps == 0 {
+			c.save(c.PC, c.Accumulator, c.StackPtr, steps)
+			return 0, false, nil
+		}
+		one := int64(1)
+		if steps == 0 {
+			one = 0
+		}
+		lo, hi := 0, 0
+		if inProgram {
+			lo, hi = c.writtenWords(c.Program[c.PC])
+		}
+		exitCode, done, err := c.execute(one)
+		steps -= one - c.stepsLeft
+		c.stepsLeft = steps
+		if done {
+			return exitCode, true, err
+		}
+		lo, hi = max(lo, 0), min(hi, len(c.Program))
+		if lo >= hi || slices.Equal(c.Program[lo:hi], j.source[lo:hi]) {
+			continue
+		}
+		// self modifying code: translate again.
+		fresh, err := c.newJIT()
+		if err != nil {
+			return 0, true, err
+		}
+		j.release()
+		*j = *fresh
+		s = j.state
+		s.stack = uintptr(unsafe.Pointer(&c.Stack[0]))
+		s.program = uintptr(unsafe.Pointer(&c.Program[0]))
+	}
+}
+
+// writtenWords returns the program words, from lo to hi (excluded, not clamped to the program),
+// the interpreter can write executing op at PC: the one of StoreR, IncrR and StoreRB and the
+// ones of the read syscalls (as the threaded engine's redecode), so only those are compared
+// with the translated source afterwards.
+func (c *CPU) writtenWords(op Operation) (int, int) {
+	d := decode(op, c.PC, ImmediateData(len(c.Program)))
+	switch op.Opcode() { //nolint:exhaustive // only the ones that can write the program memory.
+	case StoreR, IncrR:
+		return int(d.a), int(d.a) + 1
+	case StoreRB:
+		idx := c.StackPtr - int(d.b)
+		if stackCheck(idx, len(c.Stack)) != NoFault {
+			return 0, 0
+		}
+		addr := int(d.a) + int(c.Stack[idx])/8
+		return addr, addr + 1
+	case Sys:
+		if call := Syscall(d.a); call == Read8 || call == Read16 || call == ReadN { //nolint:gosec // 8 bits.
+			addr := int(int64(c.PC) + d.b)
+			return addr, addr + int(c.Accumulator)/OperationSize + 2
+		}
+	}
+	return 0, 0
+}
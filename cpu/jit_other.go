@@ -0,0 +1,22 @@
+//go:build !linux || !amd64
+
+package cpu
+
+import (
+	"errors"
+	"runtime"
+)
+
+const jitSupported = false
+
+type jitCode struct{}
+
+func (c *CPU) newJIT() (*jitCode, error) {
+	return nil, errors.New("JIT not supported on " + runtime.GOOS + "/" + runtime.GOARCH)
+}
+
+func (j *jitCode) release() {}
+
+func (c *CPU) executeJIT(_ *jitCode, steps int64) (int64, bool, error) {
+	return c.execute(steps)
+}
@@ -0,0 +1,199 @@
+package cpu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"fortio.org/log"
+)
+
+// LimitReason is why execution was stopped before the program ended.
+type LimitReason uint8
+
+const (
+	NoLimit LimitReason = iota
+
+	InstructionLimit // MaxInstructions executed
+	Timeout          // Timeout elapsed (or context deadline exceeded)
+	Canceled         // Context canceled
+
+	LastLimitReason
+)
+
+//go:generate stringer -type=LimitReason
+var _ = LastLimitReason.String() // force compile error if go generate is missing.
+
+// LimitExitCode is the exit code of a program stopped by a limit (same as timeout(1)).
+const LimitExitCode = 124
+
+// checkInterval is how many instructions are executed between checks of the context.
+const checkInterval = 1 << 16
+
+// LimitError is the error returned by Execute when it stops the program because of
+// the instruction budget, the timeout or the context.
+type LimitError struct {
+	Reason   LimitReason
+	PC       ImmediateData
+	Executed int64 // Number of instructions executed so far.
+	ctxErr   error
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%v at PC %d after %d instructions", e.Reason, e.PC, e.Executed)
+}
+
+// Unwrap returns the context error for Timeout and Canceled (so errors.Is context.DeadlineExceeded works).
+func (e *LimitError) Unwrap() error {
+	return e.ctxErr
+}
+
+// save stores the execution state back into the CPU, steps is the remaining budget.
+func (c *CPU) save(pc ImmediateData, accumulator int64, stackPtr int, steps int64) {
+	c.PC, c.Accumulator, c.StackPtr = pc, accumulator, stackPtr
+	c.stepsLeft = steps
+}
+
+// run executes the program in chunks of at most checkInterval instructions, checking the
+// instruction budget and the context in between.
+func (c *CPU) run(ctx context.Context) (int, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	execute, chunk := c.execute, int64(checkInterval)
+	switch c.Engine {
+	case SwitchEngine:
+		if c.MaxInstructions > 0 {
+			break
+		}
+		// no budget: a single chunk until the program ends or the context is done, which stops it
+		// at the next jump instead of returning every checkInterval instructions to check.
+		c.stopRequested.Store(false)
+		defer context.AfterFunc(ctx, func() { c.stopRequested.Store(true) })()
+		execute = func(steps int64) (int64, bool, error) { return c.executeSwitch(steps, true) }
+		chunk = math.MaxInt64
+	case ThreadedEngine:
+		code := decodeProgram(c.Program)
+		execute = func(steps int64) (int64, bool, error) { return c.executeThreaded(code, steps) }
+	case JITEngine:
+		j, err := c.newJIT()
+		if err != nil {
+			log.Warnf("JIT unavailable, using the switch engine: %v", err)
+			break
+		}
+		defer j.release()
+		execute = func(steps int64) (int64, bool, error) { return c.executeJIT(j, steps) }
+	}
+	c.ctx = ctx
+	defer func() { c.ctx = nil }()
+	for {
+		if err := ctx.Err(); err != nil {
+			return LimitExitCode, c.contextLimit(err)
+		}
+		steps := chunk
+		if c.MaxInstructions > 0 {
+			left := c.MaxInstructions - c.Executed
+			if left <= 0 {
+				return LimitExitCode, &LimitError{Reason: InstructionLimit, PC: c.PC, Executed: c.Executed}
+			}
+			steps = min(steps, left)
+		}
+		exitCode, done, err := execute(steps)
+		c.Executed += steps - c.stepsLeft
+		if c.interrupted {
+			// the syscall didn't complete, it runs again when resumed.
+			c.interrupted = false
+			c.Executed--
+			return LimitExitCode, c.contextLimit(ctx.Err())
+		}
+		if done {
+			return int(exitCode), err
+		}
+	}
+}
+
+// contextLimit returns the Timeout or Canceled LimitError for the context error err.
+func (c *CPU) contextLimit(err error) *LimitError {
+	reason := Canceled
+	if errors.Is(err, context.DeadlineExceeded) {
+		reason = Timeout
+	}
+	return &LimitError{Reason: reason, PC: c.PC, Executed: c.Executed, ctxErr: err}
+}
+
+// sleep waits for d, or until the context of the running Execute is done (then setting
+// interrupted).
+func (c *CPU) sleep(d time.Duration) {
+	if c.ctx == nil {
+		time.Sleep(d)
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-c.ctx.Done():
+		c.interrupted = true
+	}
+}
+
+type readResult struct {
+	data []byte
+	err  error
+}
+
+// unreadInput returns the input already read from In but not yet by the program: the rest of the
+// last read's data, plus the data of the interrupted read if it has completed since.
+func (c *CPU) unreadInput() []byte {
+	if c.pendingRead == nil {
+		return c.unread
+	}
+	select {
+	case r := <-c.pendingRead:
+		c.pendingRead = nil
+		c.unread = slices.Concat(c.unread, r.data)
+	default:
+	}
+	return c.unread
+}
+
+// read reads from In into p, like In.Read, unless the context of the running Execute is done
+// first (then setting interrupted). The read then goes on in the background and the next one
+// returns its data.
+func (c *CPU) read(p []byte) (int, error) {
+	if len(c.unread) > 0 {
+		n := copy(p, c.unread)
+		c.unread = c.unread[n:]
+		return n, nil
+	}
+	var done <-chan struct{}
+	if c.ctx != nil {
+		done = c.ctx.Done()
+	}
+	if done == nil && c.pendingRead == nil {
+		return c.In.Read(p)
+	}
+	if c.pendingRead == nil {
+		c.pendingRead = make(chan readResult, 1)
+		buf, in, res := make([]byte, len(p)), c.In, c.pendingRead
+		go func() {
+			n, err := in.Read(buf)
+			res <- readResult{buf[:n], err}
+		}()
+	}
+	select {
+	case r := <-c.pendingRead:
+		c.pendingRead = nil
+		n := copy(p, r.data)
+		c.unread = r.data[n:]
+		return n, r.err
+	case <-done:
+		c.interrupted = true
+		return 0, c.ctx.Err()
+	}
+}
@@ -0,0 +1,125 @@
+package cpu
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestInstructionLimit(t *testing.T) {
+	c := &CPU{Program: []Operation{instr(AddI, 1), instr(JumpR, -1)}, MaxInstructions: 100_001}
+	code, err := c.Execute(context.Background())
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || code != LimitExitCode {
+		t.Fatalf("expected a LimitError, got %d %v", code, err)
+	}
+	if limitErr.Reason != InstructionLimit || limitErr.Executed != 100_001 || limitErr.PC != 1 {
+		t.Errorf("unexpected %+v", limitErr)
+	}
+	if c.Accumulator != 50_001 {
+		t.Errorf("accumulator %d, expected 50001", c.Accumulator)
+	}
+	// resume for 10 more
+	c.MaxInstructions += 10
+	_, err = c.Execute(context.Background())
+	if !errors.As(err, &limitErr) || limitErr.Executed != 100_011 || c.Accumulator != 50_006 {
+		t.Errorf("unexpected after resume: %v, %d", err, c.Accumulator)
+	}
+}
+
+func TestExecutedCount(t *testing.T) {
+	c := &CPU{
+		Program:         []Operation{instr(LoadI, 1), instr(AddI, 1), sys(Sys, Exit, 5)},
+		MaxInstructions: 3,
+	}
+	code, err := c.Execute(context.Background())
+	if err != nil || code != 5 || c.Executed != 3 {
+		t.Errorf("unexpected %d %v executed %d", code, err, c.Executed)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	// without MaxInstructions the switch engine runs a single chunk.
+	for _, maxInstructions := range []int64{0, 1 << 62} {
+		c := &CPU{Program: []Operation{instr(JumpR, 0)}, Timeout: 20 * time.Millisecond, MaxInstructions: maxInstructions}
+		start := time.Now()
+		code, err := c.Execute(context.Background())
+		var limitErr *LimitError
+		if !errors.As(err, &limitErr) || limitErr.Reason != Timeout || code != LimitExitCode {
+			t.Fatalf("expected a Timeout LimitError, got %d %v", code, err)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected error to wrap DeadlineExceeded: %v", err)
+		}
+		chunked := maxInstructions > 0
+		if limitErr.Executed == 0 || limitErr.Executed != c.Executed || chunked && limitErr.Executed%checkInterval != 0 {
+			t.Errorf("unexpected executed count %d vs %d (chunked %t)", limitErr.Executed, c.Executed, chunked)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("took too long to stop: %v", elapsed)
+		}
+	}
+}
+
+func TestCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c := &CPU{Program: []Operation{instr(JumpR, 0)}}
+	_, err := c.Execute(ctx)
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Reason != Canceled || !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a Canceled LimitError, got %v", err)
+	}
+	if limitErr.Executed != 0 || c.PC != 0 {
+		t.Errorf("expected no instruction executed, got %d (PC %d)", limitErr.Executed, c.PC)
+	}
+}
+
+func TestTimeoutDuringSyscall(t *testing.T) {
+	for _, engine := range []Engine{SwitchEngine, ThreadedEngine} {
+		for name, program := range map[string][]Operation{
+			"sleep": {instr(LoadI, 1), sys(Sys, Sleep, 5000), sys(Sys, Exit, 0)},
+			"read":  {instr(LoadI, 1), sys(Sys, Read8, 2), sys(Sys, Exit, 0), 0},
+		} {
+			reader, writer := io.Pipe()
+			c := NewCPU(reader, nil, nil)
+			c.Program, c.Engine, c.Timeout = program, engine, 20*time.Millisecond
+			start := time.Now()
+			code, err := c.Execute(context.Background())
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) || limitErr.Reason != Timeout || code != LimitExitCode {
+				t.Fatalf("%v %s: expected a Timeout LimitError, got %d %v", engine, name, code, err)
+			}
+			// the syscall isn't done: it's executed again when resumed.
+			if c.PC != 1 || c.Executed != 1 || c.Accumulator != 1 {
+				t.Errorf("%v %s: unexpected PC %d, executed %d, A %d", engine, name, c.PC, c.Executed, c.Accumulator)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("%v %s: took too long to stop: %v", engine, name, elapsed)
+			}
+			writer.Close()
+		}
+	}
+}
+
+func TestResumeInterruptedRead(t *testing.T) {
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	c := NewCPU(reader, nil, nil)
+	c.Program = []Operation{instr(LoadI, 10), sys(Sys, Read8, 2), sys(Sys, Exit, 0), 0, 0}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if code, err := c.Execute(ctx); !errors.Is(err, context.Canceled) || code != LimitExitCode {
+		t.Fatalf("expected a Canceled LimitError, got %d %v", code, err)
+	}
+	// the interrupted read goes on and its data is what the resumed Read8 gets.
+	go func() { _, _ = writer.Write([]byte("hi")) }()
+	if code, err := c.Execute(context.Background()); err != nil || code != 0 || c.Accumulator != 2 {
+		t.Errorf("unexpected %d %v, A %d after resuming the read", code, err, c.Accumulator)
+	}
+	if c.Program[3] != 0x696802 {
+		t.Errorf("read %x, expected the str8 \"hi\"", c.Program[3])
+	}
+}
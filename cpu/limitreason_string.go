@@ -0,0 +1,28 @@
+// Code generated by "stringer -type=LimitReason"; DO NOT EDIT.
+
+package cpu
+
+import "strconv"
+
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[NoLimit-0]
+	_ = x[InstructionLimit-1]
+	_ = x[Timeout-2]
+	_ = x[Canceled-3]
+	_ = x[LastLimitReason-4]
+}
+
+const _LimitReason_name = "NoLimitInstructionLimitTimeoutCanceledLastLimitReason"
+
+var _LimitReason_index = [...]uint8{0, 7, 23, 30, 38, 53}
+
+func (i LimitReason) String() string {
+	idx := int(i) - 0
+	if i < 0 || idx >= len(_LimitReason_index)-1 {
+		return "LimitReason(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _LimitReason_name[_LimitReason_index[idx]:_LimitReason_index[idx+1]]
+}
@@ -0,0 +1,41 @@
+package cpu
+
+import "slices"
+
+// Reachable marks the words that can be executed as instructions starting from the entry PCs
+// and following the static control flow (jumps, calls and the instruction after each call
+// for the returns). Unknown opcodes are marked (they fault when executed) but not followed.
+func Reachable(program []Operation, entries ...ImmediateData) []bool {
+	end := ImmediateData(len(program))
+	reachable := make([]bool, len(program))
+	todo := slices.Clone(entries)
+	for len(todo) > 0 {
+		pc := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if pc < 0 || pc >= end || reachable[pc] {
+			continue
+		}
+		reachable[pc] = true
+		op := program[pc]
+		switch op.Opcode() { //nolint:exhaustive // the others just continue to the next instruction.
+		case JNE, JEQ, JLT, JGT, JGTE, JLTE, JNES, JEQS, JLTS, JGTS, JGTES, JLTES:
+			todo = append(todo, pc+1, pc+op.Operand()>>8)
+		case JNER, JEQR, JLTR, JGTR, JGTER, JLTER:
+			todo = append(todo, pc+2, pc+op.Operand()) // pc+1 is the address word.
+		case JumpR:
+			todo = append(todo, pc+op.Operand())
+		case Call:
+			todo = append(todo, pc+op.Operand(), pc+1)
+		case Ret:
+		case Sys, SysS:
+			if Syscall(op.Operand()&0xFF) != Exit { //nolint:gosec // 0xFF mask
+				todo = append(todo, pc+1)
+			}
+		default:
+			if op.Opcode() < LastInstruction {
+				todo = append(todo, pc+1)
+			}
+		}
+	}
+	return reachable
+}
@@ -0,0 +1,35 @@
+// Code generated by "stringer -type=SectionKind"; DO NOT EDIT.
+
+package cpu
+
+import "strconv"
+
+func _() {
+	// An "invalid array index" compiler error signifies that the constant values have changed.
+	// Re-run the stringer command to generate them again.
+	var x [1]struct{}
+	_ = x[InvalidSection-0]
+	_ = x[CodeSection-1]
+	_ = x[DataSection-2]
+	_ = x[SymbolsSection-3]
+	_ = x[DebugSection-4]
+	_ = x[StackSizeSection-5]
+	_ = x[EntrySection-6]
+	_ = x[ISASection-7]
+	_ = x[ExportsSection-8]
+	_ = x[ImportsSection-9]
+	_ = x[RelocationsSection-10]
+	_ = x[LastSection-11]
+}
+
+const _SectionKind_name = "InvalidSectionCodeSectionDataSectionSymbolsSectionDebugSectionStackSizeSectionEntrySectionISASectionExportsSectionImportsSectionRelocationsSectionLastSection"
+
+var _SectionKind_index = [...]uint8{0, 14, 25, 36, 50, 62, 78, 90, 100, 114, 128, 146, 157}
+
+func (i SectionKind) String() string {
+	idx := int(i) - 0
+	if i < 0 || idx >= len(_SectionKind_index)-1 {
+		return "SectionKind(" + strconv.FormatInt(int64(i), 10) + ")"
+	}
+	return _SectionKind_name[_SectionKind_index[idx]:_SectionKind_index[idx+1]]
+}
@@ -0,0 +1,180 @@
+package cpu
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// SnapshotHeader starts a CPU snapshot file, the first byte is the snapshot format version.
+const SnapshotHeader = "\x03GROL SN"
+
+// snapshotHeader1 is the header of the version 1 snapshots, which don't have the entry point
+// and the debug info (snapshotSource).
+const snapshotHeader1 = "\x01GROL SN"
+
+// snapshotHeader2 is the header of the version 2 snapshots, which don't have the unread input
+// (snapshotInput).
+const snapshotHeader2 = "\x02GROL SN"
+
+// maxSnapshotWords bounds the program and stack sizes read from a snapshot (1 GiB each).
+const maxSnapshotWords = 1 << 27
+
+// snapshotState is the fixed size part of a snapshot, after the header and followed by
+// snapshotSource, snapshotInput, ProgramSize program words, StackSize stack words, DebugSize
+// bytes of debug info and UnreadSize bytes of input (all little endian).
+type snapshotState struct {
+	Accumulator int64
+	PC          int64
+	StackPtr    int64
+	Executed    int64
+	ProgramSize int64
+	StackSize   int64
+}
+
+// snapshotSource is where the program started and the size of its (encoded) debug info, so
+// the faults and stack traces after a resume are the same as without it.
+type snapshotSource struct {
+	Entry     int64
+	DebugSize int64
+}
+
+// snapshotInput is the size of the input already read from In but not yet by the program (the
+// rest of a read syscall's data or the data of an interrupted one), so it isn't lost on resume.
+type snapshotInput struct {
+	UnreadSize int64
+}
+
+// SaveSnapshot writes the full execution state (registers, program and data memory, stack, entry
+// point, debug info and unread input) so it can be resumed later, possibly on another machine,
+// using LoadSnapshot. Input arriving after the snapshot, for a read interrupted by the limit, isn't
+// in it: the resumed program reads it from its own In.
+func (c *CPU) SaveSnapshot(w io.Writer) error {
+	c.setup()
+	state := snapshotState{
+		Accumulator: c.Accumulator,
+		PC:          int64(c.PC),
+		StackPtr:    int64(c.StackPtr),
+		Executed:    c.Executed,
+		ProgramSize: int64(len(c.Program)),
+		StackSize:   int64(len(c.Stack)),
+	}
+	var debug []byte
+	if c.Source != nil {
+		debug = c.Source.Encode()
+	}
+	source := snapshotSource{Entry: int64(c.entry), DebugSize: int64(len(debug))}
+	unread := c.unreadInput()
+	input := snapshotInput{UnreadSize: int64(len(unread))}
+	if _, err := io.WriteString(w, SnapshotHeader); err != nil {
+		return err
+	}
+	for _, data := range []any{state, source, input, c.Program, c.Stack, debug, unread} {
+		if err := binary.Write(w, binary.LittleEndian, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadSnapshot restores the state saved by SaveSnapshot. The streams and limits of c are kept.
+func (c *CPU) LoadSnapshot(r io.Reader) error {
+	header := make([]byte, len(SnapshotHeader))
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("failed to read snapshot header: %w", err)
+	}
+	version := slices.Index([]string{snapshotHeader1, snapshotHeader2, SnapshotHeader}, string(header)) + 1
+	if version == 0 {
+		return fmt.Errorf("invalid snapshot header: %q", string(header))
+	}
+	var state snapshotState
+	if err := binary.Read(r, binary.LittleEndian, &state); err != nil {
+		return fmt.Errorf("failed to read snapshot state: %w", err)
+	}
+	var source snapshotSource
+	if version >= 2 {
+		if err := binary.Read(r, binary.LittleEndian, &source); err != nil {
+			return fmt.Errorf("failed to read snapshot state: %w", err)
+		}
+	}
+	var input snapshotInput
+	if version >= 3 {
+		if err := binary.Read(r, binary.LittleEndian, &input); err != nil {
+			return fmt.Errorf("failed to read snapshot state: %w", err)
+		}
+	}
+	if state.ProgramSize < 0 || state.ProgramSize > maxSnapshotWords {
+		return fmt.Errorf("invalid snapshot program size %d", state.ProgramSize)
+	}
+	if state.StackSize <= 0 || state.StackSize > maxSnapshotWords {
+		return fmt.Errorf("invalid snapshot stack size %d", state.StackSize)
+	}
+	if state.StackPtr < -1 || state.StackPtr >= state.StackSize {
+		return fmt.Errorf("invalid snapshot stack pointer %d for stack size %d", state.StackPtr, state.StackSize)
+	}
+	if source.DebugSize < 0 || source.DebugSize > maxSnapshotWords*OperationSize {
+		return fmt.Errorf("invalid snapshot debug info size %d", source.DebugSize)
+	}
+	if input.UnreadSize < 0 || input.UnreadSize > maxSnapshotWords*OperationSize {
+		return fmt.Errorf("invalid snapshot unread input size %d", input.UnreadSize)
+	}
+	program := make([]Operation, state.ProgramSize)
+	stack := make([]Operation, state.StackSize)
+	for _, data := range [][]Operation{program, stack} {
+		if err := binary.Read(r, binary.LittleEndian, data); err != nil {
+			return fmt.Errorf("failed to read snapshot memory: %w", err)
+		}
+	}
+	var info DebugInfo
+	if source.DebugSize > 0 {
+		debug := make([]byte, source.DebugSize)
+		if _, err := io.ReadFull(r, debug); err != nil {
+			return fmt.Errorf("failed to read snapshot debug info: %w", err)
+		}
+		var err error
+		if info, err = DecodeDebugInfo(debug); err != nil {
+			return fmt.Errorf("invalid snapshot debug info: %w", err)
+		}
+	}
+	var unread []byte
+	if input.UnreadSize > 0 {
+		unread = make([]byte, input.UnreadSize)
+		if _, err := io.ReadFull(r, unread); err != nil {
+			return fmt.Errorf("failed to read snapshot unread input: %w", err)
+		}
+	}
+	c.Accumulator = state.Accumulator
+	c.PC = ImmediateData(state.PC)
+	c.StackPtr = int(state.StackPtr)
+	c.Executed = state.Executed
+	c.Program = program
+	c.Stack = stack
+	c.StackSize = int(state.StackSize)
+	c.entry = ImmediateData(source.Entry)
+	c.Source = info
+	c.unread, c.pendingRead = unread, nil
+	return nil
+}
+
+// WriteSnapshotFile saves the CPU state into the named file.
+func (c *CPU) WriteSnapshotFile(file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	err = c.SaveSnapshot(f)
+	return errors.Join(err, f.Close())
+}
+
+// ReadSnapshotFile restores the CPU state from the named file.
+func (c *CPU) ReadSnapshotFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.LoadSnapshot(f)
+}
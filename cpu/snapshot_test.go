@@ -0,0 +1,163 @@
+package cpu
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// counterProgram pushes to the stack then loops forever incrementing a memory word and
+// storing the result on the stack.
+func counterProgram() []Operation {
+	return []Operation{
+		instr(LoadI, 7),
+		instr(Push, 2),
+		instr(IncrR, 3<<8|1),
+		instr(StoreS, 1),
+		instr(JumpR, -2),
+		0, // counter
+	}
+}
+
+func TestSnapshotResume(t *testing.T) {
+	straight := &CPU{Program: counterProgram(), MaxInstructions: 1000}
+	_, err := straight.Execute(context.Background())
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("expected a LimitError, got %v", err)
+	}
+	first := &CPU{Program: counterProgram(), MaxInstructions: 501}
+	_, err = first.Execute(context.Background())
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("expected a LimitError, got %v", err)
+	}
+	var buf bytes.Buffer
+	if err = first.SaveSnapshot(&buf); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	resumed := &CPU{MaxInstructions: 1000}
+	if err = resumed.LoadSnapshot(&buf); err != nil {
+		t.Fatalf("LoadSnapshot failed: %v", err)
+	}
+	if resumed.Executed != 501 || resumed.PC != first.PC || resumed.StackPtr != 2 {
+		t.Errorf("unexpected restored state %d %d %d", resumed.Executed, resumed.PC, resumed.StackPtr)
+	}
+	_, err = resumed.Execute(context.Background())
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("expected a LimitError, got %v", err)
+	}
+	if resumed.Accumulator != straight.Accumulator || resumed.PC != straight.PC ||
+		resumed.StackPtr != straight.StackPtr || resumed.Executed != straight.Executed {
+		t.Errorf("resumed %+v differs from straight run %+v", resumed, straight)
+	}
+	if !slices.Equal(resumed.Program, straight.Program) || !slices.Equal(resumed.Stack, straight.Stack) {
+		t.Errorf("resumed memory or stack differs: %v %v vs %v %v",
+			resumed.Program, resumed.Stack[:3], straight.Program, straight.Stack[:3])
+	}
+}
+
+func TestLoadSnapshotErrors(t *testing.T) {
+	c := &CPU{Program: counterProgram(), StackSize: 4}
+	var buf bytes.Buffer
+	if err := c.SaveSnapshot(&buf); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	good := buf.Bytes()
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"bad header", append([]byte(HEADER), good[len(SnapshotHeader):]...)},
+		{"truncated", good[:len(good)-1]},
+		{"bad stack pointer", func() []byte {
+			b := slices.Clone(good)
+			b[len(SnapshotHeader)+2*8] = 4 // StackPtr = 4 for a stack of 4
+			return b
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := (&CPU{}).LoadSnapshot(bytes.NewReader(tt.data)); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestSnapshotSourceAndEntry(t *testing.T) {
+	program, info := sourceProgram()
+	// a data word first so the entry point isn't 0.
+	img := &Image{Code: append([]Operation{0}, program...), Debug: append(DebugInfo{{}}, info...).Encode(), Entry: 1}
+	straight := NewCPU(nil, nil, nil)
+	if err := straight.LoadImage(img); err != nil {
+		t.Fatal(err)
+	}
+	_, straightErr := straight.Execute(context.Background())
+	first := NewCPU(nil, nil, nil)
+	if err := first.LoadImage(img); err != nil {
+		t.Fatal(err)
+	}
+	first.MaxInstructions = 3
+	if _, err := first.Execute(context.Background()); err == nil {
+		t.Fatalf("expected a LimitError")
+	}
+	var buf bytes.Buffer
+	if err := first.SaveSnapshot(&buf); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	resumed := NewCPU(nil, nil, nil)
+	if err := resumed.LoadSnapshot(&buf); err != nil {
+		t.Fatalf("LoadSnapshot failed: %v", err)
+	}
+	_, err := resumed.Execute(context.Background())
+	if err == nil || straightErr == nil || err.Error() != straightErr.Error() || !strings.Contains(err.Error(), "t.asm:8") {
+		t.Errorf("resumed fault %v, expected %v", err, straightErr)
+	}
+	if trace, expected := resumed.StackTrace(), straight.StackTrace(); !slices.Equal(trace, expected) || len(trace) != 3 {
+		t.Errorf("resumed trace %q, expected %q", trace, expected)
+	}
+}
+
+func TestSnapshotUnreadInput(t *testing.T) {
+	// the rest of a read and the data of an interrupted one that completed since.
+	c := &CPU{Program: counterProgram(), unread: []byte("rest")}
+	c.pendingRead = make(chan readResult, 1)
+	c.pendingRead <- readResult{data: []byte(" and more")}
+	var buf bytes.Buffer
+	if err := c.SaveSnapshot(&buf); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	resumed := &CPU{In: strings.NewReader("!")}
+	if err := resumed.LoadSnapshot(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("LoadSnapshot failed: %v", err)
+	}
+	var got []byte
+	p := make([]byte, 3)
+	for {
+		n, err := resumed.read(p)
+		got = append(got, p[:n]...)
+		if err != nil {
+			break
+		}
+	}
+	if string(got) != "rest and more!" {
+		t.Errorf("resumed program read %q", got)
+	}
+	// version 2 snapshots, without the input, still load.
+	c = &CPU{Program: counterProgram()}
+	buf.Reset()
+	if err := c.SaveSnapshot(&buf); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	good := buf.Bytes()
+	fixed := len(SnapshotHeader) + 6*8 + 2*8 // header, snapshotState and snapshotSource.
+	v2 := slices.Concat([]byte(snapshotHeader2), good[len(SnapshotHeader):fixed], good[fixed+8:])
+	resumed = &CPU{}
+	if err := resumed.LoadSnapshot(bytes.NewReader(v2)); err != nil || !slices.Equal(resumed.Program, c.Program) {
+		t.Errorf("version 2 snapshot: %v, %v", err, resumed.Program)
+	}
+}
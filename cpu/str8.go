@@ -36,3 +36,24 @@ func SerializeStr8(b []byte) []Operation {
 	}
 	return result
 }
+
+// SerializeStr16 serializes a string of up to 65535 bytes into a slice of Operations: the
+// length in the first 2 bytes (little endian) followed by the data.
+func SerializeStr16(b []byte) []Operation {
+	l := len(b)
+	if l == 0 || l > 65535 {
+		panic(fmt.Sprintf("str16 can only handle strings 1-65535 bytes, got %d", l))
+	}
+	var result []Operation
+	// First word: up to 6 bytes of data + 2 length bytes
+	firstChunkSize := min(l, 6)
+	result = append(result, Serialize(b[:firstChunkSize])<<16|Operation(l))
+	// Remaining bytes in chunks of 8
+	remaining := b[firstChunkSize:]
+	for len(remaining) > 0 {
+		chunkSize := min(len(remaining), 8)
+		result = append(result, Serialize(remaining[:chunkSize]))
+		remaining = remaining[chunkSize:]
+	}
+	return result
+}
@@ -7,12 +7,14 @@ type Syscall uint8
 const (
 	InvalidSyscall Syscall = iota // skip 0 / avoid / detects accidental 0s
 
-	Exit   // Exit with A as return code
-	Read8  // Read a str8 string from stdin for up to A len bytes, result stored in param address/stack.
-	Write8 // Print (output) a str8 string to stdout - pointed at by param (and for SysS A as byte offset from said stack entry)
-	ReadN  // Read A bytes to address in param
-	WriteN // Write A bytes from address in param (so very different use of A than SysS Write8)
-	Sleep  // Sleep for A milliseconds
+	Exit    // Exit with A as return code
+	Read8   // Read a str8 string from stdin for up to A len bytes, result stored in param address/stack.
+	Write8  // Print (output) a str8 string to stdout - pointed at by param (and for SysS A as byte offset from said stack entry)
+	ReadN   // Read A bytes to address in param
+	WriteN  // Write A bytes from address in param (so very different use of A than SysS Write8)
+	Sleep   // Sleep for A milliseconds
+	Read16  // Read a str16 string from stdin for up to A len bytes, result stored in param address/stack.
+	Write16 // Print (output) a str16 string to stdout, like Write8 (including the SysS A byte offset).
 
 	LastSyscall
 )
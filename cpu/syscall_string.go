@@ -15,12 +15,14 @@ func _() {
 	_ = x[ReadN-4]
 	_ = x[WriteN-5]
 	_ = x[Sleep-6]
-	_ = x[LastSyscall-7]
+	_ = x[Read16-7]
+	_ = x[Write16-8]
+	_ = x[LastSyscall-9]
 }
 
-const _Syscall_name = "InvalidSyscallExitRead8Write8ReadNWriteNSleepLastSyscall"
+const _Syscall_name = "InvalidSyscallExitRead8Write8ReadNWriteNSleepRead16Write16LastSyscall"
 
-var _Syscall_index = [...]uint8{0, 14, 18, 23, 29, 34, 40, 45, 56}
+var _Syscall_index = [...]uint8{0, 14, 18, 23, 29, 34, 40, 45, 51, 58, 69}
 
 func (i Syscall) String() string {
 	idx := int(i) - 0
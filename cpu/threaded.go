@@ -0,0 +1,732 @@
+package cpu
+
+import (
+	"fmt"
+
+	"fortio.org/log"
+)
+
+// Engine selects how the CPU executes instructions.
+type Engine uint8
+
+const (
+	// SwitchEngine is the reference interpreter decoding each instruction in a big switch.
+	SwitchEngine Engine = iota
+	// ThreadedEngine converts the program once into a table of handlers with the operands already
+	// extracted (and checked when that can be done ahead of time), then runs that table.
+	ThreadedEngine
+	// JITEngine translates the program to native code (on linux/amd64, it falls back to the
+	// SwitchEngine elsewhere) and uses the reference interpreter for what it doesn't support.
+	JITEngine
+)
+
+func (e Engine) String() string {
+	switch e {
+	case SwitchEngine:
+		return "switch"
+	case ThreadedEngine:
+		return "threaded"
+	case JITEngine:
+		return "jit"
+	default:
+		return fmt.Sprintf("Engine(%d)", e)
+	}
+}
+
+// EngineFromString converts "switch", "threaded" or "jit" to an Engine.
+func EngineFromString(s string) (Engine, error) {
+	switch s {
+	case "switch":
+		return SwitchEngine, nil
+	case "threaded":
+		return ThreadedEngine, nil
+	case "jit":
+		return JITEngine, nil
+	default:
+		return SwitchEngine, fmt.Errorf("unknown engine %q, expecting switch, threaded or jit", s)
+	}
+}
+
+// handler executes the pre-decoded instruction at pc and returns the next pc (out of range,
+// through stop, when the machine stops because of an exit or a fault).
+type handler func(m *machine, d *decoded, pc ImmediateData) ImmediateData
+
+// decoded is an instruction with its operands extracted: a is the immediate value, the
+// absolute address (for R instructions and jumps), the stack offset or the syscall id and
+// b is the secondary operand (compare value, stack offset or absolute address to compare with,
+// increment, byte index or syscall argument).
+type decoded struct {
+	fn handler
+	a  int64
+	b  int64
+}
+
+// machine is the state of the threaded engine while it runs.
+type machine struct {
+	c           *CPU
+	program     []Operation
+	code        []decoded
+	stack       []Operation
+	accumulator int64
+	stackPtr    int
+	stopped     bool          // set by stop, on exit or fault.
+	stopPC      ImmediateData // pc of the instruction that stopped the machine.
+	fault       FaultKind
+	exitCode    int64
+}
+
+var handlers [LastInstruction]handler
+
+func init() {
+	handlers = [LastInstruction]handler{
+		LoadI: tLoadI, AddI: tAddI, SubI: tSubI, MulI: tMulI, DivI: tDivI, ModI: tModI,
+		ShiftI: tShiftI, AndI: tAndI,
+		JNE: tJNE, JEQ: tJEQ, JLT: tJLT, JGT: tJGT, JGTE: tJGTE, JLTE: tJLTE, JumpR: tJumpR,
+		LoadR: tLoadR, AddR: tAddR, SubR: tSubR, MulR: tMulR, DivR: tDivR, StoreR: tStoreR, IncrR: tIncrR,
+		Call: tCall, Ret: tRet, Push: tPush, Pop: tPop,
+		Sys: tSys, SysS: tSys,
+		LoadS: tLoadS, StoreS: tStoreS, AddS: tAddS, SubS: tSubS, MulS: tMulS, DivS: tDivS,
+		IncrS: tIncrS, IdivS: tIdivS, StoreSB: tStoreSB,
+		LoadSB: tLoadSB, LoadRB: tLoadRB, StoreRB: tStoreRB,
+		OrI: tOrI, XorI: tXorI, Not: tNot, ShrI: tShrI,
+		ModR: tModR, AndR: tAndR, OrR: tOrR, XorR: tXorR, ShiftR: tShiftR,
+		ModS: tModS, AndS: tAndS, OrS: tOrS, XorS: tXorS, ShiftS: tShiftS,
+		JNES: tJNES, JEQS: tJEQS, JLTS: tJLTS, JGTS: tJGTS, JGTES: tJGTES, JLTES: tJLTES,
+		JNER: tJNER, JEQR: tJEQR, JLTR: tJLTR, JGTR: tJGTR, JGTER: tJGTER, JLTER: tJLTER,
+	}
+}
+
+// decode pre-decodes the operation at pc. Faults that only depend on the instruction itself
+// (relative address outside of the program, division by a 0 immediate, unknown opcode) are
+// decoded into a handler raising them when (and if) the instruction is executed.
+func decode(op Operation, pc, end ImmediateData) decoded {
+	code := op.Opcode()
+	if code >= LastInstruction || handlers[code] == nil {
+		return decoded{fn: faultHandler(InvalidOpcode)}
+	}
+	d := decoded{fn: handlers[code], a: op.OperandInt64()}
+	switch code { //nolint:exhaustive // only the ones with a different operand layout.
+	case DivI, ModI:
+		if d.a == 0 {
+			return decoded{fn: faultHandler(DivideByZero)}
+		}
+	case JNE, JEQ, JLT, JGT, JGTE, JLTE:
+		param := op.OperandInt64()
+		d.a = int64(pc) + param>>8
+		d.b = param & 0xFF
+	case JNES, JEQS, JLTS, JGTS, JGTES, JLTES:
+		param := op.OperandInt64()
+		d.a = int64(pc) + param>>8
+		d.b = param & 0xFF
+	case JNER, JEQR, JLTR, JGTR, JGTER, JLTER:
+		d.a = int64(pc + op.Operand())
+		if pc+1 >= end { // no address word.
+			return decoded{fn: faultHandler(BadMemoryAccess)}
+		}
+	case JumpR, Call:
+		d.a = int64(pc + op.Operand())
+	case LoadR, AddR, SubR, MulR, DivR, StoreR, ModR, AndR, OrR, XorR, ShiftR:
+		d.a = int64(pc + op.Operand())
+		if uint64(d.a) >= uint64(end) { //nolint:gosec // negative becomes large unsigned
+			return decoded{fn: faultHandler(BadMemoryAccess)}
+		}
+	case IncrR:
+		arg := op.Operand()
+		d.a = int64(pc + arg>>8)
+		d.b = int64(int8(arg & 0xff))   //nolint:gosec // 0xff implies can't overflow (and we want the sign bit too)
+		if uint64(d.a) >= uint64(end) { //nolint:gosec // negative becomes large unsigned
+			return decoded{fn: faultHandler(BadMemoryAccess)}
+		}
+	case Pop:
+		d.a = max(0, d.a)
+	case IncrS:
+		arg := op.Operand()
+		d.a = int64(arg >> 8)
+		d.b = int64(int8(arg & 0xff)) //nolint:gosec // 0xff implies can't overflow (and we want the sign bit too)
+	case StoreSB, LoadSB:
+		arg := op.Operand()
+		d.a = int64(arg >> 8)
+		d.b = int64(uint8(arg & 0xff)) //nolint:gosec // 0xff implies can't overflow
+	case LoadRB, StoreRB:
+		arg := op.Operand()
+		d.a = int64(pc + arg>>8)       // address of the base word, checked with the byte offset.
+		d.b = int64(uint8(arg & 0xff)) //nolint:gosec // 0xff implies can't overflow
+	case Sys, SysS:
+		arg := op.OperandInt64()
+		d.a = arg & 0xFF
+		d.b = arg >> 8
+	}
+	return d
+}
+
+// decodeProgram pre-decodes the whole program for the threaded engine.
+func decodeProgram(program []Operation) []decoded {
+	end := ImmediateData(len(program))
+	code := make([]decoded, len(program))
+	for pc, op := range program {
+		code[pc] = decode(op, ImmediateData(pc), end)
+	}
+	return code
+}
+
+// redecode updates the pre-decoded instructions after the program memory from addr to addr+n
+// (excluded) was written to, so self modifying code behaves as with the switch engine.
+func (m *machine) redecode(addr, n int) {
+	end := ImmediateData(len(m.program))
+	for i := max(0, addr); i < min(addr+n, len(m.program)); i++ {
+		m.code[i] = decode(m.program[i], ImmediateData(i), end)
+	}
+}
+
+// executeThreaded is the equivalent of execute using code, the pre-decoded c.Program.
+// Unlike execute it doesn't log each instruction in Debug builds.
+func (c *CPU) executeThreaded(code []decoded, steps int64) (int64, bool, error) {
+	m := machine{
+		c: c, program: c.Program, code: code, stack: c.Stack,
+		accumulator: c.Accumulator, stackPtr: c.StackPtr,
+	}
+	pc := c.PC
+	end := ImmediateData(len(code))
+	for uint64(pc) < uint64(end) { //nolint:gosec // negative pc (bad jump) becomes a large unsigned
+		if steps == 0 {
+			c.save(pc, m.accumulator, m.stackPtr, steps)
+			return 0, false, nil
+		}
+		steps--
+		d := &code[pc]
+		pc = d.fn(&m, d, pc)
+	}
+	switch {
+	case m.stopped && m.fault != NoFault:
+		f := c.fault(m.fault, m.stopPC, m.accumulator, m.stackPtr, steps)
+		return int64(f.ExitCode()), true, f
+	case m.stopped:
+		c.save(m.stopPC, m.accumulator, m.stackPtr, steps)
+		return m.exitCode, true, nil
+	case pc != end:
+		// jumped (or returned) outside of the program.
+		f := c.fault(BadMemoryAccess, pc, m.accumulator, m.stackPtr, steps)
+		return int64(f.ExitCode()), true, f
+	}
+	log.Warnf("Program terminated without explicit Exit instruction. Accumulator: %d, PC: %d", m.accumulator, pc)
+	c.save(pc, m.accumulator, m.stackPtr, steps)
+	return 0, true, nil
+}
+
+// stop records the fault (or exit if kind is NoFault) of the instruction at pc and returns
+// an out of range pc to end the execution loop.
+func (m *machine) stop(kind FaultKind, pc ImmediateData) ImmediateData {
+	m.fault, m.stopPC, m.stopped = kind, pc, true
+	return -1
+}
+
+func faultHandler(kind FaultKind) handler {
+	return func(m *machine, _ *decoded, pc ImmediateData) ImmediateData {
+		return m.stop(kind, pc)
+	}
+}
+
+// stackIndex returns the stack index for offset, or the stack fault if it's out of range.
+func (m *machine) stackIndex(offset int64) (int, FaultKind) {
+	idx := m.stackPtr - int(offset)
+	return idx, stackCheck(idx, len(m.stack))
+}
+
+// stackCheck returns the fault for an out of range stack index, NoFault if it's valid.
+func stackCheck(idx, stackSize int) FaultKind {
+	switch {
+	case idx < 0:
+		return StackUnderflow
+	case idx >= stackSize:
+		return StackOverflow
+	default:
+		return NoFault
+	}
+}
+
+func tLoadI(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	m.accumulator = d.a
+	return pc + 1
+}
+
+func tAddI(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	m.accumulator += d.a
+	return pc + 1
+}
+
+func tSubI(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	m.accumulator -= d.a
+	return pc + 1
+}
+
+func tMulI(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	m.accumulator *= d.a
+	return pc + 1
+}
+
+func tDivI(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	m.accumulator /= d.a
+	return pc + 1
+}
+
+func tModI(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	m.accumulator %= d.a
+	return pc + 1
+}
+
+func tShiftI(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	if d.a < 0 {
+		m.accumulator >>= -d.a
+	} else {
+		m.accumulator <<= d.a
+	}
+	return pc + 1
+}
+
+func tAndI(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	m.accumulator &= d.a
+	return pc + 1
+}
+
+func tOrI(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	m.accumulator |= d.a
+	return pc + 1
+}
+
+func tXorI(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	m.accumulator ^= d.a
+	return pc + 1
+}
+
+func tNot(m *machine, _ *decoded, pc ImmediateData) ImmediateData {
+	m.accumulator = ^m.accumulator
+	return pc + 1
+}
+
+func tShrI(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	m.accumulator = Shr(m.accumulator, d.a)
+	return pc + 1
+}
+
+// jumpIf returns the decoded target if cond is true, otherwise the next instruction.
+func jumpIf(cond bool, d *decoded, pc ImmediateData) ImmediateData {
+	if cond {
+		return ImmediateData(d.a)
+	}
+	return pc + 1
+}
+
+func tJNE(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	return jumpIf(m.accumulator != d.b, d, pc)
+}
+func tJEQ(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	return jumpIf(m.accumulator == d.b, d, pc)
+}
+func tJLT(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	return jumpIf(m.accumulator < d.b, d, pc)
+}
+func tJGT(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	return jumpIf(m.accumulator > d.b, d, pc)
+}
+func tJGTE(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	return jumpIf(m.accumulator >= d.b, d, pc)
+}
+func tJLTE(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	return jumpIf(m.accumulator <= d.b, d, pc)
+}
+
+// jumpIfS jumps to d.a if comparing A with the stack word at offset d.b satisfies the
+// condition of code (one of the S conditional jumps).
+func (m *machine) jumpIfS(code Instruction, d *decoded, pc ImmediateData) ImmediateData {
+	idx, kind := m.stackIndex(d.b)
+	if kind != NoFault {
+		return m.stop(kind, pc)
+	}
+	return jumpIf(compare(code, m.accumulator, int64(m.stack[idx])), d, pc)
+}
+
+// jumpIfR is jumpIfS for the R conditional jumps, comparing with the program word whose
+// address is in the next word (read when executed as it's not an instruction and so not
+// redecoded when written to).
+func (m *machine) jumpIfR(code Instruction, d *decoded, pc ImmediateData) ImmediateData {
+	addr := pc + ImmediateData(m.program[pc+1])
+	if uint64(addr) >= uint64(len(m.program)) { //nolint:gosec // negative becomes large unsigned
+		return m.stop(BadMemoryAccess, pc)
+	}
+	if compare(code, m.accumulator, int64(m.program[addr])) {
+		return ImmediateData(d.a)
+	}
+	return pc + 2
+}
+
+func tJNES(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	return m.jumpIfS(JNES, d, pc)
+}
+func tJEQS(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	return m.jumpIfS(JEQS, d, pc)
+}
+func tJLTS(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	return m.jumpIfS(JLTS, d, pc)
+}
+func tJGTS(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	return m.jumpIfS(JGTS, d, pc)
+}
+func tJGTES(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	return m.jumpIfS(JGTES, d, pc)
+}
+func tJLTES(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	return m.jumpIfS(JLTES, d, pc)
+}
+func tJNER(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	return m.jumpIfR(JNER, d, pc)
+}
+func tJEQR(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	return m.jumpIfR(JEQR, d, pc)
+}
+func tJLTR(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	return m.jumpIfR(JLTR, d, pc)
+}
+func tJGTR(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	return m.jumpIfR(JGTR, d, pc)
+}
+func tJGTER(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	return m.jumpIfR(JGTER, d, pc)
+}
+func tJLTER(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	return m.jumpIfR(JLTER, d, pc)
+}
+
+func tJumpR(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	return ImmediateData(d.a)
+}
+
+func tLoadR(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	m.accumulator = int64(m.program[d.a])
+	return pc + 1
+}
+
+func tAddR(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	m.accumulator += int64(m.program[d.a])
+	return pc + 1
+}
+
+func tSubR(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	m.accumulator -= int64(m.program[d.a])
+	return pc + 1
+}
+
+func tMulR(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	m.accumulator *= int64(m.program[d.a])
+	return pc + 1
+}
+
+func tDivR(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	value := int64(m.program[d.a])
+	if value == 0 {
+		return m.stop(DivideByZero, pc)
+	}
+	m.accumulator /= value
+	return pc + 1
+}
+
+func tModR(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	value := int64(m.program[d.a])
+	if value == 0 {
+		return m.stop(DivideByZero, pc)
+	}
+	m.accumulator %= value
+	return pc + 1
+}
+
+func tAndR(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	m.accumulator &= int64(m.program[d.a])
+	return pc + 1
+}
+
+func tOrR(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	m.accumulator |= int64(m.program[d.a])
+	return pc + 1
+}
+
+func tXorR(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	m.accumulator ^= int64(m.program[d.a])
+	return pc + 1
+}
+
+func tShiftR(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	m.accumulator = Shift(m.accumulator, int64(m.program[d.a]))
+	return pc + 1
+}
+
+func tStoreR(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	m.program[d.a] = Operation(m.accumulator)
+	m.redecode(int(d.a), 1)
+	return pc + 1
+}
+
+func tIncrR(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	m.accumulator = int64(m.program[d.a]) + d.b
+	m.program[d.a] = Operation(m.accumulator)
+	m.redecode(int(d.a), 1)
+	return pc + 1
+}
+
+func tCall(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	if m.stackPtr+1 >= len(m.stack) {
+		return m.stop(StackOverflow, pc)
+	}
+	m.stackPtr++
+	m.stack[m.stackPtr] = Operation(pc + 1)
+	return ImmediateData(d.a)
+}
+
+func tRet(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	extra := int(d.a)
+	if extra > 0 {
+		if m.stackPtr-extra < 0 {
+			return m.stop(StackUnderflow, pc)
+		}
+		m.stackPtr -= extra
+	} else if m.stackPtr < 0 {
+		return m.stop(StackUnderflow, pc)
+	}
+	m.stackPtr--
+	return ImmediateData(m.stack[m.stackPtr+1])
+}
+
+func tPush(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	if m.stackPtr+1+max(0, int(d.a)) >= len(m.stack) {
+		return m.stop(StackOverflow, pc)
+	}
+	for range d.a {
+		m.stackPtr++
+		m.stack[m.stackPtr] = 0
+	}
+	m.stackPtr++
+	m.stack[m.stackPtr] = Operation(m.accumulator)
+	return pc + 1
+}
+
+func tPop(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	if m.stackPtr-int(d.a) < 0 {
+		return m.stop(StackUnderflow, pc)
+	}
+	m.accumulator = int64(m.stack[m.stackPtr])
+	m.stackPtr -= 1 + int(d.a)
+	return pc + 1
+}
+
+func tSys(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	callID := Syscall(d.a) //nolint:gosec // decoded from 0xFF mask so can't overflow
+	isStack := m.program[pc].Opcode() == SysS
+	log.Infof("Syscall %v at PC: %d%s, accumulator: %d - operand: %d (%x)", callID, pc, m.c.where(pc), m.accumulator, d.b, d.b)
+	res, abort, ok := m.c.executeSyscall(callID, d.b, m.accumulator, m.program, pc, isStack, m.stack, m.stackPtr)
+	if !ok {
+		return m.stop(BadMemoryAccess, pc)
+	}
+	if abort {
+		m.exitCode = res
+		return m.stop(NoFault, pc)
+	}
+	if !isStack && (callID == Read8 || callID == Read16 || callID == ReadN) {
+		// the read may have overwritten instructions.
+		m.redecode(int(int64(pc)+d.b), int(m.accumulator)/OperationSize+2)
+	}
+	m.accumulator = res
+	return pc + 1
+}
+
+func tLoadS(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	idx, kind := m.stackIndex(d.a)
+	if kind != NoFault {
+		return m.stop(kind, pc)
+	}
+	m.accumulator = int64(m.stack[idx])
+	return pc + 1
+}
+
+func tStoreS(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	idx, kind := m.stackIndex(d.a)
+	if kind != NoFault {
+		return m.stop(kind, pc)
+	}
+	m.stack[idx] = Operation(m.accumulator)
+	return pc + 1
+}
+
+func tAddS(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	idx, kind := m.stackIndex(d.a)
+	if kind != NoFault {
+		return m.stop(kind, pc)
+	}
+	m.accumulator += int64(m.stack[idx])
+	return pc + 1
+}
+
+func tSubS(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	idx, kind := m.stackIndex(d.a)
+	if kind != NoFault {
+		return m.stop(kind, pc)
+	}
+	m.accumulator -= int64(m.stack[idx])
+	return pc + 1
+}
+
+func tMulS(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	idx, kind := m.stackIndex(d.a)
+	if kind != NoFault {
+		return m.stop(kind, pc)
+	}
+	m.accumulator *= int64(m.stack[idx])
+	return pc + 1
+}
+
+func tDivS(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	idx, kind := m.stackIndex(d.a)
+	if kind != NoFault {
+		return m.stop(kind, pc)
+	}
+	if m.stack[idx] == 0 {
+		return m.stop(DivideByZero, pc)
+	}
+	m.accumulator /= int64(m.stack[idx])
+	return pc + 1
+}
+
+func tModS(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	idx, kind := m.stackIndex(d.a)
+	if kind != NoFault {
+		return m.stop(kind, pc)
+	}
+	if m.stack[idx] == 0 {
+		return m.stop(DivideByZero, pc)
+	}
+	m.accumulator %= int64(m.stack[idx])
+	return pc + 1
+}
+
+func tAndS(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	idx, kind := m.stackIndex(d.a)
+	if kind != NoFault {
+		return m.stop(kind, pc)
+	}
+	m.accumulator &= int64(m.stack[idx])
+	return pc + 1
+}
+
+func tOrS(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	idx, kind := m.stackIndex(d.a)
+	if kind != NoFault {
+		return m.stop(kind, pc)
+	}
+	m.accumulator |= int64(m.stack[idx])
+	return pc + 1
+}
+
+func tXorS(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	idx, kind := m.stackIndex(d.a)
+	if kind != NoFault {
+		return m.stop(kind, pc)
+	}
+	m.accumulator ^= int64(m.stack[idx])
+	return pc + 1
+}
+
+func tShiftS(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	idx, kind := m.stackIndex(d.a)
+	if kind != NoFault {
+		return m.stop(kind, pc)
+	}
+	m.accumulator = Shift(m.accumulator, int64(m.stack[idx]))
+	return pc + 1
+}
+
+func tIncrS(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	idx, kind := m.stackIndex(d.a)
+	if kind != NoFault {
+		return m.stop(kind, pc)
+	}
+	m.accumulator = int64(m.stack[idx]) + d.b
+	m.stack[idx] = Operation(m.accumulator)
+	return pc + 1
+}
+
+func tIdivS(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	idx, kind := m.stackIndex(d.a)
+	if kind != NoFault {
+		return m.stop(kind, pc)
+	}
+	if m.accumulator == 0 {
+		return m.stop(DivideByZero, pc)
+	}
+	current := int64(m.stack[idx])
+	m.stack[idx] = Operation(current / m.accumulator)
+	m.accumulator = current % m.accumulator
+	return pc + 1
+}
+
+func tStoreSB(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	wordIdx, shift, kind := m.stackBytes(d)
+	if kind != NoFault {
+		return m.stop(kind, pc)
+	}
+	m.stack[wordIdx] = (m.stack[wordIdx] & ^(0xff << shift)) | (Operation(m.accumulator&0xff) << shift)
+	return pc + 1
+}
+
+// stackBytes returns the stack word and bit shift of the byte of LoadSB and StoreSB.
+func (m *machine) stackBytes(d *decoded) (int, int, FaultKind) {
+	idx, kind := m.stackIndex(d.b)
+	if kind != NoFault {
+		return 0, 0, kind
+	}
+	bytesOffset := int(m.stack[idx])
+	wordIdx := m.stackPtr - int(d.a) + bytesOffset/8
+	kind = stackCheck(wordIdx, len(m.stack))
+	if kind == NoFault && bytesOffset < 0 {
+		kind = StackOverflow
+	}
+	return wordIdx, (bytesOffset % 8) * 8, kind
+}
+
+func tLoadSB(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	wordIdx, shift, kind := m.stackBytes(d)
+	if kind != NoFault {
+		return m.stop(kind, pc)
+	}
+	m.accumulator = int64(uint8(m.stack[wordIdx] >> shift)) //nolint:gosec // the byte on purpose
+	return pc + 1
+}
+
+// memoryBytes returns the program word and bit shift of the byte of LoadRB and StoreRB.
+func (m *machine) memoryBytes(d *decoded) (int, int, FaultKind) {
+	idx, kind := m.stackIndex(d.b)
+	if kind != NoFault {
+		return 0, 0, kind
+	}
+	bytesOffset := int(m.stack[idx])
+	addr := int(d.a) + bytesOffset/8
+	if uint(addr) >= uint(len(m.program)) || bytesOffset < 0 { //nolint:gosec // negative becomes large unsigned
+		return 0, 0, BadMemoryAccess
+	}
+	return addr, (bytesOffset % 8) * 8, NoFault
+}
+
+func tLoadRB(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	addr, shift, kind := m.memoryBytes(d)
+	if kind != NoFault {
+		return m.stop(kind, pc)
+	}
+	m.accumulator = int64(uint8(m.program[addr] >> shift)) //nolint:gosec // the byte on purpose
+	return pc + 1
+}
+
+func tStoreRB(m *machine, d *decoded, pc ImmediateData) ImmediateData {
+	addr, shift, kind := m.memoryBytes(d)
+	if kind != NoFault {
+		return m.stop(kind, pc)
+	}
+	m.program[addr] = (m.program[addr] &^ (0xff << shift)) | (Operation(m.accumulator&0xff) << shift)
+	m.redecode(addr, 1)
+	return pc + 1
+}
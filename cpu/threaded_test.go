@@ -0,0 +1,263 @@
+package cpu
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// runEngine executes a copy of program with the given engine and returns a description of
+// the outcome and of the final CPU state.
+func runEngine(engine Engine, program []Operation, input string, maxInstructions int64) string {
+	var out, errOut bytes.Buffer
+	c := NewCPU(strings.NewReader(input), &out, &errOut)
+	c.Program = slices.Clone(program)
+	c.Engine = engine
+	c.MaxInstructions = maxInstructions
+	code, err := c.Execute(context.Background())
+	return fmt.Sprintf("code %d err %v\nA %d PC %d SP %d executed %d\nprogram %x\nstack %x\nout %q err %q",
+		code, err, c.Accumulator, c.PC, c.StackPtr, c.Executed, c.Program, c.Stack[:max(0, c.StackPtr+1)],
+		out.String(), errOut.String())
+}
+
+func TestEnginesMatch(t *testing.T) {
+	programs := map[string][]Operation{
+		"echo":    echoProgram(),
+		"counter": counterProgram(),
+		"self modifying": {
+			instr(LoadR, 3),   // load the AddI 5 instruction
+			instr(StoreR, 1),  // and overwrite the next instruction with it
+			instr(LoadI, 100), // replaced by AddI 5
+			instr(AddI, 5),
+			instr(IncrR, -1<<8|1), // turns the AddI 5 into AddI 5 + 1 as a 56 bits op...
+			instr(JNE, 2<<8|111),
+			sys(Sys, Exit, 1),
+			sys(Sys, Exit, 2),
+		},
+		"read over code": {
+			instr(LoadI, 16),
+			sys(Sys, ReadN, 1),
+			sys(Sys, Exit, 0),
+			instr(LoadI, 42), // overwritten by the read
+			sys(Sys, Exit, 3),
+		},
+		"store byte": {
+			instr(LoadI, 9),
+			instr(Push, 2),
+			instr(LoadI, 'A'),
+			instr(StoreSB, 2<<8),
+			instr(LoadS, 1),
+			sys(Sys, Exit, 0),
+		},
+		"jumps": {
+			instr(LoadI, 3),
+			instr(JGT, 2<<8|5),
+			instr(JLTE, 2<<8|3),
+			instr(AddI, 1),
+			instr(JLT, -1<<8|5),
+			instr(JGTE, 2<<8|5),
+			instr(JumpR, -5),
+			instr(JEQ, 2<<8|5),
+			sys(Sys, Exit, 7),
+			instr(MulI, 3),
+			instr(ShiftI, -1),
+			instr(AndI, 6),
+			instr(ModI, 4),
+			instr(DivI, 1),
+			instr(SubI, 1),
+			sys(Sys, Exit, 0),
+		},
+		"no exit": {instr(LoadI, 1)},
+		"stack ops": {
+			instr(LoadI, 1000),
+			instr(Push, 3),
+			instr(LoadI, 7),
+			instr(StoreS, 1),
+			instr(AddS, 3),
+			instr(SubS, 2),
+			instr(MulS, 1),
+			instr(IncrS, 2<<8|0xFE),
+			instr(DivS, 2),
+			instr(LoadS, 2),
+			instr(MulI, 1<<40),
+			instr(ShiftI, 70),
+			instr(AddI, -1<<50),
+			instr(ShiftI, -80),
+			instr(Pop, 1),
+			instr(Pop, 0),
+			instr(Ret, 0),
+		},
+		"recursion": {
+			instr(LoadI, 100),
+			instr(Call, 3),
+			sys(Sys, Exit, 0),
+			Operation(0), // unused
+			instr(JEQ, 3<<8|0),
+			instr(SubI, 1),
+			instr(Call, -2),
+			instr(Ret, 0),
+		},
+		"memory": {
+			instr(LoadR, 8),
+			instr(AddR, 8),
+			instr(MulR, 7),
+			instr(SubR, 6),
+			instr(DivR, 5),
+			instr(StoreR, 4),
+			instr(IncrR, 3<<8|3),
+			instr(JumpR, 3),
+			9,
+			21,
+			instr(JLTE, -2<<8|200),
+			instr(DivI, -1),
+			instr(ModI, 5),
+			instr(AndI, 0xF0F),
+			instr(IncrR, -6<<8|0x80),
+			instr(StoreR, -5),
+			instr(JGTE, -7<<8|3),
+			instr(Ret, 2),
+		},
+		"bitwise": {
+			instr(LoadI, 0x1234),
+			instr(OrI, 0x8000),
+			instr(XorI, -1),
+			instr(Not, 0),
+			instr(Push, 0), // 0x9234
+			instr(ShrI, 4),
+			instr(Push, 0),
+			instr(LoadI, -256),
+			instr(ShrI, 60), // logical: 15
+			instr(Push, 0),
+			instr(LoadI, -256),
+			instr(ShrI, -4),
+			instr(ShrI, 64),
+			instr(OrR, 17),
+			instr(AndR, 17),
+			instr(XorR, 15),
+			instr(ModR, 16),
+			instr(ShiftR, 16),
+			instr(Push, 0),
+			instr(ModS, 3),
+			instr(AndS, 2),
+			instr(OrS, 1),
+			instr(XorS, 3),
+			instr(ShiftS, 1),
+			instr(Push, 0),
+			instr(LoadI, -70),
+			instr(Push, 0),
+			instr(LoadR, 3),
+			instr(ShiftS, 0), // arithmetic: -1
+			sys(Sys, Exit, 0),
+			-1 << 63,
+			0x7FF0_0000_0000_00FF,
+			1000,
+			-3,
+		},
+		"compare": {
+			instr(LoadI, -1000),
+			instr(Push, 0),
+			instr(LoadI, 1<<40),
+			instr(JLTS, 15<<8|0), // not taken
+			instr(JGTES, 2<<8|0), // taken
+			sys(Sys, Exit, 1),    // skipped
+			instr(JNER, 3), 22,   // the -1000 word, taken
+			sys(Sys, Exit, 2),  // skipped
+			instr(JEQR, 5), -1, // compares with the previous word, not taken
+			instr(LoadI, -2000),
+			instr(JLTER, 3), 16, // -2000 <= -1000, taken
+			sys(Sys, Exit, 3),   // skipped
+			instr(JGTR, -1), 13, // not taken
+			instr(JNES, 6<<8|0),   // taken
+			sys(Sys, Exit, 4),     // skipped
+			sys(Sys, Exit, 5),     // skipped
+			sys(Sys, Exit, 6),     // skipped
+			sys(Sys, Exit, 7),     // skipped
+			sys(Sys, Exit, 8),     // skipped
+			instr(StoreS, 0),      // target of JNES
+			instr(JEQS, 2<<8|0),   // taken
+			sys(Sys, Exit, 9),     // skipped
+			instr(JGTS, -23<<8|0), // not taken
+			sys(Sys, Exit, 0),
+			-1000,
+		},
+		"store address word": {
+			instr(LoadI, 4),
+			instr(StoreR, 3), // now compares with the 7 word
+			instr(LoadI, 7),
+			instr(JEQR, 3), 1, // taken
+			sys(Sys, Exit, 1), // skipped
+			sys(Sys, Exit, 0),
+			7,
+		},
+		"store byte over code": {
+			instr(LoadI, 0),
+			instr(Push, 0), // byte offset 0: the opcode
+			instr(LoadI, ImmediateData(AddI)),
+			instr(StoreRB, 2<<8|0), // turns the LoadI 7 into AddI 7
+			instr(LoadI, 1),
+			instr(LoadI, 7),
+			sys(Sys, Exit, 0),
+		},
+		"ret to end": {instr(LoadI, 2), instr(Push, 0), instr(Ret, 0)},
+	}
+	for _, tt := range faultTests {
+		programs[tt.name] = tt.program
+	}
+	input := "\x01\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00rest of input"
+	for name, program := range programs {
+		for _, limit := range []int64{1, 2, 3, 7, 100, 100_000} {
+			t.Run(fmt.Sprintf("%s/%d", name, limit), func(t *testing.T) {
+				expected := runEngine(SwitchEngine, program, input, limit)
+				for _, engine := range []Engine{ThreadedEngine, JITEngine} {
+					got := runEngine(engine, program, input, limit)
+					if got != expected {
+						t.Errorf("%v engine got:\n%s\nswitch engine got:\n%s", engine, got, expected)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestEngineFromString(t *testing.T) {
+	for _, e := range []Engine{SwitchEngine, ThreadedEngine, JITEngine} {
+		got, err := EngineFromString(e.String())
+		if err != nil || got != e {
+			t.Errorf("round trip of %v got %v %v", e, got, err)
+		}
+	}
+	if _, err := EngineFromString("bogus"); err == nil {
+		t.Errorf("expected an error for an unknown engine")
+	}
+}
+
+// loopProgram counts down from 10 millions, like programs/loop.asm.
+func loopProgram() []Operation {
+	return []Operation{instr(LoadI, 10_000_000), instr(AddI, -1), instr(JNE, -1<<8), sys(Sys, Exit, 0)}
+}
+
+func benchmarkEngine(b *testing.B, engine Engine) {
+	for b.Loop() {
+		c := NewCPU(nil, DiscardWriter{}, DiscardWriter{})
+		c.Program = loopProgram()
+		c.Engine = engine
+		if code, err := c.Execute(context.Background()); code != 0 || err != nil {
+			b.Fatalf("unexpected %d %v", code, err)
+		}
+	}
+}
+
+func BenchmarkSwitchEngine(b *testing.B) {
+	benchmarkEngine(b, SwitchEngine)
+}
+
+func BenchmarkThreadedEngine(b *testing.B) {
+	benchmarkEngine(b, ThreadedEngine)
+}
+
+func BenchmarkJITEngine(b *testing.B) {
+	benchmarkEngine(b, JITEngine)
+}
@@ -0,0 +1,261 @@
+package cpu
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"fortio.org/log"
+)
+
+// VerifyError is one problem found by Verify.
+type VerifyError struct {
+	PC  ImmediateData
+	Op  Operation
+	Msg string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("PC %d: %v %d: %s", e.PC, e.Op.Opcode(), e.Op.Operand(), e.Msg)
+}
+
+// Verify statically checks the code reachable from PC 0: that every opcode and syscall is
+// known, that the relative jump, call and memory targets are inside the program and that the
+// stack depth is the same along every control-flow path reaching an instruction, never goes
+// below empty and matches the Ret of each called function. The result is nil or the
+// errors.Join of the *VerifyError found, by PC.
+//
+// The stack depth is tracked relative to the entry of each function (PC 0 and the Call
+// targets): a Call then changes the caller's depth by the depth at the callee's Ret minus
+// the entries it unwinds (0 for functions returning their own variables, negative when they
+// also pop the caller's arguments). Self-modifying code and Ret to computed addresses other
+// than the return address can't be verified statically and are assumed not to happen.
+func Verify(program []Operation) error {
+	return VerifyFrom(program, 0)
+}
+
+// VerifyFrom is Verify for a program starting at entry instead of PC 0.
+func VerifyFrom(program []Operation, entry ImmediateData) error {
+	if entry < 0 || entry >= ImmediateData(len(program)) {
+		return fmt.Errorf("entry point %d outside of the program (0-%d)", entry, len(program)-1)
+	}
+	v := newVerifier(program, entry)
+	errs := map[ImmediateData]*VerifyError{}
+	v.walkAll(errs)
+	pcs := make([]ImmediateData, 0, len(errs))
+	for pc := range errs {
+		pcs = append(pcs, pc)
+	}
+	slices.Sort(pcs)
+	joined := make([]error, 0, len(pcs))
+	for _, pc := range pcs {
+		joined = append(joined, errs[pc])
+	}
+	return errors.Join(joined...)
+}
+
+// newVerifier finds the functions called from entry and computes their stack effect, until
+// none changes (recursive ones only get known through their base case, which can then unlock
+// their callers).
+func newVerifier(program []Operation, entry ImmediateData) *verifier {
+	v := &verifier{program: program, effects: map[ImmediateData]int{}, functions: []ImmediateData{entry}, main: entry}
+	for changed := true; changed; {
+		changed = false
+		for i := 0; i < len(v.functions); i++ {
+			entry := v.functions[i]
+			if _, known := v.effects[entry]; known {
+				continue
+			}
+			n := len(v.functions)
+			if effect, ok := v.walk(entry, nil); ok {
+				v.effects[entry] = effect
+				changed = true
+			}
+			changed = changed || len(v.functions) != n
+		}
+	}
+	return v
+}
+
+// frameDepths returns the static stack depth of the code reachable from entry, for unwinding
+// the stack (the first function reaching a PC shared by several wins).
+func frameDepths(program []Operation, entry ImmediateData) map[ImmediateData]frameDepth {
+	v := newVerifier(program, entry)
+	v.frames = make(map[ImmediateData]frameDepth)
+	v.walkAll(nil)
+	return v.frames
+}
+
+type verifier struct {
+	program   []Operation
+	effects   map[ImmediateData]int // Stack depth change of the callers, for the functions that return.
+	functions []ImmediateData       // Entry PCs, main first then the Call targets.
+	main      ImmediateData         // Where the execution starts.
+	frames    map[ImmediateData]frameDepth
+}
+
+// frameDepth is the static stack depth at a PC, relative to the entry of its function (where
+// the return address is the entry just below), or to the empty stack for main.
+type frameDepth struct {
+	depth int
+	main  bool
+}
+
+// walkAll walks main and every function found, recording the errors in errs if not nil.
+func (v *verifier) walkAll(errs map[ImmediateData]*VerifyError) {
+	for _, entry := range v.functions {
+		v.walk(entry, errs)
+	}
+}
+
+// walk follows the control flow from entry, with the stack depth relative to it, and returns
+// the effect of a call to entry if a Ret was reached. Problems are recorded in errs if not nil
+// (first one per PC).
+func (v *verifier) walk(entry ImmediateData, errs map[ImmediateData]*VerifyError) (int, bool) {
+	end := ImmediateData(len(v.program))
+	isMain := entry == v.main
+	depths := map[ImmediateData]int{entry: 0}
+	todo := []ImmediateData{entry}
+	effect, returns := 0, false
+	report := func(pc ImmediateData, format string, args ...any) {
+		if errs == nil || errs[pc] != nil {
+			return
+		}
+		errs[pc] = &VerifyError{PC: pc, Op: v.program[pc], Msg: fmt.Sprintf(format, args...)}
+	}
+	next := func(from, pc ImmediateData, depth int) {
+		switch {
+		case pc < 0 || pc > end:
+			report(from, "target %d outside of the program (0-%d)", pc, end)
+			return
+		case isMain && depth < 0:
+			report(from, "stack underflow (depth %d)", depth)
+			return
+		case pc == end:
+			return // normal end of the program.
+		}
+		if d, seen := depths[pc]; seen {
+			if d != depth {
+				report(from, "stack depth %d at PC %d, reached before with %d", depth, pc, d)
+			}
+			return
+		}
+		depths[pc] = depth
+		todo = append(todo, pc)
+	}
+	for len(todo) > 0 {
+		pc := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		depth := depths[pc]
+		op := v.program[pc]
+		arg := op.Operand()
+		switch op.Opcode() { //nolint:exhaustive // the others just continue to the next instruction.
+		case JNE, JEQ, JLT, JGT, JGTE, JLTE, JNES, JEQS, JLTS, JGTS, JGTES, JLTES:
+			next(pc, pc+1, depth)
+			next(pc, pc+arg>>8, depth)
+		case JNER, JEQR, JLTR, JGTR, JGTER, JLTER:
+			if pc+1 >= end {
+				report(pc, "missing address word")
+				continue
+			}
+			v.checkAddress(pc, pc+ImmediateData(v.program[pc+1]), report)
+			next(pc, pc+2, depth)
+			next(pc, pc+arg, depth)
+		case JumpR:
+			next(pc, pc+arg, depth)
+		case LoadR, AddR, SubR, MulR, DivR, StoreR, ModR, AndR, OrR, XorR, ShiftR:
+			v.checkAddress(pc, pc+arg, report)
+			next(pc, pc+1, depth)
+		case IncrR, LoadRB, StoreRB:
+			v.checkAddress(pc, pc+arg>>8, report)
+			next(pc, pc+1, depth)
+		case Call:
+			target := pc + arg
+			if target < 0 || target > end {
+				report(pc, "target %d outside of the program (0-%d)", target, end)
+				continue
+			}
+			if target == end {
+				continue
+			}
+			if !slices.Contains(v.functions, target) {
+				v.functions = append(v.functions, target)
+			}
+			if calleeEffect, known := v.effects[target]; known {
+				next(pc, pc+1, depth+calleeEffect)
+			}
+		case Ret:
+			extra := max(0, int(arg))
+			if isMain {
+				if depth < extra+1 {
+					report(pc, "stack underflow (depth %d, needs %d)", depth, extra+1)
+				}
+				continue
+			}
+			e := depth - extra
+			if returns && e != effect {
+				report(pc, "unbalanced stack: returns with depth %d for %d entries, other Ret with %d", depth, extra,
+					effect+extra)
+				continue
+			}
+			effect, returns = e, true
+		case Push:
+			next(pc, pc+1, depth+1+max(0, int(arg)))
+		case Pop:
+			next(pc, pc+1, depth-1-max(0, int(arg)))
+		case Sys, SysS:
+			call := Syscall(arg & 0xFF) //nolint:gosec // 0xFF mask
+			if call == InvalidSyscall || call >= LastSyscall {
+				report(pc, "invalid syscall %d", call)
+				continue
+			}
+			if call != Exit {
+				next(pc, pc+1, depth)
+			}
+		default:
+			if op.Opcode() == InvalidInstruction || op.Opcode() >= LastInstruction {
+				report(pc, "invalid opcode %d", op.Opcode())
+				continue
+			}
+			next(pc, pc+1, depth)
+		}
+	}
+	if v.frames != nil {
+		for pc, depth := range depths {
+			if _, done := v.frames[pc]; !done {
+				v.frames[pc] = frameDepth{depth, isMain}
+			}
+		}
+	}
+	return effect, returns
+}
+
+// checkAddress reports addr if it is outside of the program memory.
+func (v *verifier) checkAddress(pc, addr ImmediateData, report func(ImmediateData, string, ...any)) {
+	if addr < 0 || addr >= ImmediateData(len(v.program)) {
+		report(pc, "address %d outside of the program (0-%d)", addr, len(v.program)-1)
+	}
+}
+
+// VerifyFiles runs Verify on the given .vm files and logs the problems found. It returns 0 if
+// all of them are valid.
+func VerifyFiles(files ...string) int {
+	failed := 0
+	for _, file := range files {
+		img, err := ReadImageFile(file)
+		if err != nil {
+			return log.FErrf("Failed to load %s: %v", file, err)
+		}
+		program := img.Memory()
+		if err := VerifyFrom(program, img.Entry); err != nil {
+			log.Errf("%s failed verification:\n%v", file, err)
+			failed++
+			continue
+		}
+		log.Infof("%s: ok (%d words)", file, len(program))
+	}
+	if failed > 0 {
+		return log.FErrf("%d of %d files failed verification", failed, len(files))
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+package cpu
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestVerifyValid(t *testing.T) {
+	programs := map[string][]Operation{
+		"echo":    echoProgram(),
+		"counter": counterProgram(),
+		"function": {
+			instr(LoadI, 3),
+			instr(Call, 2),
+			sys(Sys, Exit, 0),
+			instr(Push, 1), // f: 2 variables
+			instr(JEQ, 3<<8|0),
+			instr(Pop, 0),
+			instr(Ret, 1),
+			instr(Ret, 2),
+		},
+		"pops argument": {
+			instr(Push, 0),
+			instr(Call, 2),
+			sys(Sys, Exit, 0),
+			instr(Ret, 1),
+		},
+		"recursive": {
+			instr(LoadI, 5),
+			instr(Call, 2),
+			sys(Sys, Exit, 0),
+			instr(JEQ, 5<<8|0), // f:
+			instr(Push, 0),
+			instr(SubI, 1),
+			instr(Call, -3),
+			instr(Pop, 0),
+			instr(Ret, 0),
+		},
+		"data":   {instr(LoadR, 2), sys(Sys, Exit, 0), 0xFF},
+		"to end": {instr(JNE, 2<<8), instr(JumpR, 1)},
+		"full range jumps": {
+			instr(Push, 0),
+			instr(JLTR, 4), 3,
+			instr(JumpR, 2),
+			-1000,
+			instr(JGTES, 1<<8|0),
+			sys(Sys, Exit, 0),
+		},
+	}
+	for name, program := range programs {
+		if err := Verify(program); err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		program []Operation
+		pc      ImmediateData
+		msg     string
+	}{
+		{"invalid opcode", []Operation{instr(LoadI, 1), Operation(LastInstruction)}, 1, "invalid opcode"},
+		{"zero opcode", []Operation{0}, 0, "invalid opcode"},
+		{"jump outside", []Operation{instr(JumpR, -5)}, 0, "target -5 outside"},
+		{"conditional jump", []Operation{instr(JEQ, 5<<8)}, 0, "target 5 outside"},
+		{"call outside", []Operation{instr(Call, 2)}, 0, "target 2 outside"},
+		{"LoadR", []Operation{instr(LoadR, 1)}, 0, "address 1 outside"},
+		{"StoreR", []Operation{instr(StoreR, -1)}, 0, "address -1 outside"},
+		{"IncrR", []Operation{instr(IncrR, 4<<8|1)}, 0, "address 4 outside"},
+		{"JLTR address", []Operation{instr(JLTR, 2), -2}, 0, "address -2 outside"},
+		{"JLTR address word", []Operation{instr(JLTR, 1)}, 0, "missing address word"},
+		{"JEQS target", []Operation{instr(JEQS, 3<<8)}, 0, "target 3 outside"},
+		{"syscall", []Operation{sys(Sys, LastSyscall, 0)}, 0, "invalid syscall"},
+		{"pop empty", []Operation{instr(Pop, 0)}, 0, "stack underflow"},
+		{"ret empty", []Operation{instr(Push, 0), instr(Ret, 1)}, 1, "stack underflow"},
+		{"loop push", []Operation{instr(Push, 0), instr(JumpR, -1)}, 1, "stack depth 1 at PC 0"},
+		{"unbalanced ret", []Operation{
+			instr(Call, 2),
+			sys(Sys, Exit, 0),
+			instr(JEQ, 3<<8), // f:
+			instr(Push, 0),
+			instr(Ret, 0),
+			instr(Ret, 0),
+		}, 4, "unbalanced stack"},
+		{"after call", []Operation{
+			instr(Call, 3),
+			instr(Pop, 0),
+			sys(Sys, Exit, 0),
+			instr(Ret, 1), // f: pops the caller's (missing) argument
+		}, 0, "stack underflow"},
+		{"unreachable is ignored", []Operation{sys(Sys, Exit, 0), 0, instr(JumpR, 10), instr(LoadS, 0)}, 3, ""},
+	}
+	for _, tt := range tests {
+		err := Verify(tt.program)
+		if tt.msg == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+			continue
+		}
+		var vErr *VerifyError
+		if !errors.As(err, &vErr) {
+			t.Errorf("%s: expected a VerifyError, got %v", tt.name, err)
+			continue
+		}
+		if vErr.PC != tt.pc || !strings.Contains(vErr.Msg, tt.msg) {
+			t.Errorf("%s: got %v, expected PC %d with %q", tt.name, vErr, tt.pc, tt.msg)
+		}
+	}
+}
+
+func TestVerifyErrorsJoined(t *testing.T) {
+	err := Verify([]Operation{instr(JNE, 10<<8), instr(LoadR, -3), Operation(0xFF)})
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "PC 0:") || !strings.HasPrefix(lines[2], "PC 2:") {
+		t.Errorf("expected 3 errors by PC, got %q", err.Error())
+	}
+}
@@ -48,25 +48,100 @@ typedef struct CPU {
 
 enum { StackSize = 512 };
 
-// sys_write writes bytes from memory starting at addr to stdout
+// shift64 shifts x left by n bits, or right (arithmetic) by -n if n is
+// negative, for any n like cpu.Shift (ShiftI, ShiftR and ShiftS).
+int64_t shift64(int64_t x, int64_t n) {
+  if (n <= -64) {
+    return x < 0 ? -1 : 0;
+  }
+  if (n < 0) {
+    return x >> -n;
+  }
+  return n >= 64 ? 0 : (int64_t)((uint64_t)x << n);
+}
+
+// shr64 shifts x right without the sign by n bits, or left by -n if n is
+// negative, for any n like cpu.Shr (ShrI).
+int64_t shr64(int64_t x, int64_t n) {
+  if (n >= 64 || n <= -64) {
+    return 0;
+  }
+  if (n < 0) {
+    return (int64_t)((uint64_t)x << -n);
+  }
+  return (int64_t)((uint64_t)x >> n);
+}
+
+// bitwise returns the result of the bitwise (or modulo) R or S instruction
+// opcode for a and the operand value b.
+int64_t bitwise(uint8_t opcode, int64_t a, int64_t b) {
+  switch (opcode) {
+  case ModR:
+  case ModS:
+    return b == -1 ? 0 : a % b;
+  case AndR:
+  case AndS:
+    return a & b;
+  case OrR:
+  case OrS:
+    return a | b;
+  case XorR:
+  case XorS:
+    return a ^ b;
+  default: // ShiftR, ShiftS
+    return shift64(a, b);
+  }
+}
+
+// compare returns whether the S or R conditional jump opcode jumps when
+// comparing a with b.
+int compare(uint8_t opcode, int64_t a, int64_t b) {
+  switch (opcode) {
+  case JNES:
+  case JNER:
+    return a != b;
+  case JEQS:
+  case JEQR:
+    return a == b;
+  case JLTS:
+  case JLTR:
+    return a < b;
+  case JGTS:
+  case JGTR:
+    return a > b;
+  case JGTES:
+  case JGTER:
+    return a >= b;
+  default: // JLTES, JLTER
+    return a <= b;
+  }
+}
+
+// sys_write_str writes the bytes of the string at addr to stdout, its length is
+// in the first prefix bytes (1 for str8, 2 for str16, little endian).
 // Returns the number of bytes written or -1 on error
-// relies on the VM layout where the str8 payload is contiguous in memory
-// following the first word that stores the length in its low byte.
-int64_t sys_write8(Operation *memory, int addr, int offset) {
-  // All bytes are contiguous in memory (including the length byte)
+// relies on the VM layout where the string payload is contiguous in memory
+// following the length bytes at the start of the first word.
+int64_t sys_write_str(Operation *memory, int addr, int offset, int prefix) {
+  // All bytes are contiguous in memory (including the length bytes)
   uint8_t *data = ((uint8_t *)&memory[addr]) + offset;
-  int length = *data++;
+  int length = data[0];
+  if (prefix == 2) {
+    length |= data[1] << 8;
+  }
+  data += prefix;
   if (length == 0) {
     return 0;
   }
   ssize_t n = write(STDOUT_FILENO, data, length);
   if (n < 0) {
-    perror("Failed to write8");
+    perror("Failed to write string");
     return n;
   }
   if (n != length) {
-    fprintf(stderr, "Failed to write all bytes of str8: expected %d, got %zd\n",
-            length, n);
+    fprintf(stderr,
+            "Failed to write all bytes of str%d: expected %d, got %zd\n",
+            8 * prefix, length, n);
     return -1;
   }
   return length;
@@ -91,18 +166,22 @@ int64_t sys_write(Operation *memory, int addr, int length) {
   return length;
 }
 
-int64_t sys_read8(Operation *memory, int addr, int n) {
-  if (n <= 0 || n > 255) {
-    fprintf(stderr, "Invalid read size for str8: %d\n", n);
+// sys_read_str reads up to n bytes as a string with a prefix bytes length
+// (1 for str8, 2 for str16, little endian).
+int64_t sys_read_str(Operation *memory, int addr, int n, int prefix) {
+  if (n <= 0 || n >= (1 << (8 * prefix))) {
+    fprintf(stderr, "Invalid read size for str%d: %d\n", 8 * prefix, n);
     return -1;
   }
   uint8_t *data = ((uint8_t *)&memory[addr]);
-  ssize_t r = read(STDIN_FILENO, data + 1, n);
+  ssize_t r = read(STDIN_FILENO, data + prefix, n);
   if (r < 0) {
-    perror("Failed to read8");
+    perror("Failed to read string");
     return -1;
   }
-  *data = (uint8_t)r;
+  for (int i = 0; i < prefix; i++) {
+    data[i] = (uint8_t)(r >> (8 * i));
+  }
   return r;
 }
 
@@ -156,21 +235,68 @@ void run_program(CPU *cpu) {
       DEBUG_PRINT("ModI %" PRId64 " at PC %" PRId64 "\n", operand, cpu->pc);
       cpu->accumulator %= operand;
       break;
-    case ShiftI: {
-      int64_t shift_val = operand;
-      DEBUG_PRINT("ShiftI %" PRId64 " at PC %" PRId64 "\n", shift_val, cpu->pc);
-      if (shift_val < 0) {
-        uint64_t tmp = (uint64_t)cpu->accumulator;
-        tmp >>= (uint64_t)(-shift_val);
-        cpu->accumulator = (int64_t)tmp;
-      } else {
-        cpu->accumulator <<= shift_val;
-      }
-    } break;
+    case ShiftI:
+      DEBUG_PRINT("ShiftI %" PRId64 " at PC %" PRId64 "\n", operand, cpu->pc);
+      cpu->accumulator = shift64(cpu->accumulator, operand);
+      break;
     case AndI:
       DEBUG_PRINT("AndI %" PRId64 " at PC %" PRId64 "\n", operand, cpu->pc);
       cpu->accumulator &= operand;
       break;
+    case OrI:
+      DEBUG_PRINT("OrI %" PRId64 " at PC %" PRId64 "\n", operand, cpu->pc);
+      cpu->accumulator |= operand;
+      break;
+    case XorI:
+      DEBUG_PRINT("XorI %" PRId64 " at PC %" PRId64 "\n", operand, cpu->pc);
+      cpu->accumulator ^= operand;
+      break;
+    case Not:
+      DEBUG_PRINT("Not at PC %" PRId64 "\n", cpu->pc);
+      cpu->accumulator = ~cpu->accumulator;
+      break;
+    case ShrI:
+      DEBUG_PRINT("ShrI %" PRId64 " at PC %" PRId64 "\n", operand, cpu->pc);
+      cpu->accumulator = shr64(cpu->accumulator, operand);
+      break;
+    case JNES:
+    case JEQS:
+    case JLTS:
+    case JGTS:
+    case JGTES:
+    case JLTES: {
+      int64_t addr = operand >> 8;
+      int offset = (int)(operand & 0xFF);
+      int64_t value = (int64_t)stack[stack_ptr - offset];
+      DEBUG_PRINT("Jump S opcode %d at PC %" PRId64 ", addr: %" PRId64
+                  ", value: %" PRId64 "\n",
+                  opcode, cpu->pc, addr, value);
+      if (compare(opcode, cpu->accumulator, value)) {
+        cpu->pc += addr;
+        continue;
+      }
+    } break;
+    case JNER:
+    case JEQR:
+    case JLTR:
+    case JGTR:
+    case JGTER:
+    case JLTER: {
+      int64_t addr = operand;
+      DEBUG_ASSERT((size_t)(cpu->pc + 1) < cpu->program_size);
+      int64_t offset = (int64_t)cpu->program[cpu->pc + 1];
+      DEBUG_ASSERT(cpu->pc + offset >= 0 &&
+                   (size_t)(cpu->pc + offset) < cpu->program_size);
+      int64_t value = (int64_t)cpu->program[cpu->pc + offset];
+      DEBUG_PRINT("Jump R opcode %d at PC %" PRId64 ", addr: %" PRId64
+                  ", value: %" PRId64 "\n",
+                  opcode, cpu->pc, addr, value);
+      if (compare(opcode, cpu->accumulator, value)) {
+        cpu->pc += addr;
+        continue;
+      }
+      cpu->pc++; // skip the address word.
+    } break;
     case JNE: {
       int64_t addr = operand >> 8;
       int64_t value = operand & 0xFF;
@@ -281,6 +407,20 @@ void run_program(CPU *cpu) {
       cpu->accumulator /= (int64_t)cpu->program[cpu->pc + operand];
       DEBUG_PRINT("       result: %" PRId64 "\n", cpu->accumulator);
       break;
+    case ModR:
+    case AndR:
+    case OrR:
+    case XorR:
+    case ShiftR: {
+      DEBUG_PRINT("Bitwise R opcode %d at PC %" PRId64 ", offset: %" PRId64
+                  "\n",
+                  opcode, cpu->pc, operand);
+      DEBUG_ASSERT(cpu->pc + operand >= 0 &&
+                   (size_t)(cpu->pc + operand) < cpu->program_size);
+      int64_t value = (int64_t)cpu->program[cpu->pc + operand];
+      cpu->accumulator = bitwise(opcode, cpu->accumulator, value);
+      DEBUG_PRINT("       result: %" PRId64 "\n", cpu->accumulator);
+    } break;
     case StoreR:
       DEBUG_PRINT("StoreR at PC %" PRId64 ", offset: %" PRId64
                   ", value: %" PRId64 "\n",
@@ -324,14 +464,17 @@ void run_program(CPU *cpu) {
                 syscallarg, cpu->pc);
         usleep(syscallarg * 1000);
         break;
-      case Read8: {
+      case Read8:
+      case Read16: {
         int64_t addr =
             is_stack ? (stack_ptr - (int)syscallarg) : (cpu->pc + syscallarg);
-        DEBUG_PRINT("Read8 syscall at PC %" PRId64 ", addr: %" PRId64
+        DEBUG_PRINT("%s syscall at PC %" PRId64 ", addr: %" PRId64
                     ", from %s\n",
-                    cpu->pc, addr, is_stack ? "stack" : "program");
-        cpu->accumulator = sys_read8(is_stack ? stack : cpu->program, (int)addr,
-                                     (int)cpu->accumulator);
+                    syscallid == Read8 ? "Read8" : "Read16", cpu->pc, addr,
+                    is_stack ? "stack" : "program");
+        cpu->accumulator =
+            sys_read_str(is_stack ? stack : cpu->program, (int)addr,
+                         (int)cpu->accumulator, syscallid == Read8 ? 1 : 2);
       } break;
       case ReadN: {
         int64_t addr =
@@ -342,18 +485,20 @@ void run_program(CPU *cpu) {
         cpu->accumulator = sys_read(is_stack ? stack : cpu->program, (int)addr,
                                     (int)cpu->accumulator);
       } break;
-      case Write8: {
+      case Write8:
+      case Write16: {
         int64_t addr =
             is_stack ? (stack_ptr - (int)syscallarg) : (cpu->pc + syscallarg);
-        DEBUG_PRINT("Write8 syscall at PC %" PRId64 ", addr: %" PRId64
+        DEBUG_PRINT("%s syscall at PC %" PRId64 ", addr: %" PRId64
                     ", from %s\n",
-                    cpu->pc, addr, is_stack ? "stack" : "program");
-        cpu->accumulator =
-            sys_write8(is_stack ? stack : cpu->program, (int)addr,
-                       is_stack ? cpu->accumulator : 0);
+                    syscallid == Write8 ? "Write8" : "Write16", cpu->pc, addr,
+                    is_stack ? "stack" : "program");
+        cpu->accumulator = sys_write_str(
+            is_stack ? stack : cpu->program, (int)addr,
+            is_stack ? cpu->accumulator : 0, syscallid == Write8 ? 1 : 2);
         if (cpu->accumulator == -1) {
-          fprintf(stderr, "ERR: Write8 syscall failed at PC %" PRId64 "\n",
-                  cpu->pc);
+          fprintf(stderr, "ERR: %s syscall failed at PC %" PRId64 "\n",
+                  syscallid == Write8 ? "Write8" : "Write16", cpu->pc);
         }
       } break;
       case WriteN: {
@@ -456,6 +601,18 @@ void run_program(CPU *cpu) {
                   ", SP=%d\n",
                   cpu->pc, offset, cpu->accumulator, stack_ptr);
     } break;
+    case ModS:
+    case AndS:
+    case OrS:
+    case XorS:
+    case ShiftS: {
+      int offset = (int)operand;
+      int64_t value = (int64_t)stack[stack_ptr - offset];
+      cpu->accumulator = bitwise(opcode, cpu->accumulator, value);
+      DEBUG_PRINT("Bitwise S opcode %d at PC %" PRId64 ", offset %d, result %" PRId64
+                  ", SP=%d\n",
+                  opcode, cpu->pc, offset, cpu->accumulator, stack_ptr);
+    } break;
     case IncrS: {
       int64_t arg = operand;
       int offset = (int)(arg >> 8);
@@ -497,6 +654,44 @@ void run_program(CPU *cpu) {
                   cpu->pc, base_offset, bytes_stack_index, bytes_offset,
                   old_value, new_value, stack_ptr);
     } break;
+    case LoadSB: {
+      int64_t arg = operand;
+      int base_offset = (int)(arg >> 8); // highest stack offset in the span
+      uint8_t bytes_stack_index = (uint8_t)(arg & 0xFF);
+      int bytes_offset = (int)stack[stack_ptr - (int)bytes_stack_index];
+      int stack_index = stack_ptr - base_offset + bytes_offset / 8;
+      int inner_offset_bits = (bytes_offset % 8) * 8;
+      cpu->accumulator =
+          (uint8_t)((uint64_t)stack[stack_index] >> inner_offset_bits);
+      DEBUG_PRINT("LoadSB  at PC %" PRId64
+                  ", baseOffset %d, bytesStackIndex %u, bytesOffset %d, "
+                  "value %" PRId64 ", SP=%d\n",
+                  cpu->pc, base_offset, bytes_stack_index, bytes_offset,
+                  cpu->accumulator, stack_ptr);
+    } break;
+    case LoadRB:
+    case StoreRB: {
+      int64_t arg = operand;
+      uint8_t bytes_stack_index = (uint8_t)(arg & 0xFF);
+      int64_t bytes_offset = stack[stack_ptr - (int)bytes_stack_index];
+      int64_t addr = cpu->pc + (arg >> 8) + bytes_offset / 8;
+      DEBUG_ASSERT(bytes_offset >= 0 && addr >= 0 &&
+                   (size_t)addr < cpu->program_size);
+      int inner_offset_bits = (int)(bytes_offset % 8) * 8;
+      if (opcode == LoadRB) {
+        cpu->accumulator =
+            (uint8_t)((uint64_t)cpu->program[addr] >> inner_offset_bits);
+      } else {
+        uint64_t mask = ((uint64_t)0xFF) << inner_offset_bits;
+        cpu->program[addr] = (Operation)(
+            ((uint64_t)cpu->program[addr] & ~mask) |
+            (((uint64_t)(cpu->accumulator & 0xFF)) << inner_offset_bits));
+      }
+      DEBUG_PRINT("%s at PC %" PRId64 ", address %" PRId64
+                  ", bytesOffset %" PRId64 ", A=%" PRId64 "\n",
+                  opcode == LoadRB ? "LoadRB" : "StoreRB", cpu->pc, addr,
+                  bytes_offset, cpu->accumulator);
+    } break;
     default:
       fprintf(stderr, "ERR: Unknown opcode %d at PC %" PRId64 "\n", opcode,
               cpu->pc);
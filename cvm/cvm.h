@@ -39,6 +39,35 @@ enum Instruction {
   IdivS,
   StoreSB,
   SysS,
+  LoadSB,
+  LoadRB,
+  StoreRB,
+  OrI,
+  XorI,
+  Not,
+  ShrI,
+  ModR,
+  AndR,
+  OrR,
+  XorR,
+  ShiftR,
+  ModS,
+  AndS,
+  OrS,
+  XorS,
+  ShiftS,
+  JNES,
+  JEQS,
+  JLTS,
+  JGTS,
+  JGTES,
+  JLTES,
+  JNER,
+  JEQR,
+  JLTR,
+  JGTR,
+  JGTER,
+  JLTER,
 };
 
 enum Syscall {
@@ -48,4 +77,6 @@ enum Syscall {
   ReadN,
   WriteN,
   Sleep,
+  Read16,
+  Write16,
 };
@@ -0,0 +1,446 @@
+// Package debugger provides an interactive step debugger for Grol VM programs (`vm debug`).
+package debugger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"fortio.org/log"
+	"grol.io/vm/asm"
+	"grol.io/vm/cpu"
+)
+
+const help = `Commands (empty line repeats the previous one):
+  s, step [n]            execute 1 (or n) instruction(s)
+  n, next                like step but steps over Call
+  f, finish              run until the current function returns (Ret)
+  c, continue            run until a breakpoint or the end of the program
+  b, break <pc|label>    set a breakpoint, without argument lists them
+  d, delete <pc|label>   remove a breakpoint
+  r, regs                show accumulator, PC and stack pointer
+  stack                  show the stack (offsets are from the top, as in LoadS)
+  m, mem <pc|label> [n]  show n (default 1) memory words
+  l, list [n]            disassemble n (default 5) instructions from PC
+  set a|pc|sp <value>    change the accumulator, PC or stack pointer
+  set mem <addr> <value> change a memory word
+  set stack <offset> <value> change a stack entry (offset from the top)
+  restart                reload the program and start over
+  q, quit                exit the debugger
+`
+
+// Debugger drives a cpu.CPU one instruction at a time.
+type Debugger struct {
+	CPU         *cpu.CPU
+	in          *bufio.Scanner
+	out         io.Writer
+	original    []cpu.Operation
+	stackSize   int
+	entry       cpu.ImmediateData // PC to (re)start at.
+	source      cpu.DebugInfo     // For the faults.
+	listing     *asm.Listing
+	labels      map[string]int // Generated and symbol labels to their address.
+	names       map[int]string // Symbol names by address, shown instead of the generated labels.
+	breakpoints map[int]bool
+	done        bool
+	exitCode    int
+}
+
+// New creates a debugger for the program in img (memory, entry point, symbols and debug info),
+// reading commands from in and writing to out. stackSize is the number of stack words (raised
+// to the one the image needs, cpu.DefaultStackSize if smaller).
+func New(img *cpu.Image, stackSize int, in io.Reader, out io.Writer) (*Debugger, error) {
+	program := img.Memory()
+	d := &Debugger{
+		stackSize:   max(stackSize, img.StackSize),
+		in:          bufio.NewScanner(in),
+		out:         out,
+		original:    slices.Clone(program),
+		entry:       img.Entry,
+		listing:     asm.NewListing(program, int(img.Entry)),
+		labels:      make(map[string]int),
+		names:       make(map[int]string),
+		breakpoints: make(map[int]bool),
+	}
+	for pc, label := range d.listing.Labels {
+		d.labels[label] = pc
+	}
+	for _, sym := range img.Symbols {
+		d.labels[sym.Name] = int(sym.Address)
+		if _, ok := d.names[int(sym.Address)]; !ok {
+			d.names[int(sym.Address)] = sym.Name
+		}
+	}
+	if len(img.Debug) > 0 {
+		var err error
+		if d.source, err = cpu.DecodeDebugInfo(img.Debug); err != nil {
+			log.Warnf("Ignoring invalid debug info: %v", err)
+		}
+	}
+	return d, d.restart()
+}
+
+func (d *Debugger) restart() error {
+	c := cpu.NewCPU(nil, nil, nil)
+	if err := c.LoadImage(&cpu.Image{Code: slices.Clone(d.original), Entry: d.entry, StackSize: d.stackSize}); err != nil {
+		return err
+	}
+	d.CPU = c
+	d.CPU.Source = d.source
+	d.done = false
+	d.exitCode = 0
+	return nil
+}
+
+// Run loads the .vm file and starts an interactive debugging session on stdin/stdout.
+func Run(file string, stackSize int) int {
+	img, err := cpu.ReadImageFile(file)
+	if err != nil {
+		return log.FErrf("Failed to load program %s: %v", file, err)
+	}
+	d, err := New(img, stackSize, os.Stdin, os.Stdout)
+	if err != nil {
+		return log.FErrf("Failed to load program %s: %v", file, err)
+	}
+	return d.Loop()
+}
+
+func (d *Debugger) printf(format string, args ...any) {
+	_, _ = fmt.Fprintf(d.out, format, args...)
+}
+
+// Loop reads and executes commands until quit or end of input. It returns the program's exit code.
+func (d *Debugger) Loop() int {
+	d.printf("Debugging %d words program, h for help\n", len(d.original))
+	d.showCurrent()
+	var last []string
+	for {
+		d.printf("(vm) ")
+		if !d.in.Scan() {
+			d.printf("\n")
+			return d.exitCode
+		}
+		fields := strings.Fields(d.in.Text())
+		if len(fields) == 0 {
+			fields = last
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		last = fields
+		if fields[0] == "q" || fields[0] == "quit" {
+			return d.exitCode
+		}
+		if err := d.command(fields[0], fields[1:]); err != nil {
+			d.printf("Error: %v\n", err)
+		}
+	}
+}
+
+//nolint:gocyclo // it's a command dispatcher.
+func (d *Debugger) command(cmd string, args []string) error {
+	switch cmd {
+	case "h", "help", "?":
+		d.printf("%s", help)
+	case "s", "step":
+		n := int64(1)
+		if len(args) > 0 {
+			v, err := strconv.ParseInt(args[0], 0, 64)
+			if err != nil {
+				return err
+			}
+			n = v
+		}
+		for range n {
+			if !d.step() {
+				break
+			}
+		}
+		d.showCurrent()
+	case "n", "next":
+		if !d.checkRunning() {
+			return nil
+		}
+		if d.currentOp().Opcode() == cpu.Call {
+			d.runUntilDepth(0)
+		} else {
+			d.step()
+		}
+		d.showCurrent()
+	case "f", "finish":
+		d.runUntilDepth(-1)
+		d.showCurrent()
+	case "c", "continue":
+		for d.step() {
+			if d.atBreakpoint() {
+				break
+			}
+		}
+		d.showCurrent()
+	case "b", "break":
+		if len(args) == 0 {
+			d.listBreakpoints()
+			return nil
+		}
+		pc, err := d.address(args[0])
+		if err != nil {
+			return err
+		}
+		d.breakpoints[pc] = true
+		d.printf("Breakpoint at %s\n", d.pcName(pc))
+	case "d", "delete":
+		if len(args) != 1 {
+			return fmt.Errorf("expecting 1 argument for %s", cmd)
+		}
+		pc, err := d.address(args[0])
+		if err != nil {
+			return err
+		}
+		delete(d.breakpoints, pc)
+	case "r", "regs":
+		d.showRegisters()
+	case "stack":
+		d.showStack()
+	case "m", "mem":
+		return d.showMemory(args)
+	case "l", "list":
+		n := 5
+		if len(args) > 0 {
+			v, err := strconv.Atoi(args[0])
+			if err != nil {
+				return err
+			}
+			n = v
+		}
+		d.list(int(d.CPU.PC), n)
+	case "set":
+		return d.set(args)
+	case "restart":
+		if err := d.restart(); err != nil {
+			return err
+		}
+		d.showCurrent()
+	default:
+		return fmt.Errorf("unknown command %q (h for help)", cmd)
+	}
+	return nil
+}
+
+func (d *Debugger) checkRunning() bool {
+	if d.done {
+		d.printf("Program exited with code %d (restart to start over)\n", d.exitCode)
+		return false
+	}
+	return true
+}
+
+// currentOp returns the operation at PC, or InvalidInstruction when PC is outside of the program
+// (after a set pc or a jump), so next and finish step into the fault.
+func (d *Debugger) currentOp() cpu.Operation {
+	if d.CPU.PC < 0 || int(d.CPU.PC) >= len(d.CPU.Program) {
+		return cpu.Operation(0)
+	}
+	return d.CPU.Program[d.CPU.PC]
+}
+
+// step executes one instruction, returns false if the program is (now) done.
+func (d *Debugger) step() bool {
+	if !d.checkRunning() {
+		return false
+	}
+	code, done, err := d.CPU.Step()
+	if err != nil {
+		d.printf("Fault: %v\n", err)
+	}
+	if done {
+		d.done = true
+		d.exitCode = code
+		d.printf("Program exited with code %d\n", code)
+		return false
+	}
+	return true
+}
+
+func (d *Debugger) atBreakpoint() bool {
+	return d.breakpoints[int(d.CPU.PC)]
+}
+
+// runUntilDepth steps until the call depth, relative to the current function, reaches target
+// (0 to step over a Call, -1 to run until the current function returns), or a breakpoint or
+// the end of the program is reached.
+func (d *Debugger) runUntilDepth(target int) {
+	depth := 0
+	for d.checkRunning() {
+		switch d.currentOp().Opcode() { //nolint:exhaustive // only the call/return ones matter.
+		case cpu.Call:
+			depth++
+		case cpu.Ret:
+			depth--
+		}
+		if !d.step() || depth == target || d.atBreakpoint() {
+			return
+		}
+	}
+}
+
+func (d *Debugger) pcName(pc int) string {
+	if name, ok := d.names[pc]; ok {
+		return fmt.Sprintf("%d (%s)", pc, name)
+	}
+	if label, ok := d.listing.Labels[pc]; ok {
+		return fmt.Sprintf("%d (%s)", pc, label)
+	}
+	return strconv.Itoa(pc)
+}
+
+// address parses a pc or a label.
+func (d *Debugger) address(s string) (int, error) {
+	if pc, ok := d.labels[s]; ok {
+		return pc, nil
+	}
+	pc, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address or unknown label %q", s)
+	}
+	if pc < 0 || pc >= len(d.CPU.Program) {
+		return 0, fmt.Errorf("address %d out of range (0 to %d)", pc, len(d.CPU.Program)-1)
+	}
+	return pc, nil
+}
+
+func (d *Debugger) listBreakpoints() {
+	pcs := make([]int, 0, len(d.breakpoints))
+	for pc := range d.breakpoints {
+		pcs = append(pcs, pc)
+	}
+	slices.Sort(pcs)
+	for _, pc := range pcs {
+		d.printf("  %s\n", d.pcName(pc))
+	}
+}
+
+func (d *Debugger) showCurrent() {
+	if d.done {
+		return
+	}
+	d.list(int(d.CPU.PC), 1)
+}
+
+func (d *Debugger) list(pc, n int) {
+	for ; n > 0 && pc < len(d.listing.Lines); pc++ {
+		line := d.listing.Lines[pc]
+		if line == "" {
+			continue
+		}
+		marker := "  "
+		if pc == int(d.CPU.PC) {
+			marker = "=>"
+		}
+		if d.breakpoints[pc] {
+			marker = "*" + marker[1:]
+		}
+		if name, ok := d.names[pc]; ok {
+			d.printf("%s:\n", name)
+		} else if label, ok := d.listing.Labels[pc]; ok {
+			d.printf("%s:\n", label)
+		}
+		d.printf("%s %4d  %s\n", marker, pc, line)
+		n--
+	}
+}
+
+func (d *Debugger) showRegisters() {
+	c := d.CPU
+	d.printf("A = %d (0x%x)  PC = %s  SP = %d\n", c.Accumulator, c.Accumulator, d.pcName(int(c.PC)), c.StackPtr)
+}
+
+func (d *Debugger) showStack() {
+	c := d.CPU
+	if c.StackPtr < 0 {
+		d.printf("Stack is empty (SP = %d)\n", c.StackPtr)
+		return
+	}
+	for i := c.StackPtr; i >= 0; i-- {
+		v := int64(c.Stack[i])
+		d.printf("  [SP-%d] %4d: %d (0x%x)\n", c.StackPtr-i, i, v, v)
+	}
+}
+
+func (d *Debugger) showMemory(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("expecting 1 or 2 arguments for mem")
+	}
+	pc, err := d.address(args[0])
+	if err != nil {
+		return err
+	}
+	n := 1
+	if len(args) == 2 {
+		n, err = strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+	}
+	for i := pc; i < pc+n && i < len(d.CPU.Program); i++ {
+		v := int64(d.CPU.Program[i])
+		d.printf("  %s: %d (0x%x)\n", d.pcName(i), v, uint64(v)) //nolint:gosec // on purpose
+	}
+	return nil
+}
+
+func (d *Debugger) set(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("expecting at least 2 arguments for set")
+	}
+	value, err := strconv.ParseInt(args[len(args)-1], 0, 64)
+	if len(args) == 2 && args[0] == "pc" {
+		var pc int
+		pc, err = d.address(args[1])
+		value = int64(pc)
+	}
+	if err != nil {
+		return err
+	}
+	c := d.CPU
+	switch args[0] {
+	case "a", "acc":
+		c.Accumulator = value
+	case "pc":
+		c.PC = cpu.ImmediateData(value)
+		d.showCurrent()
+	case "sp":
+		if value < -1 || value >= int64(len(c.Stack)) {
+			return fmt.Errorf("stack pointer %d out of range (-1 to %d)", value, len(c.Stack)-1)
+		}
+		c.StackPtr = int(value)
+	case "mem":
+		if len(args) != 3 {
+			return fmt.Errorf("expecting set mem <addr> <value>")
+		}
+		pc, err := d.address(args[1])
+		if err != nil {
+			return err
+		}
+		c.Program[pc] = cpu.Operation(value)
+	case "stack":
+		if len(args) != 3 {
+			return fmt.Errorf("expecting set stack <offset> <value>")
+		}
+		offset, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+		idx := c.StackPtr - offset
+		if idx < 0 || idx > c.StackPtr {
+			return fmt.Errorf("stack offset %d out of range (0 to %d)", offset, c.StackPtr)
+		}
+		c.Stack[idx] = cpu.Operation(value)
+	default:
+		return fmt.Errorf("unknown set target %q", args[0])
+	}
+	return nil
+}
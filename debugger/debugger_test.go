@@ -0,0 +1,150 @@
+package debugger
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"grol.io/vm/cpu"
+)
+
+func op(instr cpu.Instruction, operand cpu.ImmediateData) cpu.Operation {
+	return cpu.Operation(0).SetOpcode(instr).SetOperand(operand)
+}
+
+// program is: A = 3; call double; A++; exit 7 with double: A *= 2.
+func testProgram() []cpu.Operation {
+	return []cpu.Operation{
+		op(cpu.LoadI, 3),
+		op(cpu.Call, 3),
+		op(cpu.AddI, 1),
+		op(cpu.Sys, 7<<8|cpu.ImmediateData(cpu.Exit)),
+		op(cpu.MulI, 2),
+		op(cpu.Ret, 0),
+	}
+}
+
+func newDebugger(t *testing.T, img *cpu.Image, in io.Reader, out io.Writer) *Debugger {
+	t.Helper()
+	d, err := New(img, 0, in, out)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	return d
+}
+
+func TestDebuggerSession(t *testing.T) {
+	script := strings.Join([]string{
+		"n",       // LoadI
+		"n",       // over the Call
+		"r",       // A = 6
+		"set a 9", // change the accumulator
+		"s",       // AddI -> 10
+		"regs",
+		"s", // exit 7
+		"s", // already exited
+		"restart",
+		"b 4",
+		"c", // stops at the breakpoint
+		"stack",
+		"f", // back after the call
+		"r",
+		"mem 4 2",
+		"bogus",
+		"q",
+	}, "\n")
+	var out bytes.Buffer
+	d := newDebugger(t, &cpu.Image{Code: testProgram()}, strings.NewReader(script), &out)
+	code := d.Loop()
+	if code != 0 {
+		t.Errorf("exit code %d, expected 0 after restart", code)
+	}
+	output := out.String()
+	for _, expected := range []string{
+		"A = 6 (0x6)  PC = 2",
+		"A = 10 (0xa)  PC = 3",
+		"Program exited with code 7\n",
+		"Program exited with code 7 (restart to start over)",
+		"Breakpoint at 4 (L0004)",
+		"*>    4  MulI 2",
+		"[SP-0]    0: 2 (0x2)",
+		"A = 6 (0x6)  PC = 2  SP = -1",
+		"4 (L0004): ",
+		"unknown command \"bogus\"",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("output missing %q:\n%s", expected, output)
+		}
+	}
+}
+
+func TestDebuggerSetStack(t *testing.T) {
+	var out bytes.Buffer
+	d := newDebugger(t, &cpu.Image{Code: testProgram()}, strings.NewReader("s\ns\nset stack 0 42\nset stack 1 1\nset sp 600\n"), &out)
+	d.Loop()
+	if d.CPU.Stack[0] != 42 {
+		t.Errorf("stack[0] = %d, expected 42", d.CPU.Stack[0])
+	}
+	output := out.String()
+	if !strings.Contains(output, "stack offset 1 out of range") || !strings.Contains(output, "stack pointer 600 out of range") {
+		t.Errorf("expected range errors, got:\n%s", output)
+	}
+}
+
+func TestDebuggerBeforeFirstStep(t *testing.T) {
+	var out bytes.Buffer
+	d := newDebugger(t, &cpu.Image{Code: testProgram()}, strings.NewReader("stack\nset sp 0\nr\nset sp 600\n"), &out)
+	d.Loop()
+	if d.CPU.StackPtr != 0 || len(d.CPU.Stack) != cpu.DefaultStackSize {
+		t.Errorf("SP = %d with %d stack words, expected 0 and %d", d.CPU.StackPtr, len(d.CPU.Stack), cpu.DefaultStackSize)
+	}
+	output := out.String()
+	if !strings.Contains(output, "SP = 0") || !strings.Contains(output, "stack pointer 600 out of range") {
+		t.Errorf("unexpected output:\n%s", output)
+	}
+}
+
+func TestDebuggerEntryAndSymbols(t *testing.T) {
+	// a data word first so the entry point isn't 0.
+	img := &cpu.Image{
+		Code:    append([]cpu.Operation{0}, testProgram()...),
+		Entry:   1,
+		Symbols: []cpu.Symbol{{Name: "double", Address: 5}},
+	}
+	var out bytes.Buffer
+	d := newDebugger(t, img, strings.NewReader("b double\nc\nr\nrestart\nr\n"), &out)
+	d.Loop()
+	output := out.String()
+	for _, expected := range []string{
+		"Breakpoint at 5 (double)",
+		"double:\n*>    5  MulI 2",
+		"A = 3 (0x3)  PC = 5 (double)",
+		"A = 0 (0x0)  PC = 1  SP = -1",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("output missing %q:\n%s", expected, output)
+		}
+	}
+	if _, err := New(&cpu.Image{Code: testProgram(), Entry: 6}, 0, nil, nil); err == nil {
+		t.Errorf("expected an error for an entry point outside of the program")
+	}
+}
+
+func TestDebuggerPCOutsideProgram(t *testing.T) {
+	// next and finish look at the current instruction, which doesn't exist there.
+	var out bytes.Buffer
+	d := newDebugger(t, &cpu.Image{Code: testProgram()}, strings.NewReader("n\n"), &out)
+	d.CPU.PC = 50
+	d.Loop()
+	if err := d.command("restart", nil); err != nil {
+		t.Fatalf("restart failed: %v", err)
+	}
+	d.CPU.PC = -1
+	if err := d.command("f", nil); err != nil {
+		t.Errorf("finish failed: %v", err)
+	}
+	if output := out.String(); !strings.Contains(output, "Fault: ") {
+		t.Errorf("expected a fault, got:\n%s", output)
+	}
+}
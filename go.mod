@@ -5,6 +5,7 @@ go 1.24.0
 require (
 	fortio.org/cli v1.12.3
 	fortio.org/log v1.18.3
+	github.com/tetratelabs/wazero v1.10.1
 )
 
 require (
@@ -0,0 +1,92 @@
+; bits.asm: the bitwise instructions. FNV-1a hash of a str8 (LoadRB, XorS, MulR), masks (OrI,
+; XorI, Not, AndR, OrS, XorR, ModR) and the shifts (ShiftS and ShiftR are arithmetic for negative
+; counts, ShrI is logical), all printed in hex. `make bits-test` checks the C VM prints the same.
+    Var h i len
+    LoadR fnv_basis
+    StoreS h
+    LoadRB msg i ; i is 0: the length byte
+    StoreS len
+.hash:
+    IncrS 1 i
+    SubS len
+    JGT 0 .masks
+    LoadRB msg i
+    XorS h
+    MulR fnv_prime
+    StoreS h
+    JumpR .hash
+.masks:
+    LoadS h
+    Call hex ; 108dd60c22c6a35e
+    LoadI 0x1234
+    OrI 0x8000
+    XorI 0x0204
+    StoreS i ; 0x9030
+    Not
+    AndR mask ; 0x6f00
+    OrS i ; 0xff30
+    XorR mask ; 0x0030
+    Call hex
+    LoadS i
+    ModR seven ; 0x9030 % 7 = 1
+    AndS i ; 1 & 0x9030 = 0
+    XorS i
+    Call hex ; 9030
+.shifts:
+    LoadI 4
+    StoreS i
+    LoadI -256
+    StoreS len
+    ShiftS i
+    Call hex ; -256 << 4
+    LoadI -4
+    StoreS i
+    LoadS len
+    ShiftS i
+    Call hex ; -256 >> 4, keeps the sign
+    LoadS len
+    ShrI 4
+    Call hex ; logical: no sign
+    LoadS len
+    ShiftR sixty_four
+    Call hex ; all the bits are shifted out
+    Sys Exit 0
+
+hex: ; prints the accumulator as 16 hex digits, using ShrI so negative numbers work too.
+    Var x idx _ _ buf ; buf is 3 words: the length byte, 16 digits and a newline
+    LoadI 17
+    StoreSB buf idx ; idx is 0: the length byte
+    StoreS idx
+    LoadI '\n'
+    StoreSB buf idx
+.digit:
+    IncrS -1 idx
+    JEQ 0 .print
+    LoadS x
+    AndI 15
+    AddI '0'
+    JLTE '9' .store
+    AddI 'a' - '0' - 10
+.store:
+    StoreSB buf idx
+    LoadS x
+    ShrI 4
+    StoreS x
+    JumpR .digit
+.print:
+    LoadI 0 ; byte offset of the str8 in buf
+    SysS Write8 buf
+    Return
+
+fnv_basis:
+    data -3750763034362895579 ; 0xcbf29ce484222325
+fnv_prime:
+    data 0x100000001b3
+mask:
+    data 0xff00
+seven:
+    data 7
+sixty_four:
+    data 64
+msg:
+    str8 "Hello, bits!"
@@ -0,0 +1,48 @@
+; bytes.asm: byte by byte string processing, with LoadRB/StoreRB in memory and LoadSB/StoreSB
+; on the stack. Uppercases a str8 in place, then writes it reversed (and lowercased) from a
+; stack buffer.
+    Var i len src _ buf ; buf is 2 words (16 bytes), enough for msg and its length byte
+    LoadRB msg i ; i is 0: the length byte
+    StoreS len
+.upper:
+    IncrS 1 i
+    SubS len
+    JGT 0 .reverse ; i > len: done
+    LoadRB msg i
+    JLT 'a' .upper
+    JGT 'z' .upper
+    SubI 'a' - 'A'
+    StoreRB msg i
+    JumpR .upper
+.reverse:
+    Sys Write8 msg
+    Sys Write8 newline
+    LoadI 0
+    StoreS i
+    LoadS len
+    StoreSB buf i ; length byte of the str8 on the stack
+.reverse_loop:
+    IncrS 1 i
+    SubS len
+    JGT 0 .print
+    LoadS len ; src = len - i + 1
+    SubS i
+    AddI 1
+    StoreS src
+    LoadRB msg src
+    StoreSB buf i
+    LoadSB buf i ; read it back to lowercase it
+    JLT 'A' .reverse_loop
+    JGT 'Z' .reverse_loop
+    AddI 'a' - 'A'
+    StoreSB buf i
+    JumpR .reverse_loop
+.print:
+    LoadI 0 ; byte offset of the str8 in buf
+    SysS Write8 buf
+    Sys Write8 newline
+    Sys Exit 0
+msg:
+    str8 "Hello, bytes!"
+newline:
+    str8 "\n"
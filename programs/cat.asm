@@ -2,7 +2,7 @@
 ; test for instance with 1234567_10_234567_20_234567_30_234567_40
 
 read:
-    LoadI 4096 ; read up to 4096 bytes at a time; note this match the full stack size (512*8 bytes)
+    LoadI 4096 ; read up to 4096 bytes at a time; note this matches the full default stack size (512*8 bytes)
     SysS ReadN -1 ; hack reads to the blank stack (stack_ptr -  -1 = next stack slot)
     JGT 0 write ; proceed to write if any bytes were read
     JLT 0 error ; jump if error
@@ -0,0 +1,44 @@
+; compare: the full range compare and branch instructions. Prints the powers of -7 (loop on
+; JLTS against a stack variable), whether they are within [low, high] (JLTR and JGTR against
+; memory words) or very negative or positive: jlt and jgt immediates that don't fit in 8 bits,
+; which the assembler expands to the R variant comparing with a data word.
+
+.import itoa
+
+    Var x i n
+    LoadI 8
+    StoreS n
+    LoadI 1
+    StoreS x
+.loop:
+    LoadS x
+    Call itoa
+    LoadS x
+    JLT -1000 .very_negative
+    JGT 100_000 .very_positive
+    JLTR low .next
+    JGTR high .next
+    Sys Write8 in_range
+    JumpR .next
+.very_negative:
+    Sys Write8 very_negative
+    JumpR .next
+.very_positive:
+    Sys Write8 very_positive
+.next:
+    LoadS x
+    MulI -7
+    StoreS x
+    IncrS 1 i
+    JLTS n .loop ; i < n
+    Sys Exit 0
+low:
+    data -100
+high:
+    data 1000
+in_range:
+    str8 "  in range\n"
+very_negative:
+    str8 "  very negative\n"
+very_positive:
+    str8 "  very positive\n"
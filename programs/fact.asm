@@ -1,6 +1,9 @@
 ; factorial
-; depends on itoa, so compile with
-; vm compile programs/fact.asm programs/itoa.asm
+; uses itoa from another object, assemble both separately and link them with
+; vm compile -c programs/fact.asm programs/itoa.asm
+; vm link programs/fact.o programs/itoa.o
+
+.extern itoa
 
     Sys Write8 fact_rec_str
     loadI 5
@@ -16,10 +19,10 @@
 
 factrec: ; recursive factorial
     var n
-    jgte 2 more
+    jgte 2 .more
     loadI 1
     return
-more:
+.more:
     subi 1
     call factrec
     muls n
@@ -29,14 +32,14 @@ facti: ; iterative factorial
     var n result
     loadI 1
     stores result
-  loop:
+  .loop:
     loadS n
-    jlte 1 end
+    jlte 1 .end
     muls result
     storeS result
     incrs -1 n
-    jumpr loop
-end:
+    jumpr .loop
+.end:
     loadS result
     return
 
@@ -24,6 +24,7 @@
     CALL itoa
     Sys exit 0
 
+.export itoa
 itoa: ; prints accumulator as a decimal string
     Var num sign idx _ _ buf ; -> Push 5 reserve 5 additional entries on stack
     ; Maximum length + sign + \n (for numbers in the order of min_int64) including room for the length byte
@@ -38,12 +39,12 @@ itoa: ; prints accumulator as a decimal string
     LoadI 1
     StoreS sign
     LoadS num
-    JGTE 0 digits_loop
+    JGTE 0 .digits_loop
     ; else mark/remember as negative to add the minus sign at the end and multiply by -1 each digit.
     LoadI -1
     StoreS sign
 
-digits_loop:
+.digits_loop:
     LoadI 10
     IdivS num ; num /= 10; A = num % 10
     MulS sign ; multiply by sign (-1 if negative or 1 if not)
@@ -51,14 +52,14 @@ digits_loop:
     StoreSB buf idx ; stores digit in buf at offset indicated by idx
     IncrS -1 idx ; decrement idx by 1 (which thus also increments the length=21-idx)
     LoadS num
-    JNE 0 digits_loop
-done:
+    JNE 0 .digits_loop
+.done:
     LoadS sign ; sign
-    JEQ 1 finish_str ; positive, so done/no need to add the minus sign
+    JEQ 1 .finish_str ; positive, so done/no need to add the minus sign
     LoadI '-'
     StoreSB buf idx ; stores '-' in buf at offset indicated by idx
     IncrS -1 idx ; idx by -1
-finish_str:
+.finish_str:
     LoadI 21 ; calculate length based on what we started idx at
     SubS idx
     StoreSB buf idx ; first byte of str8 is the length (to write)
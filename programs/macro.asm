@@ -0,0 +1,27 @@
+; macros: `.macro name params...` to `.endm` blocks are expanded where they are used,
+; with the labels defined in the body local to each use.
+
+.macro say msg
+    sys write8 msg
+.endm
+
+; repeat prints msg n times, counting down in the counter word.
+.macro repeat n msg counter
+    loadi n
+    storer counter
+loop:
+    say msg
+    incrr -1 counter
+    jne 0 loop
+.endm
+
+    repeat 3 hello count
+    repeat 2 bye count
+    sys exit 0
+
+count:
+    data 0
+hello:
+    str8 "hello\n"
+bye:
+    str8 "bye\n"
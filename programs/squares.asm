@@ -0,0 +1,17 @@
+; squares: prints the squares of 5 down to 1 using itoa, which is found next to this
+; file by .import so it doesn't need to be on the command line:
+; vm compile programs/squares.asm
+
+.import itoa
+
+    LoadI 5
+    StoreR n
+loop:
+    LoadR n
+    MulR n
+    Call itoa
+    IncrR -1 n
+    JNE 0 loop
+    Sys Exit 0
+n:
+    Data 0
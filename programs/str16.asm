@@ -0,0 +1,19 @@
+; str16.asm: strings with a 2 bytes length, so they can be longer than the 255 bytes of str8.
+; Writes a long str16 from memory then echoes up to 300 bytes of input read in a stack buffer.
+    Sys Write16 banner
+    Push 40 ; reserves 41 words (328 bytes) of stack buffer, index 40 is its first word
+    LoadI 300
+    SysS Read16 40
+    JLT 0 error
+    LoadI 0 ; byte offset from the start of the buffer
+    SysS Write16 40
+    Pop 40
+    Sys Exit 0
+error:
+    Sys Exit 1
+banner:
+    str16 `This message is longer than what a str8 can hold: str16 strings start with their length
+in 2 bytes (little endian) instead of 1, so they can be up to 65535 bytes long. Sys Write16 and
+Read16 write and read them from memory and SysS Write16 and Read16 from stack buffers.
+Echoing the input now:
+`